@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMECerts 节点 ACME 证书：包装 autocert.Manager，支持在不中断服务的情况下强制重新申请证书。
+// 重新申请时用一个新的 Manager 签发，期间只有 ACME 验证流量交给它，普通握手仍使用旧证书；
+// 签发成功后新 Manager 接管，失败时保持原状
+type ACMECerts struct {
+	cfg      *Config
+	cacheDir string
+	mu       sync.RWMutex
+	current  *autocert.Manager
+	renewing *autocert.Manager // 正在重新申请时非 nil
+	renewMu  sync.Mutex        // 同一时间只允许一次重新申请
+}
+
+func NewACMECerts(cfg *Config, cacheDir string) *ACMECerts {
+	ac := &ACMECerts{cfg: cfg, cacheDir: cacheDir}
+	ac.current = ac.newManager(autocert.DirCache(cacheDir))
+	return ac
+}
+
+func (ac *ACMECerts) newManager(cache autocert.Cache) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(ac.cfg.Domain),
+		Cache:      cache,
+		Email:      ac.cfg.ACMEEmail,
+	}
+}
+
+// TLSConfig 供 HTTPS 监听使用的 TLS 配置
+func (ac *ACMECerts) TLSConfig() *tls.Config {
+	cfg := ac.current.TLSConfig()
+	cfg.GetCertificate = ac.getCertificate
+	return cfg
+}
+
+func (ac *ACMECerts) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ac.mu.RLock()
+	m := ac.current
+	if ac.renewing != nil && isACMEChallenge(hello) {
+		m = ac.renewing
+	}
+	ac.mu.RUnlock()
+	return m.GetCertificate(hello)
+}
+
+// isACMEChallenge TLS-ALPN-01 验证握手
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPHandler 处理 HTTP-01 验证，其余请求交给 fallback
+func (ac *ACMECerts) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ac.mu.RLock()
+		m := ac.current
+		if ac.renewing != nil {
+			m = ac.renewing
+		}
+		ac.mu.RUnlock()
+		m.HTTPHandler(fallback).ServeHTTP(w, r)
+	})
+}
+
+// Renew 强制重新申请域名证书，返回新证书的到期时间
+func (ac *ACMECerts) Renew(ctx context.Context) (time.Time, error) {
+	if ac.cfg.Domain == "" {
+		return time.Time{}, errors.New("未配置 domain")
+	}
+	if !ac.renewMu.TryLock() {
+		return time.Time{}, errors.New("证书正在重新申请")
+	}
+	defer ac.renewMu.Unlock()
+
+	m := ac.newManager(&renewCache{Cache: autocert.DirCache(ac.cacheDir), domain: ac.cfg.Domain})
+	ac.mu.Lock()
+	ac.renewing = m
+	ac.mu.Unlock()
+	defer func() {
+		ac.mu.Lock()
+		ac.renewing = nil
+		ac.mu.Unlock()
+	}()
+
+	// 按支持 ECDSA 的客户端申请，与大多数浏览器拿到的证书一致
+	hello := &tls.ClientHelloInfo{
+		ServerName:       ac.cfg.Domain,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	}
+	done := make(chan struct{})
+	var cert *tls.Certificate
+	var err error
+	go func() {
+		cert, err = m.GetCertificate(hello)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return time.Time{}, ctx.Err()
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ac.mu.Lock()
+	ac.current = m
+	ac.mu.Unlock()
+	if cert.Leaf != nil {
+		return cert.Leaf.NotAfter, nil
+	}
+	return time.Time{}, nil
+}
+
+// renewCache 重新申请期间对域名证书返回未命中，迫使 Manager 重新签发；
+// 账户密钥等其他条目照常读取，新证书写入后恢复正常读取
+type renewCache struct {
+	autocert.Cache
+	domain string
+	mu     sync.Mutex
+	stored bool
+}
+
+func (c *renewCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	skip := !c.stored && (key == c.domain || key == c.domain+"+rsa")
+	c.mu.Unlock()
+	if skip {
+		return nil, autocert.ErrCacheMiss
+	}
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *renewCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	if key == c.domain || key == c.domain+"+rsa" {
+		c.mu.Lock()
+		c.stored = true
+		c.mu.Unlock()
+	}
+	return nil
+}
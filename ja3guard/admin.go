@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -20,16 +22,64 @@ var adminFS embed.FS
 var installScript string
 
 type AdminHandler struct {
-	cfg       *Config
-	store     *Store
-	nodeStore *NodeStore
-	nginx     *NginxManager
-	tmpl      *template.Template
+	cfg        *Config
+	store      *Store
+	nodeStore  *NodeStore
+	nginx      *NginxManager
+	events     *EventHub       // 节点推送通道（仅 master）
+	ca         *NodeCA         // 节点 mTLS CA（仅 master 且配置了 listen_node_tls）
+	joinTokens *JoinTokenStore // 节点自助加入令牌（仅 master）
+	configs    *ConfigStore    // 节点期望配置（仅 master）
+	health     *HealthMonitor  // 节点健康历史与告警（仅 master）
+	replica    *Replicator     // 备用 Master 的复制（仅配置了 replicate_from）
+	commands   *CommandQueue   // 节点命令队列（仅 master）
+	releases   *ReleaseStore   // 节点自动更新的发布版本（仅 master）
+	sshPool    *SSHPool        // 到节点的 SSH 连接池（仅 master）
+	jobs       *JobManager     // 部署、推送等异步任务（仅 master）
+	fleet      *FleetManager   // 多节点批量操作（仅 master）
+	audit      *AuditLog       // 远程执行审计记录（仅 master）
+	users      *UserStore      // 管理面板用户与登录会话
+	tmpl       *template.Template
 }
 
 func NewAdminHandler(cfg *Config, store *Store, nodeStore *NodeStore) *AdminHandler {
 	tmpl := template.Must(template.ParseFS(adminFS, "web/admin.html"))
-	return &AdminHandler{cfg: cfg, store: store, nodeStore: nodeStore, nginx: NewNginxManager(), tmpl: tmpl}
+	h := &AdminHandler{cfg: cfg, store: store, nodeStore: nodeStore, nginx: NewNginxManager(), tmpl: tmpl}
+	if nodeStore != nil {
+		h.events = NewEventHub(h.pushSnapshot)
+		h.joinTokens = NewJoinTokenStore()
+		h.health = NewHealthMonitor(cfg)
+		h.sshPool = NewSSHPool()
+		store.OnWhitelistChange(func(delta *WhitelistDelta) {
+			if delta != nil {
+				h.events.Publish(EventWhitelist, "", &WhitelistSync{Mode: WhitelistSyncDelta, Version: delta.To, Delta: delta})
+			}
+		})
+	}
+	return h
+}
+
+// sshClient 连接节点的 SSH 客户端，使用连接池并在首次连接时记录主机公钥
+func (h *AdminHandler) sshClient(node *NodeInfo) *SSHClient {
+	return NewSSHClient(h.nodeStore.ResolveCredentials(node), h.nodeStore, h.sshPool)
+}
+
+// pushSnapshot 节点（重）连接且无法续传时下发的全量状态
+func (h *AdminHandler) pushSnapshot(nodeID string) []*PushEvent {
+	var events []*PushEvent
+	if ev, err := newPushEvent(EventWhitelist, nodeID, h.store.WhitelistFull()); err == nil {
+		events = append(events, ev)
+	}
+	if h.configs != nil {
+		if node, err := h.nodeStore.GetNode(nodeID); err == nil {
+			if desired := h.resolveNodeConfig(node); desired != nil {
+				if ev, err := newPushEvent(EventNodeConfig, nodeID, desired); err == nil {
+					events = append(events, ev)
+				}
+			}
+		}
+	}
+	return events
 }
 
 func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -45,18 +95,86 @@ func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleNodeWhitelistPull(w, r)
 		return
 	}
+	// 节点申请 / 续期 mTLS 证书 —— Token 或证书认证
+	if path == "api/node/cert" && r.Method == http.MethodPost {
+		h.handleNodeCert(w, r)
+		return
+	}
+	// 节点自助加入 —— 一次性加入令牌认证
+	if path == "api/node/join" && r.Method == http.MethodPost {
+		h.handleNodeJoin(w, r)
+		return
+	}
+	// 节点拉取期望配置 —— Token 认证
+	if path == "api/node/config" && r.Method == http.MethodGet {
+		h.handleNodeConfigPull(w, r)
+		return
+	}
+	// 节点查询 / 下载更新版本 —— Token 或证书认证
+	if path == "api/node/release" && r.Method == http.MethodGet {
+		h.handleNodeRelease(w, r)
+		return
+	}
+	if path == "api/node/release/download" && r.Method == http.MethodGet {
+		h.handleNodeReleaseDownload(w, r)
+		return
+	}
+	// 节点事件推送长连接 —— Token 认证
+	if path == "api/node/events" && r.Method == http.MethodGet {
+		h.handleNodeEvents(w, r)
+		return
+	}
+	// 备用 Master 拉取状态 —— 复制密钥认证
+	if path == "api/replication/snapshot" && r.Method == http.MethodGet {
+		h.handleReplicationSnapshot(w, r)
+		return
+	}
+
+	// 登录 / 退出
+	if path == "api/login" && r.Method == http.MethodPost {
+		h.handleLogin(w, r)
+		return
+	}
+	if path == "api/logout" && r.Method == http.MethodPost {
+		h.handleLogout(w, r)
+		return
+	}
+	// 页面本身不含数据，未登录时由页面显示登录框
+	if path == "" || path == "/" {
+		h.tmpl.Execute(w, nil)
+		return
+	}
+
+	// 会话 Cookie 或 Basic Auth（管理面板用户），再按接口检查角色
+	user, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if role := requiredRole(path, r.Method); !user.HasRole(role) {
+		h.jsonErr(w, fmt.Sprintf("权限不足：需要 %s 角色", role), 403)
+		return
+	}
+	r = withUser(r, user)
 
-	// Basic Auth（管理面板）
-	_, pass, ok := r.BasicAuth()
-	if !ok || pass != h.cfg.AdminPassword {
-		w.Header().Set("WWW-Authenticate", `Basic realm="JA3 Guard"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// 备用 Master 的白名单、节点、配置层以主 Master 为准
+	if h.replica != nil && h.replica.Standby() && replicatedWrite(path, r.Method) {
+		h.jsonErr(w, fmt.Sprintf("备用 Master 只读（从 %s 复制），请在主 Master 上修改或先提升为主 Master", h.cfg.ReplicateFrom), 409)
 		return
 	}
 
 	switch {
-	case path == "" || path == "/":
-		h.tmpl.Execute(w, nil)
+	case path == "api/me" && r.Method == http.MethodGet:
+		h.handleMe(w, r)
+	case path == "api/me/password" && r.Method == http.MethodPut:
+		h.handleMePassword(w, r)
+	case path == "api/users" && r.Method == http.MethodGet:
+		h.handleUserList(w, r)
+	case path == "api/users" && r.Method == http.MethodPost:
+		h.handleUserAdd(w, r)
+	case strings.HasPrefix(path, "api/users/") && r.Method == http.MethodPut:
+		h.handleUserUpdate(w, r, strings.TrimPrefix(path, "api/users/"))
+	case strings.HasPrefix(path, "api/users/") && r.Method == http.MethodDelete:
+		h.handleUserDelete(w, r, strings.TrimPrefix(path, "api/users/"))
 	case path == "api/stats":
 		h.handleStats(w, r)
 	case path == "api/logs":
@@ -67,6 +185,10 @@ func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleWhitelistGet(w, r)
 	case path == "api/whitelist" && r.Method == http.MethodPost:
 		h.handleWhitelistAdd(w, r)
+	case path == "api/whitelist/export" && r.Method == http.MethodGet:
+		h.handleWhitelistExport(w, r)
+	case path == "api/whitelist/import" && r.Method == http.MethodPost:
+		h.handleWhitelistImport(w, r)
 	case strings.HasPrefix(path, "api/whitelist/") && r.Method == http.MethodDelete:
 		hash := strings.TrimPrefix(path, "api/whitelist/")
 		h.handleWhitelistDelete(w, r, hash)
@@ -83,16 +205,73 @@ func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleNodeList(w, r)
 	case path == "api/nodes" && r.Method == http.MethodPost:
 		h.handleNodeAdd(w, r)
-	case strings.HasPrefix(path, "api/nodes/") && r.Method == http.MethodGet:
+	case path == "api/credentials" && r.Method == http.MethodGet:
+		h.handleCredentialProfileList(w, r)
+	case path == "api/credentials" && r.Method == http.MethodPost:
+		h.handleCredentialProfileAdd(w, r)
+	case strings.HasPrefix(path, "api/credentials/") && r.Method == http.MethodGet:
+		h.handleCredentialProfileGet(w, r, strings.TrimPrefix(path, "api/credentials/"))
+	case strings.HasPrefix(path, "api/credentials/") && r.Method == http.MethodPut:
+		h.handleCredentialProfileUpdate(w, r, strings.TrimPrefix(path, "api/credentials/"))
+	case strings.HasPrefix(path, "api/credentials/") && r.Method == http.MethodDelete:
+		h.handleCredentialProfileDelete(w, r, strings.TrimPrefix(path, "api/credentials/"))
+	case path == "api/node-configs" && r.Method == http.MethodGet:
+		h.handleConfigLayerList(w, r)
+	case strings.HasPrefix(path, "api/node-configs/") && r.Method == http.MethodPut:
+		h.handleConfigLayerSet(w, r, strings.TrimPrefix(path, "api/node-configs/"))
+	case strings.HasPrefix(path, "api/node-configs/") && r.Method == http.MethodDelete:
+		h.handleConfigLayerDelete(w, r, strings.TrimPrefix(path, "api/node-configs/"))
+	case path == "api/releases" && r.Method == http.MethodGet:
+		h.handleReleaseList(w, r)
+	case path == "api/releases" && r.Method == http.MethodPost:
+		h.handleReleaseUpload(w, r)
+	case path == "api/releases/rollout" && r.Method == http.MethodGet:
+		h.handleReleaseRollout(w, r)
+	case strings.HasPrefix(path, "api/releases/") && r.Method == http.MethodDelete:
+		h.handleReleaseDelete(w, r, strings.TrimPrefix(path, "api/releases/"))
+	case path == "api/replication" && r.Method == http.MethodGet:
+		h.handleReplicationStatus(w, r)
+	case path == "api/replication/promote" && r.Method == http.MethodPost:
+		h.handleReplicationPromote(w, r)
+	case path == "api/health/alerts" && r.Method == http.MethodGet:
+		h.handleHealthAlerts(w, r)
+	case path == "api/health/thresholds" && r.Method == http.MethodGet:
+		h.handleHealthThresholdsGet(w, r)
+	case path == "api/health/thresholds" && r.Method == http.MethodPut:
+		h.handleHealthThresholdsUpdate(w, r)
+	case path == "api/join-tokens" && r.Method == http.MethodGet:
+		h.handleJoinTokenList(w, r)
+	case path == "api/join-tokens" && r.Method == http.MethodPost:
+		h.handleJoinTokenCreate(w, r)
+	case strings.HasPrefix(path, "api/join-tokens/") && r.Method == http.MethodDelete:
+		h.handleJoinTokenRevoke(w, r, strings.TrimPrefix(path, "api/join-tokens/"))
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/commands") && r.Method == http.MethodGet:
 		id := strings.TrimPrefix(path, "api/nodes/")
-		h.handleNodeGet(w, r, id)
-	case strings.HasPrefix(path, "api/nodes/") && r.Method == http.MethodPut:
+		id = strings.TrimSuffix(id, "/commands")
+		h.handleNodeCommandList(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/commands") && r.Method == http.MethodPost:
 		id := strings.TrimPrefix(path, "api/nodes/")
-		h.handleNodeUpdate(w, r, id)
+		id = strings.TrimSuffix(id, "/commands")
+		h.handleNodeCommandCreate(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.Contains(path, "/commands/") && strings.HasSuffix(path, "/cancel") && r.Method == http.MethodPost:
+		id, cmdID, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(path, "api/nodes/"), "/cancel"), "/commands/")
+		h.handleNodeCommandCancel(w, r, id, cmdID)
 	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/config/push") && r.Method == http.MethodPost:
 		id := strings.TrimPrefix(path, "api/nodes/")
 		id = strings.TrimSuffix(id, "/config/push")
 		h.handleNodeConfigPush(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/token/rotate") && r.Method == http.MethodPost:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/token/rotate")
+		h.handleNodeTokenRotate(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/config") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/config")
+		h.handleNodeConfigView(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/health") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/health")
+		h.handleNodeHealth(w, r, id)
 	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/deploy") && r.Method == http.MethodPost:
 		id := strings.TrimPrefix(path, "api/nodes/")
 		id = strings.TrimSuffix(id, "/deploy")
@@ -113,6 +292,89 @@ func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		id := strings.TrimPrefix(path, "api/nodes/")
 		id = strings.TrimSuffix(id, "/ssh/info")
 		h.handleNodeSSHInfo(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/ssh/hostkey/accept") && r.Method == http.MethodPost:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/ssh/hostkey/accept")
+		h.handleNodeSSHHostKeyAccept(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/ssh/hostkey") && r.Method == http.MethodPut:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/ssh/hostkey")
+		h.handleNodeSSHHostKeySet(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/files/stat") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/files/stat")
+		h.handleNodeFileStat(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/files") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/files")
+		h.handleNodeFileDownload(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/terminal") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/terminal")
+		h.handleNodeTerminal(w, r, id)
+	case path == "api/exec/policy" && r.Method == http.MethodGet:
+		h.handleExecPolicyGet(w, r)
+	case path == "api/exec/policy" && r.Method == http.MethodPut:
+		h.handleExecPolicyUpdate(w, r)
+	case path == "api/audit" && r.Method == http.MethodGet:
+		h.handleAuditList(w, r)
+	case path == "api/audit/verify" && r.Method == http.MethodGet:
+		h.handleAuditVerify(w, r)
+	case path == "api/terminal/recordings" && r.Method == http.MethodGet:
+		h.handleRecordingList(w, r)
+	case strings.HasPrefix(path, "api/terminal/recordings/") && r.Method == http.MethodGet:
+		h.handleRecordingDownload(w, r, strings.TrimPrefix(path, "api/terminal/recordings/"))
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/files") && r.Method == http.MethodPut:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/files")
+		h.handleNodeFileUpload(w, r, id)
+	case path == "api/jobs" && r.Method == http.MethodGet:
+		h.handleJobList(w, r)
+	case strings.HasPrefix(path, "api/jobs/") && strings.HasSuffix(path, "/stream") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(path, "api/jobs/")
+		id = strings.TrimSuffix(id, "/stream")
+		h.handleJobStream(w, r, id)
+	case strings.HasPrefix(path, "api/jobs/") && strings.HasSuffix(path, "/cancel") && r.Method == http.MethodPost:
+		id := strings.TrimPrefix(path, "api/jobs/")
+		id = strings.TrimSuffix(id, "/cancel")
+		h.handleJobCancel(w, r, id)
+	case strings.HasPrefix(path, "api/jobs/") && r.Method == http.MethodGet:
+		h.handleJobGet(w, r, strings.TrimPrefix(path, "api/jobs/"))
+	case path == "api/fleet" && r.Method == http.MethodGet:
+		h.handleFleetList(w, r)
+	case path == "api/fleet" && r.Method == http.MethodPost:
+		h.handleFleetStart(w, r)
+	case strings.HasPrefix(path, "api/fleet/") && strings.HasSuffix(path, "/cancel") && r.Method == http.MethodPost:
+		id := strings.TrimPrefix(path, "api/fleet/")
+		id = strings.TrimSuffix(id, "/cancel")
+		h.handleFleetCancel(w, r, id)
+	case strings.HasPrefix(path, "api/fleet/") && r.Method == http.MethodGet:
+		h.handleFleetGet(w, r, strings.TrimPrefix(path, "api/fleet/"))
+	case path == "api/pki" && r.Method == http.MethodGet:
+		h.handleNodeCAInfo(w, r)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/cert/revoke") && r.Method == http.MethodPost:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/cert/revoke")
+		h.handleNodeCertRevoke(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/settings") && r.Method == http.MethodPost:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/settings")
+		h.handleNodeRuntimeSettings(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/logs/summary") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/logs/summary")
+		h.handleNodeLogs(w, r, id, true)
+	case strings.HasPrefix(path, "api/nodes/") && strings.HasSuffix(path, "/logs") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		id = strings.TrimSuffix(id, "/logs")
+		h.handleNodeLogs(w, r, id, false)
+	// 通用节点 CRUD 放在子路径之后，避免吞掉 /ssh/info 等 GET 子路由
+	case strings.HasPrefix(path, "api/nodes/") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		h.handleNodeGet(w, r, id)
+	case strings.HasPrefix(path, "api/nodes/") && r.Method == http.MethodPut:
+		id := strings.TrimPrefix(path, "api/nodes/")
+		h.handleNodeUpdate(w, r, id)
 	case strings.HasPrefix(path, "api/nodes/") && r.Method == http.MethodDelete:
 		id := strings.TrimPrefix(path, "api/nodes/")
 		h.handleNodeDelete(w, r, id)
@@ -147,6 +409,14 @@ func (h *AdminHandler) jsonOK(w http.ResponseWriter, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// adminUser 当前请求的登录用户名，用于日志和审计记录
+func (h *AdminHandler) adminUser(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		return user.Username
+	}
+	return ""
+}
+
 func (h *AdminHandler) jsonErr(w http.ResponseWriter, msg string, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -169,21 +439,45 @@ func (h *AdminHandler) handleLogs(w http.ResponseWriter, r *http.Request) {
 		size = 50
 	}
 
-	logs, total := h.store.GetLogs(page, size)
+	nodeID := r.URL.Query().Get("node")
+	logs, total := h.store.GetLogs(nodeID, page, size)
 	h.jsonOK(w, map[string]interface{}{
 		"logs":  logs,
 		"total": total,
 		"page":  page,
 		"size":  size,
+		"node":  nodeID,
 	})
 }
 
 func (h *AdminHandler) handleLogSummary(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.URL.Query().Get("node")
 	h.jsonOK(w, map[string]interface{}{
-		"summaries": h.store.GetJA3Summary(),
+		"summaries": h.store.GetJA3Summary(nodeID),
+		"node":      nodeID,
 	})
 }
 
+// handleNodeLogs 单个节点的日志 / JA3 聚合（Master 模式）
+func (h *AdminHandler) handleNodeLogs(w http.ResponseWriter, r *http.Request, id string, summary bool) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	if _, err := h.nodeStore.GetNode(id); err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	q := r.URL.Query()
+	q.Set("node", id)
+	r.URL.RawQuery = q.Encode()
+	if summary {
+		h.handleLogSummary(w, r)
+	} else {
+		h.handleLogs(w, r)
+	}
+}
+
 func (h *AdminHandler) handleWhitelistGet(w http.ResponseWriter, r *http.Request) {
 	h.jsonOK(w, map[string]interface{}{
 		"entries": h.store.GetWhitelist(),
@@ -250,53 +544,8 @@ func (h *AdminHandler) handleCleanup(w http.ResponseWriter, r *http.Request) {
 	h.jsonOK(w, map[string]string{"status": "ok"})
 }
 
-// handleWhitelistSync 将白名单推送到所有在线节点（通过 SSH 写入）
-func (h *AdminHandler) handleWhitelistSync(w http.ResponseWriter, r *http.Request) {
-	if h.nodeStore == nil {
-		h.jsonErr(w, "仅在 master 模式下可用", 400)
-		return
-	}
-
-	whitelist := h.store.GetWhitelist()
-	wlJSON, _ := json.MarshalIndent(whitelist, "", "  ")
-
-	nodes := h.nodeStore.ListNodes()
-	results := make([]map[string]interface{}, 0, len(nodes))
-
-	for _, n := range nodes {
-		nodeID, _ := n["id"].(string)
-		nodeName, _ := n["name"].(string)
-
-		node, err := h.nodeStore.GetNode(nodeID)
-		if err != nil {
-			results = append(results, map[string]interface{}{
-				"name": nodeName, "ok": false, "error": err.Error(),
-			})
-			continue
-		}
-
-		client := NewSSHClient(node)
-		// 将白名单写入节点的数据目录
-		cmd := fmt.Sprintf("mkdir -p /opt/ja3guard/data && cat > /opt/ja3guard/data/whitelist.json << 'WLEOF'\n%s\nWLEOF", string(wlJSON))
-		_, err = client.Exec(cmd)
-		if err != nil {
-			results = append(results, map[string]interface{}{
-				"name": nodeName, "ok": false, "error": err.Error(),
-			})
-			continue
-		}
-
-		results = append(results, map[string]interface{}{
-			"name": nodeName, "ok": true,
-		})
-		log.Printf("[Sync] 白名单已推送到 %s", nodeName)
-	}
-
-	h.jsonOK(w, map[string]interface{}{
-		"status":  "ok",
-		"results": results,
-	})
-}
+// nodeReloadCmd 让节点重新加载白名单文件（SIGHUP）；旧版 unit 没有 ExecReload 时退回重启
+const nodeReloadCmd = "systemctl reload ja3guard 2>/dev/null || systemctl restart ja3guard 2>/dev/null || true"
 
 // ============================================================
 // 节点管理 API（需要 Basic Auth）
@@ -307,8 +556,28 @@ func (h *AdminHandler) handleNodeList(w http.ResponseWriter, r *http.Request) {
 		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
 		return
 	}
+	nodes := h.nodeStore.ListNodes()
+	connected := h.events.ConnectedNodes()
+	secrets := showSecrets(r)
+	for _, n := range nodes {
+		id, _ := n["id"].(string)
+		// 节点上报的实际配置含 guard_secret
+		if st, _ := n["status"].(*NodeStatus); st != nil && st.Config != nil && !secrets {
+			redacted := *st
+			spec := st.Config.Redacted()
+			redacted.Config = &spec
+			n["status"] = &redacted
+		}
+		n["push_connected"] = connected[id]
+		n["alerts"] = h.health.Alerts(id)
+		if h.configs != nil {
+			if node, err := h.nodeStore.GetNode(id); err == nil {
+				n["config"] = h.configDrift(node, h.nodeStore.GetStatus(id))
+			}
+		}
+	}
 	h.jsonOK(w, map[string]interface{}{
-		"nodes": h.nodeStore.ListNodes(),
+		"nodes": nodes,
 	})
 }
 
@@ -322,12 +591,13 @@ func (h *AdminHandler) handleNodeAdd(w http.ResponseWriter, r *http.Request) {
 		h.jsonErr(w, "请求格式错误", 400)
 		return
 	}
-	id, err := h.nodeStore.AddNode(node)
+	id, token, err := h.nodeStore.AddNode(node)
 	if err != nil {
 		h.jsonErr(w, err.Error(), 400)
 		return
 	}
-	h.jsonOK(w, map[string]string{"status": "ok", "id": id})
+	// 令牌明文只在创建时返回这一次
+	h.jsonOK(w, map[string]string{"status": "ok", "id": id, "token": token})
 }
 
 func (h *AdminHandler) handleNodeGet(w http.ResponseWriter, r *http.Request, id string) {
@@ -340,7 +610,7 @@ func (h *AdminHandler) handleNodeGet(w http.ResponseWriter, r *http.Request, id
 		h.jsonErr(w, err.Error(), 404)
 		return
 	}
-	h.jsonOK(w, node)
+	h.jsonOK(w, redactNode(node))
 }
 
 func (h *AdminHandler) handleNodeUpdate(w http.ResponseWriter, r *http.Request, id string) {
@@ -357,6 +627,8 @@ func (h *AdminHandler) handleNodeUpdate(w http.ResponseWriter, r *http.Request,
 		h.jsonErr(w, err.Error(), 400)
 		return
 	}
+	// 域名、上游或分组变化会改变期望配置
+	h.publishNodeConfigs(id)
 	h.jsonOK(w, map[string]string{"status": "ok"})
 }
 
@@ -369,6 +641,14 @@ func (h *AdminHandler) handleNodeDelete(w http.ResponseWriter, r *http.Request,
 		h.jsonErr(w, err.Error(), 400)
 		return
 	}
+	if h.configs != nil {
+		h.configs.ForgetNode(id)
+	}
+	h.health.Forget(id)
+	h.sshPool.Forget(id)
+	if h.commands != nil {
+		h.commands.ForgetNode(id)
+	}
 	h.jsonOK(w, map[string]string{"status": "ok"})
 }
 
@@ -387,7 +667,7 @@ func (h *AdminHandler) handleNodeSSHTest(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	client := NewSSHClient(node)
+	client := h.sshClient(node)
 	if err := client.TestConnection(); err != nil {
 		h.jsonOK(w, map[string]interface{}{
 			"ok":    false,
@@ -412,31 +692,19 @@ func (h *AdminHandler) handleNodeSSHExec(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	var req struct {
-		Command string `json:"command"`
-	}
+	var req execRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		h.jsonErr(w, "请求格式错误", 400)
 		return
 	}
-	if req.Command == "" {
-		h.jsonErr(w, "命令不能为空", 400)
-		return
-	}
-
-	client := NewSSHClient(node)
-	output, err := client.Exec(req.Command)
+	command, err := req.resolve(h.execPolicyFor(r))
 	if err != nil {
-		h.jsonOK(w, map[string]interface{}{
-			"ok":     false,
-			"output": err.Error(),
-		})
+		h.jsonErr(w, err.Error(), execPolicyStatus(err))
 		return
 	}
-	h.jsonOK(w, map[string]interface{}{
-		"ok":     true,
-		"output": output,
-	})
+
+	job := h.jobs.Start(JobExec, node, command, h.auditedExec(h.auditActor(r), node, &req, command))
+	h.jsonOK(w, map[string]interface{}{"status": "ok", "job": job})
 }
 
 func (h *AdminHandler) handleNodeSSHInfo(w http.ResponseWriter, r *http.Request, id string) {
@@ -450,7 +718,7 @@ func (h *AdminHandler) handleNodeSSHInfo(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	client := NewSSHClient(node)
+	client := h.sshClient(node)
 	info, err := client.GetSystemInfo()
 	if err != nil {
 		h.jsonErr(w, err.Error(), 500)
@@ -459,69 +727,206 @@ func (h *AdminHandler) handleNodeSSHInfo(w http.ResponseWriter, r *http.Request,
 	h.jsonOK(w, info)
 }
 
+// handleNodeSSHHostKeyAccept 确认节点更换了主机密钥，请求中的指纹必须与待确认公钥一致
+func (h *AdminHandler) handleNodeSSHHostKeyAccept(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	var req struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Fingerprint == "" {
+		h.jsonErr(w, "请提供待确认公钥的指纹 fingerprint", 400)
+		return
+	}
+	key, err := h.nodeStore.AcceptSSHHostKey(id, req.Fingerprint)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	h.sshPool.Forget(id)
+	log.Printf("[SSH] 节点 %s 的新主机公钥 %s 已被接受", id, req.Fingerprint)
+	h.jsonOK(w, map[string]string{"status": "ok", "ssh_host_key": key})
+}
+
+// handleNodeSSHHostKeySet 直接设置节点主机公钥（如 ssh-keyscan 的输出），为空时清除并在下次连接时重新记录
+func (h *AdminHandler) handleNodeSSHHostKeySet(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	var req struct {
+		HostKey string `json:"ssh_host_key"`
+		Jump    *int   `json:"jump"` // proxy_jump 下标，不填为节点本身
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	jump, target := -1, "节点 "+id
+	if req.Jump != nil {
+		if *req.Jump < 0 {
+			h.jsonErr(w, "jump 无效", 400)
+			return
+		}
+		jump, target = *req.Jump, fmt.Sprintf("节点 %s 的第 %d 个跳板机", id, *req.Jump+1)
+	}
+	if err := h.nodeStore.SetSSHHostKey(id, jump, req.HostKey); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	h.sshPool.Forget(id)
+	if req.HostKey == "" {
+		log.Printf("[SSH] %s 的主机公钥已清除，下次连接时重新记录", target)
+	} else {
+		log.Printf("[SSH] %s 的主机公钥已设置", target)
+	}
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
 // ============================================================
 // 节点上报 API（Token 认证，无需 Basic Auth）
 // ============================================================
 
-func (h *AdminHandler) handleNodeReport(w http.ResponseWriter, r *http.Request) {
-	if h.nodeStore == nil {
-		h.jsonErr(w, "上报仅在 master 模式下可用", 400)
-		return
+// authNode 校验节点身份，失败时写入 401 并返回 nil。
+// 节点通道上出示了客户端证书时按证书认证，否则使用令牌（Authorization: Bearer <token>）；
+// require_node_mtls 开启后令牌只能用于申请证书
+func (h *AdminHandler) authNode(w http.ResponseWriter, r *http.Request) *NodeInfo {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		leaf := r.TLS.VerifiedChains[0][0]
+		node, err := h.nodeStore.GetNodeByCert(leaf.Subject.CommonName, certSerial(leaf))
+		if err != nil {
+			h.jsonErr(w, "客户端证书无效: "+err.Error(), 401)
+			return nil
+		}
+		return node
+	}
+	if h.ca != nil {
+		if tlsURL := h.nodeTLSURL(r); tlsURL != "" {
+			w.Header().Set(headerNodeTLSURL, tlsURL)
+		}
+	}
+	if h.cfg.RequireNodeMTLS && r.URL.Path != "/api/node/cert" {
+		h.jsonErr(w, "Master 要求节点使用客户端证书", 401)
+		return nil
 	}
 
-	// Token 认证: Authorization: Bearer <token>
 	token := r.Header.Get("Authorization")
 	if strings.HasPrefix(token, "Bearer ") {
 		token = strings.TrimPrefix(token, "Bearer ")
 	}
 	if token == "" {
 		h.jsonErr(w, "缺少认证令牌", 401)
-		return
+		return nil
 	}
 
 	node, err := h.nodeStore.GetNodeByToken(token)
 	if err != nil {
 		h.jsonErr(w, "无效的认证令牌", 401)
+		return nil
+	}
+	return node
+}
+
+func (h *AdminHandler) handleNodeReport(w http.ResponseWriter, r *http.Request) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "上报仅在 master 模式下可用", 400)
 		return
 	}
+	// 出错时也声明上报协议能力，节点据此判断对方不是旧版 Master
+	setReportCapabilityHeaders(w.Header())
 
-	var report struct {
-		Version       string     `json:"version"`
-		Uptime        int64      `json:"uptime"`
-		TotalRequests int        `json:"total_requests"`
-		TrustedCount  int        `json:"trusted_count"`
-		BlockedCount  int        `json:"blocked_count"`
-		Domain        string     `json:"domain"`
-		Upstream      string     `json:"upstream"`
-		Logs          []LogEntry `json:"logs"`
+	node := h.authNode(w, r)
+	if node == nil {
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
-		h.jsonErr(w, "请求格式错误", 400)
+
+	report, err := decodeNodeReport(w, r)
+	if err != nil {
+		h.jsonErr(w, "请求格式错误: "+err.Error(), reportErrorStatus(err))
 		return
 	}
 
 	// 更新节点状态
+	var configVersion int64
+	if report.ConfigVersion != nil {
+		configVersion = *report.ConfigVersion
+	}
+	// 旧版节点上报 guard_secret 明文，只保存摘要
+	if report.Config != nil {
+		spec := report.Config.WithSecretDigest()
+		report.Config = &spec
+	}
+	// 健康指标只随每轮第一页上报，后续页沿用
+	health := report.Health
+	if health == nil {
+		if prev := h.nodeStore.GetStatus(node.ID); prev != nil {
+			health = prev.Health
+		}
+	} else {
+		h.health.Record(node.ID, node.Name, health)
+	}
 	h.nodeStore.UpdateStatus(node.ID, &NodeStatus{
 		Version:       report.Version,
+		Protocol:      report.Protocol,
 		Uptime:        report.Uptime,
 		TotalRequests: report.TotalRequests,
 		TrustedCount:  report.TrustedCount,
 		BlockedCount:  report.BlockedCount,
 		Domain:        report.Domain,
 		Upstream:      report.Upstream,
+		ConfigVersion: configVersion,
+		Config:        report.Config,
+		ConfigError:   report.ConfigError,
+		Health:        health,
+		Commands:      report.Commands,
+		Platform:      report.Platform,
+		Update:        report.Update,
 	})
 
-	// 存储节点上报的日志
-	for _, logEntry := range report.Logs {
-		h.store.LogRequest(logEntry.IP, logEntry.JA3Hash, logEntry.UA, logEntry.Trusted)
+	// 存储节点上报的日志（保留原始时间戳和来源节点，重发的批次只保存一次）
+	duplicate := false
+	if len(report.Logs) > 0 {
+		inserted, err := h.store.AppendNodeLogs(node, report.BatchID, report.Logs)
+		if err != nil {
+			h.jsonErr(w, "保存日志失败: "+err.Error(), 500)
+			return
+		}
+		duplicate = !inserted
 	}
 
-	// 返回白名单给节点同步
-	whitelist := h.store.GetWhitelist()
-	h.jsonOK(w, map[string]interface{}{
+	// 返回白名单同步结果
+	resp := map[string]interface{}{
 		"status":    "ok",
-		"whitelist": whitelist,
-	})
+		"protocol":  ReportProtocolVersion,
+		"duplicate": duplicate,
+	}
+	h.addWhitelistSync(resp, report.WhitelistVersion)
+	// 支持命令的节点：记录执行结果，下发待执行的命令
+	if report.Commands && h.commands != nil {
+		h.commands.Complete(node, report.CommandResults)
+		if commands := h.commands.Deliver(node.ID); len(commands) > 0 {
+			resp["commands"] = commands
+		}
+	}
+	// 支持期望配置的节点：返回当前期望版本，与已应用版本不同时节点主动拉取
+	if report.ConfigVersion != nil && h.configs != nil {
+		if desired := h.resolveNodeConfig(node); desired != nil {
+			resp["config_version"] = desired.Version
+		}
+	}
+	h.jsonOK(w, resp)
+}
+
+// addWhitelistSync 带版本号的节点返回 whitelist_sync（unchanged / delta / full），
+// 旧版节点返回全量 whitelist
+func (h *AdminHandler) addWhitelistSync(resp map[string]interface{}, version *int64) {
+	if version == nil {
+		resp["whitelist"] = h.store.GetWhitelist()
+		return
+	}
+	resp["whitelist_sync"] = h.store.WhitelistSince(*version)
 }
 
 // ============================================================
@@ -548,7 +953,7 @@ func (h *AdminHandler) handleNodeConfigPush(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// 从请求体可选覆盖 domain/upstream/admin_password
+	// 从请求体可选覆盖 domain/upstream（写回节点信息）/admin_password
 	var req struct {
 		Domain        string `json:"domain"`
 		Upstream      string `json:"upstream"`
@@ -556,16 +961,30 @@ func (h *AdminHandler) handleNodeConfigPush(w http.ResponseWriter, r *http.Reque
 	}
 	json.NewDecoder(r.Body).Decode(&req)
 
-	domain := node.Domain
-	if req.Domain != "" {
-		domain = req.Domain
+	if (req.Domain != "" && req.Domain != node.Domain) || (req.Upstream != "" && req.Upstream != node.Upstream) {
+		if req.Domain != "" {
+			node.Domain = req.Domain
+		}
+		if req.Upstream != "" {
+			node.Upstream = req.Upstream
+		}
+		if err := h.nodeStore.UpdateNode(id, *node); err != nil {
+			h.jsonErr(w, err.Error(), 400)
+			return
+		}
 	}
-	upstream := node.Upstream
-	if req.Upstream != "" {
-		upstream = req.Upstream
+
+	// 配置内容来自节点的期望配置，推送后节点上报的版本与之一致
+	desired, err := h.configs.Resolve(node)
+	if err != nil {
+		h.jsonErr(w, "合并节点配置失败: "+err.Error(), 500)
+		return
 	}
-	if upstream != "" && !strings.HasPrefix(upstream, "http://") && !strings.HasPrefix(upstream, "https://") {
-		upstream = "http://" + upstream
+	full := defaultNodeConfigSpec(h.cfg)
+	full.Merge(&desired.Spec)
+	if err := full.Validate(true); err != nil {
+		h.jsonErr(w, err.Error()+"，请在节点信息或配置层中填写", 400)
+		return
 	}
 
 	adminPassword := req.AdminPassword
@@ -573,59 +992,84 @@ func (h *AdminHandler) handleNodeConfigPush(w http.ResponseWriter, r *http.Reque
 		adminPassword = generateRandomPassword(20)
 	}
 
-	if domain == "" {
-		h.jsonErr(w, "domain 不能为空，请在节点信息中填写或在请求中提供", 400)
-		return
-	}
-	if upstream == "" {
-		h.jsonErr(w, "upstream 不能为空，请在节点信息中填写或在请求中提供", 400)
-		return
-	}
-
 	// 构建 Master 地址
 	masterURL := fmt.Sprintf("http://%s", r.Host)
 	if r.TLS != nil {
 		masterURL = fmt.Sprintf("https://%s", r.Host)
 	}
 
+	// Master 不保存令牌明文，推送时轮换出新令牌写入节点配置，失败则撤销轮换
+	token, err := h.nodeStore.RotateNodeToken(id, nodeTokenDefaultOverlap)
+	if err != nil {
+		h.jsonErr(w, "生成节点令牌失败: "+err.Error(), 500)
+		return
+	}
+
 	// 生成 config.json
-	configJSON := fmt.Sprintf(`{
-  "mode": "node",
-  "domain": "%s",
-  "upstream": "%s",
-  "listen_https": ":443",
-  "listen_admin": ":8443",
-  "admin_password": "%s",
-  "guard_secret": "%s",
-  "acme_email": "%s",
-  "data_dir": "/opt/ja3guard/data",
-  "log_enabled": true,
-  "master_url": "%s",
-  "node_token": "%s",
-  "node_name": "%s",
-  "report_interval": 60
-}`, domain, upstream, adminPassword, h.cfg.GuardSecret, h.cfg.ACMEEmail, masterURL, node.Token, node.Name)
-
-	// 通过 SSH 写入配置
-	client := NewSSHClient(node)
-	if err := client.WriteFile(configJSON, "/opt/ja3guard/data/config.json"); err != nil {
-		h.jsonErr(w, "推送配置失败: "+err.Error(), 500)
-		return
-	}
-
-	// 尝试重启服务（如果已安装）
-	restartOutput, _ := client.Exec("systemctl restart ja3guard 2>&1 || echo 'ja3guard 服务未安装，跳过重启'")
-
-	log.Printf("[ConfigPush] 配置已推送到 %s (%s)", node.Name, node.Host)
+	doc := full.Fields()
+	doc["mode"] = "node"
+	doc["admin_password"] = adminPassword
+	doc["data_dir"] = "/opt/ja3guard/data"
+	doc["master_url"] = masterURL
+	doc["node_token"] = token
+	doc["node_name"] = node.Name
+	doc["master_ca_fingerprint"] = h.caFingerprint()
+	doc["release_public_key"] = h.cfg.ReleasePublicKey
+	doc["config_version"] = desired.Version
+	data, _ := json.MarshalIndent(doc, "", "  ")
+	configJSON := string(data)
+
+	// 通过 SSH 写入配置并重启，在后台任务中执行
+	client := h.sshClient(node)
+	const restartCmd = "systemctl restart ja3guard 2>&1 || echo 'ja3guard 服务未安装，跳过重启'"
+	rec := AuditRecord{
+		Action:  AuditConfigPush,
+		Args:    map[string]string{"config_version": strconv.FormatInt(desired.Version, 10)},
+		Command: restartCmd,
+		Path:    "/opt/ja3guard/data/config.json",
+	}
+	push := h.auditedJob(h.auditActor(r), node, rec, func(ctx context.Context, run *JobRun) error {
+		run.SetSecret("admin_password", adminPassword)
+		run.Logf("写入 /opt/ja3guard/data/config.json")
+		// 含 node_token、admin_password 和 guard_secret，与 install.sh 写入的一样只允许属主读写
+		if err := client.WriteFile(configJSON, "/opt/ja3guard/data/config.json", 0600); err != nil {
+			h.settleRotatedToken(run, client, id, token, false)
+			return fmt.Errorf("推送配置失败: %w", err)
+		}
+
+		// 尝试重启服务（如果已安装）
+		run.Logf("重启 ja3guard 服务")
+		if err := client.ExecStream(ctx, restartCmd, run.Stdout(), run.Stderr()); err != nil {
+			h.settleRotatedToken(run, client, id, token, true)
+			return err
+		}
+		log.Printf("[ConfigPush] 配置已推送到 %s (%s)", node.Name, node.Host)
+		run.Logf("配置已推送到 %s", node.Name)
+		return nil
+	})
+	job := h.jobs.Start(JobConfigPush, node, "", func(ctx context.Context, run *JobRun) error {
+		err := push(ctx, run)
+		if errors.Is(err, errAuditStart) {
+			h.revertUnusedToken(run, id, token)
+		}
+		return err
+	})
 
 	h.jsonOK(w, map[string]interface{}{
 		"status":         "ok",
 		"admin_password": adminPassword,
-		"restart_output": restartOutput,
-		"message":        fmt.Sprintf("配置已推送到 %s", node.Name),
+		"job":            job,
 	})
 }
 
+// caFingerprint 节点 CA 指纹，未启用 mTLS 时为空
+func (h *AdminHandler) caFingerprint() string {
+	if h.ca == nil {
+		return ""
+	}
+	return h.ca.Fingerprint()
+}
+
 // handleNodeDeploy 远程部署子节点
 func (h *AdminHandler) handleNodeDeploy(w http.ResponseWriter, r *http.Request, id string) {
 	if h.nodeStore == nil {
@@ -665,6 +1109,10 @@ func (h *AdminHandler) handleNodeDeploy(w http.ResponseWriter, r *http.Request,
 		h.jsonErr(w, "domain 不能为空", 400)
 		return
 	}
+	if err := (&NodeConfigSpec{Domain: &domain, Upstream: &upstream}).Validate(false); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
 
 	// 构建 Master 地址
 	masterURL := fmt.Sprintf("http://%s", r.Host)
@@ -672,43 +1120,73 @@ func (h *AdminHandler) handleNodeDeploy(w http.ResponseWriter, r *http.Request,
 		masterURL = fmt.Sprintf("https://%s", r.Host)
 	}
 
-	// 构建环境变量前缀
+	token, err := h.nodeStore.RotateNodeToken(id, nodeTokenDefaultOverlap)
+	if err != nil {
+		h.jsonErr(w, "生成节点令牌失败: "+err.Error(), 500)
+		return
+	}
+
+	// 构建环境变量前缀，值都经过单引号转义，节点名称、密码等包含空格或 shell 元字符时不会被解释
+	env := func(name, value string) string {
+		return name + "=" + shellQuote(value)
+	}
 	envParts := []string{
 		"JA3_MODE=node",
-		fmt.Sprintf("JA3_DOMAIN=%s", domain),
-		fmt.Sprintf("JA3_ADMIN_PASSWORD=%s", adminPassword),
-		fmt.Sprintf("JA3_MASTER_URL=%s", masterURL),
-		fmt.Sprintf("JA3_NODE_TOKEN=%s", node.Token),
-		fmt.Sprintf("JA3_NODE_NAME=%s", node.Name),
+		env("JA3_DOMAIN", domain),
+		env("JA3_ADMIN_PASSWORD", adminPassword),
+		env("JA3_MASTER_URL", masterURL),
+		env("JA3_NODE_TOKEN", token),
+		env("JA3_NODE_NAME", node.Name),
 	}
 	if upstream != "" {
-		envParts = append(envParts, fmt.Sprintf("JA3_UPSTREAM=%s", upstream))
+		envParts = append(envParts, env("JA3_UPSTREAM", upstream))
+	}
+	if fp := h.caFingerprint(); fp != "" {
+		envParts = append(envParts, env("JA3_MASTER_CA_FINGERPRINT", fp))
 	}
 	if req.SkipNginx {
 		envParts = append(envParts, "JA3_SKIP_NGINX=1")
 	}
 	envPrefix := strings.Join(envParts, " ")
 
-	// 通过 SSH 上传并执行 install.sh
-	client := NewSSHClient(node)
-	output, err := client.UploadAndRun(installScript, "/tmp/ja3guard-install.sh", envPrefix)
-	if err != nil {
-		h.jsonOK(w, map[string]interface{}{
-			"ok":             false,
-			"output":         output,
-			"error":          err.Error(),
-			"admin_password": adminPassword,
-		})
-		return
-	}
-
-	log.Printf("[Deploy] 节点 %s (%s) 部署完成", node.Name, node.Host)
+	// 通过 SSH 上传并执行 install.sh，在后台任务中执行，输出实时推送。
+	// 审计记录不含环境变量（面板密码和节点令牌）
+	client := h.sshClient(node)
+	const installCmd = "bash /tmp/ja3guard-install.sh node"
+	rec := AuditRecord{
+		Action:  AuditDeploy,
+		Args:    map[string]string{"domain": domain, "upstream": upstream, "skip_nginx": strconv.FormatBool(req.SkipNginx)},
+		Command: installCmd,
+	}
+	deploy := h.auditedJob(h.auditActor(r), node, rec, func(ctx context.Context, run *JobRun) error {
+		run.SetSecret("admin_password", adminPassword)
+		run.Logf("上传 install.sh")
+		if _, err := client.PutFile(strings.NewReader(installScript), "/tmp/ja3guard-install.sh", PutFileOptions{Mode: 0755}); err != nil {
+			h.settleRotatedToken(run, client, id, token, false)
+			return fmt.Errorf("上传脚本失败: %w", err)
+		}
+		run.Logf("执行 install.sh")
+		if err := client.ExecStream(ctx, envPrefix+" "+installCmd, run.Stdout(), run.Stderr()); err != nil {
+			// 安装脚本可能已写入新令牌，读取节点配置确认后再决定是否撤销
+			h.settleRotatedToken(run, client, id, token, false)
+			return err
+		}
+		log.Printf("[Deploy] 节点 %s (%s) 部署完成", node.Name, node.Host)
+		run.Logf("节点 %s 部署完成", node.Name)
+		return nil
+	})
+	job := h.jobs.Start(JobDeploy, node, domain, func(ctx context.Context, run *JobRun) error {
+		err := deploy(ctx, run)
+		if errors.Is(err, errAuditStart) {
+			h.revertUnusedToken(run, id, token)
+		}
+		return err
+	})
 
 	h.jsonOK(w, map[string]interface{}{
-		"ok":             true,
-		"output":         output,
+		"status":         "ok",
 		"admin_password": adminPassword,
-		"message":        fmt.Sprintf("节点 %s 部署完成", node.Name),
+		"job":            job,
 	})
 }
 
@@ -725,24 +1203,9 @@ func (h *AdminHandler) handleNodeWhitelistSync(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	whitelist := h.store.GetWhitelist()
-	wlJSON, _ := json.MarshalIndent(whitelist, "", "  ")
-
-	client := NewSSHClient(node)
-	if err := client.WriteFile(string(wlJSON), "/opt/ja3guard/data/whitelist.json"); err != nil {
-		h.jsonOK(w, map[string]interface{}{
-			"ok":    false,
-			"error": err.Error(),
-		})
-		return
-	}
-
-	log.Printf("[Sync] 白名单已推送到 %s", node.Name)
-
-	h.jsonOK(w, map[string]interface{}{
-		"ok":      true,
-		"message": fmt.Sprintf("白名单已推送到 %s", node.Name),
-	})
+	op := h.whitelistSyncOp(h.auditActor(r))
+	job := h.jobs.Start(op.Type, node, op.Summary, op.Build(node))
+	h.jsonOK(w, map[string]interface{}{"status": "ok", "job": job})
 }
 
 // handleNodeWhitelistPull 节点主动拉取白名单
@@ -752,21 +1215,20 @@ func (h *AdminHandler) handleNodeWhitelistPull(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	token := r.Header.Get("Authorization")
-	if strings.HasPrefix(token, "Bearer ") {
-		token = strings.TrimPrefix(token, "Bearer ")
-	}
-	if token == "" {
-		h.jsonErr(w, "缺少认证令牌", 401)
+	if h.authNode(w, r) == nil {
 		return
 	}
 
-	if _, err := h.nodeStore.GetNodeByToken(token); err != nil {
-		h.jsonErr(w, "无效的认证令牌", 401)
-		return
+	resp := make(map[string]interface{})
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			h.jsonErr(w, "version 格式错误", 400)
+			return
+		}
+		h.addWhitelistSync(resp, &version)
+	} else {
+		h.addWhitelistSync(resp, nil)
 	}
-
-	h.jsonOK(w, map[string]interface{}{
-		"whitelist": h.store.GetWhitelist(),
-	})
+	h.jsonOK(w, resp)
 }
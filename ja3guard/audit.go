@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 审计动作
+const (
+	AuditExec          = "exec"           // 执行命令（单节点或批量操作）
+	AuditTerminal      = "terminal"       // Web 终端会话
+	AuditDeploy        = "deploy"         // 远程部署（install.sh）
+	AuditConfigPush    = "config_push"    // 推送 config.json 并重启
+	AuditWhitelistSync = "whitelist_sync" // 推送白名单并重新加载
+	AuditFileUpload    = "file_upload"    // 上传文件到节点
+	AuditFileDownload  = "file_download"  // 从节点下载文件
+)
+
+// 审计阶段：执行前写入 started，结束后写入 finished 并以 start_seq 指向 started 记录。
+// 只有 started 没有 finished 的记录表示操作未结束或 Master 在执行中退出
+const (
+	AuditStarted  = "started"
+	AuditFinished = "finished"
+)
+
+const auditOutputHead = 512 // 审计记录保存的输出开头字节数
+
+// AuditRecord 一次远程执行的审计记录。记录只追加，
+// hash = sha256(prev_hash 与其余字段)，修改或删除任何一条都会使之后的校验失败
+type AuditRecord struct {
+	Seq          int64             `json:"seq"`
+	Time         string            `json:"time"`
+	Actor        string            `json:"actor"`
+	RemoteAddr   string            `json:"remote_addr"`
+	Action       string            `json:"action"`
+	Phase        string            `json:"phase,omitempty"`     // 早期版本的记录没有阶段，均为结束时写入
+	StartSeq     int64             `json:"start_seq,omitempty"` // finished 记录对应的 started 记录序号
+	NodeID       string            `json:"node_id"`
+	NodeName     string            `json:"node_name"`
+	Template     string            `json:"template,omitempty"`
+	Args         map[string]string `json:"args,omitempty"`
+	Command      string            `json:"command,omitempty"`
+	Path         string            `json:"path,omitempty"` // 文件传输的远程路径
+	JobID        string            `json:"job_id,omitempty"`
+	Recording    string            `json:"recording,omitempty"` // 终端录像文件名
+	ExitCode     int               `json:"exit_code"`           // -1 表示未正常结束（连接失败、超时、取消等），started 记录为 -1
+	Error        string            `json:"error,omitempty"`
+	DurationMs   int64             `json:"duration_ms"`
+	OutputSize   int64             `json:"output_size"` // 文件传输为文件的字节数和 sha256，不保留开头内容
+	OutputSHA256 string            `json:"output_sha256"`
+	OutputHead   string            `json:"output_head"`
+	PrevHash     string            `json:"prev_hash"`
+	Hash         string            `json:"hash"`
+}
+
+// computeHash 记录除 hash 外全部字段的摘要
+func (rec AuditRecord) computeHash() string {
+	rec.Hash = ""
+	data, _ := json.Marshal(rec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog 审计记录（Master 模式），内存中保留全部记录用于查询
+type AuditLog struct {
+	mu      sync.Mutex
+	backend AuditBackend
+	records []AuditRecord
+}
+
+func NewAuditLog(backend AuditBackend) (*AuditLog, error) {
+	records, err := backend.LoadAudit()
+	if err != nil {
+		return nil, err
+	}
+	al := &AuditLog{backend: backend, records: records}
+	if bad := al.verifyLocked(); bad != nil {
+		log.Printf("[Audit] ⚠ 审计记录校验失败：第 %d 条 %s", bad.Seq, bad.Reason)
+	}
+	return al, nil
+}
+
+// Append 填写序号和哈希链后写入，返回记录的序号
+func (al *AuditLog) Append(rec AuditRecord) (int64, error) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	rec.Seq = 1
+	rec.PrevHash = ""
+	if n := len(al.records); n > 0 {
+		rec.Seq = al.records[n-1].Seq + 1
+		rec.PrevHash = al.records[n-1].Hash
+	}
+	rec.Hash = rec.computeHash()
+	if err := al.backend.AppendAudit(&rec); err != nil {
+		return 0, err
+	}
+	al.records = append(al.records, rec)
+	return rec.Seq, nil
+}
+
+// Query 按节点 / 操作人过滤，最新在前，最多 limit 条
+func (al *AuditLog) Query(nodeID, actor string, limit int) []AuditRecord {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	result := []AuditRecord{}
+	for i := len(al.records) - 1; i >= 0 && len(result) < limit; i-- {
+		rec := al.records[i]
+		if (nodeID == "" || rec.NodeID == nodeID) && (actor == "" || rec.Actor == actor) {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+// auditBreak 哈希链断开的位置
+type auditBreak struct {
+	Seq    int64  `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+func (al *AuditLog) Verify() (int, *auditBreak) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return len(al.records), al.verifyLocked()
+}
+
+func (al *AuditLog) verifyLocked() *auditBreak {
+	prev, seq := "", int64(0)
+	for _, rec := range al.records {
+		switch {
+		case rec.Seq != seq+1:
+			return &auditBreak{rec.Seq, fmt.Sprintf("序号不连续（上一条为 %d）", seq)}
+		case rec.PrevHash != prev:
+			return &auditBreak{rec.Seq, "prev_hash 与上一条不符"}
+		case rec.computeHash() != rec.Hash:
+			return &auditBreak{rec.Seq, "内容与 hash 不符"}
+		}
+		prev, seq = rec.Hash, rec.Seq
+	}
+	return nil
+}
+
+// outputDigest 统计输出的字节数和 sha256，并保留开头一段
+type outputDigest struct {
+	mu   sync.Mutex
+	size int64
+	h    hash.Hash
+	head []byte
+}
+
+func newOutputDigest() *outputDigest {
+	return &outputDigest{h: sha256.New()}
+}
+
+func (d *outputDigest) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.size += int64(len(p))
+	d.h.Write(p)
+	if n := auditOutputHead - len(d.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		d.head = append(d.head, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// fill 把摘要写入审计记录
+func (d *outputDigest) fill(rec *AuditRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	head := d.head
+	// 截断处可能切开多字节字符
+	for i := len(head) - 1; i >= 0 && i >= len(head)-3; i-- {
+		if utf8.RuneStart(head[i]) {
+			if !utf8.FullRune(head[i:]) {
+				head = head[:i]
+			}
+			break
+		}
+	}
+	rec.OutputSize = d.size
+	rec.OutputSHA256 = hex.EncodeToString(d.h.Sum(nil))
+	rec.OutputHead = strings.ToValidUTF8(string(head), "�")
+}
+
+// exitCode 远程命令的退出码，未正常结束时为 -1
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	return -1
+}
+
+// auditActor 发起操作的用户和来源地址
+type auditActor struct {
+	User       string
+	RemoteAddr string
+}
+
+func (h *AdminHandler) auditActor(r *http.Request) auditActor {
+	return auditActor{User: h.adminUser(r), RemoteAddr: remoteIP(r)}
+}
+
+// appendAudit 写入审计记录，失败时只记日志（操作已经执行）
+func (h *AdminHandler) appendAudit(rec AuditRecord) {
+	if h.audit == nil {
+		return
+	}
+	if _, err := h.audit.Append(rec); err != nil {
+		log.Printf("[Audit] 写入审计记录失败（%s 在 %s %s %q）: %v", rec.Actor, rec.NodeName, rec.Action, rec.Command+rec.Path, err)
+	}
+}
+
+// errAuditStart started 记录写入失败，操作未执行
+var errAuditStart = errors.New("写入审计记录失败，操作未执行")
+
+// auditOp 一次远程操作的审计记录，由 startAudit 创建，操作结束后调用 finish
+type auditOp struct {
+	h       *AdminHandler
+	rec     AuditRecord
+	started time.Time
+	digest  *outputDigest // 命令输出的摘要，为 nil 时由调用方填写 OutputSize / OutputSHA256
+}
+
+// startAudit 在执行前写入 started 记录。写入失败时返回错误，调用方不应再执行操作，
+// 以免 Master 在执行中退出后远程操作没有任何记录
+func (h *AdminHandler) startAudit(actor auditActor, node *NodeInfo, rec AuditRecord) (*auditOp, error) {
+	op := &auditOp{h: h, started: time.Now()}
+	rec.Time = op.started.Format("2006-01-02 15:04:05")
+	rec.Actor, rec.RemoteAddr = actor.User, actor.RemoteAddr
+	rec.NodeID, rec.NodeName = node.ID, node.Name
+	op.rec = rec
+	if h.audit == nil {
+		return op, nil
+	}
+	rec.Phase, rec.ExitCode = AuditStarted, -1
+	seq, err := h.audit.Append(rec)
+	if err != nil {
+		log.Printf("[Audit] 写入审计记录失败，不执行（%s 在 %s %s %q）: %v", rec.Actor, rec.NodeName, rec.Action, rec.Command+rec.Path, err)
+		return nil, fmt.Errorf("%w: %v", errAuditStart, err)
+	}
+	op.rec.StartSeq = seq
+	return op, nil
+}
+
+// finish 写入 finished 记录：退出码、耗时和输出摘要
+func (op *auditOp) finish(err error) {
+	rec := op.rec
+	rec.Phase = AuditFinished
+	rec.ExitCode = exitCode(err)
+	rec.DurationMs = time.Since(op.started).Milliseconds()
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if op.digest != nil {
+		op.digest.fill(&rec)
+	}
+	op.h.appendAudit(rec)
+}
+
+// auditedJob 包装任务：开始执行时写入 started 记录，远程命令的输出同时计入摘要，结束后写入 finished 记录
+func (h *AdminHandler) auditedJob(actor auditActor, node *NodeInfo, rec AuditRecord, fn JobFunc) JobFunc {
+	return func(ctx context.Context, run *JobRun) error {
+		rec.JobID = run.ID()
+		op, err := h.startAudit(actor, node, rec)
+		if err != nil {
+			return err
+		}
+		op.digest = newOutputDigest()
+		run.tee = op.digest
+		err = fn(ctx, run)
+		op.finish(err)
+		return err
+	}
+}
+
+// auditedExec 执行命令，前后写入审计记录
+func (h *AdminHandler) auditedExec(actor auditActor, node *NodeInfo, req *execRequest, command string) JobFunc {
+	client := h.sshClient(node)
+	rec := AuditRecord{Action: AuditExec, Template: req.Template, Args: req.Args, Command: command}
+	return h.auditedJob(actor, node, rec, func(ctx context.Context, run *JobRun) error {
+		return client.ExecStream(ctx, command, run.Stdout(), run.Stderr())
+	})
+}
+
+// ============================================================
+// 审计 API
+// ============================================================
+
+// handleAuditList 审计记录（最新在前），?node= ?actor= 过滤，?limit= 默认 200
+func (h *AdminHandler) handleAuditList(w http.ResponseWriter, r *http.Request) {
+	if h.audit == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > 5000 {
+		limit = 200
+	}
+	h.jsonOK(w, h.audit.Query(q.Get("node"), q.Get("actor"), limit))
+}
+
+// handleAuditVerify 校验审计记录的哈希链
+func (h *AdminHandler) handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if h.audit == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	count, bad := h.audit.Verify()
+	h.jsonOK(w, map[string]interface{}{"ok": bad == nil, "count": count, "break": bad})
+}
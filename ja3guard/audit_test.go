@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestAuditLog 含 4 条记录的审计日志
+func newTestAuditLog(t *testing.T) (*AuditLog, *FileBackend) {
+	t.Helper()
+	backend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	al, err := NewAuditLog(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cmd := range []string{"uptime", "df -h", "free -m", "id"} {
+		seq, err := al.Append(AuditRecord{Actor: "admin", Action: AuditExec, NodeID: "n1", Command: cmd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != int64(i+1) {
+			t.Fatalf("第 %d 条的序号 = %d", i+1, seq)
+		}
+	}
+	return al, backend
+}
+
+func TestAuditLogVerify(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tamper func([]AuditRecord) []AuditRecord
+		seq    int64  // 断开位置，0 表示校验通过
+		reason string // 原因（包含）
+	}{
+		{"未修改", func(r []AuditRecord) []AuditRecord { return r }, 0, ""},
+		{"修改内容", func(r []AuditRecord) []AuditRecord {
+			r[1].Command = "rm -rf /"
+			return r
+		}, 2, "内容与 hash 不符"},
+		{"修改退出码", func(r []AuditRecord) []AuditRecord {
+			r[2].ExitCode = 1
+			return r
+		}, 3, "内容与 hash 不符"},
+		{"修改内容并重新计算本条 hash", func(r []AuditRecord) []AuditRecord {
+			r[1].Command = "rm -rf /"
+			r[1].Hash = r[1].computeHash()
+			return r
+		}, 3, "prev_hash 与上一条不符"},
+		{"删除中间一条", func(r []AuditRecord) []AuditRecord {
+			return append(r[:1], r[2:]...)
+		}, 3, "序号不连续（上一条为 1）"},
+		{"删除第一条", func(r []AuditRecord) []AuditRecord { return r[1:] }, 2, "序号不连续（上一条为 0）"},
+		{"调换顺序", func(r []AuditRecord) []AuditRecord {
+			r[1], r[2] = r[2], r[1]
+			return r
+		}, 3, "序号不连续"},
+		{"删除后重新编号", func(r []AuditRecord) []AuditRecord {
+			r = append(r[:1], r[2:]...)
+			r[1].Seq, r[2].Seq = 2, 3
+			return r
+		}, 2, "prev_hash 与上一条不符"},
+	} {
+		al, _ := newTestAuditLog(t)
+		al.records = tc.tamper(al.records)
+		count, bad := al.Verify()
+		if count != len(al.records) {
+			t.Errorf("%s: count = %d", tc.name, count)
+		}
+		switch {
+		case tc.seq == 0 && bad != nil:
+			t.Errorf("%s: 校验失败 %+v", tc.name, bad)
+		case tc.seq != 0 && (bad == nil || bad.Seq != tc.seq || !strings.Contains(bad.Reason, tc.reason)):
+			t.Errorf("%s: break = %+v, want 第 %d 条 %s", tc.name, bad, tc.seq, tc.reason)
+		}
+	}
+}
+
+func TestAuditLogVerifyAfterReload(t *testing.T) {
+	_, backend := newTestAuditLog(t)
+	data, err := os.ReadFile(backend.auditPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 直接修改文件中的第 2 条
+	tampered := strings.Replace(string(data), `"command":"df -h"`, `"command":"df"`, 1)
+	if tampered == string(data) {
+		t.Fatal("未找到要修改的记录")
+	}
+	if err := os.WriteFile(backend.auditPath(), []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	al, err := NewAuditLog(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, bad := al.Verify(); bad == nil || bad.Seq != 2 {
+		t.Fatalf("重新加载后 break = %+v, want 第 2 条", bad)
+	}
+}
+
+func TestAuditRecordLegacyHash(t *testing.T) {
+	// 新增字段为空时不出现在序列化结果中，早期版本的记录 hash 不变
+	data, err := json.Marshal(AuditRecord{Seq: 1, Action: AuditExec, Command: "uptime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"phase"`, `"start_seq"`, `"path"`} {
+		if strings.Contains(string(data), key) {
+			t.Errorf("空的 %s 不应序列化: %s", key, data)
+		}
+	}
+}
+
+// failingAuditBackend 写入总是失败
+type failingAuditBackend struct{}
+
+func (failingAuditBackend) AppendAudit(*AuditRecord) error    { return errors.New("磁盘已满") }
+func (failingAuditBackend) LoadAudit() ([]AuditRecord, error) { return nil, nil }
+
+func TestAuditedJob(t *testing.T) {
+	node := &NodeInfo{ID: "n1", Name: "node-1"}
+	actor := auditActor{User: "alice", RemoteAddr: "192.0.2.1"}
+	for _, tc := range []struct {
+		name     string
+		fail     error
+		exitCode int
+	}{
+		{"成功", nil, 0},
+		{"失败", errors.New("连接失败"), -1},
+	} {
+		backend, err := NewFileBackend(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		al, err := NewAuditLog(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jm, err := NewJobManager(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &AdminHandler{audit: al, jobs: jm}
+
+		var before []AuditRecord
+		fn := h.auditedJob(actor, node, AuditRecord{Action: AuditConfigPush, Command: "systemctl restart ja3guard"},
+			func(ctx context.Context, run *JobRun) error {
+				before = al.Query("", "", 10)
+				run.Logf("不计入输出摘要")
+				run.Stdout().Write([]byte("restarted\n"))
+				return tc.fail
+			})
+		job := jm.Start(JobConfigPush, node, "", fn)
+		jm.Wait(context.Background(), job.ID)
+
+		// 执行前已写入 started 记录
+		if len(before) != 1 || before[0].Phase != AuditStarted || before[0].ExitCode != -1 || before[0].JobID != job.ID {
+			t.Fatalf("%s: 执行前的记录 = %+v", tc.name, before)
+		}
+		records := al.Query("", "", 10)
+		if len(records) != 2 {
+			t.Fatalf("%s: 记录 = %+v", tc.name, records)
+		}
+		fin := records[0]
+		if fin.Phase != AuditFinished || fin.StartSeq != before[0].Seq || fin.JobID != job.ID ||
+			fin.Actor != "alice" || fin.RemoteAddr != "192.0.2.1" || fin.NodeName != "node-1" ||
+			fin.ExitCode != tc.exitCode || fin.OutputSize != 10 || fin.OutputHead != "restarted\n" {
+			t.Errorf("%s: finished 记录 = %+v", tc.name, fin)
+		}
+		if (fin.Error != "") != (tc.fail != nil) {
+			t.Errorf("%s: error = %q", tc.name, fin.Error)
+		}
+		if _, bad := al.Verify(); bad != nil {
+			t.Errorf("%s: 校验失败 %+v", tc.name, bad)
+		}
+	}
+}
+
+func TestAuditedJobRefusesWithoutRecord(t *testing.T) {
+	backend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	al, err := NewAuditLog(failingAuditBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jm, err := NewJobManager(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &AdminHandler{audit: al, jobs: jm}
+	node := &NodeInfo{ID: "n1", Name: "node-1"}
+	ran := false
+	job := jm.Start(JobExec, node, "id", h.auditedJob(auditActor{User: "alice"}, node, AuditRecord{Action: AuditExec, Command: "id"},
+		func(ctx context.Context, run *JobRun) error {
+			ran = true
+			return nil
+		}))
+	final, _ := jm.Wait(context.Background(), job.ID)
+	if ran {
+		t.Fatal("started 记录写入失败时不应执行")
+	}
+	if final.State != JobFailed || !strings.Contains(final.Error, "写入审计记录失败") {
+		t.Fatalf("任务 = %s %q", final.State, final.Error)
+	}
+}
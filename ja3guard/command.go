@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 节点命令类型，由节点内置的处理函数执行，不经过 shell
+const (
+	CommandRestart     = "restart"     // 重启节点进程
+	CommandClearLogs   = "clear_logs"  // 清理请求日志，args: {"keep_days": 0}
+	CommandSetLogging  = "set_logging" // 开关请求日志，args: {"enabled": true}
+	CommandRenewCert   = "renew_cert"  // 重新申请证书，args: {"target": "acme" | "mtls"}
+	CommandFlushSpool  = "flush_spool" // 立即补发离线缓存
+	CommandDiagnostics = "diagnostics" // 采集诊断信息
+)
+
+// commandTypes 支持的命令及说明（面板下拉框使用）
+var commandTypes = []map[string]string{
+	{"type": CommandRestart, "name": "重启进程"},
+	{"type": CommandClearLogs, "name": "清理日志"},
+	{"type": CommandSetLogging, "name": "开关请求日志"},
+	{"type": CommandRenewCert, "name": "重新申请证书"},
+	{"type": CommandFlushSpool, "name": "补发离线缓存"},
+	{"type": CommandDiagnostics, "name": "诊断信息"},
+}
+
+// 命令状态
+const (
+	CommandPending   = "pending"   // 等待节点领取
+	CommandDelivered = "delivered" // 已下发，等待结果
+	CommandSucceeded = "succeeded"
+	CommandFailed    = "failed"
+	CommandCancelled = "cancelled" // 下发前被取消
+	CommandExpired   = "expired"   // 超时未领取或未返回结果
+)
+
+const (
+	commandTTL            = 24 * time.Hour  // 超过该时间仍未完成的命令视为过期
+	commandRedeliverAfter = 2 * time.Minute // 已下发但节点未确认时，下一次上报重新下发
+	commandHistorySize    = 50              // 每个节点保留的已结束命令数
+	commandMaxOutput      = 64 << 10        // 命令输出上限
+)
+
+// NodeCommand Master 下发给节点的命令及其执行结果
+type NodeCommand struct {
+	ID          string          `json:"id"`
+	NodeID      string          `json:"node_id"`
+	Type        string          `json:"type"`
+	Args        json.RawMessage `json:"args,omitempty"`
+	Status      string          `json:"status"`
+	Output      string          `json:"output,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   string          `json:"created_at"`
+	DeliveredAt string          `json:"delivered_at,omitempty"`
+	FinishedAt  string          `json:"finished_at,omitempty"`
+}
+
+// CommandResult 节点返回的命令执行结果，随上报第一页发送
+type CommandResult struct {
+	ID         string `json:"id"`
+	Status     string `json:"status"` // succeeded / failed
+	Output     string `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+	FinishedAt string `json:"finished_at"`
+}
+
+// commandArgs 各命令的参数，未用到的字段忽略
+type commandArgs struct {
+	KeepDays *int   `json:"keep_days,omitempty"`
+	Enabled  *bool  `json:"enabled,omitempty"`
+	Target   string `json:"target,omitempty"`
+}
+
+// validateCommand 检查命令类型和参数
+func validateCommand(typ string, raw json.RawMessage) error {
+	var args commandArgs
+	if len(raw) > 0 && string(raw) != "null" {
+		dec := json.NewDecoder(strings.NewReader(string(raw)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&args); err != nil {
+			return fmt.Errorf("参数格式错误: %v", err)
+		}
+	}
+	switch typ {
+	case CommandRestart, CommandFlushSpool, CommandDiagnostics:
+	case CommandClearLogs:
+		if args.KeepDays != nil && *args.KeepDays < 0 {
+			return fmt.Errorf("keep_days 不能为负数")
+		}
+	case CommandSetLogging:
+		if args.Enabled == nil {
+			return fmt.Errorf("缺少参数 enabled")
+		}
+	case CommandRenewCert:
+		if args.Target != "" && args.Target != "acme" && args.Target != "mtls" {
+			return fmt.Errorf("target 只能为 acme 或 mtls")
+		}
+	default:
+		return fmt.Errorf("不支持的命令: %s", typ)
+	}
+	return nil
+}
+
+// CommandQueue Master 端命令队列：命令在节点下一次上报时随响应下发（推送通道在线时立即下发），
+// 节点执行后在上报中返回结果。队列整体持久化，Master 重启后未完成的命令继续下发
+type CommandQueue struct {
+	backend  CommandBackend
+	mu       sync.Mutex
+	commands []NodeCommand
+}
+
+func NewCommandQueue(backend CommandBackend) (*CommandQueue, error) {
+	commands, err := backend.LoadCommands()
+	if err != nil {
+		return nil, err
+	}
+	return &CommandQueue{backend: backend, commands: commands}, nil
+}
+
+func (cq *CommandQueue) saveLocked() {
+	if err := cq.backend.SaveCommands(cq.commands); err != nil {
+		log.Printf("[Command] 保存命令队列失败: %v", err)
+	}
+}
+
+// Enqueue 创建一条待下发的命令
+func (cq *CommandQueue) Enqueue(nodeID, typ string, args json.RawMessage) (*NodeCommand, error) {
+	if err := validateCommand(typ, args); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	cmd := NodeCommand{
+		ID:        "cmd_" + hex.EncodeToString(b),
+		NodeID:    nodeID,
+		Type:      typ,
+		Args:      args,
+		Status:    CommandPending,
+		CreatedAt: time.Now().Format("2006-01-02 15:04:05"),
+	}
+
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	cq.commands = append(cq.commands, cmd)
+	cq.saveLocked()
+	return &cmd, nil
+}
+
+// Deliver 取出需要下发给节点的命令（待领取的，以及下发后超过重发间隔仍未返回结果的），标记为已下发
+func (cq *CommandQueue) Deliver(nodeID string) []NodeCommand {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	now := time.Now()
+	result := []NodeCommand{}
+	changed := cq.expireLocked(now)
+	for i := range cq.commands {
+		c := &cq.commands[i]
+		if c.NodeID != nodeID {
+			continue
+		}
+		switch c.Status {
+		case CommandPending:
+		case CommandDelivered:
+			delivered, err := time.ParseInLocation("2006-01-02 15:04:05", c.DeliveredAt, time.Local)
+			if err == nil && now.Sub(delivered) < commandRedeliverAfter {
+				continue
+			}
+		default:
+			continue
+		}
+		c.Status = CommandDelivered
+		c.DeliveredAt = now.Format("2006-01-02 15:04:05")
+		result = append(result, *c)
+		changed = true
+	}
+	if changed {
+		cq.saveLocked()
+	}
+	return result
+}
+
+// expireLocked 将超过 commandTTL 仍未完成的命令标记为过期
+func (cq *CommandQueue) expireLocked(now time.Time) bool {
+	changed := false
+	for i := range cq.commands {
+		c := &cq.commands[i]
+		if c.Status != CommandPending && c.Status != CommandDelivered {
+			continue
+		}
+		created, err := time.ParseInLocation("2006-01-02 15:04:05", c.CreatedAt, time.Local)
+		if err != nil || now.Sub(created) < commandTTL {
+			continue
+		}
+		c.Status = CommandExpired
+		c.FinishedAt = now.Format("2006-01-02 15:04:05")
+		changed = true
+	}
+	return changed
+}
+
+// Complete 记录节点返回的结果；不属于该节点或已结束的命令忽略
+func (cq *CommandQueue) Complete(node *NodeInfo, results []CommandResult) {
+	if len(results) == 0 {
+		return
+	}
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+
+	for _, res := range results {
+		for i := range cq.commands {
+			c := &cq.commands[i]
+			if c.ID != res.ID || c.NodeID != node.ID {
+				continue
+			}
+			if c.Status == CommandSucceeded || c.Status == CommandFailed {
+				break
+			}
+			c.Status = CommandFailed
+			if res.Status == CommandSucceeded {
+				c.Status = CommandSucceeded
+			}
+			c.Output = truncateOutput(res.Output)
+			c.Error = res.Error
+			c.FinishedAt = res.FinishedAt
+			if c.Status == CommandSucceeded {
+				log.Printf("[Command] 节点 %s 已执行 %s（%s）", node.Name, c.Type, c.ID)
+			} else {
+				log.Printf("[Command] 节点 %s 执行 %s 失败（%s）: %s", node.Name, c.Type, c.ID, c.Error)
+			}
+			break
+		}
+	}
+	cq.pruneLocked()
+	cq.saveLocked()
+}
+
+// pruneLocked 每个节点只保留最近 commandHistorySize 条已结束的命令
+func (cq *CommandQueue) pruneLocked() {
+	finished := make(map[string]int)
+	for i := len(cq.commands) - 1; i >= 0; i-- {
+		c := cq.commands[i]
+		if c.Status != CommandPending && c.Status != CommandDelivered {
+			finished[c.NodeID]++
+		}
+	}
+	kept := cq.commands[:0]
+	for _, c := range cq.commands {
+		if c.Status != CommandPending && c.Status != CommandDelivered && finished[c.NodeID] > commandHistorySize {
+			finished[c.NodeID]--
+			continue
+		}
+		kept = append(kept, c)
+	}
+	cq.commands = kept
+}
+
+// Cancel 取消尚未下发的命令
+func (cq *CommandQueue) Cancel(nodeID, id string) error {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	for i := range cq.commands {
+		c := &cq.commands[i]
+		if c.ID != id || c.NodeID != nodeID {
+			continue
+		}
+		if c.Status != CommandPending {
+			return fmt.Errorf("命令已%s，无法取消", commandStatusName(c.Status))
+		}
+		c.Status = CommandCancelled
+		c.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+		cq.saveLocked()
+		return nil
+	}
+	return fmt.Errorf("命令不存在")
+}
+
+// List 节点的命令（最新在前）
+func (cq *CommandQueue) List(nodeID string) []NodeCommand {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	if cq.expireLocked(time.Now()) {
+		cq.saveLocked()
+	}
+	result := []NodeCommand{}
+	for i := len(cq.commands) - 1; i >= 0; i-- {
+		if cq.commands[i].NodeID == nodeID {
+			result = append(result, cq.commands[i])
+		}
+	}
+	return result
+}
+
+// ForgetNode 删除节点时清除其命令
+func (cq *CommandQueue) ForgetNode(nodeID string) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	kept := cq.commands[:0]
+	for _, c := range cq.commands {
+		if c.NodeID != nodeID {
+			kept = append(kept, c)
+		}
+	}
+	cq.commands = kept
+	cq.saveLocked()
+}
+
+// markDelivered 通过推送通道下发后标记
+func (cq *CommandQueue) markDelivered(id string) {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	for i := range cq.commands {
+		if c := &cq.commands[i]; c.ID == id && c.Status == CommandPending {
+			c.Status = CommandDelivered
+			c.DeliveredAt = time.Now().Format("2006-01-02 15:04:05")
+			cq.saveLocked()
+			return
+		}
+	}
+}
+
+func commandStatusName(status string) string {
+	switch status {
+	case CommandPending:
+		return "等待下发"
+	case CommandDelivered:
+		return "下发"
+	case CommandSucceeded:
+		return "执行成功"
+	case CommandFailed:
+		return "执行失败"
+	case CommandCancelled:
+		return "取消"
+	case CommandExpired:
+		return "过期"
+	}
+	return status
+}
+
+func truncateOutput(s string) string {
+	if len(s) > commandMaxOutput {
+		return s[:commandMaxOutput] + "\n...（输出已截断）"
+	}
+	return s
+}
+
+// handleNodeCommandList 节点的命令及结果
+func (h *AdminHandler) handleNodeCommandList(w http.ResponseWriter, r *http.Request, id string) {
+	if h.commands == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	if _, err := h.nodeStore.GetNode(id); err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	supported := false
+	if st := h.nodeStore.GetStatus(id); st != nil {
+		supported = st.Commands
+	}
+	h.jsonOK(w, map[string]interface{}{
+		"commands":  h.commands.List(id),
+		"types":     commandTypes,
+		"supported": supported,
+	})
+}
+
+// handleNodeCommandCreate 创建命令；节点推送通道在线时立即下发，否则随下一次上报下发
+func (h *AdminHandler) handleNodeCommandCreate(w http.ResponseWriter, r *http.Request, id string) {
+	if h.commands == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	node, err := h.nodeStore.GetNode(id)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	var req struct {
+		Type string          `json:"type"`
+		Args json.RawMessage `json:"args"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	cmd, err := h.commands.Enqueue(node.ID, req.Type, req.Args)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+
+	// 只推送给已上报支持命令的节点，旧版节点会忽略未知事件
+	delivered := false
+	if st := h.nodeStore.GetStatus(node.ID); st != nil && st.Commands && h.events.IsConnected(node.ID) {
+		h.commands.markDelivered(cmd.ID)
+		cmd.Status = CommandDelivered
+		h.events.Publish(EventCommand, node.ID, []NodeCommand{*cmd})
+		delivered = true
+	}
+	log.Printf("[Command] 节点 %s 新命令 %s（%s），%s", node.Name, cmd.Type, cmd.ID,
+		map[bool]string{true: "已推送", false: "等待节点上报时下发"}[delivered])
+	h.jsonOK(w, map[string]interface{}{
+		"status":    "ok",
+		"command":   cmd,
+		"delivered": delivered,
+	})
+}
+
+// handleNodeCommandCancel 取消尚未下发的命令
+func (h *AdminHandler) handleNodeCommandCancel(w http.ResponseWriter, r *http.Request, id, cmdID string) {
+	if h.commands == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	if err := h.commands.Cancel(id, cmdID); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
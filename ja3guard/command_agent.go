@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	commandQueueSize   = 64  // 节点端待执行命令队列
+	commandDoneHistory = 200 // 记录已执行的命令 ID，避免重复下发时再次执行
+)
+
+// commandAgentState 持久化到 data/command_state.json：已执行的命令 ID 和尚未送达 Master 的结果。
+// 重启命令在进程退出前写入结果，重启后随第一次上报返回
+type commandAgentState struct {
+	Done    []string        `json:"done"`
+	Results []CommandResult `json:"results"`
+}
+
+// CommandAgent 节点端命令执行：按顺序执行 Master 下发的命令，结果随上报返回。
+// 所有命令都由内置处理函数完成，不执行任意 shell 命令
+type CommandAgent struct {
+	cfg      *Config
+	store    *Store
+	link     *MasterLink
+	reporter *Reporter
+	certs    *ACMECerts
+	restart  chan<- struct{}
+	queue    chan NodeCommand
+	mu       sync.Mutex
+	state    commandAgentState
+	queued   map[string]bool
+}
+
+func NewCommandAgent(cfg *Config, store *Store, link *MasterLink, reporter *Reporter, certs *ACMECerts, restart chan<- struct{}) *CommandAgent {
+	ca := &CommandAgent{
+		cfg:      cfg,
+		store:    store,
+		link:     link,
+		reporter: reporter,
+		certs:    certs,
+		restart:  restart,
+		queue:    make(chan NodeCommand, commandQueueSize),
+		queued:   make(map[string]bool),
+	}
+	data, err := os.ReadFile(ca.statePath())
+	if err == nil {
+		err = json.Unmarshal(data, &ca.state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[Command] 读取命令状态失败: %v", err)
+	}
+	for _, id := range ca.state.Done {
+		ca.queued[id] = true
+	}
+	return ca
+}
+
+func (ca *CommandAgent) statePath() string {
+	return filepath.Join(ca.cfg.DataDir, "command_state.json")
+}
+
+func (ca *CommandAgent) saveLocked() {
+	data, err := json.MarshalIndent(ca.state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(ca.statePath(), data, 0644)
+	}
+	if err != nil {
+		log.Printf("[Command] 保存命令状态失败: %v", err)
+	}
+}
+
+// Enqueue 接收 Master 下发的命令，已执行或已在队列中的忽略
+func (ca *CommandAgent) Enqueue(commands []NodeCommand) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for _, cmd := range commands {
+		if ca.queued[cmd.ID] {
+			continue
+		}
+		select {
+		case ca.queue <- cmd:
+			ca.queued[cmd.ID] = true
+		default:
+			// 队列已满：不记录，Master 稍后重新下发
+			log.Printf("[Command] 命令队列已满，暂不执行 %s", cmd.ID)
+		}
+	}
+}
+
+// Start 依次执行队列中的命令
+func (ca *CommandAgent) Start() {
+	for cmd := range ca.queue {
+		log.Printf("[Command] 执行 %s（%s）", cmd.Type, cmd.ID)
+		if cmd.Type == CommandRestart {
+			// 先记录结果再重启，重启后随上报返回
+			ca.finish(cmd, "进程即将重启", nil)
+			select {
+			case ca.restart <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		output, err := ca.execute(cmd)
+		ca.finish(cmd, output, err)
+		ca.reporter.Wake()
+	}
+}
+
+// finish 记录执行结果，等待随上报返回
+func (ca *CommandAgent) finish(cmd NodeCommand, output string, err error) {
+	res := CommandResult{
+		ID:         cmd.ID,
+		Status:     CommandSucceeded,
+		Output:     truncateOutput(output),
+		FinishedAt: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if err != nil {
+		res.Status = CommandFailed
+		res.Error = err.Error()
+		log.Printf("[Command] %s（%s）失败: %v", cmd.Type, cmd.ID, err)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.state.Results = append(ca.state.Results, res)
+	ca.state.Done = append(ca.state.Done, cmd.ID)
+	if len(ca.state.Done) > commandDoneHistory {
+		for _, id := range ca.state.Done[:len(ca.state.Done)-commandDoneHistory] {
+			delete(ca.queued, id)
+		}
+		ca.state.Done = append([]string(nil), ca.state.Done[len(ca.state.Done)-commandDoneHistory:]...)
+	}
+	ca.saveLocked()
+}
+
+// PendingResults 尚未送达 Master 的结果
+func (ca *CommandAgent) PendingResults() []CommandResult {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return append([]CommandResult(nil), ca.state.Results...)
+}
+
+// Ack Master 确认收到后删除已发送的结果
+func (ca *CommandAgent) Ack(sent []CommandResult) {
+	if len(sent) == 0 {
+		return
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	acked := make(map[string]bool, len(sent))
+	for _, res := range sent {
+		acked[res.ID] = true
+	}
+	kept := ca.state.Results[:0]
+	for _, res := range ca.state.Results {
+		if !acked[res.ID] {
+			kept = append(kept, res)
+		}
+	}
+	ca.state.Results = kept
+	ca.saveLocked()
+}
+
+// execute 执行一条命令，返回输出
+func (ca *CommandAgent) execute(cmd NodeCommand) (string, error) {
+	var args commandArgs
+	if len(cmd.Args) > 0 && string(cmd.Args) != "null" {
+		if err := json.Unmarshal(cmd.Args, &args); err != nil {
+			return "", fmt.Errorf("参数格式错误: %v", err)
+		}
+	}
+
+	switch cmd.Type {
+	case CommandClearLogs:
+		keepDays := 0
+		if args.KeepDays != nil {
+			keepDays = *args.KeepDays
+		}
+		before := ca.store.GetStats().TotalRequests
+		if err := ca.store.Cleanup(keepDays); err != nil {
+			return "", err
+		}
+		after := ca.store.GetStats().TotalRequests
+		if keepDays == 0 {
+			return fmt.Sprintf("已清理全部日志，共 %d 条", before-after), nil
+		}
+		return fmt.Sprintf("已清理 %d 天前的日志 %d 条，保留 %d 条", keepDays, before-after, after), nil
+
+	case CommandSetLogging:
+		if args.Enabled == nil {
+			return "", fmt.Errorf("缺少参数 enabled")
+		}
+		ca.cfg.SetLogEnabled(*args.Enabled)
+		return fmt.Sprintf("请求日志已%s（运行时设置，重启后以配置文件为准）",
+			map[bool]string{true: "开启", false: "关闭"}[*args.Enabled]), nil
+
+	case CommandRenewCert:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		if args.Target == "mtls" {
+			if err := ca.link.requestCert(); err != nil {
+				return "", err
+			}
+			notAfter, _ := ca.link.CertNotAfter()
+			return "节点 mTLS 证书已更新，有效期至 " + notAfter.Format("2006-01-02 15:04:05"), nil
+		}
+		notAfter, err := ca.certs.Renew(ctx)
+		if err != nil {
+			return "", fmt.Errorf("申请证书失败: %w", err)
+		}
+		return fmt.Sprintf("域名 %s 证书已更新，有效期至 %s", ca.cfg.Domain, notAfter.Local().Format("2006-01-02 15:04:05")), nil
+
+	case CommandFlushSpool:
+		return ca.reporter.Flush()
+
+	case CommandDiagnostics:
+		data, err := json.MarshalIndent(ca.diagnostics(), "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return "", fmt.Errorf("不支持的命令: %s", cmd.Type)
+}
+
+// diagnostics 采集诊断信息（不含令牌、密码等敏感配置）
+func (ca *CommandAgent) diagnostics() map[string]interface{} {
+	hostname, _ := os.Hostname()
+	exe, _ := os.Executable()
+	health, _ := ca.reporter.health.Snapshot()
+	spoolBatches, spoolBytes := 0, int64(0)
+	if ca.reporter.spool != nil {
+		spoolBatches, spoolBytes = ca.reporter.spool.Stats()
+	}
+	logCursorEnd, _ := ca.store.LogCursorEnd()
+
+	diag := map[string]interface{}{
+		"version":    Version,
+		"go_version": runtime.Version(),
+		"os_arch":    runtime.GOOS + "/" + runtime.GOARCH,
+		"hostname":   hostname,
+		"pid":        os.Getpid(),
+		"executable": exe,
+		"uptime":     int64(time.Since(ca.reporter.startTime).Seconds()),
+		"config": map[string]interface{}{
+			"domain":          ca.cfg.Domain,
+			"upstream":        ca.cfg.Upstream,
+			"listen_https":    ca.cfg.ListenHTTPS,
+			"listen_admin":    ca.cfg.ListenAdmin,
+			"data_dir":        ca.cfg.DataDir,
+			"storage_backend": ca.cfg.StorageBackend,
+			"log_enabled":     ca.cfg.GetLogEnabled(),
+			"report_interval": ca.cfg.GetReportInterval(),
+			"masters":         strings.Join(ca.cfg.MasterEndpoints(), ", "),
+		},
+		"master":            ca.link.ActiveMaster(),
+		"whitelist_version": ca.store.WhitelistVersion(),
+		"whitelist_count":   len(ca.store.GetWhitelist()),
+		"stats":             ca.store.GetStats(),
+		"report_cursor":     ca.reporter.Cursor(),
+		"log_cursor_end":    logCursorEnd,
+		"spool_batches":     spoolBatches,
+		"spool_bytes":       spoolBytes,
+		"health":            health,
+	}
+	if ca.reporter.configs != nil {
+		version, _, errMsg := ca.reporter.configs.Status()
+		diag["config_version"] = version
+		diag["config_error"] = errMsg
+	}
+	if notAfter, ok := ca.link.CertNotAfter(); ok {
+		diag["mtls_cert_not_after"] = notAfter.Format("2006-01-02 15:04:05")
+	}
+	return diag
+}
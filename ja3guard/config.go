@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 )
 
@@ -18,7 +19,7 @@ type Config struct {
 	ListenHTTPS string `json:"listen_https"`
 	// 管理面板监听地址
 	ListenAdmin string `json:"listen_admin"`
-	// 管理面板密码
+	// 管理面板初始密码：没有任何用户时用它创建 admin 账户，之后在用户管理中修改
 	AdminPassword string `json:"admin_password"`
 	// 共享密钥（防止绕过 JA3 Guard 直接请求上游伪造 header）
 	GuardSecret string `json:"guard_secret"`
@@ -28,16 +29,61 @@ type Config struct {
 	DataDir string `json:"data_dir"`
 	// 是否记录请求日志
 	LogEnabled bool `json:"log_enabled"`
+	// 存储后端: "file"（默认，JSON/JSONL 文件）或 "sqlite"
+	StorageBackend string `json:"storage_backend"`
+	// SQLite 数据库路径（默认 data_dir/ja3guard.db）
+	SQLiteFile string `json:"sqlite_path"`
+	// 发布签名公钥（ed25519，base64）：Master 只接受该密钥签名的版本，节点只安装该密钥签名的版本
+	ReleasePublicKey string `json:"release_public_key"`
+
+	// --- Master 模式专用 ---
+	// 节点 mTLS 通道监听地址（如 ":8444"），为空则不启用
+	ListenNodeTLS string `json:"listen_node_tls"`
+	// 节点访问 mTLS 通道的地址（如 https://master.example.com:8444），为空时按请求主机名推导
+	NodeTLSURL string `json:"node_tls_url"`
+	// mTLS 服务端证书附加的主机名 / IP
+	NodeTLSHosts []string `json:"node_tls_hosts"`
+	// 开启后节点 API 只接受客户端证书，令牌仅用于首次申请证书
+	RequireNodeMTLS bool `json:"require_node_mtls"`
+	// 节点 SSH 凭据加密主密钥文件（默认 /etc/ja3guard/credential.key，不能位于数据目录内），
+	// 设置环境变量 JA3GUARD_CREDENTIAL_KEY 时使用环境变量
+	CredentialKeyFile string `json:"credential_key_file"`
+	// 节点终端无输入超过该时间（分钟）后断开，默认 15
+	TerminalIdleTimeout int `json:"terminal_idle_timeout"`
+	// 管理面板登录会话无操作超过该时间（分钟）后失效，默认 480
+	SessionTimeout int `json:"session_timeout"`
+	// 节点健康告警阈值，未填写的项使用默认值
+	HealthThresholds HealthThresholds `json:"health_thresholds"`
+	// 远程执行策略：命令模板，以及是否允许任意命令和终端（默认允许，并提供常用模板）
+	ExecPolicy ExecPolicy `json:"exec_policy"`
+	// 主备复制共享密钥：设置后开放复制接口，备用 Master 使用同一密钥拉取
+	ReplicationSecret string `json:"replication_secret"`
+	// 备用 Master 设置为主 Master 的管理面板地址，定时复制白名单、节点和配置层
+	ReplicateFrom string `json:"replicate_from"`
+	// 复制间隔（秒），默认 10
+	ReplicationInterval int `json:"replication_interval"`
 
 	// --- Node 模式专用 ---
 	// Master 服务器地址（如 https://master.example.com:8443）
 	MasterURL string `json:"master_url"`
+	// 多个 Master 地址，按优先级排列，前一个不可用时依次切换；设置后 master_url 不再使用
+	MasterURLs []string `json:"master_urls"`
 	// 节点认证令牌（与 master 通信时使用）
 	NodeToken string `json:"node_token"`
 	// 节点名称（标识当前节点）
 	NodeName string `json:"node_name"`
+	// Master CA 证书 SHA-256 指纹，首次申请证书时校验（为空则信任首次获取的 CA）
+	MasterCAFingerprint string `json:"master_ca_fingerprint"`
 	// 上报间隔（秒），默认 60
 	ReportInterval int `json:"report_interval"`
+	// Master 不可达时离线缓存上限（MB），默认 64
+	SpoolMaxMB int `json:"spool_max_mb"`
+	// 已应用的 Master 期望配置版本（由节点自动维护）
+	ConfigVersion int64 `json:"config_version"`
+	// 节点应运行的程序版本，与当前版本不同时从 Master 下载并自动更新（通常由期望配置下发）
+	TargetVersion string `json:"target_version"`
+
+	path string // 配置文件路径，应用 Master 下发的配置时写回
 
 	mu sync.RWMutex `json:"-"`
 }
@@ -55,19 +101,36 @@ func LoadConfig(path string) (*Config, error) {
 		DataDir:        "/data",
 		LogEnabled:     true,
 		ReportInterval: 60,
+		SpoolMaxMB:     64,
+
+		HealthThresholds:    defaultHealthThresholds(),
+		ExecPolicy:          defaultExecPolicy(),
+		ReplicationInterval: 10,
 	}
 
 	if err := json.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("解析配置文件失败: %w", err)
 	}
+	cfg.path = path
 
 	// 通用校验
 	if cfg.Mode != "master" && cfg.Mode != "node" {
 		return nil, fmt.Errorf("mode 必须为 \"master\" 或 \"node\"，当前: %s", cfg.Mode)
 	}
+	if cfg.StorageBackend != "" && cfg.StorageBackend != StorageFile && cfg.StorageBackend != StorageSQLite {
+		return nil, fmt.Errorf("storage_backend 必须为 \"file\" 或 \"sqlite\"，当前: %s", cfg.StorageBackend)
+	}
 	if cfg.AdminPassword == "" {
 		return nil, fmt.Errorf("admin_password 不能为空")
 	}
+	if cfg.ReleasePublicKey != "" {
+		if _, err := parseReleasePublicKey(cfg.ReleasePublicKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ExecPolicy.validate(); err != nil {
+		return nil, fmt.Errorf("exec_policy: %w", err)
+	}
 
 	// Node 模式校验
 	if cfg.Mode == "node" {
@@ -87,6 +150,9 @@ func LoadConfig(path string) (*Config, error) {
 		if cfg.GuardSecret == "" {
 			cfg.GuardSecret = "master-default"
 		}
+		if cfg.ReplicateFrom != "" && cfg.ReplicationSecret == "" {
+			return nil, fmt.Errorf("设置 replicate_from 时 replication_secret 不能为空")
+		}
 	}
 
 	return cfg, nil
@@ -102,6 +168,24 @@ func (c *Config) IsNode() bool {
 	return c.Mode == "node"
 }
 
+// MasterEndpoints 节点使用的 Master 地址（按优先级）：master_urls 非空时使用它，否则为 master_url
+func (c *Config) MasterEndpoints() []string {
+	var result []string
+	seen := make(map[string]bool)
+	list := c.MasterURLs
+	if len(list) == 0 {
+		list = []string{c.MasterURL}
+	}
+	for _, u := range list {
+		u = strings.TrimRight(strings.TrimSpace(u), "/")
+		if u != "" && !seen[u] {
+			seen[u] = true
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
 func (c *Config) GetLogEnabled() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -113,3 +197,106 @@ func (c *Config) SetLogEnabled(v bool) {
 	defer c.mu.Unlock()
 	c.LogEnabled = v
 }
+
+func (c *Config) GetReportInterval() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ReportInterval
+}
+
+func (c *Config) SetReportInterval(v int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ReportInterval = v
+}
+
+func (c *Config) GetTargetVersion() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.TargetVersion
+}
+
+func (c *Config) SetTargetVersion(v string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.TargetVersion = v
+}
+
+func (c *Config) GetHealthThresholds() HealthThresholds {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.HealthThresholds
+}
+
+func (c *Config) SetHealthThresholds(t HealthThresholds) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.HealthThresholds = t
+}
+
+func (c *Config) GetExecPolicy() ExecPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ExecPolicy
+}
+
+func (c *Config) SetExecPolicy(p ExecPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ExecPolicy = p
+}
+
+// UpdateFile 把 fields 合并写回配置文件，文件中的其他字段保持不变；
+// backup 为 true 时旧文件备份为 config.json.bak
+func (c *Config) UpdateFile(fields map[string]interface{}, backup bool) error {
+	if c.path == "" {
+		return fmt.Errorf("配置文件路径未知")
+	}
+	old, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(old, &doc); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if backup {
+		if err := writeFileAtomic(c.path+".bak", old, 0600); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(c.path, data, 0600)
+}
+
+// ManagedSpec 当前生效的、由 Master 统一管理的配置字段
+func (c *Config) ManagedSpec() *NodeConfigSpec {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	domain, upstream, secret, email := c.Domain, c.Upstream, c.GuardSecret, c.ACMEEmail
+	logEnabled, interval, spool := c.LogEnabled, c.ReportInterval, c.SpoolMaxMB
+	listenHTTPS, listenAdmin, targetVersion := c.ListenHTTPS, c.ListenAdmin, c.TargetVersion
+	var masterURLs []string
+	if len(c.MasterURLs) > 0 {
+		masterURLs = append(masterURLs, c.MasterURLs...)
+	}
+	return &NodeConfigSpec{
+		Domain:         &domain,
+		Upstream:       &upstream,
+		GuardSecret:    &secret,
+		ACMEEmail:      &email,
+		LogEnabled:     &logEnabled,
+		ReportInterval: &interval,
+		SpoolMaxMB:     &spool,
+		ListenHTTPS:    &listenHTTPS,
+		ListenAdmin:    &listenAdmin,
+		MasterURLs:     masterURLs,
+		TargetVersion:  &targetVersion,
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// CredentialProfile 共享 SSH 凭据。节点和跳板机通过 credential_id 引用，
+// 轮换私钥或证书只需修改这一处，引用它的节点下次连接时使用新凭据
+type CredentialProfile struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	SSHAuth
+	Note      string `json:"note"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// credentialProfileView 接口返回的共享凭据：不含凭据明文，附带引用它的节点数
+type credentialProfileView struct {
+	CredentialProfile
+	authView
+	UsedBy []string `json:"used_by"` // 引用该凭据的节点名称（跳板机引用时记为所在节点）
+}
+
+// profileFields 共享凭据中需要加密的字段及其 aad
+func profileFields(p *CredentialProfile) map[string]*string {
+	fields := make(map[string]*string)
+	authFields(fields, "credential_profile/"+p.ID, &p.SSHAuth)
+	return fields
+}
+
+// sealProfiles 返回凭据已加密的共享凭据副本
+func (ck *CredentialKeys) sealProfiles(profiles []CredentialProfile) []CredentialProfile {
+	sealed := make([]CredentialProfile, len(profiles))
+	for i, p := range profiles {
+		for aad, v := range profileFields(&p) {
+			*v = ck.Seal(*v, aad)
+		}
+		sealed[i] = p
+	}
+	return sealed
+}
+
+// openProfiles 原地解密共享凭据，返回需要重新加密的个数
+func (ck *CredentialKeys) openProfiles(profiles []CredentialProfile) (int, error) {
+	stale := 0
+	for i := range profiles {
+		p := &profiles[i]
+		pStale := false
+		for aad, v := range profileFields(p) {
+			plain, s, err := ck.Open(*v, aad)
+			if err != nil {
+				return 0, fmt.Errorf("解密共享凭据 %s 失败: %w", p.Name, err)
+			}
+			*v = plain
+			pStale = pStale || s
+		}
+		if pStale {
+			stale++
+		}
+	}
+	return stale, nil
+}
+
+func (ns *NodeStore) saveCredentialProfiles() error {
+	return ns.cpBackend.SaveCredentialProfiles(ns.creds.sealProfiles(ns.profiles))
+}
+
+// findCredentialProfile 调用方需持有锁
+func (ns *NodeStore) findCredentialProfile(id string) *CredentialProfile {
+	for i := range ns.profiles {
+		if ns.profiles[i].ID == id {
+			return &ns.profiles[i]
+		}
+	}
+	return nil
+}
+
+// CredentialProfiles 返回全部共享凭据的副本
+func (ns *NodeStore) CredentialProfiles() []CredentialProfile {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	result := make([]CredentialProfile, len(ns.profiles))
+	copy(result, ns.profiles)
+	return result
+}
+
+// credentialUsers 引用共享凭据的节点名称，调用方需持有锁
+func (ns *NodeStore) credentialUsers(id string) []string {
+	users := []string{}
+	for _, n := range ns.nodes {
+		used := n.CredentialID == id
+		for _, j := range n.ProxyJump {
+			used = used || j.CredentialID == id
+		}
+		if used {
+			users = append(users, n.Name)
+		}
+	}
+	return users
+}
+
+// ListCredentialProfiles 列出共享凭据（隐藏凭据明文）
+func (ns *NodeStore) ListCredentialProfiles() []credentialProfileView {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	result := make([]credentialProfileView, 0, len(ns.profiles))
+	for _, p := range ns.profiles {
+		result = append(result, ns.credentialProfileView(p))
+	}
+	return result
+}
+
+// GetCredentialProfile 返回共享凭据（隐藏凭据明文）
+func (ns *NodeStore) GetCredentialProfile(id string) (*credentialProfileView, error) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	p := ns.findCredentialProfile(id)
+	if p == nil {
+		return nil, fmt.Errorf("共享凭据不存在: %s", id)
+	}
+	v := ns.credentialProfileView(*p)
+	return &v, nil
+}
+
+func (ns *NodeStore) credentialProfileView(p CredentialProfile) credentialProfileView {
+	v := credentialProfileView{CredentialProfile: p, UsedBy: ns.credentialUsers(p.ID)}
+	v.authView = redactAuth(&v.SSHAuth)
+	return v
+}
+
+// AddCredentialProfile 添加共享凭据，返回 ID
+func (ns *NodeStore) AddCredentialProfile(p CredentialProfile) (string, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return "", fmt.Errorf("凭据名称不能为空")
+	}
+	for _, other := range ns.profiles {
+		if other.Name == p.Name {
+			return "", fmt.Errorf("凭据名称已存在: %s", p.Name)
+		}
+	}
+	if err := normalizeSSHAuth(&p.SSHAuth, SSHAuth{}); err != nil {
+		return "", err
+	}
+	p.ID = fmt.Sprintf("cred_%d", time.Now().UnixNano())
+	p.CreatedAt = time.Now().Format("2006-01-02 15:04:05")
+	p.UpdatedAt = p.CreatedAt
+
+	ns.profiles = append(ns.profiles, p)
+	if err := ns.saveCredentialProfiles(); err != nil {
+		ns.profiles = ns.profiles[:len(ns.profiles)-1]
+		return "", err
+	}
+	return p.ID, nil
+}
+
+// UpdateCredentialProfile 修改共享凭据，未填写的私钥 / 口令 / 密码沿用原值
+func (ns *NodeStore) UpdateCredentialProfile(id string, updated CredentialProfile) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	p := ns.findCredentialProfile(id)
+	if p == nil {
+		return fmt.Errorf("共享凭据不存在: %s", id)
+	}
+	updated.Name = strings.TrimSpace(updated.Name)
+	if updated.Name == "" {
+		updated.Name = p.Name
+	}
+	for _, other := range ns.profiles {
+		if other.ID != id && other.Name == updated.Name {
+			return fmt.Errorf("凭据名称已存在: %s", updated.Name)
+		}
+	}
+	if err := normalizeSSHAuth(&updated.SSHAuth, p.SSHAuth); err != nil {
+		return err
+	}
+	updated.ID = p.ID
+	updated.CreatedAt = p.CreatedAt
+	updated.UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
+
+	old := *p
+	*p = updated
+	if err := ns.saveCredentialProfiles(); err != nil {
+		*p = old
+		return err
+	}
+	return nil
+}
+
+// RemoveCredentialProfile 删除共享凭据，仍被节点引用时拒绝
+func (ns *NodeStore) RemoveCredentialProfile(id string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i, p := range ns.profiles {
+		if p.ID != id {
+			continue
+		}
+		if users := ns.credentialUsers(id); len(users) > 0 {
+			return fmt.Errorf("共享凭据仍被以下节点使用: %s", strings.Join(users, ", "))
+		}
+		old := ns.profiles
+		ns.profiles = append(append([]CredentialProfile{}, old[:i]...), old[i+1:]...)
+		if err := ns.saveCredentialProfiles(); err != nil {
+			ns.profiles = old
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("共享凭据不存在: %s", id)
+}
+
+// ResolveCredentials 返回填入了共享凭据的节点副本（连接时使用）。
+// 找不到的凭据保留 credential_id，连接时报错
+func (ns *NodeStore) ResolveCredentials(node *NodeInfo) *NodeInfo {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	c := *node
+	if c.CredentialID != "" {
+		if p := ns.findCredentialProfile(c.CredentialID); p != nil {
+			c.SSHAuth, c.CredentialID = p.SSHAuth, ""
+		}
+	}
+	c.ProxyJump = append([]SSHJump(nil), node.ProxyJump...)
+	for i := range c.ProxyJump {
+		j := &c.ProxyJump[i]
+		if j.CredentialID == "" {
+			continue
+		}
+		if p := ns.findCredentialProfile(j.CredentialID); p != nil {
+			j.SSHAuth, j.CredentialID = p.SSHAuth, ""
+		}
+	}
+	return &c
+}
+
+// SealedCredentialProfiles 凭据已加密的全部共享凭据（复制快照用）
+func (ns *NodeStore) SealedCredentialProfiles() []CredentialProfile {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return ns.creds.sealProfiles(ns.profiles)
+}
+
+// ReplaceCredentialProfiles 备用 Master 用主 Master 的共享凭据整体替换本地的，返回是否有变化
+func (ns *NodeStore) ReplaceCredentialProfiles(profiles []CredentialProfile) (bool, error) {
+	if profiles == nil {
+		profiles = []CredentialProfile{}
+	}
+	if _, err := ns.creds.openProfiles(profiles); err != nil {
+		return false, err
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if reflect.DeepEqual(ns.profiles, profiles) {
+		return false, nil
+	}
+	old := ns.profiles
+	ns.profiles = profiles
+	if err := ns.saveCredentialProfiles(); err != nil {
+		ns.profiles = old
+		return false, err
+	}
+	return true, nil
+}
+
+// ============================================================
+// 共享凭据 API
+// ============================================================
+
+func (h *AdminHandler) handleCredentialProfileList(w http.ResponseWriter, r *http.Request) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	h.jsonOK(w, h.nodeStore.ListCredentialProfiles())
+}
+
+func (h *AdminHandler) handleCredentialProfileAdd(w http.ResponseWriter, r *http.Request) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	var p CredentialProfile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	id, err := h.nodeStore.AddCredentialProfile(p)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	h.jsonOK(w, map[string]string{"status": "ok", "id": id})
+}
+
+func (h *AdminHandler) handleCredentialProfileGet(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	p, err := h.nodeStore.GetCredentialProfile(id)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	h.jsonOK(w, p)
+}
+
+func (h *AdminHandler) handleCredentialProfileUpdate(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	var p CredentialProfile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	if err := h.nodeStore.UpdateCredentialProfile(id, p); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	// 连接池按连接参数摘要复用连接，引用该凭据的节点下次操作时自动用新凭据重新连接
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+func (h *AdminHandler) handleCredentialProfileDelete(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	if err := h.nodeStore.RemoveCredentialProfile(id); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
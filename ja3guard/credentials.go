@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 节点 SSH 凭据（私钥、密码，含跳板机的）在 nodes.json / 数据库中以 AES-256-GCM 加密保存。
+// 主密钥放在数据目录之外（密钥文件或环境变量），备份数据目录不会同时带走密钥
+
+const (
+	defaultCredentialKeyFile = "/etc/ja3guard/credential.key"
+	credentialKeyEnv         = "JA3GUARD_CREDENTIAL_KEY"
+	credentialSealedPrefix   = "enc:v1:"
+)
+
+// CredentialKeys 凭据主密钥，第一个用于加密，其余只用于解密（轮换期间的旧密钥）
+type CredentialKeys struct {
+	keys   []credentialKey
+	source string // 密钥来源，用于日志和错误信息
+}
+
+type credentialKey struct {
+	id   string // 密钥摘要前 8 位，写在密文中用于选择解密密钥
+	aead cipher.AEAD
+}
+
+// credentialKeyFile 密钥文件路径：配置的 credential_key_file，默认 /etc/ja3guard/credential.key
+func (c *Config) credentialKeyFile() string {
+	if c.CredentialKeyFile != "" {
+		return c.CredentialKeyFile
+	}
+	return defaultCredentialKeyFile
+}
+
+// checkCredentialKeyFile 密钥文件不能放在数据目录内
+func (c *Config) checkCredentialKeyFile() error {
+	keyPath, err := filepath.Abs(c.credentialKeyFile())
+	if err != nil {
+		return err
+	}
+	dataDir, err := filepath.Abs(c.DataDir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(dataDir, keyPath); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("credential_key_file 不能位于数据目录 %s 内", c.DataDir)
+	}
+	return nil
+}
+
+func newCredentialKey(raw []byte) (credentialKey, error) {
+	if len(raw) != 32 {
+		return credentialKey{}, fmt.Errorf("凭据主密钥长度应为 32 字节，当前 %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return credentialKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return credentialKey{}, err
+	}
+	sum := sha256.Sum256(raw)
+	return credentialKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+// parseCredentialKeys 解析密钥列表：每行（环境变量中以逗号分隔）一个 base64 编码的 32 字节密钥，
+// 第一个为当前密钥。# 开头的行为注释
+func parseCredentialKeys(text, source string) (*CredentialKeys, error) {
+	ck := &CredentialKeys{source: source}
+	seen := make(map[string]bool)
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: 凭据主密钥不是有效的 base64", source)
+		}
+		key, err := newCredentialKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		if !seen[key.id] {
+			seen[key.id] = true
+			ck.keys = append(ck.keys, key)
+		}
+	}
+	if len(ck.keys) == 0 {
+		return nil, fmt.Errorf("%s 中没有凭据主密钥", source)
+	}
+	return ck, nil
+}
+
+func generateCredentialKey() string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// LoadCredentialKeys 读取凭据主密钥：优先使用环境变量 JA3GUARD_CREDENTIAL_KEY，否则读取密钥文件，
+// 密钥文件不存在时生成（首次启动或从旧版本升级）
+func LoadCredentialKeys(cfg *Config) (*CredentialKeys, error) {
+	if env := os.Getenv(credentialKeyEnv); env != "" {
+		return parseCredentialKeys(env, "环境变量 "+credentialKeyEnv)
+	}
+	if err := cfg.checkCredentialKeyFile(); err != nil {
+		return nil, err
+	}
+	path := cfg.credentialKeyFile()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("创建凭据主密钥目录失败: %w", err)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("生成凭据主密钥失败: %w", err)
+		}
+		key := generateCredentialKey()
+		_, err = fmt.Fprintln(f, key)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+			return nil, fmt.Errorf("写入凭据主密钥失败: %w", err)
+		}
+		log.Printf("[Credential] 已生成凭据主密钥 %s，请单独备份（丢失后节点 SSH 凭据无法解密）", path)
+		data = []byte(key)
+	} else if err != nil {
+		return nil, fmt.Errorf("读取凭据主密钥失败: %w", err)
+	}
+	return parseCredentialKeys(string(data), path)
+}
+
+// Seal 用当前密钥加密，aad 绑定节点和字段，密文不能挪用到其他节点或字段
+func (ck *CredentialKeys) Seal(plain, aad string) string {
+	if plain == "" {
+		return ""
+	}
+	key := ck.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	sealed := key.aead.Seal(nonce, nonce, []byte(plain), []byte(aad))
+	return credentialSealedPrefix + key.id + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// Open 解密。未加密的旧数据原样返回，stale 为 true 表示需要用当前密钥重新加密（明文或旧密钥）
+func (ck *CredentialKeys) Open(value, aad string) (plain string, stale bool, err error) {
+	if value == "" {
+		return "", false, nil
+	}
+	if !strings.HasPrefix(value, credentialSealedPrefix) {
+		return value, true, nil
+	}
+	id, data, ok := strings.Cut(strings.TrimPrefix(value, credentialSealedPrefix), ":")
+	if !ok {
+		return "", false, errors.New("密文格式错误")
+	}
+	for i, key := range ck.keys {
+		if key.id != id {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(data)
+		if err != nil || len(sealed) < key.aead.NonceSize() {
+			return "", false, errors.New("密文格式错误")
+		}
+		n := key.aead.NonceSize()
+		out, err := key.aead.Open(nil, sealed[:n], sealed[n:], []byte(aad))
+		if err != nil {
+			return "", false, errors.New("密文校验失败")
+		}
+		return string(out), i > 0, nil
+	}
+	return "", false, fmt.Errorf("没有密钥 %s（%s）", id, ck.source)
+}
+
+// credentialFields 节点中需要加密的字段及其 aad。跳板机按地址区分，调整顺序不影响解密
+func credentialFields(n *NodeInfo) map[string]*string {
+	fields := make(map[string]*string)
+	authFields(fields, n.ID, &n.SSHAuth)
+	for i := range n.ProxyJump {
+		j := &n.ProxyJump[i]
+		authFields(fields, n.ID+"/proxy_jump/"+j.addr(), &j.SSHAuth)
+	}
+	return fields
+}
+
+// authFields 认证信息中需要加密的字段，aad 为 prefix + 字段名
+func authFields(fields map[string]*string, prefix string, a *SSHAuth) {
+	fields[prefix+"/ssh_key"] = &a.SSHKey
+	fields[prefix+"/ssh_pass"] = &a.SSHPass
+	fields[prefix+"/ssh_key_passphrase"] = &a.SSHKeyPassphrase
+}
+
+// sealNodes 返回凭据已加密的节点副本
+func (ck *CredentialKeys) sealNodes(nodes []NodeInfo) []NodeInfo {
+	sealed := make([]NodeInfo, len(nodes))
+	for i, n := range nodes {
+		n.ProxyJump = append([]SSHJump(nil), n.ProxyJump...)
+		for aad, v := range credentialFields(&n) {
+			*v = ck.Seal(*v, aad)
+		}
+		sealed[i] = n
+	}
+	return sealed
+}
+
+// openNodes 原地解密节点凭据，返回需要重新加密的节点数（明文或使用旧密钥）
+func (ck *CredentialKeys) openNodes(nodes []NodeInfo) (int, error) {
+	stale := 0
+	for i := range nodes {
+		n := &nodes[i]
+		if len(n.ProxyJump) > 0 {
+			n.ProxyJump = append([]SSHJump(nil), n.ProxyJump...)
+		}
+		nodeStale := false
+		for aad, v := range credentialFields(n) {
+			plain, s, err := ck.Open(*v, aad)
+			if err != nil {
+				return 0, fmt.Errorf("解密节点 %s 的 SSH 凭据失败: %w", n.Name, err)
+			}
+			*v = plain
+			nodeStale = nodeStale || s
+		}
+		if nodeStale {
+			stale++
+		}
+	}
+	return stale, nil
+}
+
+// nodeView 接口返回的节点：不含凭据和令牌哈希，只标明是否已设置
+type nodeView struct {
+	NodeInfo
+	authView
+	ProxyJump []jumpView `json:"proxy_jump,omitempty"`
+}
+
+type jumpView struct {
+	SSHJump
+	authView
+}
+
+// authView 凭据是否已设置，以及用户证书的信息
+type authView struct {
+	HasSSHKey           bool         `json:"has_ssh_key"`
+	HasSSHKeyPassphrase bool         `json:"has_ssh_key_passphrase"`
+	HasSSHPass          bool         `json:"has_ssh_pass"`
+	SSHCertInfo         *sshCertInfo `json:"ssh_cert_info,omitempty"`
+}
+
+// redactAuth 清除凭据明文，返回是否已设置
+func redactAuth(a *SSHAuth) authView {
+	v := authView{
+		HasSSHKey:           a.SSHKey != "",
+		HasSSHKeyPassphrase: a.SSHKeyPassphrase != "",
+		HasSSHPass:          a.SSHPass != "",
+		SSHCertInfo:         describeSSHCert(a.SSHCert),
+	}
+	a.SSHKey, a.SSHKeyPassphrase, a.SSHPass = "", "", ""
+	return v
+}
+
+func redactNode(n *NodeInfo) nodeView {
+	v := nodeView{NodeInfo: *n}
+	v.authView = redactAuth(&v.SSHAuth)
+	v.TokenHash, v.PrevTokenHash = "", ""
+	v.NodeInfo.ProxyJump = nil
+	for _, j := range n.ProxyJump {
+		jv := jumpView{SSHJump: j}
+		jv.authView = redactAuth(&jv.SSHAuth)
+		v.ProxyJump = append(v.ProxyJump, jv)
+	}
+	return v
+}
+
+// checkCurrent 全部凭据都已使用当前密钥加密时返回 nil，这是 prune 删除旧密钥的前提
+func (ck *CredentialKeys) checkCurrent(nodes []NodeInfo, profiles []CredentialProfile) error {
+	current := credentialSealedPrefix + ck.keys[0].id + ":"
+	for i := range nodes {
+		for _, v := range credentialFields(&nodes[i]) {
+			if *v != "" && !strings.HasPrefix(*v, current) {
+				return fmt.Errorf("节点 %s 的凭据未使用当前密钥加密", nodes[i].Name)
+			}
+		}
+	}
+	for i := range profiles {
+		for _, v := range profileFields(&profiles[i]) {
+			if *v != "" && !strings.HasPrefix(*v, current) {
+				return fmt.Errorf("共享凭据 %s 未使用当前密钥加密", profiles[i].Name)
+			}
+		}
+	}
+	return nil
+}
+
+// pruneCredentialKeyFile 密钥文件只保留第一个（当前）密钥和注释、空行，返回新内容和删除的密钥数
+func pruneCredentialKeyFile(data []byte) ([]byte, int) {
+	var kept bytes.Buffer
+	removed := 0
+	first := true
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || first {
+			kept.WriteString(scanner.Text() + "\n")
+			first = first && (line == "" || strings.HasPrefix(line, "#"))
+			continue
+		}
+		removed++
+	}
+	return kept.Bytes(), removed
+}
+
+// ============================================================
+// 命令行：ja3guard credentials rotate|prune
+// ============================================================
+
+func runCredentials(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "用法: ja3guard credentials rotate|prune -config /opt/ja3guard/data/config.json")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("credentials "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "/data/config.json", "配置文件路径")
+	fs.Parse(args[1:])
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+	if !cfg.IsMaster() {
+		log.Fatalf("凭据加密仅用于 master 模式")
+	}
+	if os.Getenv(credentialKeyEnv) != "" {
+		log.Fatalf("凭据主密钥来自环境变量 %s，请直接修改环境变量：新密钥放在最前，旧密钥保留到重新加密完成", credentialKeyEnv)
+	}
+	keys, err := LoadCredentialKeys(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	path := cfg.credentialKeyFile()
+	backend, err := OpenBackend(cfg)
+	if err != nil {
+		log.Fatalf("打开存储失败: %v", err)
+	}
+	defer backend.Close()
+
+	switch args[0] {
+	case "rotate":
+		// 新密钥放在最前，旧密钥保留用于解密；加载节点时自动用新密钥重新加密
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("读取凭据主密钥失败: %v", err)
+		}
+		newKey := generateCredentialKey()
+		if err := writeFileAtomic(path, append([]byte(newKey+"\n"), data...), 0600); err != nil {
+			log.Fatalf("写入凭据主密钥失败: %v", err)
+		}
+		if keys, err = parseCredentialKeys(newKey+"\n"+string(data), path); err != nil {
+			log.Fatalf("%v", err)
+		}
+		ns, err := NewNodeStore(backend, keys)
+		if err != nil {
+			log.Fatalf("重新加密失败（新密钥已写入 %s，旧密钥仍保留）: %v", path, err)
+		}
+		fmt.Fprintf(os.Stderr, "已生成新密钥 %s 并重新加密 %d 个节点和 %d 个共享凭据\n请重启 Master；确认运行正常后可执行 credentials prune 删除旧密钥\n",
+			keys.keys[0].id, len(ns.Nodes()), len(ns.CredentialProfiles()))
+
+	case "prune":
+		// 只有全部凭据都已使用当前密钥加密时才删除旧密钥
+		nodes, err := backend.LoadNodes()
+		if err != nil {
+			log.Fatalf("加载节点失败: %v", err)
+		}
+		profiles, err := backend.LoadCredentialProfiles()
+		if err != nil {
+			log.Fatalf("加载共享凭据失败: %v", err)
+		}
+		if err := keys.checkCurrent(nodes, profiles); err != nil {
+			log.Fatalf("%v，请先重启 Master 或执行 credentials rotate", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("读取凭据主密钥失败: %v", err)
+		}
+		kept, removed := pruneCredentialKeyFile(data)
+		if err := writeFileAtomic(path, kept, 0600); err != nil {
+			log.Fatalf("写入凭据主密钥失败: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "已删除 %d 个旧密钥，当前密钥 %s\n", removed, keys.keys[0].id)
+
+	default:
+		fmt.Fprintf(os.Stderr, "未知子命令: %s\n", args[0])
+		os.Exit(2)
+	}
+}
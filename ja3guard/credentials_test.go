@@ -0,0 +1,188 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestCredentialKeys(t *testing.T, keys ...string) *CredentialKeys {
+	t.Helper()
+	ck, err := parseCredentialKeys(strings.Join(keys, "\n"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ck
+}
+
+func TestCredentialSealOpen(t *testing.T) {
+	current, other := generateCredentialKey(), generateCredentialKey()
+	ck := newTestCredentialKeys(t, current)
+	sealed := ck.Seal("p@ss", "n1/ssh_pass")
+	if !strings.HasPrefix(sealed, credentialSealedPrefix+ck.keys[0].id+":") || strings.Contains(sealed, "p@ss") {
+		t.Fatalf("密文格式不正确: %q", sealed)
+	}
+	if again := ck.Seal("p@ss", "n1/ssh_pass"); again == sealed {
+		t.Fatal("每次加密应使用新的 nonce")
+	}
+	oldSealed := newTestCredentialKeys(t, other).Seal("p@ss", "n1/ssh_pass")
+	rotated := newTestCredentialKeys(t, current, other)
+	body := strings.TrimPrefix(sealed, credentialSealedPrefix+ck.keys[0].id+":")
+
+	for _, tc := range []struct {
+		name      string
+		keys      *CredentialKeys
+		value     string
+		aad       string
+		plain     string
+		stale, ok bool
+	}{
+		{"往返", ck, sealed, "n1/ssh_pass", "p@ss", false, true},
+		{"空值", ck, "", "n1/ssh_pass", "", false, true},
+		{"挪用到其他节点", ck, sealed, "n2/ssh_pass", "", false, false},
+		{"挪用到其他字段", ck, sealed, "n1/ssh_key", "", false, false},
+		{"挪用到跳板机", ck, sealed, "n1/proxy_jump/10.0.0.1:22/ssh_pass", "", false, false},
+		{"未知密钥", newTestCredentialKeys(t, other), sealed, "n1/ssh_pass", "", false, false},
+		{"明文需要重新加密", ck, "p@ss", "n1/ssh_pass", "p@ss", true, true},
+		{"旧密钥需要重新加密", rotated, oldSealed, "n1/ssh_pass", "p@ss", true, true},
+		{"当前密钥", rotated, sealed, "n1/ssh_pass", "p@ss", false, true},
+		{"密文被篡改", ck, sealed[:len(sealed)-4] + "AAA=", "n1/ssh_pass", "", false, false},
+		{"缺少密钥 ID", ck, credentialSealedPrefix + body, "n1/ssh_pass", "", false, false},
+		{"密文不是 base64", ck, credentialSealedPrefix + ck.keys[0].id + ":!!", "n1/ssh_pass", "", false, false},
+		{"密文过短", ck, credentialSealedPrefix + ck.keys[0].id + ":AAAA", "n1/ssh_pass", "", false, false},
+	} {
+		plain, stale, err := tc.keys.Open(tc.value, tc.aad)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+			continue
+		}
+		if tc.ok && (plain != tc.plain || stale != tc.stale) {
+			t.Errorf("%s: Open = %q, stale=%v, want %q, stale=%v", tc.name, plain, stale, tc.plain, tc.stale)
+		}
+	}
+}
+
+func TestParseCredentialKeys(t *testing.T) {
+	key := generateCredentialKey()
+	for _, tc := range []struct {
+		name, text string
+		keys       int
+		ok         bool
+	}{
+		{"单个密钥", key, 1, true},
+		{"注释与重复", "# 当前\n" + key + "\n\n" + key + "\n", 1, true},
+		{"环境变量格式", key + "," + generateCredentialKey(), 2, true},
+		{"不是 base64", "not base64!", 0, false},
+		{"长度错误", "AAAA", 0, false},
+		{"没有密钥", "# 空\n", 0, false},
+	} {
+		ck, err := parseCredentialKeys(tc.text, "test")
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+			continue
+		}
+		if tc.ok && len(ck.keys) != tc.keys {
+			t.Errorf("%s: %d 个密钥, want %d", tc.name, len(ck.keys), tc.keys)
+		}
+	}
+}
+
+func testCredentialNode(id string) NodeInfo {
+	return NodeInfo{
+		ID: id, Name: id, Host: "10.0.0.2", SSHPort: 22,
+		SSHAuth: SSHAuth{AuthType: SSHAuthPassword, SSHPass: "pass-" + id},
+		ProxyJump: []SSHJump{{Host: "10.0.0.1", SSHPort: 22,
+			SSHAuth: SSHAuth{AuthType: "key", SSHKey: "key-" + id, SSHKeyPassphrase: "phrase-" + id}}},
+	}
+}
+
+func TestCredentialRotation(t *testing.T) {
+	oldKey, newKey := generateCredentialKey(), generateCredentialKey()
+	old := newTestCredentialKeys(t, oldKey)
+	rotated := newTestCredentialKeys(t, newKey, oldKey)
+
+	// 旧密钥加密的节点、一个明文节点和共享凭据保存在存储中
+	backend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := old.sealNodes([]NodeInfo{testCredentialNode("n1")})
+	nodes = append(nodes, testCredentialNode("n2"))
+	if err := backend.SaveNodes(nodes); err != nil {
+		t.Fatal(err)
+	}
+	profiles := old.sealProfiles([]CredentialProfile{{ID: "cp1", Name: "cp1", SSHAuth: SSHAuth{AuthType: SSHAuthPassword, SSHPass: "shared"}}})
+	if err := backend.SaveCredentialProfiles(profiles); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotated.checkCurrent(nodes, profiles); err == nil {
+		t.Fatal("还有旧密钥或明文的凭据时 prune 应拒绝")
+	}
+
+	// 加载时解密并用当前密钥重新加密
+	ns, err := NewNodeStore(backend, rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range ns.Nodes() {
+		want := testCredentialNode(n.ID)
+		if n.SSHPass != want.SSHPass || n.ProxyJump[0].SSHKey != want.ProxyJump[0].SSHKey ||
+			n.ProxyJump[0].SSHKeyPassphrase != want.ProxyJump[0].SSHKeyPassphrase {
+			t.Fatalf("节点 %s 的凭据解密不正确: %+v", n.ID, n)
+		}
+	}
+	stored, err := backend.LoadNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedProfiles, err := backend.LoadCredentialProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := credentialSealedPrefix + rotated.keys[0].id + ":"
+	for i := range stored {
+		for aad, v := range credentialFields(&stored[i]) {
+			if *v != "" && !strings.HasPrefix(*v, current) {
+				t.Errorf("%s 未用当前密钥重新加密: %q", aad, *v)
+			}
+		}
+	}
+	if err := rotated.checkCurrent(stored, storedProfiles); err != nil {
+		t.Fatalf("全部重新加密后 prune 应允许: %v", err)
+	}
+
+	// prune 后只剩新密钥，仍能解密
+	pruned, removed := pruneCredentialKeyFile([]byte("# 凭据主密钥\n" + newKey + "\n" + oldKey + "\n"))
+	if removed != 1 || string(pruned) != "# 凭据主密钥\n"+newKey+"\n" {
+		t.Fatalf("prune 结果 = %q, 删除 %d 个", pruned, removed)
+	}
+	if _, err := NewNodeStore(backend, newTestCredentialKeys(t, string(pruned))); err != nil {
+		t.Fatalf("删除旧密钥后应能加载: %v", err)
+	}
+	// 只有旧密钥时无法解密
+	if _, err := NewNodeStore(backend, old); err == nil {
+		t.Fatal("缺少当前密钥时加载应失败")
+	}
+}
+
+func TestCheckCredentialKeyFile(t *testing.T) {
+	data := filepath.Join(t.TempDir(), "data")
+	for _, tc := range []struct {
+		name, dataDir, keyFile string
+		ok                     bool
+	}{
+		{"默认位置", data, "", true},
+		{"数据目录之外", data, "/etc/ja3guard/credential.key", true},
+		{"同级目录", data, data + "2/credential.key", true},
+		{"数据目录内", data, filepath.Join(data, "credential.key"), false},
+		{"数据目录的子目录", data, filepath.Join(data, "pki", "credential.key"), false},
+		{"以 .. 开头的文件名", data, filepath.Join(data, "..credential.key"), false},
+		{"经 .. 回到数据目录", data, filepath.Join(data, "pki", "..", "credential.key"), false},
+		{"相对路径", "data", "data/credential.key", false},
+	} {
+		cfg := &Config{DataDir: tc.dataDir, CredentialKeyFile: tc.keyFile}
+		if err := cfg.checkCredentialKeyFile(); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultCommandParamPattern 未设置 pattern 时参数值允许的字符
+const defaultCommandParamPattern = `[A-Za-z0-9._@:/=+-]+`
+
+var (
+	commandPlaceholderRe = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+	commandNameRe        = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// ExecPolicy 远程执行策略：命令模板之外的任意命令和 Web 终端需要 allow_raw
+type ExecPolicy struct {
+	AllowRaw  bool              `json:"allow_raw"` // 允许执行任意命令和打开终端
+	Templates []CommandTemplate `json:"templates"`
+}
+
+// CommandTemplate 命令模板。command 中的 {{参数名}} 替换为校验后的参数值（自动加单引号）
+type CommandTemplate struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Command     string         `json:"command"`
+	Params      []CommandParam `json:"params,omitempty"`
+}
+
+// CommandParam 模板参数。values 非空时只能取其中之一，否则需完整匹配 pattern
+type CommandParam struct {
+	Name    string   `json:"name"`
+	Pattern string   `json:"pattern,omitempty"` // 正则，默认 defaultCommandParamPattern
+	Values  []string `json:"values,omitempty"`
+	Default string   `json:"default,omitempty"` // 未传时使用，为空表示必填
+}
+
+// defaultExecPolicy 未配置 exec_policy 时的策略：保持旧版行为允许任意命令，并提供常用模板
+func defaultExecPolicy() ExecPolicy {
+	units := []string{"ja3guard", "nginx"}
+	return ExecPolicy{
+		AllowRaw: true,
+		Templates: []CommandTemplate{
+			{Name: "service_status", Description: "查看服务状态", Command: "systemctl status {{unit}} --no-pager",
+				Params: []CommandParam{{Name: "unit", Values: units}}},
+			{Name: "service_restart", Description: "重启服务", Command: "systemctl restart {{unit}}",
+				Params: []CommandParam{{Name: "unit", Values: units}}},
+			{Name: "journal", Description: "查看服务日志", Command: "journalctl -u {{unit}} -n {{lines}} --no-pager",
+				Params: []CommandParam{{Name: "unit", Values: units}, {Name: "lines", Pattern: `[0-9]{1,4}`, Default: "100"}}},
+			{Name: "nginx_test", Description: "检查 Nginx 配置", Command: "nginx -t"},
+			{Name: "disk_usage", Description: "磁盘使用情况", Command: "df -h"},
+			{Name: "system_load", Description: "负载与内存", Command: "uptime && free -m"},
+		},
+	}
+}
+
+// validate 检查模板名唯一、占位符都已定义、正则可编译、默认值合法
+func (p *ExecPolicy) validate() error {
+	seen := make(map[string]bool)
+	for i := range p.Templates {
+		t := &p.Templates[i]
+		if !commandNameRe.MatchString(t.Name) {
+			return fmt.Errorf("命令模板名称只能包含字母、数字、_ 和 -: %q", t.Name)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("命令模板重复: %s", t.Name)
+		}
+		seen[t.Name] = true
+		if strings.TrimSpace(t.Command) == "" {
+			return fmt.Errorf("命令模板 %s 的命令为空", t.Name)
+		}
+		params := make(map[string]bool)
+		for _, param := range t.Params {
+			if !commandNameRe.MatchString(param.Name) || params[param.Name] {
+				return fmt.Errorf("命令模板 %s 的参数名无效或重复: %q", t.Name, param.Name)
+			}
+			params[param.Name] = true
+			if _, err := param.regexp(); err != nil {
+				return fmt.Errorf("命令模板 %s 参数 %s 的 pattern 无效: %w", t.Name, param.Name, err)
+			}
+			if param.Default != "" {
+				if err := param.check(param.Default); err != nil {
+					return fmt.Errorf("命令模板 %s 参数 %s 的默认值无效: %w", t.Name, param.Name, err)
+				}
+			}
+		}
+		for _, m := range commandPlaceholderRe.FindAllStringSubmatch(t.Command, -1) {
+			if !params[m[1]] {
+				return fmt.Errorf("命令模板 %s 使用了未定义的参数: %s", t.Name, m[1])
+			}
+		}
+	}
+	return nil
+}
+
+func (cp *CommandParam) regexp() (*regexp.Regexp, error) {
+	pattern := cp.Pattern
+	if pattern == "" {
+		pattern = defaultCommandParamPattern
+	}
+	// 完整匹配
+	return regexp.Compile(`^(?:` + pattern + `)$`)
+}
+
+func (cp *CommandParam) check(value string) error {
+	if len(cp.Values) > 0 {
+		for _, v := range cp.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("只能是 %s 之一", strings.Join(cp.Values, " / "))
+	}
+	re, err := cp.regexp()
+	if err != nil {
+		return err
+	}
+	if !re.MatchString(value) {
+		return fmt.Errorf("格式不符合 %s", re.String())
+	}
+	return nil
+}
+
+// Render 按模板生成命令。参数值校验后以单引号转义替换，未知参数视为错误
+func (p *ExecPolicy) Render(name string, args map[string]string) (string, error) {
+	var t *CommandTemplate
+	for i := range p.Templates {
+		if p.Templates[i].Name == name {
+			t = &p.Templates[i]
+			break
+		}
+	}
+	if t == nil {
+		return "", fmt.Errorf("命令模板不存在: %s", name)
+	}
+	values := make(map[string]string, len(t.Params))
+	for _, param := range t.Params {
+		v, ok := args[param.Name]
+		if !ok || v == "" {
+			if param.Default == "" {
+				return "", fmt.Errorf("缺少参数: %s", param.Name)
+			}
+			v = param.Default
+		}
+		if err := param.check(v); err != nil {
+			return "", fmt.Errorf("参数 %s %w", param.Name, err)
+		}
+		values[param.Name] = v
+	}
+	var unknown []string
+	for k := range args {
+		if _, ok := values[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return "", fmt.Errorf("模板 %s 没有参数: %s", name, strings.Join(unknown, ", "))
+	}
+	return commandPlaceholderRe.ReplaceAllStringFunc(t.Command, func(m string) string {
+		return shellQuote(values[commandPlaceholderRe.FindStringSubmatch(m)[1]])
+	}), nil
+}
+
+// errRawExecDenied 执行策略不允许任意命令，或当前用户不是管理员
+var errRawExecDenied = errors.New("执行策略不允许任意命令（或需要管理员），请使用命令模板")
+
+// execPolicyStatus 策略拒绝返回 403，其余为请求错误
+func execPolicyStatus(err error) int {
+	if errors.Is(err, errRawExecDenied) {
+		return 403
+	}
+	return 400
+}
+
+// execRequest 执行请求：template + args 使用命令模板，command 为任意命令（需要 allow_raw）
+type execRequest struct {
+	Command  string            `json:"command"`
+	Template string            `json:"template"`
+	Args     map[string]string `json:"args"`
+}
+
+// resolve 按策略校验请求，返回要执行的命令
+func (req *execRequest) resolve(policy ExecPolicy) (string, error) {
+	if req.Template != "" {
+		if req.Command != "" {
+			return "", fmt.Errorf("command 和 template 只能填写一个")
+		}
+		return policy.Render(req.Template, req.Args)
+	}
+	if strings.TrimSpace(req.Command) == "" {
+		return "", fmt.Errorf("命令不能为空")
+	}
+	if !policy.AllowRaw {
+		return "", errRawExecDenied
+	}
+	return req.Command, nil
+}
+
+// handleExecPolicyGet 当前用户适用的执行策略（面板据此显示模板和参数）
+func (h *AdminHandler) handleExecPolicyGet(w http.ResponseWriter, r *http.Request) {
+	h.jsonOK(w, h.execPolicyFor(r))
+}
+
+// handleExecPolicyUpdate 整体替换执行策略，写回 config.json 并立即生效
+func (h *AdminHandler) handleExecPolicyUpdate(w http.ResponseWriter, r *http.Request) {
+	var p ExecPolicy
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		h.jsonErr(w, "请求格式错误: "+err.Error(), 400)
+		return
+	}
+	if p.Templates == nil {
+		p.Templates = []CommandTemplate{}
+	}
+	if err := p.validate(); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	if err := h.cfg.UpdateFile(map[string]interface{}{"exec_policy": p}, false); err != nil {
+		h.jsonErr(w, "保存配置失败: "+err.Error(), 500)
+		return
+	}
+	h.cfg.SetExecPolicy(p)
+	log.Printf("[Exec] %s 更新了执行策略：%d 个命令模板，任意命令%s", h.adminUser(r), len(p.Templates),
+		map[bool]string{true: "允许", false: "禁止"}[p.AllowRaw])
+	h.jsonOK(w, p)
+}
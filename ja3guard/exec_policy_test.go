@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExecPolicyValidate(t *testing.T) {
+	if p := defaultExecPolicy(); p.validate() != nil {
+		t.Fatalf("默认策略应合法: %v", p.validate())
+	}
+	for _, tc := range []struct {
+		name string
+		tmpl CommandTemplate
+		want string // 为空表示合法
+	}{
+		{"合法", CommandTemplate{Name: "tail", Command: "tail -n {{ lines }} {{file}}",
+			Params: []CommandParam{{Name: "lines", Pattern: `[0-9]+`, Default: "10"}, {Name: "file", Values: []string{"/var/log/syslog"}}}}, ""},
+		{"名称非法", CommandTemplate{Name: "a b", Command: "true"}, "名称"},
+		{"命令为空", CommandTemplate{Name: "empty", Command: "  "}, "命令为空"},
+		{"未定义的参数", CommandTemplate{Name: "x", Command: "echo {{msg}}"}, "未定义的参数: msg"},
+		{"参数名重复", CommandTemplate{Name: "x", Command: "echo {{a}}", Params: []CommandParam{{Name: "a"}, {Name: "a"}}}, "无效或重复"},
+		{"参数名非法", CommandTemplate{Name: "x", Command: "true", Params: []CommandParam{{Name: "a;b"}}}, "无效或重复"},
+		{"pattern 无效", CommandTemplate{Name: "x", Command: "echo {{a}}", Params: []CommandParam{{Name: "a", Pattern: "("}}}, "pattern 无效"},
+		{"默认值不符合 pattern", CommandTemplate{Name: "x", Command: "echo {{a}}", Params: []CommandParam{{Name: "a", Pattern: "[0-9]+", Default: "abc"}}}, "默认值无效"},
+		{"默认值不在 values 中", CommandTemplate{Name: "x", Command: "echo {{a}}", Params: []CommandParam{{Name: "a", Values: []string{"x"}, Default: "y"}}}, "默认值无效"},
+	} {
+		p := ExecPolicy{Templates: []CommandTemplate{tc.tmpl}}
+		err := p.validate()
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%s: err = %v, want 包含 %q", tc.name, err, tc.want)
+		}
+	}
+
+	dup := ExecPolicy{Templates: []CommandTemplate{{Name: "a", Command: "true"}, {Name: "a", Command: "false"}}}
+	if err := dup.validate(); err == nil || !strings.Contains(err.Error(), "重复") {
+		t.Errorf("模板名重复: err = %v", err)
+	}
+}
+
+func TestExecPolicyRender(t *testing.T) {
+	p := ExecPolicy{Templates: []CommandTemplate{
+		{Name: "journal", Command: "journalctl -u {{unit}} -n {{lines}}",
+			Params: []CommandParam{{Name: "unit", Values: []string{"ja3guard", "nginx"}}, {Name: "lines", Pattern: `[0-9]{1,4}`, Default: "100"}}},
+		{Name: "echo", Command: "echo {{msg}}", Params: []CommandParam{{Name: "msg", Pattern: `.*`}}},
+		{Name: "grep", Command: "grep {{word}} /var/log/syslog", Params: []CommandParam{{Name: "word"}}},
+		{Name: "uptime", Command: "uptime"},
+	}}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, tmpl string
+		args       map[string]string
+		want       string // 期望的命令
+		err        string // 期望的错误（包含）
+	}{
+		{"默认值", "journal", map[string]string{"unit": "nginx"}, "journalctl -u 'nginx' -n '100'", ""},
+		{"空值使用默认值", "journal", map[string]string{"unit": "nginx", "lines": ""}, "journalctl -u 'nginx' -n '100'", ""},
+		{"指定参数", "journal", map[string]string{"unit": "ja3guard", "lines": "20"}, "journalctl -u 'ja3guard' -n '20'", ""},
+		{"单引号转义", "echo", map[string]string{"msg": "it's $(id); `id`"}, `echo 'it'\''s $(id); ` + "`id`'", ""},
+		{"无参数模板", "uptime", nil, "uptime", ""},
+		{"缺少必填参数", "journal", map[string]string{"lines": "20"}, "", "缺少参数: unit"},
+		{"不在 values 中", "journal", map[string]string{"unit": "sshd"}, "", "参数 unit 只能是"},
+		{"不符合 pattern", "journal", map[string]string{"unit": "nginx", "lines": "10; reboot"}, "", "参数 lines 格式不符合"},
+		{"默认 pattern 拒绝 shell 元字符", "grep", map[string]string{"word": "a b"}, "", "参数 word 格式不符合"},
+		{"未知参数", "journal", map[string]string{"unit": "nginx", "since": "1h", "extra": "x"}, "", "没有参数: extra, since"},
+		{"模板不存在", "rm", nil, "", "命令模板不存在: rm"},
+	} {
+		got, err := p.Render(tc.tmpl, tc.args)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: Render = %q, %v, want 错误 %q", tc.name, got, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s: Render = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestExecRequestResolve(t *testing.T) {
+	policy := defaultExecPolicy()
+	policy.AllowRaw = false
+	for _, tc := range []struct {
+		name string
+		req  execRequest
+		raw  bool
+		ok   bool
+	}{
+		{"模板", execRequest{Template: "disk_usage"}, false, true},
+		{"任意命令被禁止", execRequest{Command: "id"}, false, false},
+		{"允许任意命令", execRequest{Command: "id"}, true, true},
+		{"同时填写", execRequest{Command: "id", Template: "disk_usage"}, true, false},
+		{"命令为空", execRequest{Command: " "}, true, false},
+	} {
+		policy.AllowRaw = tc.raw
+		if _, err := tc.req.resolve(policy); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+	if _, err := (&execRequest{Command: "id"}).resolve(ExecPolicy{}); execPolicyStatus(err) != 403 {
+		t.Errorf("任意命令被策略拒绝应返回 403: %v", err)
+	}
+}
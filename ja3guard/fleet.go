@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	fleetDefaultConcurrency = 5
+	fleetMaxConcurrency     = 50
+	fleetDefaultTimeout     = 300 // 秒
+	fleetMaxTimeout         = 3600
+	fleetHistorySize        = 50
+)
+
+// 批量操作状态
+const (
+	FleetRunning   = "running"
+	FleetSucceeded = "succeeded" // 全部节点成功
+	FleetPartial   = "partial"   // 全部执行完毕，部分节点失败
+	FleetStopped   = "stopped"   // 灰度节点失败或失败数达到阈值，其余节点未执行
+	FleetCanceled  = "canceled"
+)
+
+// 批量操作中节点的状态：执行后为对应任务的状态，另有等待执行和未执行
+const (
+	FleetNodePending = "pending"
+	FleetNodeSkipped = "skipped"
+)
+
+// FleetOptions 批量操作的节点范围和执行策略
+type FleetOptions struct {
+	Nodes       []string `json:"nodes,omitempty"`        // 节点 ID，为空时按分组选择
+	Group       string   `json:"group,omitempty"`        // 节点分组，与 nodes 都为空时为全部节点
+	Concurrency int      `json:"concurrency,omitempty"`  // 同时执行的节点数
+	Timeout     int      `json:"timeout,omitempty"`      // 单个节点的超时（秒），从任务开始执行时计时
+	Canary      int      `json:"canary,omitempty"`       // 先在前 N 个节点上执行，全部成功后再继续
+	MaxFailures int      `json:"max_failures,omitempty"` // 失败节点数达到该值后不再开始新的节点，0 表示不限
+}
+
+// FleetNodeResult 单个节点的执行结果
+type FleetNodeResult struct {
+	NodeID     string  `json:"node_id"`
+	NodeName   string  `json:"node_name"`
+	Canary     bool    `json:"canary,omitempty"`
+	State      string  `json:"state"`
+	JobID      string  `json:"job_id,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	StartedAt  string  `json:"started_at,omitempty"`
+	FinishedAt string  `json:"finished_at,omitempty"`
+	Duration   float64 `json:"duration,omitempty"` // 秒，含排队时间
+}
+
+// FleetRun 一次批量操作
+type FleetRun struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type"`
+	Summary    string            `json:"summary,omitempty"`
+	Options    FleetOptions      `json:"options"`
+	State      string            `json:"state"`
+	StopReason string            `json:"stop_reason,omitempty"`
+	Total      int               `json:"total"`
+	Succeeded  int               `json:"succeeded"`
+	Failed     int               `json:"failed"`
+	Canceled   int               `json:"canceled"`
+	Skipped    int               `json:"skipped"`
+	CreatedAt  string            `json:"created_at"`
+	FinishedAt string            `json:"finished_at,omitempty"`
+	Results    []FleetNodeResult `json:"results"`
+}
+
+// fleetOp 批量执行的操作，Build 生成单个节点的任务
+type fleetOp struct {
+	Type    string
+	Summary string
+	Build   func(node *NodeInfo) JobFunc
+}
+
+type fleetEntry struct {
+	run    FleetRun
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// FleetManager 在多个节点上并发执行同一操作。每个节点的执行是一个普通任务，
+// 输出和取消通过任务接口；批量操作只负责调度并汇总结果。记录只保存在内存中
+type FleetManager struct {
+	jobs *JobManager
+	mu   sync.Mutex
+	runs []*fleetEntry // 最新在后
+}
+
+func NewFleetManager(jobs *JobManager) *FleetManager {
+	return &FleetManager{jobs: jobs}
+}
+
+// normalizeFleetOptions 补全默认值并检查范围
+func normalizeFleetOptions(opts *FleetOptions) error {
+	if opts.Concurrency == 0 {
+		opts.Concurrency = fleetDefaultConcurrency
+	}
+	if opts.Concurrency < 1 || opts.Concurrency > fleetMaxConcurrency {
+		return fmt.Errorf("concurrency 范围为 1-%d", fleetMaxConcurrency)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = fleetDefaultTimeout
+	}
+	if opts.Timeout < 1 || opts.Timeout > fleetMaxTimeout {
+		return fmt.Errorf("timeout 范围为 1-%d 秒", fleetMaxTimeout)
+	}
+	if opts.Canary < 0 || opts.MaxFailures < 0 {
+		return fmt.Errorf("canary 和 max_failures 不能为负数")
+	}
+	return nil
+}
+
+// Start 在后台开始批量操作，opts 需已经过 normalizeFleetOptions
+func (fm *FleetManager) Start(op fleetOp, nodes []NodeInfo, opts FleetOptions) *FleetRun {
+	b := make([]byte, 8)
+	rand.Read(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &fleetEntry{
+		run: FleetRun{
+			ID:        "fleet_" + hex.EncodeToString(b),
+			Type:      op.Type,
+			Summary:   op.Summary,
+			Options:   opts,
+			State:     FleetRunning,
+			Total:     len(nodes),
+			CreatedAt: time.Now().Format("2006-01-02 15:04:05"),
+			Results:   make([]FleetNodeResult, len(nodes)),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	canary := min(opts.Canary, len(nodes))
+	for i := range nodes {
+		e.run.Results[i] = FleetNodeResult{
+			NodeID:   nodes[i].ID,
+			NodeName: nodes[i].Name,
+			Canary:   i < canary,
+			State:    FleetNodePending,
+		}
+	}
+
+	fm.mu.Lock()
+	fm.runs = append(fm.runs, e)
+	if len(fm.runs) > fleetHistorySize {
+		// 只淘汰已结束的
+		for i, old := range fm.runs {
+			if old.run.State != FleetRunning {
+				fm.runs = append(fm.runs[:i:i], fm.runs[i+1:]...)
+				break
+			}
+		}
+	}
+	run := e.snapshotLocked()
+	fm.mu.Unlock()
+
+	log.Printf("[Fleet] %s 开始: %s，%d 个节点（并发 %d，灰度 %d，失败上限 %d）",
+		run.ID, op.Type, len(nodes), opts.Concurrency, canary, opts.MaxFailures)
+	go fm.execute(ctx, e, op, nodes, canary)
+	return run
+}
+
+func (e *fleetEntry) snapshotLocked() *FleetRun {
+	run := e.run
+	run.Results = append([]FleetNodeResult(nil), e.run.Results...)
+	return &run
+}
+
+// execute 先执行灰度节点，全部成功后再执行其余节点
+func (fm *FleetManager) execute(ctx context.Context, e *fleetEntry, op fleetOp, nodes []NodeInfo, canary int) {
+	fm.phase(ctx, e, op, nodes, 0, canary)
+	fm.mu.Lock()
+	if canary > 0 && canary < len(nodes) && e.run.Failed > 0 && e.run.StopReason == "" {
+		e.run.StopReason = "灰度节点执行失败，其余节点未执行"
+	}
+	fm.mu.Unlock()
+	fm.phase(ctx, e, op, nodes, canary, len(nodes))
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	r := &e.run
+	for i := range r.Results {
+		if r.Results[i].State == FleetNodePending {
+			r.Results[i].State = FleetNodeSkipped
+			r.Skipped++
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		r.State = FleetCanceled
+	case r.StopReason != "":
+		r.State = FleetStopped
+	case r.Failed > 0:
+		r.State = FleetPartial
+	default:
+		r.State = FleetSucceeded
+	}
+	r.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+	e.cancel()
+	close(e.done)
+	log.Printf("[Fleet] %s 结束: %s（成功 %d，失败 %d，未执行 %d）", r.ID, r.State, r.Succeeded, r.Failed, r.Skipped)
+}
+
+// phase 以限定的并发数执行 nodes[from:to]，停止或取消后不再开始新的节点
+func (fm *FleetManager) phase(ctx context.Context, e *fleetEntry, op fleetOp, nodes []NodeInfo, from, to int) {
+	sem := make(chan struct{}, e.run.Options.Concurrency)
+	var wg sync.WaitGroup
+	for i := from; i < to; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		fm.mu.Lock()
+		stop := ctx.Err() != nil || e.run.StopReason != ""
+		fm.mu.Unlock()
+		if stop {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fm.runNode(ctx, e, op, &nodes[i], i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// runNode 在单个节点上创建任务并等待结束。批量操作取消时结束该节点的任务
+func (fm *FleetManager) runNode(ctx context.Context, e *fleetEntry, op fleetOp, node *NodeInfo, i int) {
+	timeout := time.Duration(e.run.Options.Timeout) * time.Second
+	fn := op.Build(node)
+	start := time.Now()
+	job := fm.jobs.Start(op.Type, node, op.Summary, func(jctx context.Context, run *JobRun) error {
+		if ctx.Err() != nil {
+			return context.Canceled
+		}
+		jctx, cancel := context.WithTimeout(jctx, timeout)
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+		err := fn(jctx, run)
+		switch {
+		case ctx.Err() != nil:
+			return context.Canceled
+		case errors.Is(jctx.Err(), context.DeadlineExceeded):
+			return fmt.Errorf("执行超时（%s）", timeout)
+		}
+		return err
+	})
+
+	fm.mu.Lock()
+	res := &e.run.Results[i]
+	res.State, res.JobID = job.State, job.ID
+	fm.mu.Unlock()
+
+	final, ok := fm.jobs.Wait(context.Background(), job.ID)
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	res.Duration = float64(time.Since(start).Milliseconds()) / 1000
+	if !ok {
+		res.State, res.Error = JobFailed, "任务记录丢失"
+	} else {
+		res.State, res.Error = final.State, final.Error
+		res.StartedAt, res.FinishedAt = final.StartedAt, final.FinishedAt
+	}
+	switch res.State {
+	case JobSucceeded:
+		e.run.Succeeded++
+		return
+	case JobCanceled:
+		e.run.Canceled++
+		return
+	}
+	e.run.Failed++
+	if limit := e.run.Options.MaxFailures; limit > 0 && e.run.Failed >= limit && e.run.StopReason == "" && ctx.Err() == nil {
+		e.run.StopReason = fmt.Sprintf("失败节点数达到 %d，其余节点未执行", limit)
+		log.Printf("[Fleet] %s %s", e.run.ID, e.run.StopReason)
+	}
+}
+
+func (fm *FleetManager) find(id string) *fleetEntry {
+	for _, e := range fm.runs {
+		if e.run.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (fm *FleetManager) Get(id string) (*FleetRun, bool) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	e := fm.find(id)
+	if e == nil {
+		return nil, false
+	}
+	return e.snapshotLocked(), true
+}
+
+// List 最近的批量操作，最新在前
+func (fm *FleetManager) List() []*FleetRun {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	runs := make([]*FleetRun, 0, len(fm.runs))
+	for i := len(fm.runs) - 1; i >= 0; i-- {
+		runs = append(runs, fm.runs[i].snapshotLocked())
+	}
+	return runs
+}
+
+// Cancel 不再开始新的节点，并取消正在执行的节点任务
+func (fm *FleetManager) Cancel(id string) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	e := fm.find(id)
+	if e == nil || e.run.State != FleetRunning {
+		return fmt.Errorf("批量操作不存在或已结束")
+	}
+	log.Printf("[Fleet] 取消 %s", id)
+	e.cancel()
+	return nil
+}
+
+// Wait 等待批量操作结束，ctx 结束时返回当前状态
+func (fm *FleetManager) Wait(ctx context.Context, id string) (*FleetRun, bool) {
+	fm.mu.Lock()
+	e := fm.find(id)
+	fm.mu.Unlock()
+	if e == nil {
+		return nil, false
+	}
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+	return fm.Get(id)
+}
+
+// ============================================================
+// 批量操作
+// ============================================================
+
+// whitelistSyncOp 通过 SSH 写入节点的白名单文件并让节点重新加载，每个节点各写审计记录
+func (h *AdminHandler) whitelistSyncOp(actor auditActor) fleetOp {
+	whitelist := h.store.GetWhitelist()
+	wlJSON, _ := json.MarshalIndent(whitelist, "", "  ")
+	sum := sha256.Sum256(wlJSON)
+	rec := AuditRecord{
+		Action:  AuditWhitelistSync,
+		Args:    map[string]string{"entries": strconv.Itoa(len(whitelist)), "sha256": hex.EncodeToString(sum[:])},
+		Command: nodeReloadCmd,
+		Path:    "/opt/ja3guard/data/whitelist.json",
+	}
+	return fleetOp{
+		Type:    JobWhitelistSync,
+		Summary: fmt.Sprintf("%d 条", len(whitelist)),
+		Build: func(node *NodeInfo) JobFunc {
+			client := h.sshClient(node)
+			return h.auditedJob(actor, node, rec, func(ctx context.Context, run *JobRun) error {
+				run.Logf("写入 /opt/ja3guard/data/whitelist.json（%d 条）", len(whitelist))
+				if err := client.WriteFile(string(wlJSON), "/opt/ja3guard/data/whitelist.json", 0644); err != nil {
+					return err
+				}
+				run.Logf("重新加载白名单")
+				if err := client.ExecStream(ctx, nodeReloadCmd, run.Stdout(), run.Stderr()); err != nil {
+					return err
+				}
+				log.Printf("[Sync] 白名单已推送到 %s", node.Name)
+				return nil
+			})
+		},
+	}
+}
+
+// execOp 通过 SSH 执行已按执行策略校验过的命令，每个节点各写一条审计记录
+func (h *AdminHandler) execOp(actor auditActor, req *execRequest, command string) fleetOp {
+	return fleetOp{
+		Type:    JobExec,
+		Summary: command,
+		Build: func(node *NodeInfo) JobFunc {
+			return h.auditedExec(actor, node, req, command)
+		},
+	}
+}
+
+// fleetNodes 按 ID 列表或分组选择节点，都为空时为全部节点
+func (h *AdminHandler) fleetNodes(opts *FleetOptions) ([]NodeInfo, error) {
+	all := h.nodeStore.Nodes()
+	if len(opts.Nodes) > 0 {
+		byID := make(map[string]NodeInfo, len(all))
+		for _, n := range all {
+			byID[n.ID] = n
+		}
+		nodes := make([]NodeInfo, 0, len(opts.Nodes))
+		seen := make(map[string]bool)
+		for _, id := range opts.Nodes {
+			n, ok := byID[id]
+			if !ok {
+				return nil, fmt.Errorf("节点不存在: %s", id)
+			}
+			if !seen[id] {
+				seen[id] = true
+				nodes = append(nodes, n)
+			}
+		}
+		return nodes, nil
+	}
+	if opts.Group == "" {
+		return all, nil
+	}
+	var nodes []NodeInfo
+	for _, n := range all {
+		if n.Group == opts.Group {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("分组 %s 中没有节点", opts.Group)
+	}
+	return nodes, nil
+}
+
+// startFleet 选择节点并开始批量操作；?wait=1 时等待全部节点结束后返回结果
+func (h *AdminHandler) startFleet(w http.ResponseWriter, r *http.Request, op fleetOp, opts FleetOptions) {
+	if err := normalizeFleetOptions(&opts); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	nodes, err := h.fleetNodes(&opts)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	run := h.fleet.Start(op, nodes, opts)
+	if r.URL.Query().Get("wait") == "1" {
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		run, _ = h.fleet.Wait(r.Context(), run.ID)
+	}
+	h.jsonOK(w, map[string]interface{}{"status": "ok", "fleet": run})
+}
+
+// ============================================================
+// 管理接口
+// ============================================================
+
+// handleFleetStart 在选定节点上批量执行操作
+func (h *AdminHandler) handleFleetStart(w http.ResponseWriter, r *http.Request) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	var req struct {
+		FleetOptions
+		execRequest
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+
+	var op fleetOp
+	switch req.Type {
+	case JobWhitelistSync:
+		op = h.whitelistSyncOp(h.auditActor(r))
+	case JobExec:
+		command, err := req.resolve(h.execPolicyFor(r))
+		if err != nil {
+			h.jsonErr(w, err.Error(), execPolicyStatus(err))
+			return
+		}
+		op = h.execOp(h.auditActor(r), &req.execRequest, command)
+	default:
+		h.jsonErr(w, "不支持的批量操作: "+req.Type, 400)
+		return
+	}
+	h.startFleet(w, r, op, req.FleetOptions)
+}
+
+// handleWhitelistSync 通过 SSH 将白名单推送到节点，请求体可选（FleetOptions）
+func (h *AdminHandler) handleWhitelistSync(w http.ResponseWriter, r *http.Request) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "仅在 master 模式下可用", 400)
+		return
+	}
+	var opts FleetOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	h.startFleet(w, r, h.whitelistSyncOp(h.auditActor(r)), opts)
+}
+
+func (h *AdminHandler) handleFleetList(w http.ResponseWriter, r *http.Request) {
+	if h.fleet == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	h.jsonOK(w, h.fleet.List())
+}
+
+func (h *AdminHandler) handleFleetGet(w http.ResponseWriter, r *http.Request, id string) {
+	if h.fleet == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	run, ok := h.fleet.Get(id)
+	if !ok {
+		h.jsonErr(w, "批量操作不存在", 404)
+		return
+	}
+	h.jsonOK(w, run)
+}
+
+func (h *AdminHandler) handleFleetCancel(w http.ResponseWriter, r *http.Request, id string) {
+	if h.fleet == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	if err := h.fleet.Cancel(id); err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
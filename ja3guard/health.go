@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NodeHealth 节点健康指标，随每轮上报的第一页发送。
+// 进程 / 系统指标为采集时刻的值，无法获取时为 0（如非 Linux 系统）；
+// 上游、握手、日志计数为统计窗口内（距上一次成功上报）的增量
+type NodeHealth struct {
+	Window               int64   `json:"window"`     // 统计窗口（秒）
+	RSSBytes             uint64  `json:"rss_bytes"`  // 进程常驻内存
+	Goroutines           int     `json:"goroutines"` // goroutine 数
+	OpenFDs              int     `json:"open_fds"`   // 打开的文件描述符
+	CPUs                 int     `json:"cpus"`       // CPU 核数
+	Load1                float64 `json:"load1"`      // 系统 1 / 5 / 15 分钟负载
+	Load5                float64 `json:"load5"`
+	Load15               float64 `json:"load15"`
+	DiskFreeBytes        uint64  `json:"disk_free_bytes"`          // 数据目录所在分区可用空间
+	DiskTotalBytes       uint64  `json:"disk_total_bytes"`         // 数据目录所在分区总空间
+	CertNotAfter         string  `json:"cert_not_after,omitempty"` // ACME 证书到期时间，尚未签发时为空
+	UpstreamRequests     int64   `json:"upstream_requests"`        // 转发到上游的请求数
+	UpstreamErrors       int64   `json:"upstream_errors"`          // 上游连接失败或返回 5xx 的请求数
+	UpstreamLatencyMs    float64 `json:"upstream_latency_ms"`      // 上游平均响应时间（到响应头）
+	UpstreamLatencyMaxMs float64 `json:"upstream_latency_max_ms"`  // 上游最长响应时间
+	HandshakeFailures    int64   `json:"handshake_failures"`       // TLS 握手失败次数
+	LogDropped           int64   `json:"log_dropped"`              // 写入失败而丢弃的请求日志条数
+}
+
+// healthCounters 启动以来的累计计数
+type healthCounters struct {
+	upstreamRequests  int64
+	upstreamErrors    int64
+	upstreamLatency   time.Duration
+	handshakeFailures int64
+	logDropped        int64
+}
+
+// HealthCollector 节点端健康指标采集：代理和 HTTPS 服务实时累计计数，
+// 上报时取快照，只有上报成功后统计窗口才前进，失败期间的计数并入下一次上报
+type HealthCollector struct {
+	cfg        *Config
+	store      *Store
+	mu         sync.Mutex
+	total      healthCounters
+	maxLatency time.Duration  // 当前窗口内的最长上游响应时间
+	base       healthCounters // 上一次成功上报时的累计值
+	baseTime   time.Time
+}
+
+func NewHealthCollector(cfg *Config, store *Store) *HealthCollector {
+	return &HealthCollector{cfg: cfg, store: store, baseTime: time.Now()}
+}
+
+// ObserveUpstream 记录一次上游请求
+func (hc *HealthCollector) ObserveUpstream(d time.Duration, failed bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.total.upstreamRequests++
+	hc.total.upstreamLatency += d
+	if failed {
+		hc.total.upstreamErrors++
+	}
+	if d > hc.maxLatency {
+		hc.maxLatency = d
+	}
+}
+
+func (hc *HealthCollector) handshakeFailed() {
+	hc.mu.Lock()
+	hc.total.handshakeFailures++
+	hc.mu.Unlock()
+}
+
+// Transport 包装代理的上游 Transport，统计响应时间和错误
+func (hc *HealthCollector) Transport(inner http.RoundTripper) http.RoundTripper {
+	return &healthTransport{inner: inner, hc: hc}
+}
+
+type healthTransport struct {
+	inner http.RoundTripper
+	hc    *HealthCollector
+}
+
+func (t *healthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.inner.RoundTrip(req)
+	// 客户端主动断开不算上游错误
+	if err != nil && req.Context().Err() != nil {
+		return resp, err
+	}
+	t.hc.ObserveUpstream(time.Since(start), err != nil || resp.StatusCode >= 500)
+	return resp, err
+}
+
+// ErrorLog 供 HTTPS 服务使用的错误日志：统计 TLS 握手失败，日志照常输出
+func (hc *HealthCollector) ErrorLog() *log.Logger {
+	return log.New(&handshakeLogWriter{hc: hc}, "", log.LstdFlags)
+}
+
+type handshakeLogWriter struct {
+	hc *HealthCollector
+}
+
+func (w *handshakeLogWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		w.hc.handshakeFailed()
+	}
+	return log.Writer().Write(p)
+}
+
+// Snapshot 采集当前健康指标，返回的计数在上报成功后交给 Commit
+func (hc *HealthCollector) Snapshot() (*NodeHealth, healthCounters) {
+	hc.mu.Lock()
+	hc.total.logDropped = hc.store.LogDropped()
+	cur, base, maxLatency := hc.total, hc.base, hc.maxLatency
+	window := time.Since(hc.baseTime)
+	hc.mu.Unlock()
+
+	h := &NodeHealth{
+		Window:               int64(window.Seconds()),
+		Goroutines:           runtime.NumGoroutine(),
+		CPUs:                 runtime.NumCPU(),
+		UpstreamRequests:     cur.upstreamRequests - base.upstreamRequests,
+		UpstreamErrors:       cur.upstreamErrors - base.upstreamErrors,
+		UpstreamLatencyMaxMs: durationMs(maxLatency),
+		HandshakeFailures:    cur.handshakeFailures - base.handshakeFailures,
+		LogDropped:           cur.logDropped - base.logDropped,
+	}
+	if h.UpstreamRequests > 0 {
+		h.UpstreamLatencyMs = durationMs((cur.upstreamLatency - base.upstreamLatency) / time.Duration(h.UpstreamRequests))
+	}
+	h.RSSBytes = processRSS()
+	h.OpenFDs = openFDCount()
+	h.Load1, h.Load5, h.Load15 = loadAverage()
+	if free, total, err := diskUsage(hc.cfg.DataDir); err == nil {
+		h.DiskFreeBytes, h.DiskTotalBytes = free, total
+	}
+	if notAfter, ok := acmeCertExpiry(filepath.Join(hc.cfg.DataDir, "certs"), hc.cfg.Domain); ok {
+		h.CertNotAfter = notAfter.Local().Format("2006-01-02 15:04:05")
+	}
+	return h, cur
+}
+
+// Commit 上报成功后前进统计窗口
+func (hc *HealthCollector) Commit(c healthCounters) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.base = c
+	hc.baseTime = time.Now()
+	hc.maxLatency = 0
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// processRSS 从 /proc/self/status 读取常驻内存
+func processRSS() uint64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+// openFDCount 统计 /proc/self/fd 下的条目数
+func openFDCount() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// loadAverage 读取 /proc/loadavg
+func loadAverage() (float64, float64, float64) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, 0, 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return 0, 0, 0
+	}
+	l1, _ := strconv.ParseFloat(fields[0], 64)
+	l5, _ := strconv.ParseFloat(fields[1], 64)
+	l15, _ := strconv.ParseFloat(fields[2], 64)
+	return l1, l5, l15
+}
+
+// acmeCertExpiry 读取 autocert 缓存中域名证书的到期时间。
+// 缓存文件为私钥 PEM 加证书链 PEM，ECDSA 证书以域名命名，RSA 证书带 +rsa 后缀
+func acmeCertExpiry(certDir, domain string) (time.Time, bool) {
+	if domain == "" {
+		return time.Time{}, false
+	}
+	var latest time.Time
+	for _, name := range []string{domain, domain + "+rsa"} {
+		f, err := os.Open(filepath.Join(certDir, name))
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(f, 1<<20))
+		f.Close()
+		if err != nil {
+			continue
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			// 第一张证书为叶子证书
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil && cert.NotAfter.After(latest) {
+				latest = cert.NotAfter
+			}
+			break
+		}
+	}
+	return latest, !latest.IsZero()
+}
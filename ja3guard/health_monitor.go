@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 每个节点保留的健康历史条数（按 60 秒上报间隔约 2 小时）
+const healthHistorySize = 120
+
+// 上游请求数低于该值时不计算错误率，避免少量请求造成误报
+const healthMinUpstreamRequests = 20
+
+// HealthThresholds 节点健康告警阈值，任一项为负数时关闭该项检查
+type HealthThresholds struct {
+	MaxRSSMB             float64 `json:"max_rss_mb"`              // 进程常驻内存上限（MB）
+	MaxGoroutines        float64 `json:"max_goroutines"`          // goroutine 数上限
+	MaxOpenFDs           float64 `json:"max_open_fds"`            // 文件描述符上限
+	MaxLoadPerCPU        float64 `json:"max_load_per_cpu"`        // 1 分钟负载 / CPU 核数上限
+	MinDiskFreeMB        float64 `json:"min_disk_free_mb"`        // 数据目录可用空间下限（MB）
+	MinCertDays          float64 `json:"min_cert_days"`           // 证书剩余有效天数下限
+	MaxUpstreamErrorRate float64 `json:"max_upstream_error_rate"` // 上游错误率上限（%）
+	MaxUpstreamLatencyMs float64 `json:"max_upstream_latency_ms"` // 上游平均响应时间上限（毫秒）
+	MaxHandshakeFailures float64 `json:"max_handshake_failures"`  // 每分钟 TLS 握手失败次数上限
+	MaxLogDropped        float64 `json:"max_log_dropped"`         // 单个上报窗口内丢弃日志条数上限
+}
+
+func defaultHealthThresholds() HealthThresholds {
+	return HealthThresholds{
+		MaxRSSMB:             512,
+		MaxGoroutines:        10000,
+		MaxOpenFDs:           10000,
+		MaxLoadPerCPU:        2,
+		MinDiskFreeMB:        1024,
+		MinCertDays:          14,
+		MaxUpstreamErrorRate: 5,
+		MaxUpstreamLatencyMs: 2000,
+		MaxHandshakeFailures: 300,
+		MaxLogDropped:        0,
+	}
+}
+
+// HealthSample 一次上报的健康指标
+type HealthSample struct {
+	Time string `json:"time"`
+	*NodeHealth
+}
+
+// HealthAlert 节点当前触发的告警
+type HealthAlert struct {
+	NodeID    string  `json:"node_id"`
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Message   string  `json:"message"`
+	Since     string  `json:"since"` // 首次触发时间
+}
+
+type nodeHealthState struct {
+	history []HealthSample
+	alerts  map[string]*HealthAlert // metric -> alert
+}
+
+// HealthMonitor Master 端节点健康：保存最近的上报历史（仅内存），
+// 每次上报按阈值评估，告警触发和恢复时记录日志
+type HealthMonitor struct {
+	cfg   *Config
+	mu    sync.Mutex
+	nodes map[string]*nodeHealthState
+}
+
+func NewHealthMonitor(cfg *Config) *HealthMonitor {
+	return &HealthMonitor{cfg: cfg, nodes: make(map[string]*nodeHealthState)}
+}
+
+// Record 保存一次健康上报并重新评估告警
+func (hm *HealthMonitor) Record(nodeID, nodeName string, h *NodeHealth) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	firing := evaluateHealth(h, hm.cfg.GetHealthThresholds())
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	st := hm.nodes[nodeID]
+	if st == nil {
+		st = &nodeHealthState{alerts: make(map[string]*HealthAlert)}
+		hm.nodes[nodeID] = st
+	}
+	st.history = append(st.history, HealthSample{Time: now, NodeHealth: h})
+	if len(st.history) > healthHistorySize {
+		st.history = append([]HealthSample(nil), st.history[len(st.history)-healthHistorySize:]...)
+	}
+
+	for metric, alert := range st.alerts {
+		if _, ok := firing[metric]; !ok {
+			delete(st.alerts, metric)
+			log.Printf("[Health] 节点 %s 已恢复: %s", nodeName, alert.Message)
+		}
+	}
+	for metric, alert := range firing {
+		alert.NodeID = nodeID
+		if prev, ok := st.alerts[metric]; ok {
+			alert.Since = prev.Since
+		} else {
+			alert.Since = now
+			log.Printf("[Health] 节点 %s 告警: %s", nodeName, alert.Message)
+		}
+		st.alerts[metric] = alert
+	}
+}
+
+// Forget 删除节点时清除其健康记录
+func (hm *HealthMonitor) Forget(nodeID string) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	delete(hm.nodes, nodeID)
+}
+
+// History 返回节点的健康历史（从旧到新）
+func (hm *HealthMonitor) History(nodeID string) []HealthSample {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	st := hm.nodes[nodeID]
+	if st == nil {
+		return []HealthSample{}
+	}
+	return append([]HealthSample(nil), st.history...)
+}
+
+// Alerts 返回节点当前的告警；nodeID 为空时返回全部节点
+func (hm *HealthMonitor) Alerts(nodeID string) []HealthAlert {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	result := []HealthAlert{}
+	for id, st := range hm.nodes {
+		if nodeID != "" && id != nodeID {
+			continue
+		}
+		for _, alert := range st.alerts {
+			result = append(result, *alert)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].NodeID != result[j].NodeID {
+			return result[i].NodeID < result[j].NodeID
+		}
+		return result[i].Metric < result[j].Metric
+	})
+	return result
+}
+
+// evaluateHealth 按阈值检查一次上报，返回触发的告警（metric -> alert）
+func evaluateHealth(h *NodeHealth, t HealthThresholds) map[string]*HealthAlert {
+	firing := make(map[string]*HealthAlert)
+	above := func(metric string, value, max float64, format string) {
+		if max >= 0 && value > max {
+			firing[metric] = &HealthAlert{Metric: metric, Value: value, Threshold: max, Message: fmt.Sprintf(format, value, max)}
+		}
+	}
+	below := func(metric string, value, min float64, format string) {
+		if min >= 0 && value < min {
+			firing[metric] = &HealthAlert{Metric: metric, Value: value, Threshold: min, Message: fmt.Sprintf(format, value, min)}
+		}
+	}
+
+	// 无法采集的指标为 0，上限检查不会误报；下限检查先确认已采集
+	above("rss", float64(h.RSSBytes)/(1<<20), t.MaxRSSMB, "内存占用 %.0f MB 超过 %.0f MB")
+	above("goroutines", float64(h.Goroutines), t.MaxGoroutines, "goroutine 数 %.0f 超过 %.0f")
+	above("open_fds", float64(h.OpenFDs), t.MaxOpenFDs, "文件描述符 %.0f 超过 %.0f")
+	if h.CPUs > 0 {
+		above("load", h.Load1/float64(h.CPUs), t.MaxLoadPerCPU, "每核负载 %.2f 超过 %.2f")
+	}
+	if h.DiskTotalBytes > 0 {
+		below("disk_free", float64(h.DiskFreeBytes)/(1<<20), t.MinDiskFreeMB, "数据目录可用空间 %.0f MB 低于 %.0f MB")
+	}
+	if h.CertNotAfter != "" {
+		if exp, err := time.ParseInLocation("2006-01-02 15:04:05", h.CertNotAfter, time.Local); err == nil {
+			below("cert_expiry", time.Until(exp).Hours()/24, t.MinCertDays, "证书剩余 %.1f 天，低于 %.0f 天")
+		}
+	}
+	if h.UpstreamRequests >= healthMinUpstreamRequests {
+		rate := float64(h.UpstreamErrors) * 100 / float64(h.UpstreamRequests)
+		above("upstream_errors", rate, t.MaxUpstreamErrorRate, "上游错误率 %.1f%% 超过 %.1f%%")
+	}
+	if h.UpstreamRequests > 0 {
+		above("upstream_latency", h.UpstreamLatencyMs, t.MaxUpstreamLatencyMs, "上游平均响应 %.0f ms 超过 %.0f ms")
+	}
+	if h.Window > 0 {
+		perMin := float64(h.HandshakeFailures) * 60 / float64(h.Window)
+		above("handshake_failures", perMin, t.MaxHandshakeFailures, "TLS 握手失败 %.0f 次/分钟，超过 %.0f")
+	}
+	above("log_dropped", float64(h.LogDropped), t.MaxLogDropped, "丢弃日志 %.0f 条，超过 %.0f")
+	return firing
+}
+
+// handleNodeHealth 节点当前健康指标、历史和告警
+func (h *AdminHandler) handleNodeHealth(w http.ResponseWriter, r *http.Request, id string) {
+	if h.health == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	if _, err := h.nodeStore.GetNode(id); err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	var current *NodeHealth
+	if st := h.nodeStore.GetStatus(id); st != nil {
+		current = st.Health
+	}
+	h.jsonOK(w, map[string]interface{}{
+		"node_id": id,
+		"current": current,
+		"history": h.health.History(id),
+		"alerts":  h.health.Alerts(id),
+	})
+}
+
+// handleHealthAlerts 全部节点当前的告警
+func (h *AdminHandler) handleHealthAlerts(w http.ResponseWriter, r *http.Request) {
+	if h.health == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	h.jsonOK(w, map[string]interface{}{
+		"alerts": h.health.Alerts(""),
+	})
+}
+
+func (h *AdminHandler) handleHealthThresholdsGet(w http.ResponseWriter, r *http.Request) {
+	h.jsonOK(w, h.cfg.GetHealthThresholds())
+}
+
+// handleHealthThresholdsUpdate 修改告警阈值（只需提交要修改的字段），写回配置文件后立即生效
+func (h *AdminHandler) handleHealthThresholdsUpdate(w http.ResponseWriter, r *http.Request) {
+	t := h.cfg.GetHealthThresholds()
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		h.jsonErr(w, "请求格式错误: "+err.Error(), 400)
+		return
+	}
+	if err := h.cfg.UpdateFile(map[string]interface{}{"health_thresholds": t}, false); err != nil {
+		h.jsonErr(w, "保存配置失败: "+err.Error(), 500)
+		return
+	}
+	h.cfg.SetHealthThresholds(t)
+	log.Printf("[Health] 告警阈值已更新")
+	h.jsonOK(w, t)
+}
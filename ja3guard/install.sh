@@ -26,7 +26,9 @@
 #   JA3_WEBROOT         - SSPanel 网站根目录 (node 默认 /www/sspanel/public)
 #   JA3_MASTER_URL      - Master 地址 (node 模式可选，用于上报)
 #   JA3_NODE_TOKEN      - 节点令牌 (node 模式可选，用于上报)
+#   JA3_JOIN_TOKEN      - 一次性加入令牌 (node 模式可选，代替 JA3_NODE_TOKEN 自助注册到 Master)
 #   JA3_NODE_NAME       - 节点名称 (node 模式可选)
+#   JA3_MASTER_CA_FINGERPRINT - Master 节点 CA 指纹 (node 模式可选，启用 mTLS 时校验；配合 JA3_JOIN_TOKEN 时 JA3_MASTER_URL 须为 https 的 mTLS 通道地址)
 #   JA3_SKIP_NGINX      - 设为 1 跳过 Nginx/PHP 安装 (纯反代模式，上游在远程服务器)
 #
 # 支持: Debian 11/12, Ubuntu 20.04/22.04/24.04, CentOS 8/9 (Stream), RHEL 8/9
@@ -39,7 +41,8 @@ set -euo pipefail
 readonly APP_NAME="ja3guard"
 readonly INSTALL_DIR="/opt/ja3guard"
 readonly DATA_DIR="/opt/ja3guard/data"
-readonly BIN_PATH="/usr/local/bin/ja3guard"
+readonly BIN_DIR="/opt/ja3guard/bin"            # 节点自动更新需要写入该目录
+readonly BIN_PATH="/usr/local/bin/ja3guard"     # 指向 ${BIN_DIR}/ja3guard 的软链接
 readonly SERVICE_NAME="ja3guard"
 readonly GO_VERSION="1.22.5"
 readonly GO_MIN_VERSION="1.22"
@@ -412,15 +415,18 @@ build_app() {
     go mod tidy
 
     info "编译二进制 ..."
-    CGO_ENABLED=0 GOOS=linux go build -ldflags='-s -w' -o "$BIN_PATH" .
+    mkdir -p "$BIN_DIR"
+    CGO_ENABLED=0 GOOS=linux go build -ldflags='-s -w' -o "${BIN_DIR}/ja3guard" .
 
-    if [[ ! -x "$BIN_PATH" ]]; then
+    if [[ ! -x "${BIN_DIR}/ja3guard" ]]; then
         error "编译失败"
         exit 1
     fi
+    # 旧版本直接安装在 BIN_PATH，替换为软链接
+    ln -sfn "${BIN_DIR}/ja3guard" "$BIN_PATH"
 
     local bin_size
-    bin_size=$(du -sh "$BIN_PATH" | cut -f1)
+    bin_size=$(du -sh "${BIN_DIR}/ja3guard" | cut -f1)
     info "编译成功: $BIN_PATH ($bin_size)"
 }
 
@@ -688,7 +694,7 @@ setup_config() {
     if [[ -f "$config_file" ]]; then
         # 如果配置已存在且没有提供任何 JA3_* 环境变量 → 直接使用（Master 预推送场景）
         local has_env_vars=false
-        for v in JA3_DOMAIN JA3_UPSTREAM JA3_ADMIN_PASSWORD JA3_MASTER_URL JA3_NODE_TOKEN JA3_NODE_NAME; do
+        for v in JA3_DOMAIN JA3_UPSTREAM JA3_ADMIN_PASSWORD JA3_MASTER_URL JA3_NODE_TOKEN JA3_JOIN_TOKEN JA3_NODE_NAME; do
             if [[ -n "${!v:-}" ]]; then
                 has_env_vars=true
                 break
@@ -829,7 +835,7 @@ setup_config_node() {
     fi
 
     if [[ -n "$master_url" ]]; then
-        if [[ -z "$node_token" ]]; then
+        if [[ -z "$node_token" && -z "${JA3_JOIN_TOKEN:-}" ]]; then
             echo ""
             echo "  节点令牌: 在 Master 管理面板 → Nodes → 添加节点后生成"
             ask "节点令牌" node_token ""
@@ -856,9 +862,64 @@ setup_config_node() {
   "master_url": "${master_url}",
   "node_token": "${node_token}",
   "node_name": "${node_name}",
+  "master_ca_fingerprint": "${JA3_MASTER_CA_FINGERPRINT:-}",
   "report_interval": 60
 }
 JSONEOF
+
+    # 使用加入令牌向 Master 注册，由 Master 签发节点令牌并写回配置
+    if [[ -n "$master_url" && -n "${JA3_JOIN_TOKEN:-}" ]]; then
+        info "使用加入令牌注册到 Master..."
+        local join_args=(-config "$config_file")
+        [[ -n "$node_name" ]] && join_args+=(-name "$node_name")
+        [[ -n "${JA3_MASTER_CA_FINGERPRINT:-}" ]] && join_args+=(-ca-fingerprint "$JA3_MASTER_CA_FINGERPRINT")
+        if ! "$BIN_PATH" join "${join_args[@]}" "$master_url" "$JA3_JOIN_TOKEN"; then
+            error "加入 Master 失败，请检查加入令牌是否有效"
+            exit 1
+        fi
+    fi
+}
+
+# 节点 SSH 凭据加密主密钥（Master）：放在数据目录之外，服务以只读方式访问 /etc，需要提前生成
+CREDENTIAL_KEY_FILE="/etc/ja3guard/credential.key"
+setup_credential_key() {
+    if [[ -f "$CREDENTIAL_KEY_FILE" ]]; then
+        return
+    fi
+    mkdir -p "$(dirname "$CREDENTIAL_KEY_FILE")"
+    chmod 700 "$(dirname "$CREDENTIAL_KEY_FILE")"
+    (umask 077 && head -c 32 /dev/urandom | base64 > "$CREDENTIAL_KEY_FILE")
+    info "已生成 SSH 凭据加密主密钥: $CREDENTIAL_KEY_FILE（请单独备份）"
+}
+
+# 安装自动更新守护脚本：systemd 每次启动服务前执行（ExecStartPre），不依赖新版本程序。
+# 自动更新后新版本在初始化阶段反复崩溃、根本运行不到健康检查时，由它换回 ja3guard.prev
+setup_update_guard() {
+    cat > "${BIN_DIR}/update-guard.sh" <<'GUARDEOF'
+#!/bin/sh
+# 用法: update-guard.sh <程序路径> <数据目录>
+# update_state.json 处于 verifying 状态时统计启动次数，超过 MAX_BOOTS 次仍未通过健康检查则回滚
+EXE="$1"
+STATE="$2/update_state.json"
+BOOTS="$2/update_boots"
+MAX_BOOTS=3
+
+if [ ! -f "$EXE.prev" ] || ! grep -q '"state": "verifying"' "$STATE" 2>/dev/null; then
+    rm -f "$BOOTS"
+    exit 0
+fi
+n=$(cat "$BOOTS" 2>/dev/null || echo 0)
+n=$((n + 1))
+if [ "$n" -le "$MAX_BOOTS" ]; then
+    echo "$n" > "$BOOTS"
+    exit 0
+fi
+mv -f "$EXE.prev" "$EXE" || exit 1
+rm -f "$BOOTS"
+sed -i "s/\"state\": \"verifying\",/\"state\": \"rolled_back\",\n  \"error\": \"新版本重启 ${MAX_BOOTS} 次仍未通过健康检查，已回滚\",/" "$STATE"
+echo "ja3guard: 新版本重启 ${MAX_BOOTS} 次仍未通过健康检查，已回滚到更新前的版本"
+GUARDEOF
+    chmod 755 "${BIN_DIR}/update-guard.sh"
 }
 
 # 配置 systemd 服务
@@ -873,7 +934,12 @@ setup_systemd() {
     fi
 
     local capabilities=""
+    local update_guard=""
     if [[ "$INSTALL_MODE" == "node" ]]; then
+        setup_update_guard
+        update_guard="
+# 自动更新后新版本反复启动失败时换回旧版本（失败不影响启动）
+ExecStartPre=-/bin/sh ${BIN_DIR}/update-guard.sh ${BIN_DIR}/ja3guard ${DATA_DIR}"
         capabilities="
 # 允许绑定低端口 (80, 443)
 AmbientCapabilities=CAP_NET_BIND_SERVICE
@@ -888,8 +954,9 @@ After=network-online.target
 Wants=network-online.target
 
 [Service]
-Type=simple
-ExecStart=${BIN_PATH} -config ${DATA_DIR}/config.json
+Type=simple${update_guard}
+ExecStart=${BIN_DIR}/ja3guard -config ${DATA_DIR}/config.json
+ExecReload=/bin/kill -HUP \$MAINPID
 WorkingDirectory=${INSTALL_DIR}
 Restart=on-failure
 RestartSec=5
@@ -898,7 +965,7 @@ RestartSec=5
 NoNewPrivileges=true
 ProtectSystem=strict
 ProtectHome=true
-ReadWritePaths=${DATA_DIR}
+ReadWritePaths=${DATA_DIR} ${BIN_DIR}
 PrivateTmp=true
 ${capabilities}
 # 日志
@@ -1088,8 +1155,9 @@ uninstall() {
     fi
 
     # 移除二进制
-    if [[ -f "$BIN_PATH" ]]; then
+    if [[ -f "$BIN_PATH" || -L "$BIN_PATH" ]]; then
         rm -f "$BIN_PATH"
+        rm -rf "$BIN_DIR"
         info "二进制文件已移除: $BIN_PATH"
     fi
 
@@ -1161,6 +1229,18 @@ upgrade() {
     # 构建新版本
     build_app
 
+    # 旧版本 Master 升级：先生成凭据主密钥，启动时自动加密已保存的 SSH 凭据
+    if grep -q '"mode": *"master"' "${DATA_DIR}/config.json" 2>/dev/null; then
+        setup_credential_key
+    else
+        # 节点：更新守护脚本，旧版本创建的 systemd 服务补上 ExecStartPre
+        INSTALL_MODE="node"
+        setup_update_guard
+        if ! grep -q "update-guard.sh" "/etc/systemd/system/${SERVICE_NAME}.service" 2>/dev/null; then
+            setup_systemd
+        fi
+    fi
+
     # 重启服务
     if $was_running; then
         systemctl restart "$SERVICE_NAME"
@@ -1213,6 +1293,9 @@ main() {
 
     build_app
     setup_config
+    if [[ "$INSTALL_MODE" == "master" ]]; then
+        setup_credential_key
+    fi
 
     if [[ "$INSTALL_MODE" == "node" && "$SKIP_NGINX" != "1" ]]; then
         setup_nginx_vhost
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 任务类型
+const (
+	JobDeploy        = "deploy"         // 远程部署（install.sh）
+	JobConfigPush    = "config_push"    // 推送 config.json 并重启
+	JobWhitelistSync = "whitelist_sync" // 推送白名单并重新加载
+	JobExec          = "exec"           // 执行 SSH 命令
+)
+
+// 任务状态：queued → running → succeeded / failed / canceled
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+const (
+	jobOutputLimit        = 1 << 20  // 运行中的任务在内存中保留的输出
+	jobHistoryOutputLimit = 64 << 10 // 历史中每个任务保留的输出（末尾）
+	jobHistorySize        = 200      // 保留的已结束任务数
+)
+
+// JobOutput 一段输出，Seq 从 1 开始递增，用作 SSE 事件 ID
+type JobOutput struct {
+	Seq    int64  `json:"seq"`
+	Stream string `json:"stream"` // stdout / stderr / info
+	Data   string `json:"data"`
+}
+
+// Job 一次在节点上执行的异步任务
+type Job struct {
+	ID         string                 `json:"id"`
+	Type       string                 `json:"type"`
+	NodeID     string                 `json:"node_id"`
+	NodeName   string                 `json:"node_name"`
+	Summary    string                 `json:"summary,omitempty"` // 如执行的命令
+	State      string                 `json:"state"`
+	Error      string                 `json:"error,omitempty"`
+	Result     map[string]interface{} `json:"result,omitempty"`
+	CreatedAt  string                 `json:"created_at"`
+	StartedAt  string                 `json:"started_at,omitempty"`
+	FinishedAt string                 `json:"finished_at,omitempty"`
+	Output     []JobOutput            `json:"output,omitempty"`
+	// 输出超过上限时丢弃了最早的部分
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func (j *Job) finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed || j.State == JobCanceled
+}
+
+// JobFunc 任务的执行函数，输出写入 run，返回错误表示失败
+type JobFunc func(ctx context.Context, run *JobRun) error
+
+// jobEntry 运行中任务的内存状态
+type jobEntry struct {
+	job         Job
+	outputBytes int
+	cancel      context.CancelFunc
+	watchers    map[chan struct{}]bool
+	done        chan struct{} // 任务结束时关闭
+}
+
+// JobManager 管理异步任务：同一节点的任务依次执行，输出实时推送给订阅者，结束后写入历史
+type JobManager struct {
+	backend JobBackend
+	mu      sync.Mutex
+	active  map[string]*jobEntry     // 未结束及刚结束仍有订阅者的任务
+	history []Job                    // 已结束的任务，最新在后
+	tails   map[string]chan struct{} // 每个节点最后一个任务的结束信号，新任务排在其后
+	// 只在内存中保留、不写入历史的结果（如部署生成的面板密码），Master 重启后无法再查询
+	secrets     map[string]map[string]interface{}
+	secretOrder []string
+}
+
+const jobSecretsKept = 50
+
+func NewJobManager(backend JobBackend) (*JobManager, error) {
+	jobs, err := backend.LoadJobs()
+	if err != nil {
+		return nil, err
+	}
+	jm := &JobManager{
+		backend: backend,
+		active:  make(map[string]*jobEntry),
+		tails:   make(map[string]chan struct{}),
+		secrets: make(map[string]map[string]interface{}),
+	}
+	interrupted := false
+	for _, j := range jobs {
+		if !j.finished() {
+			// Master 重启时仍在运行的任务：远程进程可能仍在执行，但已无法跟踪
+			j.State, j.Error = JobFailed, "Master 重启，任务中断"
+			j.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+			interrupted = true
+		}
+		jm.history = append(jm.history, j)
+	}
+	if interrupted {
+		jm.saveLocked()
+	}
+	return jm, nil
+}
+
+// saveLocked 持久化历史和未结束的任务（未结束的在重启后标记为中断）
+func (jm *JobManager) saveLocked() {
+	jobs := append([]Job(nil), jm.history...)
+	for _, e := range jm.active {
+		if !e.job.finished() {
+			j := e.job
+			j.Output = nil
+			jobs = append(jobs, j)
+		}
+	}
+	if err := jm.backend.SaveJobs(jobs); err != nil {
+		log.Printf("[Job] 保存任务历史失败: %v", err)
+	}
+}
+
+// Start 创建并在后台执行任务
+func (jm *JobManager) Start(typ string, node *NodeInfo, summary string, fn JobFunc) *Job {
+	b := make([]byte, 8)
+	rand.Read(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &jobEntry{
+		job: Job{
+			ID:        "job_" + hex.EncodeToString(b),
+			Type:      typ,
+			NodeID:    node.ID,
+			NodeName:  node.Name,
+			Summary:   summary,
+			State:     JobQueued,
+			CreatedAt: time.Now().Format("2006-01-02 15:04:05"),
+		},
+		cancel:   cancel,
+		watchers: make(map[chan struct{}]bool),
+		done:     make(chan struct{}),
+	}
+
+	jm.mu.Lock()
+	jm.active[e.job.ID] = e
+	prev := jm.tails[node.ID]
+	done := make(chan struct{})
+	jm.tails[node.ID] = done
+	jm.saveLocked()
+	job := e.job
+	jm.mu.Unlock()
+
+	go jm.run(ctx, e, prev, done, fn)
+	return &job
+}
+
+// run 等待同一节点的前一个任务结束后执行（按创建顺序），结束时关闭 done 放行下一个任务
+func (jm *JobManager) run(ctx context.Context, e *jobEntry, prev, done chan struct{}, fn JobFunc) {
+	release := func() {
+		jm.mu.Lock()
+		if jm.tails[e.job.NodeID] == done {
+			delete(jm.tails, e.job.NodeID)
+		}
+		jm.mu.Unlock()
+		close(done)
+	}
+	if prev != nil {
+		select {
+		case <-prev:
+		case <-ctx.Done():
+			// 排队中被取消：立即结束，但后面的任务仍需等前一个任务结束
+			jm.finish(e, ctx.Err())
+			<-prev
+			release()
+			return
+		}
+	}
+	defer release()
+
+	run := &JobRun{jm: jm, e: e}
+
+	jm.mu.Lock()
+	e.job.State = JobRunning
+	e.job.StartedAt = time.Now().Format("2006-01-02 15:04:05")
+	jm.saveLocked()
+	jm.notifyLocked(e)
+	jm.mu.Unlock()
+	log.Printf("[Job] %s 开始: %s（节点 %s）", e.job.ID, e.job.Type, e.job.NodeName)
+
+	err := fn(ctx, run)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	jm.finish(e, err)
+}
+
+// finish 记录结果，移入历史
+func (jm *JobManager) finish(e *jobEntry, err error) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	e.job.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+	switch {
+	case err == context.Canceled:
+		e.job.State, e.job.Error = JobCanceled, "已取消"
+	case err != nil:
+		e.job.State, e.job.Error = JobFailed, err.Error()
+	default:
+		e.job.State = JobSucceeded
+	}
+	e.cancel()
+	close(e.done)
+	log.Printf("[Job] %s 结束: %s", e.job.ID, e.job.State)
+
+	h := e.job
+	h.Output, h.Truncated = tailJobOutput(e.job.Output, jobHistoryOutputLimit)
+	h.Truncated = h.Truncated || e.job.Truncated
+	jm.history = append(jm.history, h)
+	if len(jm.history) > jobHistorySize {
+		jm.history = append([]Job(nil), jm.history[len(jm.history)-jobHistorySize:]...)
+	}
+	jm.saveLocked()
+	jm.notifyLocked(e)
+	if len(e.watchers) == 0 {
+		delete(jm.active, e.job.ID)
+	}
+}
+
+// tailJobOutput 保留不超过 limit 字节的末尾输出
+func tailJobOutput(output []JobOutput, limit int) ([]JobOutput, bool) {
+	size := 0
+	for i := len(output) - 1; i >= 0; i-- {
+		size += len(output[i].Data)
+		if size > limit {
+			return append([]JobOutput(nil), output[i+1:]...), true
+		}
+	}
+	return append([]JobOutput(nil), output...), false
+}
+
+func (jm *JobManager) notifyLocked(e *jobEntry) {
+	for ch := range e.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// withSecretsLocked 把仍在内存中的敏感结果合并到 result 中
+func (jm *JobManager) withSecretsLocked(job *Job) {
+	secrets := jm.secrets[job.ID]
+	if len(secrets) == 0 {
+		return
+	}
+	result := make(map[string]interface{}, len(job.Result)+len(secrets))
+	for k, v := range job.Result {
+		result[k] = v
+	}
+	for k, v := range secrets {
+		result[k] = v
+	}
+	job.Result = result
+}
+
+// Get 返回任务（含输出）
+func (jm *JobManager) Get(id string) (*Job, bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	if e := jm.active[id]; e != nil {
+		job := e.job
+		job.Output = append([]JobOutput(nil), e.job.Output...)
+		jm.withSecretsLocked(&job)
+		return &job, true
+	}
+	for i := len(jm.history) - 1; i >= 0; i-- {
+		if jm.history[i].ID == id {
+			job := jm.history[i]
+			jm.withSecretsLocked(&job)
+			return &job, true
+		}
+	}
+	return nil, false
+}
+
+// List 最近的任务（不含输出，最新在前），nodeID 为空表示全部节点
+func (jm *JobManager) List(nodeID string, limit int) []Job {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	jobs := []Job{}
+	add := func(j Job) {
+		if nodeID == "" || j.NodeID == nodeID {
+			j.Output = nil
+			jobs = append(jobs, j)
+		}
+	}
+	for _, e := range jm.active {
+		if !e.job.finished() {
+			add(e.job)
+		}
+	}
+	for i := len(jm.history) - 1; i >= 0 && len(jobs) < limit; i-- {
+		add(jm.history[i])
+	}
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs
+}
+
+// Cancel 取消未结束的任务，运行中的远程进程会被结束
+func (jm *JobManager) Cancel(id string) error {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	e := jm.active[id]
+	if e == nil || e.job.finished() {
+		return fmt.Errorf("任务不存在或已结束")
+	}
+	log.Printf("[Job] 取消 %s", id)
+	e.cancel()
+	return nil
+}
+
+// Wait 等待任务结束，返回最终状态；ctx 结束时返回任务当前状态
+func (jm *JobManager) Wait(ctx context.Context, id string) (*Job, bool) {
+	jm.mu.Lock()
+	e := jm.active[id]
+	jm.mu.Unlock()
+	if e != nil {
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+		}
+	}
+	return jm.Get(id)
+}
+
+// watch 订阅任务的输出和状态变化，返回的函数取消订阅
+func (jm *JobManager) watch(id string) (chan struct{}, func(), bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	e := jm.active[id]
+	if e == nil {
+		return nil, nil, false
+	}
+	ch := make(chan struct{}, 1)
+	e.watchers[ch] = true
+	return ch, func() {
+		jm.mu.Lock()
+		defer jm.mu.Unlock()
+		delete(e.watchers, ch)
+		if len(e.watchers) == 0 && e.job.finished() {
+			delete(jm.active, id)
+		}
+	}, true
+}
+
+// since 返回 seq 之后的输出及任务当前状态
+func (jm *JobManager) since(id string, seq int64) ([]JobOutput, Job, bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	var job Job
+	if e := jm.active[id]; e != nil {
+		job = e.job
+	} else {
+		found := false
+		for i := len(jm.history) - 1; i >= 0; i-- {
+			if jm.history[i].ID == id {
+				job, found = jm.history[i], true
+				break
+			}
+		}
+		if !found {
+			return nil, job, false
+		}
+	}
+	var out []JobOutput
+	for _, o := range job.Output {
+		if o.Seq > seq {
+			out = append(out, o)
+		}
+	}
+	job.Output = nil
+	jm.withSecretsLocked(&job)
+	return out, job, true
+}
+
+// JobRun 任务执行期间的输出和结果
+type JobRun struct {
+	jm  *JobManager
+	e   *jobEntry
+	tee io.Writer // 远程命令的输出（stdout / stderr）同时写入，如审计摘要
+}
+
+// Write 写入一段输出
+func (r *JobRun) write(stream string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	jm, e := r.jm, r.e
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	var seq int64 = 1
+	if n := len(e.job.Output); n > 0 {
+		seq = e.job.Output[n-1].Seq + 1
+	}
+	e.job.Output = append(e.job.Output, JobOutput{Seq: seq, Stream: stream, Data: string(data)})
+	e.outputBytes += len(data)
+	for e.outputBytes > jobOutputLimit && len(e.job.Output) > 1 {
+		e.outputBytes -= len(e.job.Output[0].Data)
+		e.job.Output = e.job.Output[1:]
+		e.job.Truncated = true
+	}
+	jm.notifyLocked(e)
+}
+
+// ID 任务 ID
+func (r *JobRun) ID() string { return r.e.job.ID }
+
+// Stdout / Stderr 远程命令的输出
+func (r *JobRun) Stdout() io.Writer { return jobStream{r, "stdout"} }
+func (r *JobRun) Stderr() io.Writer { return jobStream{r, "stderr"} }
+
+// Logf 任务自身的进度信息
+func (r *JobRun) Logf(format string, args ...interface{}) {
+	r.write("info", []byte(fmt.Sprintf(format, args...)+"\n"))
+}
+
+// SetResult 记录结果字段，随任务历史保存
+func (r *JobRun) SetResult(key string, value interface{}) {
+	r.jm.mu.Lock()
+	defer r.jm.mu.Unlock()
+	if r.e.job.Result == nil {
+		r.e.job.Result = make(map[string]interface{})
+	}
+	r.e.job.Result[key] = value
+}
+
+// SetSecret 记录敏感结果：不写入历史，Master 进程内保留最近 50 个任务的
+func (r *JobRun) SetSecret(key string, value interface{}) {
+	jm, id := r.jm, r.e.job.ID
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	if jm.secrets[id] == nil {
+		jm.secrets[id] = make(map[string]interface{})
+		jm.secretOrder = append(jm.secretOrder, id)
+		if len(jm.secretOrder) > jobSecretsKept {
+			delete(jm.secrets, jm.secretOrder[0])
+			jm.secretOrder = jm.secretOrder[1:]
+		}
+	}
+	jm.secrets[id][key] = value
+}
+
+type jobStream struct {
+	run    *JobRun
+	stream string
+}
+
+func (s jobStream) Write(p []byte) (int, error) {
+	if s.run.tee != nil {
+		s.run.tee.Write(p)
+	}
+	s.run.write(s.stream, p)
+	return len(p), nil
+}
+
+// ============================================================
+// 管理接口
+// ============================================================
+
+// handleJobList 任务列表
+func (h *AdminHandler) handleJobList(w http.ResponseWriter, r *http.Request) {
+	if h.jobs == nil {
+		h.jsonErr(w, "任务仅在 master 模式下可用", 400)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > jobHistorySize {
+		limit = 50
+	}
+	h.jsonOK(w, h.jobs.List(r.URL.Query().Get("node"), limit))
+}
+
+// handleJobGet 任务详情（含输出）
+func (h *AdminHandler) handleJobGet(w http.ResponseWriter, r *http.Request, id string) {
+	if h.jobs == nil {
+		h.jsonErr(w, "任务仅在 master 模式下可用", 400)
+		return
+	}
+	job, ok := h.jobs.Get(id)
+	if !ok {
+		h.jsonErr(w, "任务不存在", 404)
+		return
+	}
+	h.jsonOK(w, job)
+}
+
+// handleJobCancel 取消任务
+func (h *AdminHandler) handleJobCancel(w http.ResponseWriter, r *http.Request, id string) {
+	if h.jobs == nil {
+		h.jsonErr(w, "任务仅在 master 模式下可用", 400)
+		return
+	}
+	if err := h.jobs.Cancel(id); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+// handleJobStream 以 SSE 推送任务输出：output 事件（ID 为输出序号，可用 Last-Event-ID 续传）、
+// state 事件（状态变化），任务结束后发送 done 事件并关闭
+func (h *AdminHandler) handleJobStream(w http.ResponseWriter, r *http.Request, id string) {
+	if h.jobs == nil {
+		h.jsonErr(w, "任务仅在 master 模式下可用", 400)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.jsonErr(w, "不支持流式响应", 500)
+		return
+	}
+	seq, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	if s := r.URL.Query().Get("since"); s != "" {
+		seq, _ = strconv.ParseInt(s, 10, 64)
+	}
+	notify, stop, watching := h.jobs.watch(id)
+	if watching {
+		defer stop()
+	}
+	if _, _, found := h.jobs.since(id, seq); !found {
+		h.jsonErr(w, "任务不存在", 404)
+		return
+	}
+
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	state := ""
+	ping := time.NewTicker(pushPingInterval)
+	defer ping.Stop()
+	for {
+		out, job, _ := h.jobs.since(id, seq)
+		for _, o := range out {
+			data, _ := json.Marshal(o)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: output\ndata: %s\n\n", o.Seq, data); err != nil {
+				return
+			}
+			seq = o.Seq
+		}
+		if job.State != state {
+			state = job.State
+			data, _ := json.Marshal(job)
+			event := "state"
+			if job.finished() {
+				event = "done"
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if job.finished() || !watching {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-notify:
+		case <-ping.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
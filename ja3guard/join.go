@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 加入令牌有效期
+const (
+	joinTokenDefaultTTL = time.Hour
+	joinTokenMaxTTL     = 7 * 24 * time.Hour
+)
+
+// JoinToken 一次性加入令牌，只保存哈希；Master 重启后未使用的令牌失效
+type JoinToken struct {
+	ID        string `json:"id"`
+	Note      string `json:"note"`
+	Domain    string `json:"domain,omitempty"`   // 预设给节点的域名，节点未指定时使用
+	Upstream  string `json:"upstream,omitempty"` // 预设给节点的上游
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+	UsedAt    string `json:"used_at,omitempty"`
+	UsedBy    string `json:"used_by,omitempty"` // 使用该令牌加入的节点 ID
+	hash      [32]byte
+	expires   time.Time
+}
+
+// JoinTokenStore Master 内存中的加入令牌
+type JoinTokenStore struct {
+	tokens map[string]*JoinToken
+	mu     sync.Mutex
+}
+
+func NewJoinTokenStore() *JoinTokenStore {
+	return &JoinTokenStore{tokens: make(map[string]*JoinToken)}
+}
+
+// Create 生成令牌，明文只在此处返回一次
+func (js *JoinTokenStore) Create(note, domain, upstream string, ttl time.Duration) (string, *JoinToken) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	plain := "jt_" + hex.EncodeToString(secret)
+	// ID 会出现在列表和日志中，单独生成，不能取自令牌
+	idBytes := make([]byte, 4)
+	rand.Read(idBytes)
+
+	now := time.Now()
+	t := &JoinToken{
+		ID:        "join_" + hex.EncodeToString(idBytes),
+		Note:      note,
+		Domain:    domain,
+		Upstream:  upstream,
+		CreatedAt: now.Format("2006-01-02 15:04:05"),
+		ExpiresAt: now.Add(ttl).Format("2006-01-02 15:04:05"),
+		hash:      sha256.Sum256([]byte(plain)),
+		expires:   now.Add(ttl),
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.pruneLocked()
+	js.tokens[t.ID] = t
+	c := *t
+	return plain, &c
+}
+
+// Consume 校验并作废令牌，成功时返回令牌信息
+func (js *JoinTokenStore) Consume(plain string) (*JoinToken, error) {
+	hash := sha256.Sum256([]byte(plain))
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.pruneLocked()
+
+	var found *JoinToken
+	for _, t := range js.tokens {
+		if subtle.ConstantTimeCompare(t.hash[:], hash[:]) == 1 {
+			found = t
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("加入令牌无效")
+	}
+	if found.UsedAt != "" {
+		return nil, fmt.Errorf("加入令牌已被使用")
+	}
+	if time.Now().After(found.expires) {
+		return nil, fmt.Errorf("加入令牌已过期")
+	}
+	found.UsedAt = time.Now().Format("2006-01-02 15:04:05")
+	c := *found
+	return &c, nil
+}
+
+// MarkUsedBy 记录使用令牌加入的节点
+func (js *JoinTokenStore) MarkUsedBy(id, nodeID string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if t, ok := js.tokens[id]; ok {
+		t.UsedBy = nodeID
+	}
+}
+
+// Release 节点创建失败时恢复令牌，允许重试
+func (js *JoinTokenStore) Release(id string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if t, ok := js.tokens[id]; ok {
+		t.UsedAt = ""
+	}
+}
+
+func (js *JoinTokenStore) List() []JoinToken {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.pruneLocked()
+	result := make([]JoinToken, 0, len(js.tokens))
+	for _, t := range js.tokens {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt > result[j].CreatedAt })
+	return result
+}
+
+func (js *JoinTokenStore) Revoke(id string) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if _, ok := js.tokens[id]; !ok {
+		return fmt.Errorf("令牌不存在: %s", id)
+	}
+	delete(js.tokens, id)
+	return nil
+}
+
+// pruneLocked 清理过期一天以上的令牌（保留一段时间便于在面板查看使用情况）
+func (js *JoinTokenStore) pruneLocked() {
+	cutoff := time.Now().Add(-24 * time.Hour)
+	for id, t := range js.tokens {
+		if t.expires.Before(cutoff) {
+			delete(js.tokens, id)
+		}
+	}
+}
+
+// ============================================================
+// Master API
+// ============================================================
+
+func (h *AdminHandler) handleJoinTokenList(w http.ResponseWriter, r *http.Request) {
+	if h.joinTokens == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	h.jsonOK(w, map[string]interface{}{
+		"tokens": h.joinTokens.List(),
+	})
+}
+
+func (h *AdminHandler) handleJoinTokenCreate(w http.ResponseWriter, r *http.Request) {
+	if h.joinTokens == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	var req struct {
+		Note       string `json:"note"`
+		Domain     string `json:"domain"`
+		Upstream   string `json:"upstream"`
+		TTLMinutes int    `json:"ttl_minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	ttl := time.Duration(req.TTLMinutes) * time.Minute
+	if ttl <= 0 {
+		ttl = joinTokenDefaultTTL
+	}
+	if ttl > joinTokenMaxTTL {
+		h.jsonErr(w, "有效期最长 7 天", 400)
+		return
+	}
+
+	plain, t := h.joinTokens.Create(req.Note, req.Domain, req.Upstream, ttl)
+	log.Printf("[Join] 已创建加入令牌 %s，有效期至 %s", t.ID, t.ExpiresAt)
+	h.jsonOK(w, map[string]interface{}{
+		"status":  "ok",
+		"token":   plain,
+		"info":    t,
+		"command": fmt.Sprintf("ja3guard join -config /opt/ja3guard/data/config.json %s %s", h.masterURL(r), plain),
+	})
+}
+
+func (h *AdminHandler) handleJoinTokenRevoke(w http.ResponseWriter, r *http.Request, id string) {
+	if h.joinTokens == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	if err := h.joinTokens.Revoke(id); err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+// masterURL 由请求推导 Master 地址
+func (h *AdminHandler) masterURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// JoinRequest 节点加入请求
+type JoinRequest struct {
+	JoinToken string `json:"join_token"`
+	Name      string `json:"name"`
+	Host      string `json:"host"` // 为空时使用请求来源 IP
+	Domain    string `json:"domain"`
+	Upstream  string `json:"upstream"`
+	Hostname  string `json:"hostname"`
+	Version   string `json:"version"`
+}
+
+// JoinResponse 加入成功后返回给节点的身份与配置
+type JoinResponse struct {
+	NodeID              string `json:"node_id"`
+	NodeName            string `json:"node_name"`
+	NodeToken           string `json:"node_token"`
+	GuardSecret         string `json:"guard_secret"`
+	ACMEEmail           string `json:"acme_email"`
+	Domain              string `json:"domain"`
+	Upstream            string `json:"upstream"`
+	MasterCAFingerprint string `json:"master_ca_fingerprint,omitempty"`
+	ReleasePublicKey    string `json:"release_public_key,omitempty"`
+}
+
+// handleNodeJoin 节点用一次性令牌换取永久身份（无 Basic Auth，令牌即认证）
+func (h *AdminHandler) handleNodeJoin(w http.ResponseWriter, r *http.Request) {
+	if h.nodeStore == nil || h.joinTokens == nil {
+		h.jsonErr(w, "加入仅在 master 模式下可用", 400)
+		return
+	}
+	var req JoinRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	jt, err := h.joinTokens.Consume(req.JoinToken)
+	if err != nil {
+		log.Printf("[Join] 拒绝来自 %s 的加入请求: %v", r.RemoteAddr, err)
+		h.jsonErr(w, err.Error(), 401)
+		return
+	}
+
+	if req.Host == "" {
+		req.Host, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	if req.Name == "" {
+		req.Name = req.Hostname
+	}
+	if req.Domain == "" {
+		req.Domain = jt.Domain
+	}
+	if req.Upstream == "" {
+		req.Upstream = jt.Upstream
+	}
+
+	note := "通过 join 自助加入"
+	if jt.Note != "" {
+		note += ": " + jt.Note
+	}
+	id, token, err := h.nodeStore.AddNode(NodeInfo{
+		Name:     req.Name,
+		Host:     req.Host,
+		Domain:   req.Domain,
+		Upstream: req.Upstream,
+		Note:     note,
+	})
+	if err != nil {
+		h.joinTokens.Release(jt.ID)
+		h.jsonErr(w, err.Error(), 409)
+		return
+	}
+	h.joinTokens.MarkUsedBy(jt.ID, id)
+	node, err := h.nodeStore.GetNode(id)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 500)
+		return
+	}
+	log.Printf("[Join] 节点 %s (%s) 已通过令牌 %s 加入", node.Name, node.Host, jt.ID)
+
+	h.jsonOK(w, &JoinResponse{
+		NodeID:              node.ID,
+		NodeName:            node.Name,
+		NodeToken:           token,
+		GuardSecret:         h.cfg.GuardSecret,
+		ACMEEmail:           h.cfg.ACMEEmail,
+		Domain:              node.Domain,
+		Upstream:            node.Upstream,
+		MasterCAFingerprint: h.caFingerprint(),
+		ReleasePublicKey:    h.cfg.ReleasePublicKey,
+	})
+}
+
+// ============================================================
+// 节点端: ja3guard join
+// ============================================================
+
+// pinnedCATransport 在握手时按 CA 指纹校验 Master 的传输，verified 收到校验通过的 CA
+func pinnedCATransport(fingerprint string, verified func(*x509.Certificate)) *http.Transport {
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			// 主机名不参与校验，身份由指定的 CA 保证（与 mTLS 通道相同）
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				ca, err := verifyPinnedCA(rawCerts, fingerprint)
+				if err == nil {
+					verified(ca)
+				}
+				return err
+			},
+		},
+	}
+}
+
+// runJoin 节点自助加入 Master 并写入配置
+//
+//	ja3guard join [-config path] [-name n] [-domain d] [-upstream u] <master-url> <join-token>
+//
+// 已有配置文件时只更新 Master 相关字段，其余保持不变
+func runJoin(args []string) {
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	configPath := fs.String("config", "/data/config.json", "配置文件路径")
+	name := fs.String("name", "", "节点名称（默认主机名）")
+	host := fs.String("host", "", "节点地址（默认使用 Master 看到的来源 IP）")
+	domain := fs.String("domain", "", "订阅域名（默认使用令牌预设或现有配置）")
+	upstream := fs.String("upstream", "", "上游地址")
+	caFingerprint := fs.String("ca-fingerprint", "", "预期的 Master CA 指纹（可选）")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "用法: ja3guard join [选项] <master-url> <join-token>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	masterURL := strings.TrimRight(fs.Arg(0), "/")
+	joinToken := fs.Arg(1)
+
+	// 读取现有配置（保留未知字段）
+	existing := make(map[string]interface{})
+	if data, err := os.ReadFile(*configPath); err == nil {
+		if err := json.Unmarshal(data, &existing); err != nil {
+			log.Fatalf("解析现有配置失败: %v", err)
+		}
+	}
+	if *domain == "" {
+		*domain, _ = existing["domain"].(string)
+	}
+	if *upstream == "" {
+		*upstream, _ = existing["upstream"].(string)
+	}
+	hostname, _ := os.Hostname()
+	if *name == "" {
+		*name, _ = existing["node_name"].(string)
+	}
+	if *name == "" {
+		*name = hostname
+	}
+
+	body, _ := json.Marshal(&JoinRequest{
+		JoinToken: joinToken,
+		Name:      *name,
+		Host:      *host,
+		Domain:    *domain,
+		Upstream:  *upstream,
+		Hostname:  hostname,
+		Version:   Version,
+	})
+	client := &http.Client{Timeout: 30 * time.Second}
+	// 指纹必须在握手时校验：等拿到响应再比对，令牌已经用掉，guard_secret 也已发给了对方
+	wantCA := normalizeFingerprint(*caFingerprint)
+	var pinnedCA *x509.Certificate
+	if wantCA != "" {
+		if !strings.HasPrefix(masterURL, "https://") {
+			log.Fatalf("指定 -ca-fingerprint 时 Master 地址必须是 https（节点 mTLS 通道地址）: %s", masterURL)
+		}
+		client.Transport = pinnedCATransport(wantCA, func(ca *x509.Certificate) { pinnedCA = ca })
+	}
+	resp, err := client.Post(masterURL+"/api/node/join", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("连接 Master 失败: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != 200 {
+		log.Fatalf("加入失败（%d）: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var jr JoinResponse
+	if err := json.Unmarshal(data, &jr); err != nil {
+		log.Fatalf("解析 Master 响应失败: %v", err)
+	}
+
+	cfg := existing
+	setDefault := func(key string, v interface{}) {
+		if cur, ok := cfg[key]; !ok || cur == "" {
+			cfg[key] = v
+		}
+	}
+	cfg["mode"] = "node"
+	cfg["master_url"] = masterURL
+	cfg["node_token"] = jr.NodeToken
+	cfg["node_name"] = jr.NodeName
+	if wantCA != "" {
+		cfg["master_ca_fingerprint"] = wantCA
+	} else if jr.MasterCAFingerprint != "" {
+		cfg["master_ca_fingerprint"] = jr.MasterCAFingerprint
+	}
+	if jr.ReleasePublicKey != "" {
+		cfg["release_public_key"] = jr.ReleasePublicKey
+	}
+	setDefault("domain", jr.Domain)
+	setDefault("upstream", normalizeUpstream(jr.Upstream))
+	setDefault("guard_secret", jr.GuardSecret)
+	setDefault("acme_email", jr.ACMEEmail)
+	setDefault("admin_password", generateRandomPassword(20))
+	setDefault("listen_https", ":443")
+	setDefault("listen_admin", ":8443")
+	setDefault("data_dir", filepath.Dir(*configPath))
+	setDefault("log_enabled", true)
+	setDefault("report_interval", 60)
+
+	out, _ := json.MarshalIndent(cfg, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(*configPath), 0755); err != nil {
+		log.Fatalf("创建配置目录失败: %v", err)
+	}
+	if err := writeFileAtomic(*configPath, out, 0600); err != nil {
+		log.Fatalf("写入配置失败: %v", err)
+	}
+	// 固定握手时校验过的 CA，之后以令牌访问 https 的 Master 地址时也按它校验
+	if pinnedCA != nil {
+		dataDir, _ := cfg["data_dir"].(string)
+		if err := savePinnedCA(filepath.Join(dataDir, "pki"), pinnedCA); err != nil {
+			log.Fatalf("保存 Master CA 失败: %v", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "已加入 Master %s，节点 %s (%s)\n配置已写入 %s\n", masterURL, jr.NodeName, jr.NodeID, *configPath)
+	if d, _ := cfg["domain"].(string); d == "" {
+		fmt.Fprintln(os.Stderr, "注意: 配置中 domain 为空，请补充后再启动服务")
+	} else {
+		fmt.Fprintln(os.Stderr, "重启服务生效: systemctl restart ja3guard")
+	}
+}
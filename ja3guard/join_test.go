@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinTokenIDIndependentOfSecret(t *testing.T) {
+	js := NewJoinTokenStore()
+	for i := 0; i < 20; i++ {
+		plain, tok := js.Create("", "", "", time.Hour)
+		id := strings.TrimPrefix(tok.ID, "join_")
+		if strings.Contains(plain, id) {
+			t.Fatalf("令牌 ID %s 取自令牌明文", tok.ID)
+		}
+	}
+
+	plain, tok := js.Create("", "", "", time.Hour)
+	got, err := js.Consume(plain)
+	if err != nil || got.ID != tok.ID {
+		t.Fatalf("Consume = %+v, %v", got, err)
+	}
+	if _, err := js.Consume(plain); err == nil {
+		t.Fatal("令牌只能使用一次")
+	}
+}
+
+func TestJoinPinsCAFingerprintDuringHandshake(t *testing.T) {
+	ca, err := LoadOrCreateNodeCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := LoadOrCreateNodeCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer := func(ca *NodeCA, chain func([][]byte) [][]byte) (*httptest.Server, *int) {
+		var requests int
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte(`{}`))
+		}))
+		tlsConfig, err := ca.ServerTLSConfig([]string{"127.0.0.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chain != nil {
+			tlsConfig.Certificates[0].Certificate = chain(tlsConfig.Certificates[0].Certificate)
+		}
+		srv.TLS = tlsConfig
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv, &requests
+	}
+	post := func(srv *httptest.Server, fingerprint string) (*x509.Certificate, error) {
+		var pinned *x509.Certificate
+		client := &http.Client{Transport: pinnedCATransport(fingerprint, func(c *x509.Certificate) { pinned = c })}
+		resp, err := client.Post(srv.URL+"/api/node/join", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return pinned, nil
+	}
+
+	srv, requests := newServer(ca, nil)
+	pinned, err := post(srv, normalizeFingerprint(strings.ToUpper(ca.Fingerprint())))
+	if err != nil {
+		t.Fatalf("指纹正确时应能连接: %v", err)
+	}
+	if pinned == nil || !pinned.Equal(ca.cert) || *requests != 1 {
+		t.Fatalf("固定的 CA 不正确，请求 %d 次", *requests)
+	}
+
+	// 指纹不符：握手失败，请求（含加入令牌）不会发出
+	if _, err := post(srv, other.Fingerprint()); err == nil || *requests != 1 {
+		t.Fatalf("指纹不符时应在握手阶段拒绝: %v，请求 %d 次", err, *requests)
+	}
+
+	// 冒充者在证书链中附上真实 CA，但服务端证书由自己的 CA 签发
+	impostor, impostorRequests := newServer(other, func(chain [][]byte) [][]byte {
+		return [][]byte{chain[0], ca.cert.Raw}
+	})
+	if _, err := post(impostor, ca.Fingerprint()); err == nil || *impostorRequests != 0 {
+		t.Fatalf("服务端证书不是由指定 CA 签发时应拒绝: %v", err)
+	}
+}
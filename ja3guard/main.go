@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -13,14 +14,39 @@ import (
 	"sync"
 	"syscall"
 	"time"
-
-	"golang.org/x/crypto/acme/autocert"
 )
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "join":
+			runJoin(os.Args[2:])
+			return
+		case "release":
+			runRelease(os.Args[2:])
+			return
+		case "credentials":
+			runCredentials(os.Args[2:])
+			return
+		case "users":
+			runUsers(os.Args[2:])
+			return
+		}
+	}
+
 	configPath := flag.String("config", "/data/config.json", "配置文件路径")
+	showVersion := flag.Bool("version", false, "打印版本号后退出")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(Version)
+		return
+	}
+
 	// 加载配置
 	cfg, err := LoadConfig(*configPath)
 	if err != nil {
@@ -28,24 +54,41 @@ func main() {
 	}
 
 	// 初始化存储
-	store, err := NewStore(cfg.DataDir)
+	backend, err := OpenBackend(cfg)
+	if err != nil {
+		log.Fatalf("打开存储后端失败: %v", err)
+	}
+	defer backend.Close()
+
+	store, err := NewStore(backend)
 	if err != nil {
 		log.Fatalf("初始化存储失败: %v", err)
 	}
 
 	if cfg.IsMaster() {
-		runMaster(cfg, store)
-	} else {
-		runNode(cfg, store)
+		runMaster(cfg, store, backend)
+	} else if runNode(cfg, store, backend) {
+		// 应用了需要重启的期望配置：关闭存储后原地重新执行
+		backend.Close()
+		restartSelf()
 	}
 }
 
 // runMaster 启动 Master 模式：仅管理面板
-func runMaster(cfg *Config, store *Store) {
+func runMaster(cfg *Config, store *Store, backend Backend) {
 	log.Printf("[Master] JA3 Guard 管理面板启动中...")
 
-	// 初始化节点存储
-	nodeStore, err := NewNodeStore(cfg.DataDir)
+	// Master 的白名单带版本号，节点按版本增量同步
+	if err := store.EnableWhitelistVersioning(); err != nil {
+		log.Fatalf("初始化白名单版本失败: %v", err)
+	}
+
+	// 初始化节点存储，SSH 凭据使用数据目录外的主密钥加密
+	creds, err := LoadCredentialKeys(cfg)
+	if err != nil {
+		log.Fatalf("加载凭据主密钥失败: %v", err)
+	}
+	nodeStore, err := NewNodeStore(backend, creds)
 	if err != nil {
 		log.Fatalf("初始化节点存储失败: %v", err)
 	}
@@ -69,8 +112,37 @@ func runMaster(cfg *Config, store *Store) {
 		}
 	}()
 
+	// 节点期望配置
+	configs, err := NewConfigStore(backend, cfg)
+	if err != nil {
+		log.Fatalf("初始化节点配置失败: %v", err)
+	}
+
 	// 管理面板
 	adminHandler := NewAdminHandler(cfg, store, nodeStore)
+	adminHandler.configs = configs
+	if adminHandler.commands, err = NewCommandQueue(backend); err != nil {
+		log.Fatalf("初始化节点命令队列失败: %v", err)
+	}
+	if adminHandler.jobs, err = NewJobManager(backend); err != nil {
+		log.Fatalf("初始化任务历史失败: %v", err)
+	}
+	adminHandler.fleet = NewFleetManager(adminHandler.jobs)
+	if adminHandler.users, err = NewUserStore(backend, cfg); err != nil {
+		log.Fatalf("初始化管理面板用户失败: %v", err)
+	}
+	go adminHandler.users.RunCleanup()
+	if adminHandler.audit, err = NewAuditLog(backend); err != nil {
+		log.Fatalf("初始化审计记录失败: %v", err)
+	}
+	if adminHandler.releases, err = NewReleaseStore(filepath.Join(cfg.DataDir, "releases")); err != nil {
+		log.Fatalf("初始化发布存储失败: %v", err)
+	}
+	// 备用 Master：从主 Master 复制白名单、节点和配置层
+	if cfg.ReplicateFrom != "" {
+		adminHandler.replica = NewReplicator(adminHandler)
+		go adminHandler.replica.Start()
+	}
 	adminServer := &http.Server{
 		Addr:         cfg.ListenAdmin,
 		Handler:      adminHandler,
@@ -85,6 +157,33 @@ func runMaster(cfg *Config, store *Store) {
 		}
 	}()
 
+	// 节点 mTLS 通道（可选）：内置 CA 为节点签发客户端证书，只开放节点 API
+	var nodeTLSServer *http.Server
+	if cfg.ListenNodeTLS != "" {
+		ca, err := LoadOrCreateNodeCA(filepath.Join(cfg.DataDir, "pki"))
+		if err != nil {
+			log.Fatalf("初始化节点 CA 失败: %v", err)
+		}
+		tlsConfig, err := ca.ServerTLSConfig(cfg.nodeTLSHosts())
+		if err != nil {
+			log.Fatalf("签发节点通道证书失败: %v", err)
+		}
+		adminHandler.ca = ca
+		nodeTLSServer = &http.Server{
+			Addr:         cfg.ListenNodeTLS,
+			Handler:      adminHandler.NodeTLSHandler(),
+			TLSConfig:    tlsConfig,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		go func() {
+			log.Printf("[Master] 节点 mTLS 通道启动 %s（CA 指纹 %s）", cfg.ListenNodeTLS, ca.Fingerprint())
+			if err := nodeTLSServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				log.Fatalf("[Master] mTLS 服务错误: %v", err)
+			}
+		}()
+	}
+
 	log.Println("[Master] JA3 Guard Master 已就绪")
 
 	// 优雅关闭
@@ -96,11 +195,14 @@ func runMaster(cfg *Config, store *Store) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	adminServer.Shutdown(ctx)
+	if nodeTLSServer != nil {
+		nodeTLSServer.Shutdown(ctx)
+	}
 	log.Println("已安全关闭")
 }
 
-// runNode 启动 Node 模式：完整 JA3 反代 + 上报
-func runNode(cfg *Config, store *Store) {
+// runNode 启动 Node 模式：完整 JA3 反代 + 上报。返回 true 表示需要重启进程
+func runNode(cfg *Config, store *Store, backend Backend) bool {
 	log.Printf("[Node] JA3 Guard 节点启动中...")
 
 	// 定时清理旧日志
@@ -117,18 +219,13 @@ func runNode(cfg *Config, store *Store) {
 	certDir := filepath.Join(cfg.DataDir, "certs")
 	os.MkdirAll(certDir, 0700)
 
-	manager := &autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(cfg.Domain),
-		Cache:      autocert.DirCache(certDir),
-		Email:      cfg.ACMEEmail,
-	}
+	certs := NewACMECerts(cfg, certDir)
 
 	// --- JA3 提取层 ---
 	ja3Map := &sync.Map{}
 
 	// TLS 配置（使用 ACME 自动证书）
-	tlsConfig := manager.TLSConfig()
+	tlsConfig := certs.TLSConfig()
 	tlsConfig.MinVersion = tls.VersionTLS12
 
 	// TCP 监听
@@ -142,13 +239,15 @@ func runNode(cfg *Config, store *Store) {
 	tlsListener := tls.NewListener(ja3Listener, tlsConfig)
 
 	// --- 反向代理 ---
-	proxyHandler := NewProxyHandler(cfg, store)
+	health := NewHealthCollector(cfg, store)
+	proxyHandler := NewProxyHandler(cfg, store, health)
 
 	httpsServer := &http.Server{
 		Handler:      proxyHandler,
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
+		ErrorLog:     health.ErrorLog(),
 		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
 			addr := c.RemoteAddr().String()
 			if hash, ok := ja3Map.LoadAndDelete(addr); ok {
@@ -160,6 +259,10 @@ func runNode(cfg *Config, store *Store) {
 
 	// --- 管理面板（本地调试用）---
 	adminHandler := NewAdminHandler(cfg, store, nil)
+	if adminHandler.users, err = NewUserStore(backend, cfg); err != nil {
+		log.Fatalf("初始化管理面板用户失败: %v", err)
+	}
+	go adminHandler.users.RunCleanup()
 	adminServer := &http.Server{
 		Addr:         cfg.ListenAdmin,
 		Handler:      adminHandler,
@@ -170,7 +273,7 @@ func runNode(cfg *Config, store *Store) {
 	// --- HTTP 服务（ACME HTTP-01 验证 + HTTPS 重定向）---
 	httpServer := &http.Server{
 		Addr:    ":80",
-		Handler: manager.HTTPHandler(http.HandlerFunc(httpRedirect)),
+		Handler: certs.HTTPHandler(http.HandlerFunc(httpRedirect)),
 	}
 
 	// 启动所有服务
@@ -195,19 +298,48 @@ func runNode(cfg *Config, store *Store) {
 		}
 	}()
 
-	// --- 节点上报 ---
-	if cfg.MasterURL != "" && cfg.NodeToken != "" {
-		reporter := NewReporter(cfg, store)
+	// --- 节点上报 + 推送通道 + 期望配置 ---
+	restart := make(chan struct{}, 1)
+	if len(cfg.MasterEndpoints()) > 0 && cfg.NodeToken != "" {
+		link := NewMasterLink(cfg)
+		go link.Maintain()
+		reporter := NewReporter(cfg, store, link)
+		reporter.configs = NewConfigAgent(cfg, link, restart)
+		reporter.health = health
+		reporter.commands = NewCommandAgent(cfg, store, link, reporter, certs, restart)
+		go reporter.commands.Start()
+		reporter.updater = NewUpdater(cfg, link, restart)
+		go reporter.updater.Start()
 		go reporter.Start()
+		go NewPushClient(cfg, link, reporter).Start()
 	}
 
+	// SIGHUP: 重新加载白名单文件（systemctl reload / Master 通过 SSH 写入后触发）
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := store.ReloadWhitelist(); err != nil {
+				log.Printf("[Store] 重新加载白名单失败: %v", err)
+				continue
+			}
+			log.Printf("[Store] 白名单已重新加载，共 %d 条", len(store.GetWhitelist()))
+		}
+	}()
+
 	log.Println("[Node] JA3 Guard Node 已就绪")
 
 	// 优雅关闭
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("收到停止信号，正在关闭...")
+	restarting := false
+	select {
+	case <-quit:
+		log.Println("收到停止信号，正在关闭...")
+	case <-restart:
+		restarting = true
+		log.Println("正在重启...")
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -215,7 +347,10 @@ func runNode(cfg *Config, store *Store) {
 	httpsServer.Shutdown(ctx)
 	adminServer.Shutdown(ctx)
 	httpServer.Shutdown(ctx)
-	log.Println("已安全关闭")
+	if !restarting {
+		log.Println("已安全关闭")
+	}
+	return restarting
 }
 
 func httpRedirect(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	masterLinkCheckInterval = time.Hour
+	masterFailbackInterval  = 5 * time.Minute // 使用备用 Master 时隔多久重新尝试更高优先级的 Master
+	masterDialTimeout       = 10 * time.Second
+)
+
+// masterEndpoint 一个 Master 的地址，TLSURL 为向该 Master 申请证书时获知的 mTLS 通道地址
+type masterEndpoint struct {
+	URL    string
+	TLSURL string
+}
+
+type linkTargetKey struct{}
+
+// linkTarget 请求的目标 Master 和相对路径，切换 Master 时据此重建请求
+type linkTarget struct {
+	index int
+	path  string
+}
+
+// MasterLink 节点到 Master 的连接。
+// 持有 Master CA 签发的客户端证书后，上报、推送、拉取都走 mTLS 通道，并且只信任首次注册时固定的 CA；
+// 没有证书（旧版 Master 或未启用 listen_node_tls）时使用 master_url + 节点令牌。
+// 配置了多个 Master 时按优先级使用，连接失败或返回 502/503/504 时依次切换到下一个。
+// 状态保存在 data/pki/：node.crt / node.key / ca.crt / master.json，
+// 最近一次接受请求的 Master 记录在 data/master_state.json
+type MasterLink struct {
+	cfg       *Config
+	dir       string
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	leaf      *x509.Certificate
+	caPool    *x509.CertPool
+	caCert    *x509.Certificate
+	endpoints []masterEndpoint // 按优先级排列
+	active    int              // 最近一次请求成功的 Master
+	probeAt   time.Time        // 下次尝试切回更高优先级 Master 的时间
+	mtls      *http.Transport
+	plain     *http.Transport
+	lastErr   string
+}
+
+func NewMasterLink(cfg *Config) *MasterLink {
+	ml := &MasterLink{cfg: cfg, dir: filepath.Join(cfg.DataDir, "pki")}
+	for _, u := range cfg.MasterEndpoints() {
+		ml.endpoints = append(ml.endpoints, masterEndpoint{URL: u})
+	}
+	dialer := &net.Dialer{Timeout: masterDialTimeout, KeepAlive: 30 * time.Second}
+	ml.plain = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			// 校验在 verifyPlain 中完成（固定的 CA 或系统根证书）
+			InsecureSkipVerify: true,
+			VerifyConnection:   ml.verifyPlain,
+		},
+	}
+	ml.mtls = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			// 主机名不参与校验：Master 可能通过 IP 或多个域名访问，身份由固定的 CA 保证
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: ml.verifyMaster,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				ml.mu.RLock()
+				defer ml.mu.RUnlock()
+				if ml.cert == nil {
+					return &tls.Certificate{}, nil
+				}
+				return ml.cert, nil
+			},
+		},
+	}
+	if err := ml.load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("[mTLS] 读取节点证书失败: %v", err)
+	}
+	ml.loadState()
+	return ml
+}
+
+// load 读取已保存的证书与 Master 地址
+func (ml *MasterLink) load() error {
+	caPEM, err := os.ReadFile(filepath.Join(ml.dir, "ca.crt"))
+	if err != nil {
+		return err
+	}
+	caCert, err := parseCertPEM(caPEM)
+	if err != nil {
+		return err
+	}
+	ml.setCA(caCert)
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(ml.dir, "node.crt"), filepath.Join(ml.dir, "node.key"))
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	var meta struct {
+		TLSURL  string            `json:"tls_url"`  // 旧版只有一个 Master
+		TLSURLs map[string]string `json:"tls_urls"` // Master 地址 -> mTLS 通道地址
+	}
+	data, err := os.ReadFile(filepath.Join(ml.dir, "master.json"))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+	if meta.TLSURLs == nil && meta.TLSURL != "" && len(ml.endpoints) > 0 {
+		meta.TLSURLs = map[string]string{ml.endpoints[0].URL: meta.TLSURL}
+	}
+
+	ml.mu.Lock()
+	ml.cert, ml.leaf = &pair, leaf
+	for i := range ml.endpoints {
+		ml.endpoints[i].TLSURL = meta.TLSURLs[ml.endpoints[i].URL]
+	}
+	ml.mu.Unlock()
+	return nil
+}
+
+func (ml *MasterLink) statePath() string {
+	return filepath.Join(ml.cfg.DataDir, "master_state.json")
+}
+
+// loadState 从上次接受请求的 Master 开始，该 Master 已不在配置中时从第一个开始
+func (ml *MasterLink) loadState() {
+	data, err := os.ReadFile(ml.statePath())
+	if err != nil {
+		return
+	}
+	var st struct {
+		Active string `json:"active"`
+	}
+	if json.Unmarshal(data, &st) != nil {
+		return
+	}
+	for i, ep := range ml.endpoints {
+		if ep.URL == st.Active {
+			ml.active = i
+			ml.probeAt = time.Now().Add(masterFailbackInterval)
+		}
+	}
+}
+
+// markActive 记录接受请求的 Master，变化时写入 master_state.json
+func (ml *MasterLink) markActive(index int) {
+	ml.mu.Lock()
+	if index == ml.active {
+		ml.mu.Unlock()
+		return
+	}
+	prev := ml.endpoints[ml.active].URL
+	ml.active = index
+	ml.probeAt = time.Now().Add(masterFailbackInterval)
+	url := ml.endpoints[index].URL
+	ml.mu.Unlock()
+
+	log.Printf("[MasterLink] Master 由 %s 切换到 %s", prev, url)
+	data, _ := json.Marshal(map[string]string{
+		"active": url,
+		"since":  time.Now().Format("2006-01-02 15:04:05"),
+	})
+	if err := writeFileAtomic(ml.statePath(), data, 0644); err != nil {
+		log.Printf("[MasterLink] 保存 Master 状态失败: %v", err)
+	}
+}
+
+// ActiveMaster 当前使用的 Master 地址
+func (ml *MasterLink) ActiveMaster() string {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+	if len(ml.endpoints) == 0 {
+		return ""
+	}
+	return ml.endpoints[ml.active].URL
+}
+
+// pick 选择新请求的目标：当前 Master；使用备用 Master 一段时间后先尝试优先级最高的 Master
+func (ml *MasterLink) pick() int {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if ml.active > 0 && time.Now().After(ml.probeAt) {
+		ml.probeAt = time.Now().Add(masterFailbackInterval)
+		return 0
+	}
+	return ml.active
+}
+
+// target 请求某个 Master 时使用的基础地址：有证书且已知该 Master 的 mTLS 地址时走 mTLS
+func (ml *MasterLink) target(index int) (string, bool) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+	ep := ml.endpoints[index]
+	if ml.cert != nil && ep.TLSURL != "" {
+		return ep.TLSURL, true
+	}
+	return ep.URL, false
+}
+
+// endpointOf 根据请求地址找到对应的 Master
+func (ml *MasterLink) endpointOf(rawURL string) int {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+	for i, ep := range ml.endpoints {
+		if strings.HasPrefix(rawURL, ep.URL+"/") || (ep.TLSURL != "" && strings.HasPrefix(rawURL, ep.TLSURL+"/")) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (ml *MasterLink) setCA(caCert *x509.Certificate) {
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	ml.mu.Lock()
+	ml.caCert, ml.caPool = caCert, pool
+	ml.mu.Unlock()
+}
+
+// verifyMaster 校验 Master 服务端证书由固定的 CA 签发
+func (ml *MasterLink) verifyMaster(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	ml.mu.RLock()
+	pool := ml.caPool
+	ml.mu.RUnlock()
+	if pool == nil || len(rawCerts) == 0 {
+		return errors.New("未固定 Master CA")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	inter := x509.NewCertPool()
+	for _, raw := range rawCerts[1:] {
+		if c, err := x509.ParseCertificate(raw); err == nil {
+			inter.AddCert(c)
+		}
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// verifyPlain 令牌认证的 https 连接：先按固定的 Master CA 校验（join -ca-fingerprint 时
+// master_url 为节点 mTLS 通道地址），不符时按系统根证书和主机名校验
+func (ml *MasterLink) verifyPlain(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("Master 未提供证书")
+	}
+	ml.mu.RLock()
+	pinned := ml.caPool != nil
+	ml.mu.RUnlock()
+	if pinned {
+		raw := make([][]byte, len(cs.PeerCertificates))
+		for i, c := range cs.PeerCertificates {
+			raw[i] = c.Raw
+		}
+		if ml.verifyMaster(raw, nil) == nil {
+			return nil
+		}
+	}
+	inter := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: cs.ServerName, Intermediates: inter})
+	return err
+}
+
+// NewRequest 构造发往 Master 的请求，path 以 "/" 开头
+func (ml *MasterLink) NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	if len(ml.endpoints) == 0 {
+		return nil, errors.New("未配置 master_url")
+	}
+	index := ml.pick()
+	ctx = context.WithValue(ctx, linkTargetKey{}, linkTarget{index: index, path: path})
+	base, viaTLS := ml.target(index)
+	req, err := http.NewRequestWithContext(ctx, method, base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if !viaTLS {
+		req.Header.Set("Authorization", "Bearer "+ml.cfg.NodeToken)
+	}
+	return req, nil
+}
+
+// retarget 把请求改发到另一个 Master，请求体无法重放时返回 nil
+func (ml *MasterLink) retarget(req *http.Request, index int, path string) *http.Request {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil
+	}
+	base, viaTLS := ml.target(index)
+	u, err := url.Parse(base + path)
+	if err != nil {
+		return nil
+	}
+	r := req.Clone(req.Context())
+	r.URL, r.Host = u, u.Host
+	if req.GetBody != nil {
+		if r.Body, err = req.GetBody(); err != nil {
+			return nil
+		}
+	}
+	if viaTLS {
+		r.Header.Del("Authorization")
+	} else {
+		r.Header.Set("Authorization", "Bearer "+ml.cfg.NodeToken)
+	}
+	return r
+}
+
+// Client 返回走 MasterLink 的 HTTP 客户端，timeout 为 0 表示不限（长连接）
+func (ml *MasterLink) Client(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: linkTransport{ml}}
+}
+
+// linkTransport 按优先级依次尝试各个 Master：连接失败或返回 502/503/504 时切换到下一个，
+// 成功的 Master 成为后续请求的目标
+type linkTransport struct {
+	ml *MasterLink
+}
+
+func (t linkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ml := t.ml
+	target, ok := req.Context().Value(linkTargetKey{}).(linkTarget)
+	if !ok {
+		return ml.plain.RoundTrip(req)
+	}
+
+	order := []int{target.index}
+	for i := range ml.endpoints {
+		if i != target.index {
+			order = append(order, i)
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	for n, index := range order {
+		r := req
+		if n > 0 {
+			if r = ml.retarget(req, index, target.path); r == nil {
+				break
+			}
+		}
+		resp, err = ml.roundTrip(r, index, target.path)
+		if err == nil && !masterUnavailable(resp.StatusCode) {
+			ml.markActive(index)
+			return resp, nil
+		}
+		if req.Context().Err() != nil || n == len(order)-1 {
+			break
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("返回 %d", resp.StatusCode)
+		}
+		log.Printf("[MasterLink] Master %s 不可用（%v），尝试 %s", ml.endpoints[index].URL, err, ml.endpoints[order[n+1]].URL)
+	}
+	return resp, err
+}
+
+// roundTrip 按请求地址选择 mTLS 或普通传输；mTLS 请求返回 401 说明证书已被吊销，
+// 丢弃证书回退到令牌，由 Maintain 重新申请。
+// 普通请求从响应头得知该 Master 的 mTLS 地址后，之后的请求改走 mTLS（要求 Master 共用同一个 CA）
+func (ml *MasterLink) roundTrip(req *http.Request, index int, path string) (*http.Response, error) {
+	ml.mu.RLock()
+	tlsURL := ml.endpoints[index].TLSURL
+	ml.mu.RUnlock()
+	if tlsURL == "" || !strings.HasPrefix(req.URL.String(), tlsURL+"/") {
+		resp, err := ml.plain.RoundTrip(req)
+		if err != nil || !ml.learnTLSURL(index, resp.Header.Get(headerNodeTLSURL)) || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		// Master 要求客户端证书：改走刚获知的 mTLS 通道重试一次
+		r := ml.retarget(req, index, path)
+		if r == nil {
+			return resp, err
+		}
+		resp.Body.Close()
+		req = r
+	}
+	resp, err := ml.mtls.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		log.Printf("[mTLS] Master 拒绝了节点证书，回退到令牌认证")
+		ml.dropCert()
+	}
+	return resp, err
+}
+
+// learnTLSURL 记录 Master 在响应头中声明的 mTLS 地址，只在持有证书时生效，返回是否有变化
+func (ml *MasterLink) learnTLSURL(index int, tlsURL string) bool {
+	tlsURL = strings.TrimRight(tlsURL, "/")
+	ml.mu.Lock()
+	if tlsURL == "" || ml.cert == nil || ml.endpoints[index].TLSURL == tlsURL {
+		ml.mu.Unlock()
+		return false
+	}
+	ml.endpoints[index].TLSURL = tlsURL
+	ml.mu.Unlock()
+	log.Printf("[mTLS] Master %s 的 mTLS 通道: %s", ml.endpoints[index].URL, tlsURL)
+	if err := ml.saveTLSURLs(); err != nil {
+		log.Printf("[mTLS] 保存 Master 地址失败: %v", err)
+	}
+	return true
+}
+
+// saveTLSURLs 把各 Master 的 mTLS 地址写入 master.json
+func (ml *MasterLink) saveTLSURLs() error {
+	tlsURLs := make(map[string]string)
+	ml.mu.RLock()
+	for _, ep := range ml.endpoints {
+		if ep.TLSURL != "" {
+			tlsURLs[ep.URL] = ep.TLSURL
+		}
+	}
+	ml.mu.RUnlock()
+	meta, _ := json.Marshal(map[string]interface{}{"tls_urls": tlsURLs})
+	return writeFileAtomic(filepath.Join(ml.dir, "master.json"), meta, 0644)
+}
+
+// masterUnavailable Master 正在升级或被反向代理判定为不可用
+func masterUnavailable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// CertNotAfter 节点 mTLS 证书的到期时间，没有证书时返回 false
+func (ml *MasterLink) CertNotAfter() (time.Time, bool) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+	if ml.leaf == nil {
+		return time.Time{}, false
+	}
+	return ml.leaf.NotAfter, true
+}
+
+func (ml *MasterLink) dropCert() {
+	ml.mu.Lock()
+	ml.cert, ml.leaf = nil, nil
+	ml.mu.Unlock()
+	os.Remove(filepath.Join(ml.dir, "node.crt"))
+	os.Remove(filepath.Join(ml.dir, "node.key"))
+}
+
+// Maintain 后台维护证书：没有证书时用令牌申请，剩余有效期不足 30 天时通过 mTLS 续期
+func (ml *MasterLink) Maintain() {
+	for {
+		if err := ml.ensureCert(); err != nil {
+			if msg := err.Error(); msg != ml.lastErr {
+				log.Printf("[mTLS] %v，继续使用令牌认证", err)
+				ml.lastErr = msg
+			}
+		} else {
+			ml.lastErr = ""
+		}
+		time.Sleep(masterLinkCheckInterval)
+	}
+}
+
+func (ml *MasterLink) ensureCert() error {
+	ml.mu.RLock()
+	leaf := ml.leaf
+	ml.mu.RUnlock()
+	if leaf != nil && time.Until(leaf.NotAfter) > nodeCertRenewAt {
+		return nil
+	}
+	if leaf != nil {
+		log.Printf("[mTLS] 节点证书将于 %s 过期，开始续期", leaf.NotAfter.Format("2006-01-02"))
+	}
+	return ml.requestCert()
+}
+
+// requestCert 生成新密钥并向 Master 申请证书（有证书时经 mTLS 续期，否则用令牌）
+func (ml *MasterLink) requestCert() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: ml.cfg.NodeName},
+	}, key)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]string{
+		"csr": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})),
+	})
+
+	req, err := ml.NewRequest(context.Background(), "POST", "/api/node/cert", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ml.Client(30 * time.Second).Do(req)
+	if err != nil {
+		return fmt.Errorf("申请证书失败: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Master 未签发证书（%d）", resp.StatusCode)
+	}
+
+	var result struct {
+		Cert          string `json:"cert"`
+		CA            string `json:"ca"`
+		CAFingerprint string `json:"ca_fingerprint"`
+		TLSURL        string `json:"tls_url"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	if result.TLSURL == "" {
+		return errors.New("Master 未返回 mTLS 地址")
+	}
+	caCert, err := parseCertPEM([]byte(result.CA))
+	if err != nil {
+		return fmt.Errorf("CA 证书无效: %w", err)
+	}
+	if err := ml.checkCA(caCert); err != nil {
+		return err
+	}
+	leaf, err := parseCertPEM([]byte(result.Cert))
+	if err != nil {
+		return fmt.Errorf("节点证书无效: %w", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		return fmt.Errorf("节点证书不是由 Master CA 签发: %w", err)
+	}
+
+	index := ml.endpointOf(resp.Request.URL.String())
+	if index < 0 {
+		return errors.New("无法确定签发证书的 Master")
+	}
+	if err := ml.save(caCert, leaf, key, index, strings.TrimRight(result.TLSURL, "/")); err != nil {
+		return err
+	}
+	log.Printf("[mTLS] 已获取节点证书，有效期至 %s，通道: %s", leaf.NotAfter.Format("2006-01-02"), result.TLSURL)
+	return nil
+}
+
+// checkCA 校验 Master 返回的 CA：与配置的指纹一致，且与之前固定的 CA 相同
+func (ml *MasterLink) checkCA(caCert *x509.Certificate) error {
+	fp := certFingerprint(caCert)
+	if want := normalizeFingerprint(ml.cfg.MasterCAFingerprint); want != "" && want != fp {
+		return fmt.Errorf("Master CA 指纹不匹配: %s", fp)
+	}
+	ml.mu.RLock()
+	pinned := ml.caCert
+	ml.mu.RUnlock()
+	if pinned != nil && !pinned.Equal(caCert) {
+		return fmt.Errorf("Master CA 与已固定的 CA 不一致（%s），如确认 Master 重建了 CA，请删除 %s 后重启", fp, ml.dir)
+	}
+	return nil
+}
+
+// save 保存证书和签发它的 Master（index）的 mTLS 地址
+func (ml *MasterLink) save(caCert, leaf *x509.Certificate, key *ecdsa.PrivateKey, index int, tlsURL string) error {
+	if err := os.MkdirAll(ml.dir, 0700); err != nil {
+		return err
+	}
+	if err := savePinnedCA(ml.dir, caCert); err != nil {
+		return err
+	}
+	if err := writeKeyPair(filepath.Join(ml.dir, "node.crt"), filepath.Join(ml.dir, "node.key"), leaf.Raw, key); err != nil {
+		return err
+	}
+	ml.mu.Lock()
+	ml.endpoints[index].TLSURL = tlsURL
+	ml.mu.Unlock()
+	if err := ml.saveTLSURLs(); err != nil {
+		return err
+	}
+	if err := ml.load(); err != nil {
+		return err
+	}
+	// 已建立的连接仍在使用旧证书，关闭后新请求改用新证书
+	ml.mtls.CloseIdleConnections()
+	return nil
+}
+
+// savePinnedCA 保存固定的 Master CA（pki/ca.crt）
+func savePinnedCA(dir string, caCert *x509.Certificate) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, "ca.crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0644)
+}
+
+func parseCertPEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("不是 PEM 证书")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// runMigrate 将文件存储（whitelist.json / nodes.json / ja3_logs.jsonl）导入 SQLite
+//
+//	ja3guard migrate -config /opt/ja3guard/data/config.json [-db path] [-force]
+//
+// 迁移完成后将配置中的 storage_backend 改为 "sqlite" 并重启服务即可。
+// 原文件保持不变，可作为回退备份。
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configPath := fs.String("config", "/data/config.json", "配置文件路径")
+	dbPath := fs.String("db", "", "目标 SQLite 路径（默认使用配置中的 sqlite_path）")
+	force := fs.Bool("force", false, "目标数据库已有数据时仍然导入（覆盖白名单和节点，追加日志）")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+	target := *dbPath
+	if target == "" {
+		target = cfg.SQLitePath()
+	}
+
+	src, err := NewFileBackend(cfg.DataDir)
+	if err != nil {
+		log.Fatalf("打开文件存储失败: %v", err)
+	}
+	dst, err := NewSQLiteBackend(target)
+	if err != nil {
+		log.Fatalf("打开 SQLite 失败: %v", err)
+	}
+	defer dst.Close()
+
+	if !*force {
+		if err := ensureEmptyBackend(dst); err != nil {
+			log.Fatalf("%v（如需覆盖请加 -force）", err)
+		}
+	}
+
+	if err := migrateBackend(src, dst); err != nil {
+		log.Fatalf("迁移失败: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "迁移完成: %s → %s\n请将配置中的 storage_backend 设为 \"sqlite\" 后重启服务\n", cfg.DataDir, target)
+}
+
+// ensureEmptyBackend 检查目标后端是否为空，避免重复迁移导致日志翻倍
+func ensureEmptyBackend(b Backend) error {
+	wl, _, err := b.LoadWhitelist()
+	if err != nil {
+		return err
+	}
+	nodes, err := b.LoadNodes()
+	if err != nil {
+		return err
+	}
+	stats, err := b.LogStats()
+	if err != nil {
+		return err
+	}
+	if len(wl) > 0 || len(nodes) > 0 || stats.TotalRequests > 0 {
+		return fmt.Errorf("目标数据库非空: 白名单 %d 条, 节点 %d 个, 日志 %d 条",
+			len(wl), len(nodes), stats.TotalRequests)
+	}
+	return nil
+}
+
+// migrateBackend 将 src 的白名单、节点、节点配置、节点状态和日志复制到 dst
+func migrateBackend(src, dst Backend) error {
+	wl, wlVersion, err := src.LoadWhitelist()
+	if err != nil {
+		return fmt.Errorf("读取白名单: %w", err)
+	}
+	if err := dst.SaveWhitelist(wl, wlVersion); err != nil {
+		return fmt.Errorf("写入白名单: %w", err)
+	}
+	log.Printf("[Migrate] 白名单 %d 条", len(wl))
+
+	nodes, err := src.LoadNodes()
+	if err != nil {
+		return fmt.Errorf("读取节点: %w", err)
+	}
+	if err := dst.SaveNodes(nodes); err != nil {
+		return fmt.Errorf("写入节点: %w", err)
+	}
+	log.Printf("[Migrate] 节点 %d 个", len(nodes))
+
+	configs, err := src.LoadNodeConfigs()
+	if err != nil {
+		return fmt.Errorf("读取节点配置: %w", err)
+	}
+	if configs != nil {
+		if err := dst.SaveNodeConfigs(configs); err != nil {
+			return fmt.Errorf("写入节点配置: %w", err)
+		}
+		log.Printf("[Migrate] 节点配置层 %d 个", len(configs.Layers))
+	}
+
+	commands, err := src.LoadCommands()
+	if err != nil {
+		return fmt.Errorf("读取节点命令: %w", err)
+	}
+	if commands != nil {
+		if err := dst.SaveCommands(commands); err != nil {
+			return fmt.Errorf("写入节点命令: %w", err)
+		}
+		log.Printf("[Migrate] 节点命令 %d 条", len(commands))
+	}
+
+	jobs, err := src.LoadJobs()
+	if err != nil {
+		return fmt.Errorf("读取任务历史: %w", err)
+	}
+	if jobs != nil {
+		if err := dst.SaveJobs(jobs); err != nil {
+			return fmt.Errorf("写入任务历史: %w", err)
+		}
+		log.Printf("[Migrate] 任务历史 %d 条", len(jobs))
+	}
+
+	profiles, err := src.LoadCredentialProfiles()
+	if err != nil {
+		return fmt.Errorf("读取共享凭据: %w", err)
+	}
+	if profiles != nil {
+		if err := dst.SaveCredentialProfiles(profiles); err != nil {
+			return fmt.Errorf("写入共享凭据: %w", err)
+		}
+		log.Printf("[Migrate] 共享凭据 %d 个", len(profiles))
+	}
+
+	users, err := src.LoadUsers()
+	if err != nil {
+		return fmt.Errorf("读取管理面板用户: %w", err)
+	}
+	if users != nil {
+		if err := dst.SaveUsers(users); err != nil {
+			return fmt.Errorf("写入管理面板用户: %w", err)
+		}
+		log.Printf("[Migrate] 管理面板用户 %d 个", len(users))
+	}
+
+	audit, err := src.LoadAudit()
+	if err != nil {
+		return fmt.Errorf("读取审计记录: %w", err)
+	}
+	// 审计记录只追加且带哈希链，目标已有记录时不能合并
+	if existing, err := dst.LoadAudit(); err != nil {
+		return fmt.Errorf("读取目标审计记录: %w", err)
+	} else if len(existing) > 0 && len(audit) > 0 {
+		log.Printf("[Migrate] 目标已有 %d 条审计记录，跳过审计记录", len(existing))
+		audit = nil
+	}
+	for i := range audit {
+		if err := dst.AppendAudit(&audit[i]); err != nil {
+			return fmt.Errorf("写入审计记录: %w", err)
+		}
+	}
+	if len(audit) > 0 {
+		log.Printf("[Migrate] 审计记录 %d 条", len(audit))
+	}
+
+	statuses, err := src.LoadStatuses()
+	if err != nil {
+		return fmt.Errorf("读取节点状态: %w", err)
+	}
+	for _, st := range statuses {
+		if err := dst.SaveStatus(st); err != nil {
+			return fmt.Errorf("写入节点状态: %w", err)
+		}
+	}
+
+	logs, err := src.AllLogs()
+	if err != nil {
+		return fmt.Errorf("读取日志: %w", err)
+	}
+	const batch = 5000
+	for i := 0; i < len(logs); i += batch {
+		end := i + batch
+		if end > len(logs) {
+			end = len(logs)
+		}
+		if err := dst.AppendLogs(logs[i:end]); err != nil {
+			return fmt.Errorf("写入日志: %w", err)
+		}
+	}
+	log.Printf("[Migrate] 日志 %d 条", len(logs))
+	return nil
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
+	"log"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,14 +16,32 @@ type NodeInfo struct {
 	Host      string `json:"host"`       // 节点 IP 或域名
 	SSHPort   int    `json:"ssh_port"`   // SSH 端口
 	SSHUser   string `json:"ssh_user"`   // SSH 用户名
-	AuthType  string `json:"auth_type"`  // "key" 或 "password"
-	SSHKey    string `json:"ssh_key"`    // SSH 私钥内容（auth_type=key 时）
-	SSHPass   string `json:"ssh_pass"`   // SSH 密码（auth_type=password 时）
 	Domain    string `json:"domain"`     // 节点服务域名（推送配置用）
 	Upstream  string `json:"upstream"`   // 节点上游地址（推送配置用）
-	Token     string `json:"token"`      // 节点上报令牌
+	Group     string `json:"group"`      // 节点分组，用于分组配置
 	CreatedAt string `json:"created_at"` // 创建时间
 	Note      string `json:"note"`       // 备注
+	// SSH 认证信息；引用了共享凭据（credential_id）时使用共享凭据，忽略自身的认证信息
+	SSHAuth
+	CredentialID string `json:"credential_id,omitempty"`
+	// 节点上报令牌只保存 SHA-256 哈希，明文仅在创建 / 轮换时返回一次。
+	// 轮换后旧令牌在 PrevTokenExpires 之前仍然有效
+	TokenHash        string `json:"token_hash,omitempty"`
+	PrevTokenHash    string `json:"prev_token_hash,omitempty"`
+	PrevTokenExpires string `json:"prev_token_expires,omitempty"`
+	TokenRotatedAt   string `json:"token_rotated_at,omitempty"`
+	Token            string `json:"token,omitempty"` // 旧版明文令牌，加载时转为哈希
+	// mTLS 客户端证书（由 Master CA 签发），续期后旧证书在新证书首次使用前仍有效
+	CertSerial     string `json:"cert_serial,omitempty"`
+	CertNotAfter   string `json:"cert_not_after,omitempty"`
+	PrevCertSerial string `json:"prev_cert_serial,omitempty"`
+	// SSH 主机公钥（authorized_keys 格式）：创建节点时填写或首次连接时记录，之后每次连接校验。
+	// 公钥变化时拒绝连接，收到的新公钥记为待确认，由管理员接受后替换
+	SSHHostKey        string `json:"ssh_host_key,omitempty"`
+	SSHHostKeyPending string `json:"ssh_host_key_pending,omitempty"`
+	SSHHostKeyAt      string `json:"ssh_host_key_at,omitempty"` // 记录或接受公钥的时间
+	// 跳板机链：依次经由这些主机连接节点，每台跳板机有自己的认证和主机公钥
+	ProxyJump []SSHJump `json:"proxy_jump,omitempty"`
 }
 
 // NodeStatus 节点运行状态（由节点上报）
@@ -32,58 +50,100 @@ type NodeStatus struct {
 	Online        bool   `json:"online"`
 	LastHeartbeat string `json:"last_heartbeat"`
 	Version       string `json:"version"`
-	Uptime        int64  `json:"uptime"`        // 运行秒数
+	Protocol      int    `json:"protocol"`       // 节点使用的上报协议版本
+	Uptime        int64  `json:"uptime"`         // 运行秒数
 	TotalRequests int    `json:"total_requests"` // 总请求数
 	TrustedCount  int    `json:"trusted_count"`  // 信任请求数
 	BlockedCount  int    `json:"blocked_count"`  // 拦截请求数
 	Domain        string `json:"domain"`         // 节点域名
 	Upstream      string `json:"upstream"`       // 节点上游
+	// 节点已应用的期望配置版本和实际生效的配置（旧版节点不上报）
+	ConfigVersion int64           `json:"config_version"`
+	Config        *NodeConfigSpec `json:"config,omitempty"`
+	ConfigError   string          `json:"config_error,omitempty"`
+	// 最近一次上报的健康指标（旧版节点不上报）
+	Health *NodeHealth `json:"health,omitempty"`
+	// 节点支持 Master 下发的命令
+	Commands bool `json:"commands,omitempty"`
+	// 节点平台（os/arch）和自动更新状态
+	Platform string        `json:"platform,omitempty"`
+	Update   *UpdateStatus `json:"update,omitempty"`
 }
 
 // NodeStore 管理子节点的存储
 type NodeStore struct {
-	dataDir  string
-	nodes    []NodeInfo
-	statuses map[string]*NodeStatus // nodeID -> status
-	mu       sync.RWMutex
+	backend   NodeBackend
+	stBackend StatusBackend
+	cpBackend CredentialProfileBackend
+	creds     *CredentialKeys // SSH 凭据只在存储中加密，内存中为明文
+	nodes     []NodeInfo
+	profiles  []CredentialProfile    // 共享凭据
+	statuses  map[string]*NodeStatus // nodeID -> status
+	mu        sync.RWMutex
 }
 
-func NewNodeStore(dataDir string) (*NodeStore, error) {
+func NewNodeStore(backend Backend, creds *CredentialKeys) (*NodeStore, error) {
 	ns := &NodeStore{
-		dataDir:  dataDir,
-		statuses: make(map[string]*NodeStatus),
+		backend:   backend,
+		stBackend: backend,
+		cpBackend: backend,
+		creds:     creds,
+		statuses:  make(map[string]*NodeStatus),
 	}
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	nodes, err := backend.LoadNodes()
+	if err != nil {
+		return nil, fmt.Errorf("加载节点失败: %w", err)
+	}
+	stale, err := creds.openNodes(nodes)
+	if err != nil {
 		return nil, err
 	}
-	ns.loadNodes()
-	return ns, nil
-}
+	ns.nodes = nodes
+	if err := ns.migrateTokens(); err != nil {
+		return nil, fmt.Errorf("转换节点令牌失败: %w", err)
+	}
+	// 旧版明文凭据或轮换前的旧密钥：用当前密钥重新加密
+	if stale > 0 {
+		if err := ns.saveNodes(); err != nil {
+			return nil, fmt.Errorf("加密节点凭据失败: %w", err)
+		}
+		log.Printf("[Credential] 已用当前密钥加密 %d 个节点的 SSH 凭据", stale)
+	}
 
-func (ns *NodeStore) nodesPath() string {
-	return filepath.Join(ns.dataDir, "nodes.json")
-}
+	profiles, err := backend.LoadCredentialProfiles()
+	if err != nil {
+		return nil, fmt.Errorf("加载共享凭据失败: %w", err)
+	}
+	if stale, err = creds.openProfiles(profiles); err != nil {
+		return nil, err
+	}
+	ns.profiles = profiles
+	if stale > 0 {
+		if err := ns.saveCredentialProfiles(); err != nil {
+			return nil, fmt.Errorf("加密共享凭据失败: %w", err)
+		}
+		log.Printf("[Credential] 已用当前密钥加密 %d 个共享凭据", stale)
+	}
 
-func (ns *NodeStore) loadNodes() {
-	data, err := os.ReadFile(ns.nodesPath())
+	// 恢复上次运行时的节点状态，在线状态以重启后的上报为准
+	statuses, err := backend.LoadStatuses()
 	if err != nil {
-		return
+		return nil, fmt.Errorf("加载节点状态失败: %w", err)
 	}
-	var nodes []NodeInfo
-	if json.Unmarshal(data, &nodes) != nil {
-		return
+	for id, st := range statuses {
+		st.Online = false
+		// 旧版本保存的 guard_secret 明文
+		if st.Config != nil {
+			spec := st.Config.WithSecretDigest()
+			st.Config = &spec
+		}
+		ns.statuses[id] = st
 	}
-	ns.mu.Lock()
-	defer ns.mu.Unlock()
-	ns.nodes = nodes
+	return ns, nil
 }
 
 func (ns *NodeStore) saveNodes() error {
-	data, err := json.MarshalIndent(ns.nodes, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(ns.nodesPath(), data, 0600) // 0600: 含敏感信息
+	return ns.backend.SaveNodes(ns.creds.sealNodes(ns.nodes))
 }
 
 // generateID 生成简单的节点 ID
@@ -91,22 +151,22 @@ func generateID() string {
 	return fmt.Sprintf("node_%d", time.Now().UnixNano())
 }
 
-// AddNode 添加子节点
-func (ns *NodeStore) AddNode(node NodeInfo) (string, error) {
+// AddNode 添加子节点，返回节点 ID 和令牌明文（之后无法再取回）
+func (ns *NodeStore) AddNode(node NodeInfo) (string, string, error) {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
 
 	if node.Name == "" {
-		return "", fmt.Errorf("节点名称不能为空")
+		return "", "", fmt.Errorf("节点名称不能为空")
 	}
 	if node.Host == "" {
-		return "", fmt.Errorf("节点地址不能为空")
+		return "", "", fmt.Errorf("节点地址不能为空")
 	}
 
 	// 检查名称唯一
 	for _, n := range ns.nodes {
 		if n.Name == node.Name {
-			return "", fmt.Errorf("节点名称已存在: %s", node.Name)
+			return "", "", fmt.Errorf("节点名称已存在: %s", node.Name)
 		}
 	}
 
@@ -117,16 +177,33 @@ func (ns *NodeStore) AddNode(node NodeInfo) (string, error) {
 	if node.SSHUser == "" {
 		node.SSHUser = "root"
 	}
-	if node.AuthType == "" {
-		node.AuthType = "password"
-	}
-	if node.Token == "" {
-		node.Token = fmt.Sprintf("tk_%d", time.Now().UnixNano())
+	if err := ns.normalizeAuthRef(&node.SSHAuth, node.CredentialID, SSHAuth{}); err != nil {
+		return "", "", err
 	}
+	token, hash := generateNodeToken()
+	node.Token = ""
+	node.TokenHash = hash
+	node.PrevTokenHash, node.PrevTokenExpires, node.TokenRotatedAt = "", "", ""
 	node.CreatedAt = time.Now().Format("2006-01-02 15:04:05")
+	node.CertSerial, node.CertNotAfter, node.PrevCertSerial = "", "", ""
+	node.SSHHostKeyPending, node.SSHHostKeyAt = "", ""
+	if node.SSHHostKey != "" {
+		key, err := normalizeSSHHostKey(node.SSHHostKey)
+		if err != nil {
+			return "", "", err
+		}
+		node.SSHHostKey, node.SSHHostKeyAt = key, node.CreatedAt
+	}
+	if err := ns.normalizeProxyJump(node.ProxyJump, nil, node.CreatedAt); err != nil {
+		return "", "", err
+	}
 
 	ns.nodes = append(ns.nodes, node)
-	return node.ID, ns.saveNodes()
+	if err := ns.saveNodes(); err != nil {
+		ns.nodes = ns.nodes[:len(ns.nodes)-1]
+		return "", "", err
+	}
+	return node.ID, token, nil
 }
 
 // UpdateNode 更新节点信息
@@ -139,12 +216,28 @@ func (ns *NodeStore) UpdateNode(id string, updated NodeInfo) error {
 			// 保留不可变字段
 			updated.ID = n.ID
 			updated.CreatedAt = n.CreatedAt
-			if updated.Token == "" {
-				updated.Token = n.Token
-			}
+			updated.Token = ""
+			updated.TokenHash = n.TokenHash
+			updated.PrevTokenHash = n.PrevTokenHash
+			updated.PrevTokenExpires = n.PrevTokenExpires
+			updated.TokenRotatedAt = n.TokenRotatedAt
 			if updated.SSHPort == 0 {
 				updated.SSHPort = n.SSHPort
 			}
+			updated.CertSerial = n.CertSerial
+			updated.CertNotAfter = n.CertNotAfter
+			updated.PrevCertSerial = n.PrevCertSerial
+			// 凭据只写：留空表示不修改，切换认证方式时清除另一种
+			if err := ns.normalizeAuthRef(&updated.SSHAuth, updated.CredentialID, n.SSHAuth); err != nil {
+				return err
+			}
+			// 主机公钥只能通过接受 / 重新设置修改
+			updated.SSHHostKey = n.SSHHostKey
+			updated.SSHHostKeyPending = n.SSHHostKeyPending
+			updated.SSHHostKeyAt = n.SSHHostKeyAt
+			if err := ns.normalizeProxyJump(updated.ProxyJump, n.ProxyJump, time.Now().Format("2006-01-02 15:04:05")); err != nil {
+				return err
+			}
 			ns.nodes[i] = updated
 			return ns.saveNodes()
 		}
@@ -152,6 +245,124 @@ func (ns *NodeStore) UpdateNode(id string, updated NodeInfo) error {
 	return fmt.Errorf("节点不存在: %s", id)
 }
 
+// normalizeProxyJump 校验跳板机并补全默认值。与 old 中地址相同的跳板机保留已记录的主机公钥，
+// 新增的跳板机可以直接填写主机公钥，否则首次连接时记录
+func (ns *NodeStore) normalizeProxyJump(jumps, old []SSHJump, now string) error {
+	if len(jumps) > maxSSHJumps {
+		return fmt.Errorf("跳板机最多 %d 个", maxSSHJumps)
+	}
+	for i := range jumps {
+		j := &jumps[i]
+		if j.Host == "" {
+			return fmt.Errorf("第 %d 个跳板机地址不能为空", i+1)
+		}
+		if j.SSHPort == 0 {
+			j.SSHPort = 22
+		}
+		if j.SSHUser == "" {
+			j.SSHUser = "root"
+		}
+		if findSSHJump(jumps[:i], j.addr()) != nil {
+			return fmt.Errorf("跳板机 %s 重复", j.addr())
+		}
+		j.SSHHostKeyPending, j.SSHHostKeyAt = "", ""
+		prev := findSSHJump(old, j.addr())
+		var prevAuth SSHAuth
+		if prev != nil {
+			prevAuth = prev.SSHAuth
+		}
+		if err := ns.normalizeAuthRef(&j.SSHAuth, j.CredentialID, prevAuth); err != nil {
+			return fmt.Errorf("跳板机 %s: %w", j.addr(), err)
+		}
+		if prev != nil {
+			j.SSHHostKey, j.SSHHostKeyPending, j.SSHHostKeyAt = prev.SSHHostKey, prev.SSHHostKeyPending, prev.SSHHostKeyAt
+			continue
+		}
+		if j.SSHHostKey != "" {
+			key, err := normalizeSSHHostKey(j.SSHHostKey)
+			if err != nil {
+				return fmt.Errorf("跳板机 %s: %w", j.addr(), err)
+			}
+			j.SSHHostKey, j.SSHHostKeyAt = key, now
+		}
+	}
+	return nil
+}
+
+// normalizeSSHAuth 补全认证方式并校验私钥、口令和证书。更新时未填写的私钥 / 口令 / 密码沿用 old
+// （接口不返回凭据明文），只保留当前认证方式使用的字段
+func normalizeSSHAuth(a *SSHAuth, old SSHAuth) error {
+	if a.AuthType == "" {
+		a.AuthType = old.AuthType
+	}
+	if a.AuthType == "" {
+		a.AuthType = SSHAuthPassword
+	}
+	if a.SSHKey == "" {
+		a.SSHKey = old.SSHKey
+		// 更换私钥时口令随新私钥一起提交，不沿用旧口令
+		if a.SSHKeyPassphrase == "" {
+			a.SSHKeyPassphrase = old.SSHKeyPassphrase
+		}
+	}
+	if a.SSHPass == "" {
+		a.SSHPass = old.SSHPass
+	}
+	switch a.AuthType {
+	case SSHAuthKey:
+		a.SSHPass = ""
+		a.SSHCert = strings.TrimSpace(a.SSHCert)
+		if a.SSHKey != "" {
+			// 保存前检查口令和证书，避免到连接时才发现
+			if _, err := a.signer(); err != nil {
+				return err
+			}
+		}
+	case SSHAuthPassword, SSHAuthKeyboardInteractive:
+		a.SSHKey, a.SSHKeyPassphrase, a.SSHCert = "", "", ""
+	case SSHAuthAgent:
+		*a = SSHAuth{AuthType: SSHAuthAgent}
+	default:
+		return fmt.Errorf("不支持的认证方式: %s", a.AuthType)
+	}
+	return nil
+}
+
+// normalizeAuthRef 引用共享凭据时检查凭据存在并清除自身的认证信息，否则按 normalizeSSHAuth 处理
+func (ns *NodeStore) normalizeAuthRef(a *SSHAuth, credentialID string, old SSHAuth) error {
+	if credentialID == "" {
+		return normalizeSSHAuth(a, old)
+	}
+	if ns.findCredentialProfile(credentialID) == nil {
+		return fmt.Errorf("共享凭据不存在: %s", credentialID)
+	}
+	*a = SSHAuth{}
+	return nil
+}
+
+func findSSHJump(jumps []SSHJump, addr string) *SSHJump {
+	for i := range jumps {
+		if jumps[i].addr() == addr {
+			return &jumps[i]
+		}
+	}
+	return nil
+}
+
+// sshHostKeyFields 第 hop 跳（见 SSHHostKeyStore）的主机公钥字段。
+// proxy_jump 先复制再取地址，修改不影响已返回给调用方的节点副本
+func (n *NodeInfo) sshHostKeyFields(hop int) (key, pending, at *string, err error) {
+	if hop == len(n.ProxyJump) {
+		return &n.SSHHostKey, &n.SSHHostKeyPending, &n.SSHHostKeyAt, nil
+	}
+	if hop < 0 || hop > len(n.ProxyJump) {
+		return nil, nil, nil, fmt.Errorf("跳板机不存在")
+	}
+	n.ProxyJump = append([]SSHJump(nil), n.ProxyJump...)
+	j := &n.ProxyJump[hop]
+	return &j.SSHHostKey, &j.SSHHostKeyPending, &j.SSHHostKeyAt, nil
+}
+
 // RemoveNode 删除节点
 func (ns *NodeStore) RemoveNode(id string) error {
 	ns.mu.Lock()
@@ -171,6 +382,9 @@ func (ns *NodeStore) RemoveNode(id string) error {
 	}
 	ns.nodes = filtered
 	delete(ns.statuses, id)
+	if err := ns.stBackend.DeleteStatus(id); err != nil {
+		log.Printf("[NodeStore] 删除节点状态失败: %v", err)
+	}
 	return ns.saveNodes()
 }
 
@@ -188,18 +402,246 @@ func (ns *NodeStore) GetNode(id string) (*NodeInfo, error) {
 	return nil, fmt.Errorf("节点不存在: %s", id)
 }
 
-// GetNodeByToken 通过 token 查找节点
-func (ns *NodeStore) GetNodeByToken(token string) (*NodeInfo, error) {
+// Nodes 返回全部节点的副本
+func (ns *NodeStore) Nodes() []NodeInfo {
 	ns.mu.RLock()
 	defer ns.mu.RUnlock()
+	result := make([]NodeInfo, len(ns.nodes))
+	copy(result, ns.nodes)
+	return result
+}
 
-	for _, n := range ns.nodes {
-		if n.Token == token {
-			c := n
-			return &c, nil
+// SealedNodes 凭据已加密的全部节点（复制快照用）
+func (ns *NodeStore) SealedNodes() []NodeInfo {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return ns.creds.sealNodes(ns.nodes)
+}
+
+// ReplaceNodes 备用 Master 用主 Master 的节点列表整体替换本地节点（含令牌哈希和证书序列号），
+// 返回是否有变化
+func (ns *NodeStore) ReplaceNodes(nodes []NodeInfo) (bool, error) {
+	if nodes == nil {
+		nodes = []NodeInfo{}
+	}
+	// 复制快照中的凭据是加密的，备用 Master 需配置相同的凭据主密钥
+	if _, err := ns.creds.openNodes(nodes); err != nil {
+		return false, err
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if reflect.DeepEqual(ns.nodes, nodes) {
+		return false, nil
+	}
+	old := ns.nodes
+	ns.nodes = nodes
+	if err := ns.saveNodes(); err != nil {
+		ns.nodes = old
+		return false, err
+	}
+	return true, nil
+}
+
+// GetStatus 返回节点最近一次上报的状态，没有上报过时为 nil
+func (ns *NodeStore) GetStatus(id string) *NodeStatus {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	if st, ok := ns.statuses[id]; ok {
+		c := *st
+		return &c
+	}
+	return nil
+}
+
+// GetNodeByCert 通过 mTLS 客户端证书查找节点：节点必须存在且证书序列号为当前或上一张证书。
+// 节点首次使用新证书后上一张证书失效
+func (ns *NodeStore) GetNodeByCert(id, serial string) (*NodeInfo, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i, n := range ns.nodes {
+		if n.ID != id {
+			continue
+		}
+		switch {
+		case serial != "" && serial == n.CertSerial:
+			if n.PrevCertSerial != "" {
+				ns.nodes[i].PrevCertSerial = ""
+				if err := ns.saveNodes(); err != nil {
+					log.Printf("[NodeStore] 保存节点失败: %v", err)
+				}
+			}
+		case serial != "" && serial == n.PrevCertSerial:
+		default:
+			return nil, fmt.Errorf("证书已吊销或已被替换")
+		}
+		c := ns.nodes[i]
+		return &c, nil
+	}
+	return nil, fmt.Errorf("节点不存在: %s", id)
+}
+
+// SetNodeCert 记录新签发的证书
+func (ns *NodeStore) SetNodeCert(id, serial, notAfter string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i, n := range ns.nodes {
+		if n.ID == id {
+			ns.nodes[i].PrevCertSerial = n.CertSerial
+			ns.nodes[i].CertSerial = serial
+			ns.nodes[i].CertNotAfter = notAfter
+			return ns.saveNodes()
+		}
+	}
+	return fmt.Errorf("节点不存在: %s", id)
+}
+
+// RevokeNodeCert 吊销节点的全部证书（删除节点同样会使其证书失效）
+func (ns *NodeStore) RevokeNodeCert(id string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i, n := range ns.nodes {
+		if n.ID == id {
+			ns.nodes[i].CertSerial = ""
+			ns.nodes[i].CertNotAfter = ""
+			ns.nodes[i].PrevCertSerial = ""
+			return ns.saveNodes()
+		}
+	}
+	return fmt.Errorf("节点不存在: %s", id)
+}
+
+// TrustSSHHostKey 首次连接时记录主机公钥，已有记录时不覆盖；返回最终记录的公钥
+func (ns *NodeStore) TrustSSHHostKey(id string, hop int, key string) (string, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i, n := range ns.nodes {
+		if n.ID == id {
+			updated := n
+			known, _, at, err := updated.sshHostKeyFields(hop)
+			if err != nil {
+				return "", err
+			}
+			if *known != "" {
+				return *known, nil
+			}
+			*known, *at = key, time.Now().Format("2006-01-02 15:04:05")
+			ns.nodes[i] = updated
+			if err := ns.saveNodes(); err != nil {
+				ns.nodes[i] = n
+				return "", err
+			}
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("节点不存在: %s", id)
+}
+
+// SetPendingSSHHostKey 记录与已保存公钥不符的新公钥，等待管理员确认
+func (ns *NodeStore) SetPendingSSHHostKey(id string, hop int, key string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i, n := range ns.nodes {
+		if n.ID == id {
+			updated := n
+			_, pending, _, err := updated.sshHostKeyFields(hop)
+			if err != nil {
+				return err
+			}
+			if *pending == key {
+				return nil
+			}
+			*pending = key
+			ns.nodes[i] = updated
+			if err := ns.saveNodes(); err != nil {
+				ns.nodes[i] = n
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("节点不存在: %s", id)
+}
+
+// AcceptSSHHostKey 管理员确认节点（或其跳板机）更换了主机密钥：用待确认的公钥替换已保存的公钥。
+// fingerprint 必须与某个待确认公钥一致，避免接受了与管理员核对过的不同的公钥
+func (ns *NodeStore) AcceptSSHHostKey(id, fingerprint string) (string, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i, n := range ns.nodes {
+		if n.ID != id {
+			continue
+		}
+		var pendingFPs []string
+		for hop := 0; hop <= len(n.ProxyJump); hop++ {
+			updated := n
+			known, pending, at, _ := updated.sshHostKeyFields(hop)
+			if *pending == "" {
+				continue
+			}
+			fp := sshHostKeyFingerprint(*pending)
+			if fp != fingerprint {
+				pendingFPs = append(pendingFPs, fp)
+				continue
+			}
+			key := *pending
+			*known, *pending, *at = key, "", time.Now().Format("2006-01-02 15:04:05")
+			ns.nodes[i] = updated
+			if err := ns.saveNodes(); err != nil {
+				ns.nodes[i] = n
+				return "", err
+			}
+			return key, nil
+		}
+		if len(pendingFPs) == 0 {
+			return "", fmt.Errorf("节点没有待确认的主机公钥")
 		}
+		return "", fmt.Errorf("指纹不符，待确认的主机公钥为 %s", strings.Join(pendingFPs, ", "))
 	}
-	return nil, fmt.Errorf("无效的节点令牌")
+	return "", fmt.Errorf("节点不存在: %s", id)
+}
+
+// SetSSHHostKey 管理员直接设置主机公钥；jump 为 proxy_jump 下标，-1 表示节点本身。
+// key 为空时清除，下次连接重新按首次连接记录
+func (ns *NodeStore) SetSSHHostKey(id string, jump int, key string) error {
+	if key != "" {
+		var err error
+		if key, err = normalizeSSHHostKey(key); err != nil {
+			return err
+		}
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i, n := range ns.nodes {
+		if n.ID == id {
+			hop := jump
+			if jump < 0 {
+				hop = len(n.ProxyJump)
+			}
+			updated := n
+			known, pending, at, err := updated.sshHostKeyFields(hop)
+			if err != nil {
+				return err
+			}
+			*known, *pending, *at = key, "", ""
+			if key != "" {
+				*at = time.Now().Format("2006-01-02 15:04:05")
+			}
+			ns.nodes[i] = updated
+			if err := ns.saveNodes(); err != nil {
+				ns.nodes[i] = n
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("节点不存在: %s", id)
 }
 
 // ListNodes 列出所有节点（隐藏敏感信息）
@@ -218,20 +660,27 @@ func (ns *NodeStore) ListNodes() []map[string]interface{} {
 		}
 
 		result = append(result, map[string]interface{}{
-			"id":             n.ID,
-			"name":           n.Name,
-			"host":           n.Host,
-			"ssh_port":       n.SSHPort,
-			"ssh_user":       n.SSHUser,
-			"auth_type":      n.AuthType,
-			"domain":         n.Domain,
-			"upstream":       n.Upstream,
-			"token":          n.Token,
-			"created_at":     n.CreatedAt,
-			"note":           n.Note,
-			"online":         online,
-			"last_heartbeat": lastHB,
-			"status":         status,
+			"id":                      n.ID,
+			"name":                    n.Name,
+			"host":                    n.Host,
+			"ssh_port":                n.SSHPort,
+			"ssh_user":                n.SSHUser,
+			"auth_type":               n.AuthType,
+			"credential_id":           n.CredentialID,
+			"domain":                  n.Domain,
+			"upstream":                n.Upstream,
+			"group":                   n.Group,
+			"token_rotated_at":        n.TokenRotatedAt,
+			"prev_token_expires":      prevTokenExpires(n),
+			"created_at":              n.CreatedAt,
+			"note":                    n.Note,
+			"ssh_host_key_fp":         sshHostKeyFingerprint(n.SSHHostKey),
+			"ssh_host_key_pending_fp": sshHostKeyFingerprint(n.SSHHostKeyPending),
+			"proxy_jump":              proxyJumpSummary(n.ProxyJump),
+			"online":                  online,
+			"last_heartbeat":          lastHB,
+			"status":                  status,
+			"cert_not_after":          n.CertNotAfter,
 		})
 	}
 	return result
@@ -246,6 +695,9 @@ func (ns *NodeStore) UpdateStatus(nodeID string, status *NodeStatus) {
 	status.Online = true
 	status.LastHeartbeat = time.Now().Format("2006-01-02 15:04:05")
 	ns.statuses[nodeID] = status
+	if err := ns.stBackend.SaveStatus(status); err != nil {
+		log.Printf("[NodeStore] 保存节点状态失败: %v", err)
+	}
 }
 
 // CheckOffline 检查超时未上报的节点标记为离线
@@ -264,3 +716,20 @@ func (ns *NodeStore) CheckOffline(timeoutSeconds int) {
 		}
 	}
 }
+
+// proxyJumpSummary 节点列表中展示的跳板机信息（不含认证信息）
+func proxyJumpSummary(jumps []SSHJump) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(jumps))
+	for _, j := range jumps {
+		result = append(result, map[string]interface{}{
+			"host":                    j.Host,
+			"ssh_port":                j.SSHPort,
+			"ssh_user":                j.SSHUser,
+			"auth_type":               j.AuthType,
+			"credential_id":           j.CredentialID,
+			"ssh_host_key_fp":         sshHostKeyFingerprint(j.SSHHostKey),
+			"ssh_host_key_pending_fp": sshHostKeyFingerprint(j.SSHHostKeyPending),
+		})
+	}
+	return result
+}
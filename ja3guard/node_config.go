@@ -0,0 +1,668 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 配置层作用域：default 作用于全部节点，group:<名称> 作用于该分组，node:<ID> 为单节点覆盖。
+// 合并顺序为 节点基础信息 → default → group → node，后者覆盖前者
+const (
+	ConfigScopeDefault = "default"
+	configScopeGroup   = "group:"
+	configScopeNode    = "node:"
+)
+
+// NodeConfigSpec Master 统一管理的节点配置字段，nil 表示不管理该字段
+type NodeConfigSpec struct {
+	Domain         *string `json:"domain,omitempty"`
+	Upstream       *string `json:"upstream,omitempty"`
+	GuardSecret    *string `json:"guard_secret,omitempty"`
+	ACMEEmail      *string `json:"acme_email,omitempty"`
+	LogEnabled     *bool   `json:"log_enabled,omitempty"`
+	ReportInterval *int    `json:"report_interval,omitempty"`
+	SpoolMaxMB     *int    `json:"spool_max_mb,omitempty"`
+	ListenHTTPS    *string `json:"listen_https,omitempty"`
+	ListenAdmin    *string `json:"listen_admin,omitempty"`
+	// 节点使用的 Master 地址列表（按优先级），nil 表示不管理
+	MasterURLs []string `json:"master_urls,omitempty"`
+	// 节点应运行的程序版本，空字符串表示不自动更新
+	TargetVersion *string `json:"target_version,omitempty"`
+}
+
+// ConfigLayer 一个作用域的配置
+type ConfigLayer struct {
+	Scope     string         `json:"scope"`
+	Spec      NodeConfigSpec `json:"spec"`
+	UpdatedAt string         `json:"updated_at"`
+}
+
+// DesiredConfig 某个节点合并后的期望配置，内容变化时版本号递增
+type DesiredConfig struct {
+	NodeID    string         `json:"node_id"`
+	Version   int64          `json:"version"`
+	Hash      string         `json:"hash"`
+	Spec      NodeConfigSpec `json:"spec"`
+	Layers    []string       `json:"layers"` // 参与合并的作用域
+	UpdatedAt string         `json:"updated_at"`
+}
+
+// NodeConfigState 持久化的配置状态
+type NodeConfigState struct {
+	Revision int64                     `json:"revision"` // 全局递增，分配给内容发生变化的期望配置
+	Layers   map[string]*ConfigLayer   `json:"layers"`
+	Desired  map[string]*DesiredRecord `json:"desired"` // nodeID -> 最近一次期望配置的版本
+}
+
+// DesiredRecord 节点期望配置的版本记录
+type DesiredRecord struct {
+	Version   int64  `json:"version"`
+	Hash      string `json:"hash"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// ConfigStore Master 端节点配置管理。
+// 期望配置按需合并：合并结果的哈希与上次不同时分配新版本号，因此版本只随实际内容变化
+type ConfigStore struct {
+	backend ConfigBackend
+	cfg     *Config
+	state   *NodeConfigState
+	mu      sync.Mutex
+}
+
+func NewConfigStore(backend ConfigBackend, cfg *Config) (*ConfigStore, error) {
+	state, err := backend.LoadNodeConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("加载节点配置失败: %w", err)
+	}
+	if state == nil {
+		state = &NodeConfigState{}
+	}
+	if state.Layers == nil {
+		state.Layers = make(map[string]*ConfigLayer)
+	}
+	if state.Desired == nil {
+		state.Desired = make(map[string]*DesiredRecord)
+	}
+	return &ConfigStore{backend: backend, cfg: cfg, state: state}, nil
+}
+
+// Layers 返回全部配置层，按作用域排序
+func (cs *ConfigStore) Layers() []ConfigLayer {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	result := make([]ConfigLayer, 0, len(cs.state.Layers))
+	for _, l := range cs.state.Layers {
+		result = append(result, *l)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Scope < result[j].Scope })
+	return result
+}
+
+// SetLayer 保存配置层（整体替换）
+func (cs *ConfigStore) SetLayer(scope string, spec NodeConfigSpec) error {
+	if err := validateConfigScope(scope); err != nil {
+		return err
+	}
+	if err := spec.Validate(false); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	old := cs.state.Layers[scope]
+	cs.state.Layers[scope] = &ConfigLayer{Scope: scope, Spec: spec, UpdatedAt: time.Now().Format("2006-01-02 15:04:05")}
+	if err := cs.backend.SaveNodeConfigs(cs.state); err != nil {
+		cs.restoreLayerLocked(scope, old)
+		return err
+	}
+	return nil
+}
+
+// DeleteLayer 删除配置层
+func (cs *ConfigStore) DeleteLayer(scope string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	old, ok := cs.state.Layers[scope]
+	if !ok {
+		return fmt.Errorf("配置层不存在: %s", scope)
+	}
+	delete(cs.state.Layers, scope)
+	if err := cs.backend.SaveNodeConfigs(cs.state); err != nil {
+		cs.state.Layers[scope] = old
+		return err
+	}
+	return nil
+}
+
+func (cs *ConfigStore) restoreLayerLocked(scope string, old *ConfigLayer) {
+	if old == nil {
+		delete(cs.state.Layers, scope)
+	} else {
+		cs.state.Layers[scope] = old
+	}
+}
+
+// ForgetNode 删除节点时清理其覆盖层和版本记录
+func (cs *ConfigStore) ForgetNode(id string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.state.Layers, configScopeNode+id)
+	delete(cs.state.Desired, id)
+	if err := cs.backend.SaveNodeConfigs(cs.state); err != nil {
+		log.Printf("[NodeConfig] 保存节点配置失败: %v", err)
+	}
+}
+
+// State 返回配置状态的副本（主备复制用）
+func (cs *ConfigStore) State() *NodeConfigState {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	data, _ := json.Marshal(cs.state)
+	var state NodeConfigState
+	json.Unmarshal(data, &state)
+	return &state
+}
+
+// ReplaceState 备用 Master 用主 Master 的配置状态整体替换本地状态，版本号随之一致，返回是否有变化
+func (cs *ConfigStore) ReplaceState(state *NodeConfigState) (bool, error) {
+	if state.Layers == nil {
+		state.Layers = make(map[string]*ConfigLayer)
+	}
+	if state.Desired == nil {
+		state.Desired = make(map[string]*DesiredRecord)
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if reflect.DeepEqual(cs.state, state) {
+		return false, nil
+	}
+	old := cs.state
+	cs.state = state
+	if err := cs.backend.SaveNodeConfigs(state); err != nil {
+		cs.state = old
+		return false, err
+	}
+	return true, nil
+}
+
+// Resolve 合并节点的期望配置，内容与上次不同时分配新版本号
+func (cs *ConfigStore) Resolve(node *NodeInfo) (*DesiredConfig, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	spec := cs.baseSpec(node)
+	layers := []string{}
+	scopes := []string{ConfigScopeDefault}
+	if node.Group != "" {
+		scopes = append(scopes, configScopeGroup+node.Group)
+	}
+	scopes = append(scopes, configScopeNode+node.ID)
+	for _, scope := range scopes {
+		if l, ok := cs.state.Layers[scope]; ok {
+			spec.Merge(&l.Spec)
+			layers = append(layers, scope)
+		}
+	}
+	spec.Normalize()
+	hash := spec.Hash()
+
+	rec := cs.state.Desired[node.ID]
+	if rec == nil || rec.Hash != hash {
+		cs.state.Revision++
+		next := &DesiredRecord{Version: cs.state.Revision, Hash: hash, UpdatedAt: time.Now().Format("2006-01-02 15:04:05")}
+		cs.state.Desired[node.ID] = next
+		if err := cs.backend.SaveNodeConfigs(cs.state); err != nil {
+			cs.state.Revision--
+			if rec == nil {
+				delete(cs.state.Desired, node.ID)
+			} else {
+				cs.state.Desired[node.ID] = rec
+			}
+			return nil, err
+		}
+		rec = next
+	}
+
+	return &DesiredConfig{
+		NodeID:    node.ID,
+		Version:   rec.Version,
+		Hash:      hash,
+		Spec:      spec,
+		Layers:    layers,
+		UpdatedAt: rec.UpdatedAt,
+	}, nil
+}
+
+// baseSpec 合并的起点：节点信息中填写的域名 / 上游。
+// 期望配置只包含明确管理的字段，未设置的字段节点保留本地值
+func (cs *ConfigStore) baseSpec(node *NodeInfo) NodeConfigSpec {
+	var spec NodeConfigSpec
+	if node.Domain != "" {
+		domain := node.Domain
+		spec.Domain = &domain
+	}
+	if node.Upstream != "" {
+		upstream := node.Upstream
+		spec.Upstream = &upstream
+	}
+	return spec
+}
+
+// defaultNodeConfigSpec 生成完整配置文件（SSH 推送）时未管理字段的默认值
+func defaultNodeConfigSpec(cfg *Config) NodeConfigSpec {
+	logEnabled := true
+	interval, spool := 60, 64
+	listenHTTPS, listenAdmin := ":443", ":8443"
+	secret, email := cfg.GuardSecret, cfg.ACMEEmail
+	return NodeConfigSpec{
+		GuardSecret:    &secret,
+		ACMEEmail:      &email,
+		LogEnabled:     &logEnabled,
+		ReportInterval: &interval,
+		SpoolMaxMB:     &spool,
+		ListenHTTPS:    &listenHTTPS,
+		ListenAdmin:    &listenAdmin,
+	}
+}
+
+func validateConfigScope(scope string) error {
+	switch {
+	case scope == ConfigScopeDefault:
+	case strings.HasPrefix(scope, configScopeGroup) && len(scope) > len(configScopeGroup):
+	case strings.HasPrefix(scope, configScopeNode) && len(scope) > len(configScopeNode):
+	default:
+		return fmt.Errorf("无效的作用域: %s（应为 default、group:<名称> 或 node:<ID>）", scope)
+	}
+	return nil
+}
+
+// Merge 用 o 中已设置的字段覆盖 s
+func (s *NodeConfigSpec) Merge(o *NodeConfigSpec) {
+	if o.Domain != nil {
+		s.Domain = o.Domain
+	}
+	if o.Upstream != nil {
+		s.Upstream = o.Upstream
+	}
+	if o.GuardSecret != nil {
+		s.GuardSecret = o.GuardSecret
+	}
+	if o.ACMEEmail != nil {
+		s.ACMEEmail = o.ACMEEmail
+	}
+	if o.LogEnabled != nil {
+		s.LogEnabled = o.LogEnabled
+	}
+	if o.ReportInterval != nil {
+		s.ReportInterval = o.ReportInterval
+	}
+	if o.SpoolMaxMB != nil {
+		s.SpoolMaxMB = o.SpoolMaxMB
+	}
+	if o.ListenHTTPS != nil {
+		s.ListenHTTPS = o.ListenHTTPS
+	}
+	if o.ListenAdmin != nil {
+		s.ListenAdmin = o.ListenAdmin
+	}
+	if o.MasterURLs != nil {
+		s.MasterURLs = o.MasterURLs
+	}
+	if o.TargetVersion != nil {
+		s.TargetVersion = o.TargetVersion
+	}
+}
+
+// Normalize 上游缺少协议时补 http://
+func (s *NodeConfigSpec) Normalize() {
+	if s.Upstream != nil {
+		u := normalizeUpstream(*s.Upstream)
+		s.Upstream = &u
+	}
+}
+
+// normalizeUpstream 上游地址缺少协议时补 http://
+func normalizeUpstream(upstream string) string {
+	if upstream != "" && !strings.HasPrefix(upstream, "http://") && !strings.HasPrefix(upstream, "https://") {
+		return "http://" + upstream
+	}
+	return upstream
+}
+
+// redactedSecret 非管理员查看配置时 guard_secret 显示的内容
+const redactedSecret = "******"
+
+// Redacted 返回遮盖了 guard_secret 的副本，非管理员查看配置时使用
+func (s NodeConfigSpec) Redacted() NodeConfigSpec {
+	if s.GuardSecret != nil && *s.GuardSecret != "" {
+		masked := redactedSecret
+		s.GuardSecret = &masked
+	}
+	return s
+}
+
+// guardSecretDigestPrefix 节点上报的实际配置中 guard_secret 只带摘要
+const guardSecretDigestPrefix = "sha256:"
+
+// guardSecretDigest guard_secret 的摘要；已是摘要时原样返回，空值保持为空
+func guardSecretDigest(secret string) string {
+	if secret == "" || strings.HasPrefix(secret, guardSecretDigestPrefix) {
+		return secret
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return guardSecretDigestPrefix + hex.EncodeToString(sum[:])
+}
+
+// WithSecretDigest 返回 guard_secret 换成摘要的副本。节点上报实际配置时使用，
+// Master 收到旧版节点上报的明文时同样换成摘要再保存
+func (s NodeConfigSpec) WithSecretDigest() NodeConfigSpec {
+	if s.GuardSecret != nil {
+		digest := guardSecretDigest(*s.GuardSecret)
+		s.GuardSecret = &digest
+	}
+	return s
+}
+
+// redactConfigDiffs 遮盖差异中的 guard_secret，只保留是否不同
+func redactConfigDiffs(diffs []ConfigFieldDiff) {
+	for i := range diffs {
+		if diffs[i].Field != "guard_secret" {
+			continue
+		}
+		if diffs[i].Desired != nil {
+			diffs[i].Desired = redactedSecret
+		}
+		if diffs[i].Applied != nil {
+			diffs[i].Applied = redactedSecret
+		}
+	}
+}
+
+// Hash 期望配置内容的摘要
+func (s *NodeConfigSpec) Hash() string {
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// domainRe 域名（字母、数字、- 组成的标签，以 . 分隔）
+var domainRe = regexp.MustCompile(`^(?i:[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)(\.(?i:[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?))*$`)
+
+func validDomain(domain string) bool {
+	return len(domain) <= 253 && domainRe.MatchString(domain)
+}
+
+// Validate 校验配置；complete 为 true 时要求节点必需字段都已设置（节点应用前的校验）
+func (s *NodeConfigSpec) Validate(complete bool) error {
+	if complete {
+		for name, v := range map[string]*string{"domain": s.Domain, "upstream": s.Upstream, "guard_secret": s.GuardSecret} {
+			if v == nil || *v == "" {
+				return fmt.Errorf("%s 不能为空", name)
+			}
+		}
+	}
+	if s.Domain != nil && *s.Domain != "" && !validDomain(*s.Domain) {
+		return fmt.Errorf("domain 格式错误: %s", *s.Domain)
+	}
+	if s.Upstream != nil && *s.Upstream != "" {
+		raw := *s.Upstream
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") || strings.ContainsAny(*s.Upstream, " \t\r\n'\"`$;&|<>\\") {
+			return fmt.Errorf("upstream 格式错误: %s", *s.Upstream)
+		}
+	}
+	if s.ReportInterval != nil && *s.ReportInterval < 10 {
+		return fmt.Errorf("report_interval 不能小于 10 秒")
+	}
+	if s.SpoolMaxMB != nil && *s.SpoolMaxMB < 1 {
+		return fmt.Errorf("spool_max_mb 不能小于 1")
+	}
+	if s.MasterURLs != nil {
+		if len(s.MasterURLs) == 0 {
+			return fmt.Errorf("master_urls 不能为空列表")
+		}
+		for _, raw := range s.MasterURLs {
+			u, err := url.Parse(raw)
+			if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("master_urls 格式错误: %s", raw)
+			}
+		}
+	}
+	if s.TargetVersion != nil && *s.TargetVersion != "" && !validReleaseVersion(*s.TargetVersion) {
+		return fmt.Errorf("target_version 格式错误: %s", *s.TargetVersion)
+	}
+	for name, v := range map[string]*string{"listen_https": s.ListenHTTPS, "listen_admin": s.ListenAdmin} {
+		if v == nil {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(*v); err != nil || port == "" {
+			return fmt.Errorf("%s 格式错误: %s", name, *v)
+		}
+	}
+	return nil
+}
+
+// ConfigFieldDiff 期望值与节点实际值不一致的字段
+type ConfigFieldDiff struct {
+	Field   string      `json:"field"`
+	Desired interface{} `json:"desired"`
+	Applied interface{} `json:"applied"`
+}
+
+// Fields 按字段名展开（nil 字段跳过），用于写入配置文件和比较差异
+func (s *NodeConfigSpec) Fields() map[string]interface{} {
+	m := make(map[string]interface{})
+	data, _ := json.Marshal(s)
+	json.Unmarshal(data, &m)
+	return m
+}
+
+// diffConfig 比较期望配置和节点上报的实际配置
+func diffConfig(desired, applied *NodeConfigSpec) []ConfigFieldDiff {
+	diffs := []ConfigFieldDiff{}
+	want := desired.Fields()
+	have := map[string]interface{}{}
+	if applied != nil {
+		have = applied.Fields()
+	}
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// 节点只上报 guard_secret 的摘要
+	for _, m := range []map[string]interface{}{want, have} {
+		if v, ok := m["guard_secret"].(string); ok {
+			m["guard_secret"] = guardSecretDigest(v)
+		}
+	}
+	for _, k := range keys {
+		if fmt.Sprint(want[k]) != fmt.Sprint(have[k]) {
+			diffs = append(diffs, ConfigFieldDiff{Field: k, Desired: want[k], Applied: have[k]})
+		}
+	}
+	return diffs
+}
+
+// ============================================================
+// Master API
+// ============================================================
+
+// resolveNodeConfig 合并节点期望配置，失败时记录日志并返回 nil
+func (h *AdminHandler) resolveNodeConfig(node *NodeInfo) *DesiredConfig {
+	desired, err := h.configs.Resolve(node)
+	if err != nil {
+		log.Printf("[NodeConfig] 合并节点 %s 的配置失败: %v", node.ID, err)
+		return nil
+	}
+	return desired
+}
+
+// publishNodeConfigs 配置层或节点信息变化后，把新的期望配置推送给受影响的节点（ids 为空表示全部）
+func (h *AdminHandler) publishNodeConfigs(ids ...string) {
+	if h.configs == nil || h.events == nil {
+		return
+	}
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	for _, node := range h.nodeStore.Nodes() {
+		if len(ids) > 0 && !want[node.ID] {
+			continue
+		}
+		if desired := h.resolveNodeConfig(&node); desired != nil {
+			h.events.Publish(EventNodeConfig, node.ID, desired)
+		}
+	}
+}
+
+func (h *AdminHandler) handleConfigLayerList(w http.ResponseWriter, r *http.Request) {
+	if h.configs == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	layers := h.configs.Layers()
+	if !showSecrets(r) {
+		for i := range layers {
+			layers[i].Spec = layers[i].Spec.Redacted()
+		}
+	}
+	h.jsonOK(w, map[string]interface{}{
+		"layers": layers,
+	})
+}
+
+func (h *AdminHandler) handleConfigLayerSet(w http.ResponseWriter, r *http.Request, scope string) {
+	if h.configs == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	var spec NodeConfigSpec
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		h.jsonErr(w, "请求格式错误: "+err.Error(), 400)
+		return
+	}
+	if err := h.configs.SetLayer(scope, spec); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	log.Printf("[NodeConfig] 配置层 %s 已更新", scope)
+	h.publishNodeConfigs()
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+func (h *AdminHandler) handleConfigLayerDelete(w http.ResponseWriter, r *http.Request, scope string) {
+	if h.configs == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	if err := h.configs.DeleteLayer(scope); err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	log.Printf("[NodeConfig] 配置层 %s 已删除", scope)
+	h.publishNodeConfigs()
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+// handleNodeConfigView 单个节点的期望配置、实际配置和差异
+func (h *AdminHandler) handleNodeConfigView(w http.ResponseWriter, r *http.Request, id string) {
+	if h.configs == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	node, err := h.nodeStore.GetNode(id)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	desired, err := h.configs.Resolve(node)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 500)
+		return
+	}
+	resp := map[string]interface{}{
+		"desired":         desired,
+		"applied_version": int64(0),
+		"applied":         nil,
+		"config_error":    "",
+	}
+	var applied *NodeConfigSpec
+	if st := h.nodeStore.GetStatus(id); st != nil {
+		resp["applied_version"] = st.ConfigVersion
+		resp["applied"] = st.Config
+		resp["config_error"] = st.ConfigError
+		applied = st.Config
+	}
+	diffs := diffConfig(&desired.Spec, applied)
+	resp["diff"] = diffs
+	resp["drift"] = len(diffs) > 0
+	if !showSecrets(r) {
+		redacted := *desired
+		redacted.Spec = redacted.Spec.Redacted()
+		resp["desired"] = &redacted
+		if applied != nil {
+			spec := applied.Redacted()
+			resp["applied"] = &spec
+		}
+		redactConfigDiffs(diffs)
+	}
+	h.jsonOK(w, resp)
+}
+
+// configDrift 节点列表用：期望版本、实际版本和是否存在差异
+func (h *AdminHandler) configDrift(node *NodeInfo, st *NodeStatus) map[string]interface{} {
+	desired := h.resolveNodeConfig(node)
+	if desired == nil {
+		return nil
+	}
+	info := map[string]interface{}{
+		"desired_version": desired.Version,
+		"applied_version": int64(0),
+		"drift":           true,
+	}
+	if st != nil {
+		info["applied_version"] = st.ConfigVersion
+		info["drift"] = len(diffConfig(&desired.Spec, st.Config)) > 0
+		if st.ConfigError != "" {
+			info["error"] = st.ConfigError
+		}
+	}
+	return info
+}
+
+// handleNodeConfigPull 节点拉取自己的期望配置
+func (h *AdminHandler) handleNodeConfigPull(w http.ResponseWriter, r *http.Request) {
+	if h.configs == nil {
+		h.jsonErr(w, "仅在 master 模式下可用", 400)
+		return
+	}
+	node := h.authNode(w, r)
+	if node == nil {
+		return
+	}
+	desired, err := h.configs.Resolve(node)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 500)
+		return
+	}
+	h.jsonOK(w, desired)
+}
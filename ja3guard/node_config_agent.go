@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 无需重启即可生效的配置字段，其余字段变化时节点写入配置后重启进程
+var hotConfigFields = map[string]bool{
+	"log_enabled":     true,
+	"report_interval": true,
+	"target_version":  true, // 由 Updater 下载新版本后自行重启
+}
+
+// ConfigAgent 节点端期望配置：从上报响应得知新版本后拉取（或由推送通道直接下发），
+// 校验通过后写入 config.json，能在线生效的字段直接生效，其余字段通过重启生效
+type ConfigAgent struct {
+	cfg      *Config
+	link     *MasterLink
+	client   *http.Client
+	restart  chan<- struct{}
+	mu       sync.Mutex
+	applied  int64  // 已应用的版本
+	rejected int64  // 校验失败的版本，不再重复尝试
+	lastErr  string // 最近一次应用失败的原因，随上报发送给 Master
+}
+
+func NewConfigAgent(cfg *Config, link *MasterLink, restart chan<- struct{}) *ConfigAgent {
+	return &ConfigAgent{
+		cfg:     cfg,
+		link:    link,
+		client:  link.Client(30 * time.Second),
+		restart: restart,
+		applied: cfg.ConfigVersion,
+	}
+}
+
+// Status 上报用：已应用的版本、当前生效的配置（guard_secret 只带摘要）和最近的错误
+func (ca *ConfigAgent) Status() (int64, *NodeConfigSpec, string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	spec := ca.cfg.ManagedSpec().WithSecretDigest()
+	return ca.applied, &spec, ca.lastErr
+}
+
+// Check Master 返回的期望版本与已应用版本不同时拉取并应用
+func (ca *ConfigAgent) Check(version int64) {
+	ca.mu.Lock()
+	pending := version != ca.applied && version != ca.rejected
+	ca.mu.Unlock()
+	if !pending {
+		return
+	}
+	desired, err := ca.pull()
+	if err != nil {
+		log.Printf("[Config] 拉取期望配置失败: %v", err)
+		return
+	}
+	ca.Apply(desired)
+}
+
+func (ca *ConfigAgent) pull() (*DesiredConfig, error) {
+	req, err := ca.link.NewRequest(context.Background(), "GET", "/api/node/config", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ca.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("返回 %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var desired DesiredConfig
+	if err := json.Unmarshal(body, &desired); err != nil {
+		return nil, err
+	}
+	return &desired, nil
+}
+
+// Apply 校验并应用期望配置
+func (ca *ConfigAgent) Apply(desired *DesiredConfig) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if desired.Version == ca.applied || desired.Version == ca.rejected {
+		return
+	}
+	// 期望配置只含 Master 管理的字段，与本地配置合并后必须完整有效
+	current := ca.cfg.ManagedSpec()
+	merged := *current
+	merged.Merge(&desired.Spec)
+	if err := merged.Validate(true); err != nil {
+		ca.reject(desired.Version, err)
+		return
+	}
+
+	diffs := diffConfig(&desired.Spec, current)
+	needRestart := false
+	changed := make([]string, 0, len(diffs))
+	for _, d := range diffs {
+		changed = append(changed, d.Field)
+		if !hotConfigFields[d.Field] {
+			needRestart = true
+		}
+	}
+	sort.Strings(changed)
+
+	if err := ca.writeConfig(desired); err != nil {
+		ca.reject(desired.Version, fmt.Errorf("写入配置文件失败: %w", err))
+		return
+	}
+	if desired.Spec.LogEnabled != nil {
+		ca.cfg.SetLogEnabled(*desired.Spec.LogEnabled)
+	}
+	if desired.Spec.ReportInterval != nil {
+		ca.cfg.SetReportInterval(*desired.Spec.ReportInterval)
+	}
+	if desired.Spec.TargetVersion != nil {
+		ca.cfg.SetTargetVersion(*desired.Spec.TargetVersion)
+	}
+	ca.applied = desired.Version
+	ca.lastErr = ""
+
+	switch {
+	case len(changed) == 0:
+		log.Printf("[Config] 期望配置版本 %d 与当前配置一致", desired.Version)
+	case needRestart:
+		log.Printf("[Config] 已写入期望配置版本 %d（变更: %s），重启生效", desired.Version, strings.Join(changed, ", "))
+		select {
+		case ca.restart <- struct{}{}:
+		default:
+		}
+	default:
+		log.Printf("[Config] 已在线应用期望配置版本 %d（变更: %s）", desired.Version, strings.Join(changed, ", "))
+	}
+}
+
+func (ca *ConfigAgent) reject(version int64, err error) {
+	ca.rejected = version
+	ca.lastErr = fmt.Sprintf("版本 %d: %v", version, err)
+	log.Printf("[Config] 拒绝期望配置 %s", ca.lastErr)
+}
+
+// writeConfig 把期望配置合并进 config.json（保留节点本地字段），旧文件备份为 config.json.bak
+func (ca *ConfigAgent) writeConfig(desired *DesiredConfig) error {
+	fields := desired.Spec.Fields()
+	fields["config_version"] = desired.Version
+	return ca.cfg.UpdateFile(fields, true)
+}
+
+// restartSelf 以相同参数重新执行当前程序；失败时退出，由 systemd 按 Restart=on-failure 拉起
+func restartSelf() {
+	exe, err := os.Executable()
+	if err == nil {
+		err = syscall.Exec(exe, os.Args, os.Environ())
+	}
+	log.Fatalf("[Config] 重启失败: %v", err)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNodeConfigSpecValidateDomainUpstream(t *testing.T) {
+	for _, tc := range []struct {
+		domain, upstream string
+		ok               bool
+	}{
+		{"example.com", "127.0.0.1:8080", true},
+		{"a-b.example.com", "https://backend.internal", true},
+		{"example.com", "", true},
+		{"example.com;reboot", "127.0.0.1:8080", false},
+		{"$(id).example.com", "127.0.0.1:8080", false},
+		{"exa mple.com", "127.0.0.1:8080", false},
+		{"-bad.example.com", "127.0.0.1:8080", false},
+		{"example.com", "127.0.0.1:8080;reboot", false},
+		{"example.com", "http://backend/$(id)", false},
+		{"example.com", "ftp://backend", false},
+	} {
+		domain, upstream := tc.domain, tc.upstream
+		err := (&NodeConfigSpec{Domain: &domain, Upstream: &upstream}).Validate(false)
+		if (err == nil) != tc.ok {
+			t.Errorf("Validate(domain=%q, upstream=%q) = %v, want ok=%v", domain, upstream, err, tc.ok)
+		}
+	}
+}
+
+func TestReportedGuardSecretDigest(t *testing.T) {
+	secret, other := "s3cret", "other"
+	desired := &NodeConfigSpec{GuardSecret: &secret}
+
+	reported := (&NodeConfigSpec{GuardSecret: &secret}).WithSecretDigest()
+	if *reported.GuardSecret == secret || !strings.HasPrefix(*reported.GuardSecret, guardSecretDigestPrefix) {
+		t.Fatalf("上报的 guard_secret = %q，应只带摘要", *reported.GuardSecret)
+	}
+	if again := reported.WithSecretDigest(); *again.GuardSecret != *reported.GuardSecret {
+		t.Fatal("已是摘要时不应再次计算")
+	}
+	if diffs := diffConfig(desired, &reported); len(diffs) != 0 {
+		t.Fatalf("摘要一致时不应有差异: %+v", diffs)
+	}
+	// 旧版节点上报明文
+	if diffs := diffConfig(desired, &NodeConfigSpec{GuardSecret: &secret}); len(diffs) != 0 {
+		t.Fatalf("明文一致时不应有差异: %+v", diffs)
+	}
+	changed := (&NodeConfigSpec{GuardSecret: &other}).WithSecretDigest()
+	if diffs := diffConfig(desired, &changed); len(diffs) != 1 || diffs[0].Field != "guard_secret" {
+		t.Fatalf("guard_secret 不同时应有差异: %+v", diffs)
+	}
+	empty := ""
+	if got := (NodeConfigSpec{GuardSecret: &empty}).WithSecretDigest(); *got.GuardSecret != "" {
+		t.Fatalf("空的 guard_secret 应保持为空: %q", *got.GuardSecret)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const nodeFileMaxSize = 256 << 20 // 通过管理接口上传 / 下载的单个文件上限
+
+// RemoteFile 节点上文件的信息，上传、下载和查询时返回
+type RemoteFile struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode"`
+	ModTime string `json:"mod_time,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+// PutFileOptions 上传选项
+type PutFileOptions struct {
+	Mode   os.FileMode // 文件权限，0 表示沿用目标文件现有的权限（目标不存在时为 0644）
+	Owner  string      // "user[:group]" 或数字 uid[:gid]，为空时不修改
+	SHA256 string      // 内容应有的 sha256，为空时只校验传输
+}
+
+// shellQuote 单引号转义，用于拼接远程命令中的路径等参数
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// checkRemotePath 远程路径必须是规范的绝对路径
+func checkRemotePath(p string) error {
+	if p == "" || !strings.HasPrefix(p, "/") || path.Clean(p) != p || p == "/" {
+		return fmt.Errorf("远程路径必须是绝对路径: %q", p)
+	}
+	return nil
+}
+
+// sftp 打开 SFTP 会话；复用的连接已断开时重新连接一次
+func (sc *SSHClient) sftp() (*sftp.Client, func(), error) {
+	var fc *sftp.Client
+	release, err := sc.open(func(client *ssh.Client) (err error) {
+		fc, err = sftp.NewClient(client)
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开 SFTP 失败: %w", err)
+	}
+	return fc, func() {
+		fc.Close()
+		release()
+	}, nil
+}
+
+// PutFile 通过 SFTP 上传文件：先写入同目录下的临时文件，校验 sha256、设置权限和属主后原子替换目标文件。
+// 任何一步失败都删除临时文件，目标文件保持不变
+func (sc *SSHClient) PutFile(r io.Reader, remotePath string, opts PutFileOptions) (*RemoteFile, error) {
+	if err := checkRemotePath(remotePath); err != nil {
+		return nil, err
+	}
+	uid, gid := -1, -1
+	if opts.Owner != "" {
+		var err error
+		if uid, gid, err = sc.lookupOwner(opts.Owner); err != nil {
+			return nil, err
+		}
+	}
+
+	fc, done, err := sc.sftp()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	// 替换后的是新文件，未指定权限时沿用原文件的，避免 0600 的文件被换成所有人可读
+	mode := opts.Mode
+	if mode == 0 {
+		mode = 0644
+		if fi, err := fc.Stat(remotePath); err == nil {
+			mode = fi.Mode().Perm()
+		}
+	}
+
+	dir := path.Dir(remotePath)
+	if err := fc.MkdirAll(dir); err != nil {
+		return nil, fmt.Errorf("创建目录 %s 失败: %w", dir, err)
+	}
+	b := make([]byte, 6)
+	rand.Read(b)
+	tmp := path.Join(dir, "."+path.Base(remotePath)+".ja3guard-"+hex.EncodeToString(b))
+	f, err := fc.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, fmt.Errorf("创建临时文件失败: %w", err)
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			fc.Remove(tmp)
+		}
+	}()
+
+	h := sha256.New()
+	size, err := io.Copy(f, io.TeeReader(r, h))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("写入 %s 失败: %w", remotePath, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if opts.SHA256 != "" && !strings.EqualFold(opts.SHA256, sum) {
+		return nil, fmt.Errorf("内容 sha256 不符：期望 %s，实际 %s", strings.ToLower(opts.SHA256), sum)
+	}
+	remoteSum, err := sc.remoteSHA256(fc, tmp)
+	if err != nil {
+		return nil, fmt.Errorf("校验 %s 失败: %w", remotePath, err)
+	}
+	if remoteSum != sum {
+		return nil, fmt.Errorf("传输校验失败：发送 %s，节点上为 %s", sum, remoteSum)
+	}
+
+	if err := fc.Chmod(tmp, mode); err != nil {
+		return nil, fmt.Errorf("设置权限失败: %w", err)
+	}
+	if uid >= 0 {
+		if err := fc.Chown(tmp, uid, gid); err != nil {
+			return nil, fmt.Errorf("设置属主失败: %w", err)
+		}
+	}
+	// posix-rename 覆盖已有文件；服务端不支持时退回普通 rename（目标不存在时同样是原子的）
+	if err := fc.PosixRename(tmp, remotePath); err != nil {
+		if rerr := fc.Rename(tmp, remotePath); rerr != nil {
+			return nil, fmt.Errorf("替换 %s 失败: %w", remotePath, err)
+		}
+	}
+	renamed = true
+	return &RemoteFile{Path: remotePath, Size: size, Mode: fmt.Sprintf("%04o", mode), SHA256: sum}, nil
+}
+
+// remoteSHA256 在节点上计算文件的 sha256；没有 sha256sum 时通过 SFTP 读回计算
+func (sc *SSHClient) remoteSHA256(fc *sftp.Client, remotePath string) (string, error) {
+	if out, err := sc.Exec("sha256sum -- " + shellQuote(remotePath)); err == nil {
+		if fields := strings.Fields(out); len(fields) > 0 && len(fields[0]) == 64 {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	f, err := fc.Open(remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lookupOwner 把 "user[:group]" 解析为数字 uid / gid，未指定组时使用用户的主组
+func (sc *SSHClient) lookupOwner(owner string) (int, int, error) {
+	user, group, hasGroup := strings.Cut(owner, ":")
+	if user == "" || (hasGroup && group == "") {
+		return 0, 0, fmt.Errorf("属主格式错误（应为 user 或 user:group）: %q", owner)
+	}
+	lookup := func(cmd, name string) (int, error) {
+		if n, err := strconv.Atoi(name); err == nil && n >= 0 {
+			return n, nil
+		}
+		out, err := sc.Exec(cmd)
+		if err != nil {
+			return 0, fmt.Errorf("节点上不存在 %s", name)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(out))
+		if err != nil {
+			return 0, fmt.Errorf("节点上不存在 %s", name)
+		}
+		return n, nil
+	}
+	uid, err := lookup("id -u -- "+shellQuote(user), user)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !hasGroup {
+		gid, err := lookup("id -g -- "+shellQuote(user), user)
+		return uid, gid, err
+	}
+	gid, err := lookup("getent group "+shellQuote(group)+" | cut -d: -f3", group)
+	return uid, gid, err
+}
+
+// StatFile 查询节点上的文件信息和 sha256
+func (sc *SSHClient) StatFile(remotePath string) (*RemoteFile, error) {
+	if err := checkRemotePath(remotePath); err != nil {
+		return nil, err
+	}
+	fc, done, err := sc.sftp()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	fi, err := fc.Stat(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 失败: %w", remotePath, err)
+	}
+	rf := remoteFileInfo(remotePath, fi)
+	if fi.Mode().IsRegular() {
+		if rf.SHA256, err = sc.remoteSHA256(fc, remotePath); err != nil {
+			return nil, fmt.Errorf("计算 sha256 失败: %w", err)
+		}
+	}
+	return rf, nil
+}
+
+func remoteFileInfo(p string, fi os.FileInfo) *RemoteFile {
+	return &RemoteFile{
+		Path:    p,
+		Size:    fi.Size(),
+		Mode:    fmt.Sprintf("%04o", fi.Mode().Perm()),
+		ModTime: fi.ModTime().Format("2006-01-02 15:04:05"),
+	}
+}
+
+// OpenFile 打开节点上的普通文件用于下载，关闭时释放 SFTP 会话
+func (sc *SSHClient) OpenFile(remotePath string) (io.ReadCloser, *RemoteFile, error) {
+	if err := checkRemotePath(remotePath); err != nil {
+		return nil, nil, err
+	}
+	fc, done, err := sc.sftp()
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := fc.Open(remotePath)
+	if err != nil {
+		done()
+		return nil, nil, fmt.Errorf("打开 %s 失败: %w", remotePath, err)
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fmt.Errorf("%s 不是普通文件", remotePath)
+	}
+	if err != nil {
+		f.Close()
+		done()
+		return nil, nil, err
+	}
+	return &remoteReader{File: f, done: done}, remoteFileInfo(remotePath, fi), nil
+}
+
+type remoteReader struct {
+	*sftp.File
+	done func()
+}
+
+func (rr *remoteReader) Close() error {
+	err := rr.File.Close()
+	rr.done()
+	return err
+}
+
+// ============================================================
+// 管理接口：节点文件上传 / 下载
+// ============================================================
+
+// handleNodeFileUpload 上传文件到节点：请求体为文件内容，路径、权限、属主和 sha256 由查询参数指定
+func (h *AdminHandler) handleNodeFileUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	node, err := h.nodeStore.GetNode(id)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	q := r.URL.Query()
+	opts := PutFileOptions{Owner: q.Get("owner"), SHA256: q.Get("sha256")}
+	if m := q.Get("mode"); m != "" {
+		mode, err := strconv.ParseUint(m, 8, 32)
+		if err != nil || mode > 0o7777 {
+			h.jsonErr(w, "mode 应为八进制权限，如 0644", 400)
+			return
+		}
+		opts.Mode = os.FileMode(mode)
+	}
+	if r.ContentLength > nodeFileMaxSize {
+		h.jsonErr(w, fmt.Sprintf("文件超过 %d MB", nodeFileMaxSize>>20), 413)
+		return
+	}
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(10 * time.Minute))
+	rc.SetWriteDeadline(time.Now().Add(10 * time.Minute))
+
+	args := map[string]string{}
+	for _, k := range []string{"mode", "owner", "sha256"} {
+		if v := q.Get(k); v != "" {
+			args[k] = v
+		}
+	}
+	audit, err := h.startAudit(h.auditActor(r), node, AuditRecord{Action: AuditFileUpload, Path: q.Get("path"), Args: args})
+	if err != nil {
+		h.jsonErr(w, err.Error(), 500)
+		return
+	}
+	rf, err := h.sshClient(node).PutFile(http.MaxBytesReader(w, r.Body, nodeFileMaxSize), q.Get("path"), opts)
+	if err != nil {
+		audit.finish(err)
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	audit.rec.Path, audit.rec.OutputSize, audit.rec.OutputSHA256 = rf.Path, rf.Size, rf.SHA256
+	audit.finish(nil)
+	log.Printf("[SSH] 已上传文件到节点 %s: %s（%d 字节，sha256 %s）", node.Name, rf.Path, rf.Size, rf.SHA256)
+	h.jsonOK(w, map[string]interface{}{"status": "ok", "file": rf})
+}
+
+// handleNodeFileStat 查询节点上的文件信息和 sha256
+func (h *AdminHandler) handleNodeFileStat(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	node, err := h.nodeStore.GetNode(id)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	rf, err := h.sshClient(node).StatFile(r.URL.Query().Get("path"))
+	if err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	h.jsonOK(w, rf)
+}
+
+// handleNodeFileDownload 从节点下载文件（日志、配置、证书等），sha256 在传输结束后以 trailer 返回
+func (h *AdminHandler) handleNodeFileDownload(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	node, err := h.nodeStore.GetNode(id)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	audit, err := h.startAudit(h.auditActor(r), node, AuditRecord{Action: AuditFileDownload, Path: r.URL.Query().Get("path")})
+	if err != nil {
+		h.jsonErr(w, err.Error(), 500)
+		return
+	}
+	f, rf, err := h.sshClient(node).OpenFile(r.URL.Query().Get("path"))
+	if err != nil {
+		audit.finish(err)
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	defer f.Close()
+	audit.rec.Path = rf.Path
+	if rf.Size > nodeFileMaxSize {
+		err := fmt.Errorf("文件超过 %d MB，请在节点上压缩或分割后下载", nodeFileMaxSize>>20)
+		audit.finish(err)
+		h.jsonErr(w, err.Error(), 413)
+		return
+	}
+
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(10 * time.Minute))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(rf.Path)))
+	// 不设置 Content-Length：分块传输才能在结尾附带 trailer。日志等文件可能仍在写入，只发送打开时的大小
+	w.Header().Set("X-File-Size", strconv.FormatInt(rf.Size, 10))
+	w.Header().Set("X-File-Mode", rf.Mode)
+	w.Header().Set("Trailer", "X-Content-Sha256")
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), io.LimitReader(f, rf.Size))
+	audit.rec.OutputSize, audit.rec.OutputSHA256 = n, hex.EncodeToString(hash.Sum(nil))
+	audit.finish(err)
+	if err != nil {
+		log.Printf("[SSH] 从节点 %s 下载 %s 中断: %v", node.Name, rf.Path, err)
+		return
+	}
+	w.Header().Set("X-Content-Sha256", audit.rec.OutputSHA256)
+	log.Printf("[SSH] 已从节点 %s 下载文件 %s（%d 字节）", node.Name, rf.Path, n)
+}
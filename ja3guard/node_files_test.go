@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWriteFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows 不支持 Unix 文件权限")
+	}
+	srv := newTestSSHServer(t)
+	node := srv.node()
+	node.SSHHostKey = srv.hostKey()
+	client := NewSSHClient(node, nil, nil)
+	dir := t.TempDir()
+
+	modeOf := func(p string) os.FileMode {
+		t.Helper()
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Mode().Perm()
+	}
+
+	// 推送配置：替换已有的 0644 文件后为 0600
+	config := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(config, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteFile(`{"node_token":"x"}`, config, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if m := modeOf(config); m != 0600 {
+		t.Fatalf("config.json 权限 = %o, want 600", m)
+	}
+	if data, _ := os.ReadFile(config); string(data) != `{"node_token":"x"}` {
+		t.Fatalf("config.json 内容 = %q", data)
+	}
+
+	// 未指定权限：沿用原文件的权限，新文件为 0644
+	secret := filepath.Join(dir, "secret.conf")
+	if err := os.WriteFile(secret, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path string
+		want os.FileMode
+	}{
+		{secret, 0600},
+		{filepath.Join(dir, "sub", "new.conf"), 0644},
+	} {
+		rf, err := client.PutFile(strings.NewReader("new"), tc.path, PutFileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := modeOf(tc.path); m != tc.want {
+			t.Errorf("%s 权限 = %o, want %o", filepath.Base(tc.path), m, tc.want)
+		}
+		if rf.Mode != fmt.Sprintf("%04o", tc.want) {
+			t.Errorf("%s 返回的权限 = %s", filepath.Base(tc.path), rf.Mode)
+		}
+	}
+}
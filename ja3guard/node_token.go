@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 轮换令牌时旧令牌默认继续有效的时长
+const nodeTokenDefaultOverlap = 24 * time.Hour
+
+// generateNodeToken 生成随机节点令牌，返回明文和哈希
+func generateNodeToken() (string, string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := "tk_" + hex.EncodeToString(b)
+	return token, hashNodeToken(token)
+}
+
+func hashNodeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenHashEqual 常量时间比较令牌哈希，空哈希永不匹配
+func tokenHashEqual(stored, hash string) bool {
+	if stored == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1
+}
+
+// prevTokenValid 旧令牌是否仍在重叠期内
+func prevTokenValid(n *NodeInfo, now time.Time) bool {
+	if n.PrevTokenHash == "" || n.PrevTokenExpires == "" {
+		return false
+	}
+	exp, err := time.ParseInLocation("2006-01-02 15:04:05", n.PrevTokenExpires, time.Local)
+	return err == nil && now.Before(exp)
+}
+
+// prevTokenExpires 列表展示用：旧令牌仍有效时返回过期时间
+func prevTokenExpires(n NodeInfo) string {
+	if prevTokenValid(&n, time.Now()) {
+		return n.PrevTokenExpires
+	}
+	return ""
+}
+
+// migrateTokens 把旧版明文令牌转为哈希保存
+func (ns *NodeStore) migrateTokens() error {
+	migrated := 0
+	for i := range ns.nodes {
+		n := &ns.nodes[i]
+		if n.Token == "" {
+			continue
+		}
+		if n.TokenHash == "" {
+			n.TokenHash = hashNodeToken(n.Token)
+		}
+		n.Token = ""
+		migrated++
+	}
+	if migrated == 0 {
+		return nil
+	}
+	log.Printf("[NodeStore] 已将 %d 个节点的明文令牌转为哈希存储", migrated)
+	return ns.saveNodes()
+}
+
+// GetNodeByToken 通过 token 查找节点：比较当前令牌和重叠期内的旧令牌，
+// 遍历全部节点且不提前返回，耗时与令牌内容无关
+func (ns *NodeStore) GetNodeByToken(token string) (*NodeInfo, error) {
+	if token == "" {
+		return nil, fmt.Errorf("无效的节点令牌")
+	}
+	hash := hashNodeToken(token)
+	now := time.Now()
+
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	found := -1
+	for i := range ns.nodes {
+		n := &ns.nodes[i]
+		cur := tokenHashEqual(n.TokenHash, hash)
+		prev := tokenHashEqual(n.PrevTokenHash, hash) && prevTokenValid(n, now)
+		if cur || prev {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("无效的节点令牌")
+	}
+	c := ns.nodes[found]
+	return &c, nil
+}
+
+// RotateNodeToken 为节点生成新令牌并返回明文，旧令牌在 overlap 内仍然有效（overlap <= 0 时立即失效）
+func (ns *NodeStore) RotateNodeToken(id string, overlap time.Duration) (string, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i := range ns.nodes {
+		n := &ns.nodes[i]
+		if n.ID != id {
+			continue
+		}
+		old := *n
+		token, hash := generateNodeToken()
+		now := time.Now()
+		n.PrevTokenHash, n.PrevTokenExpires = "", ""
+		if overlap > 0 && n.TokenHash != "" {
+			n.PrevTokenHash = n.TokenHash
+			n.PrevTokenExpires = now.Add(overlap).Format("2006-01-02 15:04:05")
+		}
+		n.TokenHash = hash
+		n.TokenRotatedAt = now.Format("2006-01-02 15:04:05")
+		if err := ns.saveNodes(); err != nil {
+			*n = old
+			return "", err
+		}
+		return token, nil
+	}
+	return "", fmt.Errorf("节点不存在: %s", id)
+}
+
+// RevertNodeToken 撤销一次尚未送达节点的轮换（如推送配置失败），恢复旧令牌为当前令牌。
+// 当前令牌已不是 token 时不做任何操作
+func (ns *NodeStore) RevertNodeToken(id, token string) error {
+	hash := hashNodeToken(token)
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for i := range ns.nodes {
+		n := &ns.nodes[i]
+		if n.ID != id {
+			continue
+		}
+		if !tokenHashEqual(n.TokenHash, hash) || n.PrevTokenHash == "" {
+			return nil
+		}
+		n.TokenHash = n.PrevTokenHash
+		n.PrevTokenHash, n.PrevTokenExpires = "", ""
+		return ns.saveNodes()
+	}
+	return fmt.Errorf("节点不存在: %s", id)
+}
+
+// settleRotatedToken 部署或推送配置失败时处理推送前轮换出的新令牌。
+// 节点上的 config.json 已写入新令牌（written 或读取确认）时保留轮换，并提示旧令牌的失效时间；
+// 否则撤销轮换，节点继续使用旧令牌，不会在重叠期结束后被拒绝
+func (h *AdminHandler) settleRotatedToken(run *JobRun, client *SSHClient, id, token string, written bool) {
+	if !written {
+		written = remoteNodeToken(client) == token
+	}
+	if !written {
+		if err := h.nodeStore.RevertNodeToken(id, token); err != nil {
+			log.Printf("[Token] 撤销节点 %s 的令牌轮换失败: %v", id, err)
+			run.Logf("⚠ 撤销令牌轮换失败: %v，请重新部署或推送配置", err)
+			return
+		}
+		run.Logf("新令牌未写入节点，已撤销本次令牌轮换，节点继续使用原令牌")
+		return
+	}
+	expires := "重叠期结束"
+	if node, err := h.nodeStore.GetNode(id); err == nil && node.PrevTokenExpires != "" {
+		expires = node.PrevTokenExpires
+	}
+	log.Printf("[Token] 节点 %s 的新令牌已写入但服务可能未重启，原令牌 %s 失效", id, expires)
+	run.Logf("⚠ 新令牌已写入节点配置，但服务可能仍在使用原令牌；原令牌 %s 失效，请在此之前重启节点上的 ja3guard 或重新推送配置", expires)
+}
+
+// revertUnusedToken 任务未执行（如审计记录写入失败）时撤销本次令牌轮换
+func (h *AdminHandler) revertUnusedToken(run *JobRun, id, token string) {
+	if err := h.nodeStore.RevertNodeToken(id, token); err != nil {
+		log.Printf("[Token] 撤销节点 %s 的令牌轮换失败: %v", id, err)
+		run.Logf("⚠ 撤销令牌轮换失败: %v，请重新部署或推送配置", err)
+	}
+}
+
+// remoteNodeToken 读取节点 config.json 中的 node_token，读取失败返回空
+func remoteNodeToken(client *SSHClient) string {
+	f, _, err := client.OpenFile("/opt/ja3guard/data/config.json")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	var cfg struct {
+		NodeToken string `json:"node_token"`
+	}
+	if json.NewDecoder(io.LimitReader(f, 1<<20)).Decode(&cfg) != nil {
+		return ""
+	}
+	return cfg.NodeToken
+}
+
+// handleNodeTokenRotate 轮换节点令牌，新令牌明文只在响应中出现一次
+func (h *AdminHandler) handleNodeTokenRotate(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	var req struct {
+		OverlapMinutes *int `json:"overlap_minutes"` // 旧令牌继续有效的分钟数，默认 1440，0 为立即失效
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	overlap := nodeTokenDefaultOverlap
+	if req.OverlapMinutes != nil {
+		if *req.OverlapMinutes < 0 {
+			h.jsonErr(w, "overlap_minutes 不能为负数", 400)
+			return
+		}
+		overlap = time.Duration(*req.OverlapMinutes) * time.Minute
+	}
+
+	token, err := h.nodeStore.RotateNodeToken(id, overlap)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	prevExpires := ""
+	if node, err := h.nodeStore.GetNode(id); err == nil {
+		prevExpires = prevTokenExpires(*node)
+	}
+	log.Printf("[NodeStore] 节点 %s 的令牌已轮换，旧令牌重叠期 %s", id, overlap)
+	h.jsonOK(w, map[string]interface{}{
+		"status":             "ok",
+		"token":              token,
+		"prev_token_expires": prevExpires,
+	})
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 证书有效期
+const (
+	caCertLifetime     = 10 * 365 * 24 * time.Hour
+	serverCertLifetime = 365 * 24 * time.Hour
+	nodeCertLifetime   = 90 * 24 * time.Hour
+	nodeCertRenewAt    = 30 * 24 * time.Hour // 剩余有效期低于该值时节点自动续期
+	maxCSRSize         = 16 << 10
+)
+
+// NodeCA Master 内置的小型 CA，为节点签发 mTLS 客户端证书并为节点通道签发服务端证书
+// 文件位于 data/pki/：ca.crt / ca.key / server.crt / server.key
+type NodeCA struct {
+	dir     string
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	mu      sync.Mutex
+}
+
+// LoadOrCreateNodeCA 加载 CA，不存在时生成新的 ECDSA P-256 CA
+func LoadOrCreateNodeCA(dir string) (*NodeCA, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ca := &NodeCA{dir: dir}
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          randomSerial(),
+			Subject:               pkix.Name{CommonName: "JA3 Guard Node CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(caCertLifetime),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeKeyPair(certPath, keyPath, der, key); err != nil {
+			return nil, err
+		}
+		log.Printf("[PKI] 已生成节点 CA: %s", dir)
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("加载 CA 失败: %w", err)
+	}
+	ca.cert, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA 私钥类型不支持")
+	}
+	ca.key = signer
+	ca.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	return ca, nil
+}
+
+// CertPEM CA 证书（节点用于固定 Master 身份）
+func (ca *NodeCA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Fingerprint CA 证书 DER 的 SHA-256（hex），节点首次注册时用于校验
+func (ca *NodeCA) Fingerprint() string {
+	return certFingerprint(ca.cert)
+}
+
+func (ca *NodeCA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// IssueNodeCert 按节点提交的 CSR 签发客户端证书，CN 固定为节点 ID（忽略 CSR 中的主题）
+func (ca *NodeCA) IssueNodeCert(nodeID string, csrPEM []byte) (certPEM []byte, cert *x509.Certificate, err error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, nil, errors.New("CSR 格式错误")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("CSR 解析失败: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, nil, fmt.Errorf("CSR 签名无效: %w", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: nodeID, OrganizationalUnit: []string{"ja3guard-node"}},
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(nodeCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	ca.mu.Lock()
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+	ca.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), cert, nil
+}
+
+// ServerCertificate 返回节点通道的服务端证书，不存在、即将过期或主机名变化时重新签发
+func (ca *NodeCA) ServerCertificate(hosts []string) (tls.Certificate, error) {
+	certPath, keyPath := filepath.Join(ca.dir, "server.crt"), filepath.Join(ca.dir, "server.key")
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if leaf, err := x509.ParseCertificate(pair.Certificate[0]); err == nil &&
+			time.Until(leaf.NotAfter) > nodeCertRenewAt && coversHosts(leaf, hosts) {
+			return pair, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "JA3 Guard Master"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(serverCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	ca.mu.Lock()
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	ca.mu.Unlock()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeKeyPair(certPath, keyPath, der, key); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("[PKI] 已签发节点通道服务端证书（主机: %s）", strings.Join(hosts, ", "))
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+// ServerTLSConfig 节点通道的 TLS 配置：客户端证书可选（首次注册仍走令牌），有则必须由本 CA 签发
+func (ca *NodeCA) ServerTLSConfig(hosts []string) (*tls.Config, error) {
+	cert, err := ca.ServerCertificate(hosts)
+	if err != nil {
+		return nil, err
+	}
+	// 证书链带上 CA，节点加入时可在握手阶段按指纹校验（verifyPinnedCA）
+	cert.Certificate = append(cert.Certificate, ca.cert.Raw)
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.Pool(),
+	}, nil
+}
+
+func coversHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		if h != "" && cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint 统一指纹格式：小写、去掉冒号
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+// verifyPinnedCA 在 TLS 握手时校验 Master：证书链中必须有指纹为 fingerprint 的 CA，且服务端证书由它签发。
+// 返回该 CA 证书
+func verifyPinnedCA(rawCerts [][]byte, fingerprint string) (*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("Master 未提供证书")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range rawCerts[1:] {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil || certFingerprint(c) != fingerprint {
+			continue
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(c)
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:     pool,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}); err != nil {
+			return nil, fmt.Errorf("Master 证书不是由指定的 CA 签发: %w", err)
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("Master 证书链中没有指纹为 %s 的 CA", fingerprint)
+}
+
+// certSerial 证书序列号的 hex 表示（NodeInfo 中保存）
+func certSerial(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// writeKeyPair 以 PEM 写入证书与私钥（私钥 0600）
+func writeKeyPair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// nodeTLSHosts 节点通道服务端证书的主机名：node_tls_hosts + node_tls_url 中的主机
+func (c *Config) nodeTLSHosts() []string {
+	hosts := append([]string{}, c.NodeTLSHosts...)
+	if u, err := url.Parse(c.NodeTLSURL); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	return hosts
+}
+
+// NodeTLSHandler 节点通道只开放节点 API（/api/report、/api/node/*），管理面板不对外暴露
+func (h *AdminHandler) NodeTLSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/report" && !strings.HasPrefix(r.URL.Path, "/api/node/") {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// nodeTLSURL 返回给节点的 mTLS 地址：优先 node_tls_url，否则由请求主机名 + 监听端口推导
+// headerNodeTLSURL Master 在节点 API 的响应中声明自己的 mTLS 通道地址，
+// 节点切换到另一个 Master（共用同一个 CA）时据此改走 mTLS
+const headerNodeTLSURL = "X-JA3-Node-TLS-URL"
+
+func (h *AdminHandler) nodeTLSURL(r *http.Request) string {
+	if h.cfg.NodeTLSURL != "" {
+		return strings.TrimRight(h.cfg.NodeTLSURL, "/")
+	}
+	host := r.Host
+	if hn, _, err := net.SplitHostPort(host); err == nil {
+		host = hn
+	}
+	_, port, err := net.SplitHostPort(h.cfg.ListenNodeTLS)
+	if err != nil {
+		return ""
+	}
+	return "https://" + net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// handleNodeCert 节点申请 / 续期客户端证书。
+// 首次申请使用节点令牌认证；已持有证书的节点通过 mTLS 续期，旧证书在新证书首次使用前仍然有效
+func (h *AdminHandler) handleNodeCert(w http.ResponseWriter, r *http.Request) {
+	if h.nodeStore == nil || h.ca == nil {
+		h.jsonErr(w, "Master 未启用节点 mTLS（listen_node_tls）", 404)
+		return
+	}
+	node := h.authNode(w, r)
+	if node == nil {
+		return
+	}
+
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCSRSize)).Decode(&req); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	certPEM, cert, err := h.ca.IssueNodeCert(node.ID, []byte(req.CSR))
+	if err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	if err := h.nodeStore.SetNodeCert(node.ID, certSerial(cert), cert.NotAfter.Format("2006-01-02 15:04:05")); err != nil {
+		h.jsonErr(w, err.Error(), 500)
+		return
+	}
+	log.Printf("[PKI] 已为节点 %s 签发证书 %s，有效期至 %s", node.Name, certSerial(cert), cert.NotAfter.Format("2006-01-02"))
+
+	h.jsonOK(w, map[string]interface{}{
+		"status":         "ok",
+		"cert":           string(certPEM),
+		"ca":             string(h.ca.CertPEM()),
+		"ca_fingerprint": h.ca.Fingerprint(),
+		"tls_url":        h.nodeTLSURL(r),
+		"not_after":      cert.NotAfter.Format(time.RFC3339),
+	})
+}
+
+// handleNodeCertRevoke 吊销节点证书，节点需重新用令牌申请
+func (h *AdminHandler) handleNodeCertRevoke(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	if err := h.nodeStore.RevokeNodeCert(id); err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+// handleNodeCAInfo 返回 CA 指纹，供手动部署节点时填写 master_ca_fingerprint
+func (h *AdminHandler) handleNodeCAInfo(w http.ResponseWriter, r *http.Request) {
+	if h.ca == nil {
+		h.jsonOK(w, map[string]interface{}{"enabled": false})
+		return
+	}
+	h.jsonOK(w, map[string]interface{}{
+		"enabled":     true,
+		"fingerprint": h.ca.Fingerprint(),
+		"tls_url":     h.nodeTLSURL(r),
+		"ca":          string(h.ca.CertPEM()),
+	})
+}
@@ -14,13 +14,17 @@ const ctxKeyJA3 contextKey = "ja3hash"
 
 // NewProxyHandler 创建反向代理 handler
 // 职责: 剥离客户端伪造的 header → 查白名单 → 记日志 → 注入信任 header → 转发上游
-func NewProxyHandler(cfg *Config, store *Store) http.Handler {
+// health 不为 nil 时统计上游响应时间和错误
+func NewProxyHandler(cfg *Config, store *Store, health *HealthCollector) http.Handler {
 	upstream, err := url.Parse(cfg.Upstream)
 	if err != nil {
 		log.Fatalf("无效的 upstream URL: %v", err)
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	if health != nil {
+		proxy.Transport = health.Transport(http.DefaultTransport)
+	}
 
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 推送事件类型
+const (
+	EventWhitelist  = "whitelist"   // 白名单变更，data: WhitelistSync（增量，重连快照为全量）
+	EventConfig     = "config"      // 运行时配置变更，data: NodeRuntimeSettings
+	EventNodeConfig = "node_config" // 期望配置变更（定向），data: DesiredConfig
+	EventCommand    = "command"     // 节点命令（定向），data: []NodeCommand
+)
+
+const (
+	pushHistorySize  = 256              // Master 保留的最近事件数，用于断线续传
+	pushSubBuffer    = 64               // 单个连接的待发送队列，塞满视为连接卡死并断开
+	pushPingInterval = 25 * time.Second // 心跳间隔，防止中间代理断开空闲连接
+	pushIdleTimeout  = 60 * time.Second // 节点超过该时间未收到任何数据即重连
+	pushBackoffBase  = 2 * time.Second
+	pushBackoffMax   = 5 * time.Minute
+)
+
+// PushEvent Master 推送给节点的事件
+// ID 格式为 "<epoch>-<seq>"，epoch 为 Master 启动时间，重启后旧 ID 失效，节点会收到全量快照
+type PushEvent struct {
+	ID     string
+	Type   string
+	NodeID string // 为空表示广播
+	Data   json.RawMessage
+	seq    uint64
+}
+
+// NodeRuntimeSettings 可在线下发、无需重启的节点设置
+type NodeRuntimeSettings struct {
+	LogEnabled *bool `json:"log_enabled,omitempty"`
+}
+
+type pushSub struct {
+	nodeID string
+	ch     chan *PushEvent
+	closed bool
+}
+
+// EventHub Master 端事件分发（SSE）
+type EventHub struct {
+	epoch   string
+	seq     uint64
+	history []*PushEvent
+	subs    map[*pushSub]struct{}
+	mu      sync.Mutex
+	// snapshot 生成节点（重）连接时需要的全量状态事件
+	snapshot func(nodeID string) []*PushEvent
+}
+
+func NewEventHub(snapshot func(nodeID string) []*PushEvent) *EventHub {
+	return &EventHub{
+		epoch:    strconv.FormatInt(time.Now().Unix(), 10),
+		subs:     make(map[*pushSub]struct{}),
+		snapshot: snapshot,
+	}
+}
+
+// newPushEvent 构造未分配 ID 的事件
+func newPushEvent(typ, nodeID string, data interface{}) (*PushEvent, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &PushEvent{Type: typ, NodeID: nodeID, Data: raw}, nil
+}
+
+// Publish 发布事件，nodeID 为空表示广播给所有节点；不会阻塞
+func (h *EventHub) Publish(typ, nodeID string, data interface{}) {
+	ev, err := newPushEvent(typ, nodeID, data)
+	if err != nil {
+		log.Printf("[Push] 序列化事件失败: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	ev.seq = h.seq
+	ev.ID = fmt.Sprintf("%s-%d", h.epoch, h.seq)
+	h.history = append(h.history, ev)
+	if len(h.history) > pushHistorySize {
+		h.history = h.history[len(h.history)-pushHistorySize:]
+	}
+
+	for sub := range h.subs {
+		if ev.NodeID != "" && ev.NodeID != sub.nodeID {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			// 队列已满：断开连接，节点重连时凭 Last-Event-ID 补齐
+			h.closeSub(sub)
+		}
+	}
+}
+
+// subscribe 注册连接，返回需要先发送的事件（断线期间的增量或全量快照）
+func (h *EventHub) subscribe(nodeID, lastEventID string) (*pushSub, []*PushEvent) {
+	sub := &pushSub{nodeID: nodeID, ch: make(chan *PushEvent, pushSubBuffer)}
+
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	backlog, ok := h.backlogLocked(nodeID, lastEventID)
+	seq := h.seq
+	h.mu.Unlock()
+	if ok {
+		return sub, backlog
+	}
+
+	// 无法续传：发送全量快照，ID 取注册时的序号，之后的事件可以正常续传。
+	// 快照在锁外生成（Publish 可能在持有 Store 锁时调用），注册之后发布的事件
+	// 仍会进入队列，最多与快照重复一次，全量事件重复应用没有副作用
+	var events []*PushEvent
+	if h.snapshot != nil {
+		for _, ev := range h.snapshot(nodeID) {
+			ev.seq = seq
+			ev.ID = fmt.Sprintf("%s-%d", h.epoch, seq)
+			events = append(events, ev)
+		}
+	}
+	return sub, events
+}
+
+// backlogLocked 返回 lastEventID 之后发给该节点的事件；ID 过旧或来自上一次启动时返回 false
+func (h *EventHub) backlogLocked(nodeID, lastEventID string) ([]*PushEvent, bool) {
+	epoch, seqStr, ok := strings.Cut(lastEventID, "-")
+	if !ok || epoch != h.epoch {
+		return nil, false
+	}
+	last, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil || last > h.seq {
+		return nil, false
+	}
+	if last < h.seq && (len(h.history) == 0 || h.history[0].seq > last+1) {
+		return nil, false
+	}
+
+	var events []*PushEvent
+	for _, ev := range h.history {
+		if ev.seq > last && (ev.NodeID == "" || ev.NodeID == nodeID) {
+			events = append(events, ev)
+		}
+	}
+	return events, true
+}
+
+func (h *EventHub) unsubscribe(sub *pushSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeSub(sub)
+}
+
+func (h *EventHub) closeSub(sub *pushSub) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(h.subs, sub)
+	close(sub.ch)
+}
+
+// IsConnected 节点当前是否保持推送连接
+func (h *EventHub) IsConnected(nodeID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if sub.nodeID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectedNodes 返回保持推送连接的节点 ID 集合
+func (h *EventHub) ConnectedNodes() map[string]bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := make(map[string]bool, len(h.subs))
+	for sub := range h.subs {
+		result[sub.nodeID] = true
+	}
+	return result
+}
+
+// writeSSE 写入一条 SSE 事件
+func writeSSE(w io.Writer, ev *PushEvent) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data)
+	return err
+}
+
+// handleNodeEvents 节点事件推送长连接（SSE，Token 认证）
+func (h *AdminHandler) handleNodeEvents(w http.ResponseWriter, r *http.Request) {
+	if h.nodeStore == nil || h.events == nil {
+		h.jsonErr(w, "推送仅在 master 模式下可用", 400)
+		return
+	}
+	node := h.authNode(w, r)
+	if node == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.jsonErr(w, "不支持流式响应", 500)
+		return
+	}
+	// 长连接不受管理面板 WriteTimeout 限制
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sub, initial := h.events.subscribe(node.ID, r.Header.Get("Last-Event-ID"))
+	defer h.events.unsubscribe(sub)
+	log.Printf("[Push] 节点 %s 已连接", node.Name)
+	defer log.Printf("[Push] 节点 %s 已断开", node.Name)
+
+	for _, ev := range initial {
+		if writeSSE(w, ev) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(pushPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if writeSSE(w, ev) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ping.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleNodeRuntimeSettings 在线修改单个节点的运行时设置，通过推送通道下发
+func (h *AdminHandler) handleNodeRuntimeSettings(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil || h.events == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	node, err := h.nodeStore.GetNode(id)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	var req NodeRuntimeSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	if req.LogEnabled == nil {
+		h.jsonErr(w, "没有需要下发的设置", 400)
+		return
+	}
+
+	h.events.Publish(EventConfig, node.ID, req)
+	connected := h.events.IsConnected(node.ID)
+	log.Printf("[Push] 运行时设置已下发到 %s（在线: %v）", node.Name, connected)
+	h.jsonOK(w, map[string]interface{}{
+		"status":    "ok",
+		"delivered": connected,
+	})
+}
+
+// ============================================================
+// 节点端
+// ============================================================
+
+// PushClient 节点端推送连接：保持到 Master 的 SSE 长连接，断线后退避重连并凭 Last-Event-ID 续传
+type PushClient struct {
+	cfg         *Config
+	link        *MasterLink
+	reporter    *Reporter
+	client      *http.Client
+	lastEventID string
+	failures    int
+}
+
+func NewPushClient(cfg *Config, link *MasterLink, reporter *Reporter) *PushClient {
+	return &PushClient{
+		cfg:      cfg,
+		link:     link,
+		reporter: reporter,
+		// 长连接不设整体超时，由 pushIdleTimeout 检测假死
+		client: link.Client(0),
+	}
+}
+
+// Start 保持推送连接，旧版 Master 没有该接口时按最大间隔重试
+func (pc *PushClient) Start() {
+	for {
+		received, err := pc.connect()
+		if received {
+			pc.failures = 0
+		}
+		pc.failures++
+		delay := backoffDelay(pc.failures, pushBackoffBase, pushBackoffMax)
+		log.Printf("[Push] 推送连接断开: %v，%s 后重连", err, delay.Round(time.Second))
+		time.Sleep(delay)
+	}
+}
+
+// connect 建立一次连接并处理事件，返回期间是否收到过事件
+func (pc *PushClient) connect() (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := pc.link.NewRequest(ctx, "GET", "/api/node/events", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if pc.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", pc.lastEventID)
+	}
+
+	resp, err := pc.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnauthorized {
+			// 旧版 Master 或令牌失效，不必频繁重试
+			pc.failures = 100
+		}
+		return false, fmt.Errorf("Master 返回 %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	master := pc.link.ActiveMaster()
+	log.Printf("[Push] 已连接 Master 推送通道 %s", master)
+
+	// 空闲检测：超时未收到任何数据（含心跳）则断开重连
+	idle := time.AfterFunc(pushIdleTimeout, cancel)
+	defer idle.Stop()
+
+	received := false
+	var ev PushEvent
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), reportMaxDecodedBytes)
+	for scanner.Scan() {
+		idle.Reset(pushIdleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if ev.Type != "" || data.Len() > 0 {
+				ev.Data = json.RawMessage(data.String())
+				pc.apply(&ev)
+				if ev.ID != "" {
+					pc.lastEventID = ev.ID
+				}
+				received = true
+			}
+			ev = PushEvent{}
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// 注释 / 心跳；上报已切换到其他 Master 时跟随重连
+			if active := pc.link.ActiveMaster(); active != master {
+				return received, fmt.Errorf("上报已切换到 Master %s", active)
+			}
+		case strings.HasPrefix(line, "id:"):
+			ev.ID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "event:"):
+			ev.Type = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return received, err
+	}
+	return received, io.EOF
+}
+
+// apply 在内存中应用一条事件
+func (pc *PushClient) apply(ev *PushEvent) {
+	switch ev.Type {
+	case EventWhitelist:
+		var sync WhitelistSync
+		if err := json.Unmarshal(ev.Data, &sync); err != nil {
+			log.Printf("[Push] 白名单事件解析失败: %v", err)
+			return
+		}
+		pc.reporter.syncWhitelist(&sync)
+	case EventConfig:
+		var settings NodeRuntimeSettings
+		if err := json.Unmarshal(ev.Data, &settings); err != nil {
+			log.Printf("[Push] 配置事件解析失败: %v", err)
+			return
+		}
+		if settings.LogEnabled != nil {
+			pc.cfg.SetLogEnabled(*settings.LogEnabled)
+			log.Printf("[Push] 请求日志已%s", map[bool]string{true: "开启", false: "关闭"}[*settings.LogEnabled])
+		}
+	case EventCommand:
+		var commands []NodeCommand
+		if err := json.Unmarshal(ev.Data, &commands); err != nil {
+			log.Printf("[Push] 命令事件解析失败: %v", err)
+			return
+		}
+		if pc.reporter.commands != nil {
+			pc.reporter.commands.Enqueue(commands)
+		}
+	case EventNodeConfig:
+		var desired DesiredConfig
+		if err := json.Unmarshal(ev.Data, &desired); err != nil {
+			log.Printf("[Push] 期望配置事件解析失败: %v", err)
+			return
+		}
+		if pc.reporter.configs != nil {
+			pc.reporter.configs.Apply(&desired)
+		}
+	default:
+		log.Printf("[Push] 忽略未知事件: %s", ev.Type)
+	}
+}
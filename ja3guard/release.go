@@ -0,0 +1,539 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var releaseMaxSize int64 = 256 << 20 // 单个二进制上限
+
+var (
+	releaseVersionRe  = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+_-]{0,63}$`)
+	releasePlatformRe = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+)
+
+func validReleaseVersion(v string) bool {
+	return releaseVersionRe.MatchString(v)
+}
+
+// releaseSignedMessage 签名内容：版本、平台和二进制的 SHA-256 绑定在一起，
+// 防止把某个版本的签名套用到其他版本或平台
+func releaseSignedMessage(version, goos, goarch, sha256hex string) []byte {
+	return []byte("ja3guard-release\n" + version + "\n" + goos + "/" + goarch + "\n" + sha256hex)
+}
+
+// parseReleasePublicKey 解析 base64 编码的 ed25519 公钥
+func parseReleasePublicKey(s string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("release_public_key 格式错误（应为 base64 编码的 ed25519 公钥）")
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// verifyReleaseSignature 校验发布签名
+func verifyReleaseSignature(publicKey, version, goos, goarch, sha256hex, signature string) error {
+	if publicKey == "" {
+		return errors.New("未配置 release_public_key")
+	}
+	pub, err := parseReleasePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("签名格式错误")
+	}
+	if !ed25519.Verify(pub, releaseSignedMessage(version, goos, goarch, sha256hex), sig) {
+		return errors.New("签名校验失败")
+	}
+	return nil
+}
+
+// ReleaseArtifact 某个版本在一个平台上的二进制
+type ReleaseArtifact struct {
+	OS         string `json:"os"`
+	Arch       string `json:"arch"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	Signature  string `json:"signature"` // base64 ed25519 签名，见 releaseSignedMessage
+	UploadedAt string `json:"uploaded_at"`
+}
+
+// Release 一个版本及其各平台的二进制
+type Release struct {
+	Version   string            `json:"version"`
+	Notes     string            `json:"notes,omitempty"`
+	Artifacts []ReleaseArtifact `json:"artifacts"`
+	CreatedAt string            `json:"created_at"`
+}
+
+// ReleaseStore Master 托管的发布版本：索引保存在 data/releases/releases.json，
+// 二进制保存为 data/releases/<version>/<os>_<arch>。二进制不进入存储后端，也不参与主备复制
+type ReleaseStore struct {
+	dir      string
+	mu       sync.RWMutex
+	releases []Release
+}
+
+func NewReleaseStore(dir string) (*ReleaseStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	rs := &ReleaseStore{dir: dir, releases: []Release{}}
+	data, err := os.ReadFile(rs.indexPath())
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &rs.releases); err != nil {
+		return nil, fmt.Errorf("解析 releases.json 失败: %w", err)
+	}
+	return rs, nil
+}
+
+func (rs *ReleaseStore) indexPath() string {
+	return filepath.Join(rs.dir, "releases.json")
+}
+
+func (rs *ReleaseStore) artifactPath(version, goos, goarch string) string {
+	return filepath.Join(rs.dir, version, goos+"_"+goarch)
+}
+
+func (rs *ReleaseStore) saveLocked() error {
+	data, err := json.MarshalIndent(rs.releases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rs.indexPath(), data, 0644)
+}
+
+func (rs *ReleaseStore) findLocked(version string) int {
+	for i, rel := range rs.releases {
+		if rel.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add 保存上传的二进制：边写边计算 SHA-256，签名校验通过后才放入版本目录。
+// 同一版本同一平台重复上传时覆盖
+func (rs *ReleaseStore) Add(publicKey, version, goos, goarch, signature, notes string, body io.Reader) (_ *ReleaseArtifact, err error) {
+	if !validReleaseVersion(version) {
+		return nil, fmt.Errorf("版本号格式错误: %q", version)
+	}
+	if !releasePlatformRe.MatchString(goos) || !releasePlatformRe.MatchString(goarch) {
+		return nil, fmt.Errorf("平台格式错误: %q/%q", goos, goarch)
+	}
+	if publicKey == "" {
+		return nil, errors.New("Master 未配置 release_public_key，拒绝上传")
+	}
+
+	verDir := filepath.Join(rs.dir, version)
+	if err := os.MkdirAll(verDir, 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(verDir) // 新版本上传失败时删除空目录
+		}
+	}()
+	tmp, err := os.CreateTemp(verDir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, releaseMaxSize+1))
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("接收文件失败: %w", err)
+	}
+	if size == 0 {
+		return nil, errors.New("文件为空")
+	}
+	if size > releaseMaxSize {
+		return nil, fmt.Errorf("文件超过 %d MB", releaseMaxSize>>20)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err := verifyReleaseSignature(publicKey, version, goos, goarch, sum, signature); err != nil {
+		return nil, err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err := os.Rename(tmp.Name(), rs.artifactPath(version, goos, goarch)); err != nil {
+		return nil, err
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	art := ReleaseArtifact{
+		OS:         goos,
+		Arch:       goarch,
+		Size:       size,
+		SHA256:     sum,
+		Signature:  strings.TrimSpace(signature),
+		UploadedAt: now,
+	}
+	i := rs.findLocked(version)
+	if i < 0 {
+		rs.releases = append(rs.releases, Release{Version: version, CreatedAt: now})
+		i = len(rs.releases) - 1
+	}
+	rel := &rs.releases[i]
+	if notes != "" {
+		rel.Notes = notes
+	}
+	replaced := false
+	for j := range rel.Artifacts {
+		if rel.Artifacts[j].OS == goos && rel.Artifacts[j].Arch == goarch {
+			rel.Artifacts[j] = art
+			replaced = true
+		}
+	}
+	if !replaced {
+		rel.Artifacts = append(rel.Artifacts, art)
+	}
+	if err := rs.saveLocked(); err != nil {
+		return nil, err
+	}
+	return &art, nil
+}
+
+// Artifact 查找某个版本在指定平台上的二进制，返回元数据和文件路径
+func (rs *ReleaseStore) Artifact(version, goos, goarch string) (*ReleaseArtifact, string, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	i := rs.findLocked(version)
+	if i < 0 {
+		return nil, "", fmt.Errorf("版本不存在: %s", version)
+	}
+	for _, art := range rs.releases[i].Artifacts {
+		if art.OS == goos && art.Arch == goarch {
+			a := art
+			return &a, rs.artifactPath(version, goos, goarch), nil
+		}
+	}
+	return nil, "", fmt.Errorf("版本 %s 没有 %s/%s 的二进制", version, goos, goarch)
+}
+
+// List 返回全部版本，最新上传的在前
+func (rs *ReleaseStore) List() []Release {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	result := make([]Release, len(rs.releases))
+	copy(result, rs.releases)
+	sort.SliceStable(result, func(i, j int) bool { return result[i].CreatedAt > result[j].CreatedAt })
+	return result
+}
+
+// Delete 删除版本及其全部二进制
+func (rs *ReleaseStore) Delete(version string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	i := rs.findLocked(version)
+	if i < 0 {
+		return fmt.Errorf("版本不存在: %s", version)
+	}
+	rs.releases = append(rs.releases[:i], rs.releases[i+1:]...)
+	if err := rs.saveLocked(); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(rs.dir, version))
+}
+
+// ============================================================
+// 升级进度
+// ============================================================
+
+// 节点升级进度
+const (
+	RolloutNone       = "none"        // 未设置目标版本
+	RolloutPending    = "pending"     // 等待节点开始更新
+	RolloutInProgress = "in_progress" // 下载或验证中
+	RolloutDone       = "done"        // 已运行目标版本
+	RolloutFailed     = "failed"      // 更新失败或已回滚
+)
+
+// RolloutNode 单个节点的升级进度
+type RolloutNode struct {
+	NodeID   string        `json:"node_id"`
+	Name     string        `json:"name"`
+	Online   bool          `json:"online"`
+	Platform string        `json:"platform,omitempty"`
+	Version  string        `json:"version,omitempty"`
+	Target   string        `json:"target,omitempty"`
+	State    string        `json:"state"`
+	Error    string        `json:"error,omitempty"`
+	Update   *UpdateStatus `json:"update,omitempty"`
+}
+
+// rolloutState 根据节点上报的版本和更新状态判断升级进度
+func rolloutState(st *NodeStatus, target string) (string, string) {
+	switch {
+	case target == "":
+		return RolloutNone, ""
+	case st == nil:
+		return RolloutPending, "节点尚未上报"
+	case st.Version == target:
+		return RolloutDone, ""
+	}
+	u := st.Update
+	if u == nil || u.Target != target {
+		if st.Platform == "" {
+			return RolloutPending, "节点版本过旧，不支持自动更新"
+		}
+		return RolloutPending, ""
+	}
+	switch u.State {
+	case UpdateDownloading, UpdateVerifying:
+		return RolloutInProgress, ""
+	case UpdateFailed, UpdateRolledBack:
+		if u.RetryAt != "" {
+			return RolloutPending, u.Error
+		}
+		return RolloutFailed, u.Error
+	}
+	return RolloutPending, u.Error
+}
+
+// ============================================================
+// Master API
+// ============================================================
+
+// handleReleaseList 版本列表
+func (h *AdminHandler) handleReleaseList(w http.ResponseWriter, r *http.Request) {
+	if h.releases == nil {
+		h.jsonErr(w, "发布管理仅在 master 模式下可用", 400)
+		return
+	}
+	h.jsonOK(w, map[string]interface{}{
+		"releases":   h.releases.List(),
+		"public_key": h.cfg.ReleasePublicKey,
+	})
+}
+
+// handleReleaseUpload 上传二进制，请求体为原始文件，版本和签名通过查询参数传递：
+// POST /api/releases?version=1.2.0&os=linux&arch=amd64&signature=<base64>[&notes=...]
+func (h *AdminHandler) handleReleaseUpload(w http.ResponseWriter, r *http.Request) {
+	if h.releases == nil {
+		h.jsonErr(w, "发布管理仅在 master 模式下可用", 400)
+		return
+	}
+	// 上传大文件需要超过管理面板默认的 30 秒读超时
+	http.NewResponseController(w).SetReadDeadline(time.Now().Add(10 * time.Minute))
+	q := r.URL.Query()
+	version := strings.TrimSpace(q.Get("version"))
+	art, err := h.releases.Add(h.cfg.ReleasePublicKey, version, q.Get("os"), q.Get("arch"), q.Get("signature"), q.Get("notes"),
+		http.MaxBytesReader(w, r.Body, releaseMaxSize+1))
+	if err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	log.Printf("[Release] 已上传版本 %s（%s/%s，%d KB）", version, art.OS, art.Arch, art.Size>>10)
+	h.jsonOK(w, map[string]interface{}{"status": "ok", "version": version, "artifact": art})
+}
+
+// handleReleaseDelete 删除版本
+func (h *AdminHandler) handleReleaseDelete(w http.ResponseWriter, r *http.Request, version string) {
+	if h.releases == nil {
+		h.jsonErr(w, "发布管理仅在 master 模式下可用", 400)
+		return
+	}
+	if err := h.releases.Delete(version); err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	log.Printf("[Release] 已删除版本 %s", version)
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+// handleReleaseRollout 各节点的目标版本与升级进度，目标版本由期望配置的 target_version 决定
+func (h *AdminHandler) handleReleaseRollout(w http.ResponseWriter, r *http.Request) {
+	if h.releases == nil || h.configs == nil {
+		h.jsonErr(w, "发布管理仅在 master 模式下可用", 400)
+		return
+	}
+	nodes := []RolloutNode{}
+	summary := map[string]map[string]int{} // 目标版本 -> 进度 -> 节点数
+	for _, node := range h.nodeStore.Nodes() {
+		node := node
+		st := h.nodeStore.GetStatus(node.ID)
+		target := ""
+		if desired := h.resolveNodeConfig(&node); desired != nil && desired.Spec.TargetVersion != nil {
+			target = *desired.Spec.TargetVersion
+		}
+		state, errMsg := rolloutState(st, target)
+		rn := RolloutNode{NodeID: node.ID, Name: node.Name, Target: target, State: state, Error: errMsg}
+		if st != nil {
+			rn.Online, rn.Platform, rn.Version, rn.Update = st.Online, st.Platform, st.Version, st.Update
+		}
+		// 还在等待的节点如果没有对应平台的二进制，提示先上传
+		if state == RolloutPending && errMsg == "" && rn.Platform != "" {
+			goos, goarch, _ := strings.Cut(rn.Platform, "/")
+			if _, _, err := h.releases.Artifact(target, goos, goarch); err != nil {
+				rn.Error = err.Error()
+			}
+		}
+		nodes = append(nodes, rn)
+		if target != "" {
+			if summary[target] == nil {
+				summary[target] = map[string]int{}
+			}
+			summary[target][state]++
+		}
+	}
+	h.jsonOK(w, map[string]interface{}{"nodes": nodes, "summary": summary})
+}
+
+// handleNodeRelease 节点查询目标版本的元数据（SHA-256 与签名），Token 或证书认证
+func (h *AdminHandler) handleNodeRelease(w http.ResponseWriter, r *http.Request) {
+	if h.releases == nil {
+		h.jsonErr(w, "仅在 master 模式下可用", 400)
+		return
+	}
+	if h.authNode(w, r) == nil {
+		return
+	}
+	q := r.URL.Query()
+	art, _, err := h.releases.Artifact(q.Get("version"), q.Get("os"), q.Get("arch"))
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	h.jsonOK(w, map[string]interface{}{"version": q.Get("version"), "artifact": art})
+}
+
+// handleNodeReleaseDownload 节点下载二进制，Token 或证书认证
+func (h *AdminHandler) handleNodeReleaseDownload(w http.ResponseWriter, r *http.Request) {
+	if h.releases == nil {
+		h.jsonErr(w, "仅在 master 模式下可用", 400)
+		return
+	}
+	node := h.authNode(w, r)
+	if node == nil {
+		return
+	}
+	q := r.URL.Query()
+	_, path, err := h.releases.Artifact(q.Get("version"), q.Get("os"), q.Get("arch"))
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		h.jsonErr(w, err.Error(), 500)
+		return
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(10 * time.Minute))
+	log.Printf("[Release] 节点 %s 下载版本 %s（%s/%s）", node.Name, q.Get("version"), q.Get("os"), q.Get("arch"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// ============================================================
+// 命令行：生成密钥与签名
+// ============================================================
+
+// runRelease 发布签名工具
+//
+//	ja3guard release keygen -out release.key
+//	ja3guard release sign -key release.key -version 1.2.0 [-os linux -arch amd64] ja3guard-linux-amd64
+//
+// 私钥只应保存在构建机上；公钥写入 Master 和节点配置的 release_public_key。
+func runRelease(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "用法: ja3guard release keygen|sign ...")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "keygen":
+		fs := flag.NewFlagSet("release keygen", flag.ExitOnError)
+		out := fs.String("out", "release.key", "私钥输出路径")
+		fs.Parse(args[1:])
+
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("生成密钥失败: %v", err)
+		}
+		seed := base64.StdEncoding.EncodeToString(priv.Seed())
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalf("写入私钥失败: %v", err)
+		}
+		if _, err := fmt.Fprintln(f, seed); err != nil {
+			log.Fatalf("写入私钥失败: %v", err)
+		}
+		f.Close()
+		fmt.Fprintf(os.Stderr, "私钥已写入 %s，请妥善保管\n", *out)
+		fmt.Println(base64.StdEncoding.EncodeToString(pub))
+
+	case "sign":
+		fs := flag.NewFlagSet("release sign", flag.ExitOnError)
+		keyPath := fs.String("key", "release.key", "私钥路径")
+		version := fs.String("version", "", "版本号（必须与二进制 -version 输出一致）")
+		goos := fs.String("os", "linux", "目标系统")
+		goarch := fs.String("arch", "amd64", "目标架构")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 || !validReleaseVersion(*version) {
+			fmt.Fprintln(os.Stderr, "用法: ja3guard release sign -key release.key -version 1.2.0 [-os linux -arch amd64] <二进制文件>")
+			os.Exit(2)
+		}
+
+		data, err := os.ReadFile(*keyPath)
+		if err != nil {
+			log.Fatalf("读取私钥失败: %v", err)
+		}
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			log.Fatalf("私钥格式错误")
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("打开文件失败: %v", err)
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err != nil {
+			log.Fatalf("读取文件失败: %v", err)
+		}
+		f.Close()
+		sum := hex.EncodeToString(hash.Sum(nil))
+		sig := ed25519.Sign(ed25519.NewKeyFromSeed(seed), releaseSignedMessage(*version, *goos, *goarch, sum))
+		fmt.Fprintf(os.Stderr, "%s %s/%s sha256=%s\n", *version, *goos, *goarch, sum)
+		fmt.Println(base64.StdEncoding.EncodeToString(sig))
+
+	default:
+		fmt.Fprintf(os.Stderr, "未知子命令: %s\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestReleaseKey(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(pub), priv
+}
+
+func signRelease(priv ed25519.PrivateKey, version, goos, goarch string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, releaseSignedMessage(version, goos, goarch, hex.EncodeToString(sum[:]))))
+}
+
+func TestReleaseSignedMessageFormat(t *testing.T) {
+	// 签名格式变化会使已发布版本的签名全部失效
+	got := string(releaseSignedMessage("1.2.0", "linux", "amd64", "abc"))
+	if want := "ja3guard-release\n1.2.0\nlinux/amd64\nabc"; got != want {
+		t.Fatalf("签名内容 = %q, want %q", got, want)
+	}
+}
+
+func TestVerifyReleaseSignature(t *testing.T) {
+	pub, priv := newTestReleaseKey(t)
+	otherPub, _ := newTestReleaseKey(t)
+	data := []byte("binary")
+	sum := sha256.Sum256(data)
+	sha := hex.EncodeToString(sum[:])
+	sig := signRelease(priv, "1.2.0", "linux", "amd64", data)
+
+	for _, tc := range []struct {
+		name                   string
+		pub, version, os, arch string
+		sha, sig               string
+		ok                     bool
+	}{
+		{"有效", pub, "1.2.0", "linux", "amd64", sha, sig, true},
+		{"挪用到其他版本", pub, "1.2.1", "linux", "amd64", sha, sig, false},
+		{"挪用到其他系统", pub, "1.2.0", "darwin", "amd64", sha, sig, false},
+		{"挪用到其他架构", pub, "1.2.0", "linux", "arm64", sha, sig, false},
+		{"二进制不同", pub, "1.2.0", "linux", "amd64", hex.EncodeToString(make([]byte, 32)), sig, false},
+		{"其他密钥", otherPub, "1.2.0", "linux", "amd64", sha, sig, false},
+		{"公钥格式错误", "bm90LWEta2V5", "1.2.0", "linux", "amd64", sha, sig, false},
+		{"未配置公钥", "", "1.2.0", "linux", "amd64", sha, sig, false},
+		{"签名格式错误", pub, "1.2.0", "linux", "amd64", sha, "!!", false},
+		{"签名长度错误", pub, "1.2.0", "linux", "amd64", sha, base64.StdEncoding.EncodeToString([]byte("short")), false},
+	} {
+		err := verifyReleaseSignature(tc.pub, tc.version, tc.os, tc.arch, tc.sha, tc.sig)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+// assertNoUploadTemp 版本目录中不应残留上传临时文件
+func assertNoUploadTemp(t *testing.T, dir string) {
+	t.Helper()
+	matches, _ := filepath.Glob(filepath.Join(dir, "*", ".upload-*"))
+	if len(matches) > 0 {
+		t.Fatalf("残留临时文件: %v", matches)
+	}
+}
+
+func TestReleaseStoreAdd(t *testing.T) {
+	pub, priv := newTestReleaseKey(t)
+	dir := t.TempDir()
+	rs, err := NewReleaseStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("ja3guard-binary")
+
+	art, err := rs.Add(pub, "1.2.0", "linux", "amd64", signRelease(priv, "1.2.0", "linux", "amd64", data), "notes", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, path, err := rs.Artifact("1.2.0", "linux", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) || art.Size != int64(len(data)) {
+		t.Fatalf("保存的二进制不正确: %q, %+v", got, art)
+	}
+
+	// 新版本上传失败：不留下版本目录和临时文件
+	for _, tc := range []struct {
+		name, pub, version, sig string
+		body                    []byte
+	}{
+		{"签名属于其他版本", pub, "1.3.0", signRelease(priv, "1.2.0", "linux", "amd64", data), data},
+		{"签名与内容不符", pub, "1.3.0", signRelease(priv, "1.3.0", "linux", "amd64", data), []byte("tampered")},
+		{"未配置公钥", "", "1.3.0", signRelease(priv, "1.3.0", "linux", "amd64", data), data},
+		{"空文件", pub, "1.3.0", signRelease(priv, "1.3.0", "linux", "amd64", nil), nil},
+		{"版本号格式错误", pub, "../1.3.0", signRelease(priv, "../1.3.0", "linux", "amd64", data), data},
+	} {
+		if _, err := rs.Add(tc.pub, tc.version, "linux", "amd64", tc.sig, "", bytes.NewReader(tc.body)); err == nil {
+			t.Errorf("%s: 应拒绝上传", tc.name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1.3.0")); !os.IsNotExist(err) {
+		t.Fatalf("上传失败的新版本目录应被删除: %v", err)
+	}
+
+	// 已有版本上传失败：原二进制保持不变
+	if _, err := rs.Add(pub, "1.2.0", "linux", "amd64", signRelease(priv, "1.2.0", "linux", "arm64", data), "", bytes.NewReader(data)); err == nil {
+		t.Fatal("签名属于其他平台时应拒绝上传")
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("上传失败不应影响已有的二进制")
+	}
+	assertNoUploadTemp(t, dir)
+
+	// 重新加载索引
+	reloaded, err := NewReleaseStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reloaded.List(); len(list) != 1 || list[0].Version != "1.2.0" || list[0].Notes != "notes" {
+		t.Fatalf("重新加载的版本列表 = %+v", list)
+	}
+}
+
+func TestReleaseStoreRejectsOversize(t *testing.T) {
+	defer func(n int64) { releaseMaxSize = n }(releaseMaxSize)
+	releaseMaxSize = 16
+
+	pub, priv := newTestReleaseKey(t)
+	dir := t.TempDir()
+	rs, err := NewReleaseStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), 17)
+	if _, err := rs.Add(pub, "1.2.0", "linux", "amd64", signRelease(priv, "1.2.0", "linux", "amd64", data), "", bytes.NewReader(data)); err == nil {
+		t.Fatal("超过大小上限时应拒绝上传")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1.2.0")); !os.IsNotExist(err) {
+		t.Fatalf("超限的上传不应留下版本目录: %v", err)
+	}
+	if list := rs.List(); len(list) != 0 {
+		t.Fatalf("超限的上传不应出现在版本列表: %+v", list)
+	}
+
+	data = data[:16]
+	if _, err := rs.Add(pub, "1.2.0", "linux", "amd64", signRelease(priv, "1.2.0", "linux", "amd64", data), "", bytes.NewReader(data)); err != nil {
+		t.Fatalf("正好达到上限时应接受: %v", err)
+	}
+	assertNoUploadTemp(t, dir)
+}
+
+func TestRolloutState(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		st     *NodeStatus
+		target string
+		want   string
+	}{
+		{"未设置目标", &NodeStatus{Version: "1.0.0"}, "", RolloutNone},
+		{"未上报", nil, "1.2.0", RolloutPending},
+		{"已是目标版本", &NodeStatus{Version: "1.2.0"}, "1.2.0", RolloutDone},
+		{"旧版节点", &NodeStatus{Version: "1.0.0"}, "1.2.0", RolloutPending},
+		{"尚未开始", &NodeStatus{Version: "1.0.0", Platform: "linux/amd64"}, "1.2.0", RolloutPending},
+		{"上一个目标的状态", &NodeStatus{Version: "1.0.0", Platform: "linux/amd64",
+			Update: &UpdateStatus{State: UpdateFailed, Target: "1.1.0"}}, "1.2.0", RolloutPending},
+		{"下载中", &NodeStatus{Version: "1.0.0", Platform: "linux/amd64",
+			Update: &UpdateStatus{State: UpdateDownloading, Target: "1.2.0"}}, "1.2.0", RolloutInProgress},
+		{"验证中", &NodeStatus{Version: "1.0.0", Platform: "linux/amd64",
+			Update: &UpdateStatus{State: UpdateVerifying, Target: "1.2.0"}}, "1.2.0", RolloutInProgress},
+		{"可重试的失败", &NodeStatus{Version: "1.0.0", Platform: "linux/amd64",
+			Update: &UpdateStatus{State: UpdateFailed, Target: "1.2.0", RetryAt: "2026-01-01 00:00:00"}}, "1.2.0", RolloutPending},
+		{"失败", &NodeStatus{Version: "1.0.0", Platform: "linux/amd64",
+			Update: &UpdateStatus{State: UpdateFailed, Target: "1.2.0", Error: "签名校验失败"}}, "1.2.0", RolloutFailed},
+		{"已回滚", &NodeStatus{Version: "1.0.0", Platform: "linux/amd64",
+			Update: &UpdateStatus{State: UpdateRolledBack, Target: "1.2.0"}}, "1.2.0", RolloutFailed},
+	} {
+		if got, _ := rolloutState(tc.st, tc.target); got != tc.want {
+			t.Errorf("%s: rolloutState = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
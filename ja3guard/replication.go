@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicationSnapshot 主 Master 提供给备用 Master 的状态：白名单（按版本增量）、节点、共享凭据和配置层。
+// 日志、节点运行状态和加入令牌不复制，各 Master 只保存自己收到的部分
+type ReplicationSnapshot struct {
+	Whitelist   *WhitelistSync      `json:"whitelist"`
+	Nodes       []NodeInfo          `json:"nodes"`
+	Credentials []CredentialProfile `json:"credential_profiles"`
+	Users       []User              `json:"users"` // 管理面板用户（密码为 bcrypt 哈希），故障切换后可直接登录
+	NodeConfigs *NodeConfigState    `json:"node_configs"`
+	GeneratedAt string              `json:"generated_at"`
+}
+
+// Replicator 备用 Master 定时从 replicate_from 拉取状态。
+// 复制期间修改白名单、节点、配置层的管理接口返回 409，提升为主 Master 后停止复制
+type Replicator struct {
+	h        *AdminHandler
+	from     string
+	client   *http.Client
+	mu       sync.Mutex
+	promoted bool
+	synced   bool // 本次启动后白名单是否已全量同步，之前的本地版本号与主 Master 无关
+	lastSync string
+	lastErr  string
+}
+
+func NewReplicator(h *AdminHandler) *Replicator {
+	return &Replicator{
+		h:      h,
+		from:   strings.TrimRight(h.cfg.ReplicateFrom, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Start 按 replication_interval 循环复制，直到提升为主 Master
+func (rep *Replicator) Start() {
+	interval := time.Duration(rep.h.cfg.ReplicationInterval) * time.Second
+	if interval < time.Second {
+		interval = 10 * time.Second
+	}
+	log.Printf("[Replication] 备用 Master，从 %s 复制，间隔 %s", rep.from, interval)
+	for rep.Standby() {
+		err := rep.syncOnce()
+
+		rep.mu.Lock()
+		if err != nil {
+			if msg := err.Error(); msg != rep.lastErr {
+				log.Printf("[Replication] 复制失败: %v", err)
+				rep.lastErr = msg
+			}
+		} else {
+			if rep.lastErr != "" {
+				log.Printf("[Replication] 已恢复复制")
+			}
+			rep.lastErr = ""
+			rep.lastSync = time.Now().Format("2006-01-02 15:04:05")
+		}
+		rep.mu.Unlock()
+
+		time.Sleep(interval)
+	}
+}
+
+// Standby 是否仍处于复制状态
+func (rep *Replicator) Standby() bool {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return !rep.promoted
+}
+
+// Promote 停止复制，本机成为主 Master
+func (rep *Replicator) Promote() {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.promoted = true
+}
+
+// Status 复制状态
+func (rep *Replicator) Status() map[string]interface{} {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return map[string]interface{}{
+		"replicate_from": rep.from,
+		"last_sync":      rep.lastSync,
+		"last_error":     rep.lastErr,
+	}
+}
+
+func (rep *Replicator) syncOnce() error {
+	h := rep.h
+	rep.mu.Lock()
+	version := int64(0)
+	if rep.synced {
+		version = h.store.WhitelistVersion()
+	}
+	rep.mu.Unlock()
+
+	req, err := http.NewRequest("GET", rep.from+"/api/replication/snapshot?whitelist_version="+strconv.FormatInt(version, 10), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.cfg.ReplicationSecret)
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, reportMaxDecodedBytes))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("主 Master 返回 %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var snap ReplicationSnapshot
+	if err := json.Unmarshal(body, &snap); err != nil {
+		return err
+	}
+
+	// 复制期间可能已被提升，提升后不再覆盖本地状态
+	if !rep.Standby() {
+		return nil
+	}
+
+	if snap.Whitelist != nil {
+		changed, err := h.store.ReplicateWhitelist(snap.Whitelist)
+		if err == errWhitelistVersionMismatch {
+			rep.mu.Lock()
+			rep.synced = false
+			rep.mu.Unlock()
+			return fmt.Errorf("白名单增量与本地版本 %d 不符，下次全量复制", h.store.WhitelistVersion())
+		}
+		if err != nil {
+			return fmt.Errorf("复制白名单失败: %w", err)
+		}
+		rep.mu.Lock()
+		rep.synced = true
+		rep.mu.Unlock()
+		if changed {
+			log.Printf("[Replication] 白名单已复制（%s），版本 %d", snap.Whitelist.Mode, h.store.WhitelistVersion())
+			h.events.Publish(EventWhitelist, "", snap.Whitelist)
+		}
+	}
+
+	// 旧版主 Master 的快照没有共享凭据，保留本地的
+	if snap.Credentials != nil {
+		changed, err := h.nodeStore.ReplaceCredentialProfiles(snap.Credentials)
+		if err != nil {
+			return fmt.Errorf("复制共享凭据失败: %w", err)
+		}
+		if changed {
+			log.Printf("[Replication] 共享凭据已复制，共 %d 个", len(snap.Credentials))
+		}
+	}
+	if changed, err := h.users.ReplaceUsers(snap.Users); err != nil {
+		return fmt.Errorf("复制管理面板用户失败: %w", err)
+	} else if changed {
+		log.Printf("[Replication] 管理面板用户已复制，共 %d 个", len(snap.Users))
+	}
+	nodesChanged, err := h.nodeStore.ReplaceNodes(snap.Nodes)
+	if err != nil {
+		return fmt.Errorf("复制节点失败: %w", err)
+	}
+	configsChanged := false
+	if snap.NodeConfigs != nil && h.configs != nil {
+		if configsChanged, err = h.configs.ReplaceState(snap.NodeConfigs); err != nil {
+			return fmt.Errorf("复制节点配置失败: %w", err)
+		}
+	}
+	if nodesChanged {
+		log.Printf("[Replication] 节点列表已复制，共 %d 个", len(snap.Nodes))
+	}
+	if nodesChanged || configsChanged {
+		h.publishNodeConfigs()
+	}
+	return nil
+}
+
+// replicatedWrite 请求是否会修改复制的状态（白名单、节点、共享凭据、配置层、用户），备用 Master 上拒绝。
+// SSH 测试 / 执行、运行时设置和节点命令不修改这些状态，仍然允许
+func replicatedWrite(path, method string) bool {
+	if method == http.MethodGet {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(path, "api/whitelist"), strings.HasPrefix(path, "api/node-configs"),
+		strings.HasPrefix(path, "api/join-tokens"), strings.HasPrefix(path, "api/credentials"), path == "api/nodes",
+		strings.HasPrefix(path, "api/users"), path == "api/me/password":
+		return true
+	case strings.HasPrefix(path, "api/nodes/"):
+		return !strings.HasSuffix(path, "/ssh/test") && !strings.HasSuffix(path, "/ssh/exec") &&
+			!strings.HasSuffix(path, "/files") && !strings.HasSuffix(path, "/settings") &&
+			!strings.Contains(path, "/commands")
+	}
+	return false
+}
+
+// handleReplicationSnapshot 备用 Master 拉取状态，使用 replication_secret 认证
+func (h *AdminHandler) handleReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	if h.nodeStore == nil || h.cfg.ReplicationSecret == "" {
+		h.jsonErr(w, "未启用主备复制（replication_secret）", 404)
+		return
+	}
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(h.cfg.ReplicationSecret)) != 1 {
+		h.jsonErr(w, "无效的复制密钥", 401)
+		return
+	}
+	version, _ := strconv.ParseInt(r.URL.Query().Get("whitelist_version"), 10, 64)
+	snap := ReplicationSnapshot{
+		Whitelist:   h.store.WhitelistSince(version),
+		Nodes:       h.nodeStore.SealedNodes(),
+		Credentials: h.nodeStore.SealedCredentialProfiles(),
+		Users:       h.users.Users(),
+		GeneratedAt: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if h.configs != nil {
+		snap.NodeConfigs = h.configs.State()
+	}
+	h.jsonOK(w, snap)
+}
+
+// handleReplicationStatus 本机的主备角色和复制状态
+func (h *AdminHandler) handleReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{
+		"role":               "primary",
+		"replication_secret": h.cfg.ReplicationSecret != "",
+		"whitelist_version":  h.store.WhitelistVersion(),
+	}
+	if h.replica != nil {
+		for k, v := range h.replica.Status() {
+			status[k] = v
+		}
+		if h.replica.Standby() {
+			status["role"] = "standby"
+		}
+	}
+	h.jsonOK(w, status)
+}
+
+// handleReplicationPromote 备用 Master 停止复制并成为主 Master，replicate_from 从配置文件中清除
+func (h *AdminHandler) handleReplicationPromote(w http.ResponseWriter, r *http.Request) {
+	if h.replica == nil || !h.replica.Standby() {
+		h.jsonErr(w, "本机不是备用 Master", 400)
+		return
+	}
+	if err := h.cfg.UpdateFile(map[string]interface{}{"replicate_from": ""}, false); err != nil {
+		h.jsonErr(w, "保存配置失败: "+err.Error(), 500)
+		return
+	}
+	h.replica.Promote()
+	log.Printf("[Replication] 已提升为主 Master，停止从 %s 复制", h.cfg.ReplicateFrom)
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 上报协议版本
+//
+//	1: 旧版节点，单个未压缩 JSON，无 protocol 字段
+//	2: 带 protocol/batch_id/page/more 字段，请求体可 gzip/zstd 压缩
+const ReportProtocolVersion = 2
+
+// Master 端上报限制
+const (
+	reportMaxBodyBytes    = 8 << 20  // 压缩后请求体上限
+	reportMaxDecodedBytes = 64 << 20 // 解压后上限，防止压缩炸弹
+	reportMaxLogsPerPage  = 1000     // 单页日志条数上限
+)
+
+// 协商用 HTTP 头
+const (
+	headerReportProtocol = "X-JA3-Report-Protocol"        // 双方支持的最高协议版本
+	headerReportEncoding = "X-JA3-Report-Accept-Encoding" // Master 可解码的请求体压缩方式
+	headerReportMaxLogs  = "X-JA3-Report-Max-Logs"        // Master 单页日志上限
+)
+
+// 支持的请求体编码，按优先级排序
+var reportEncodings = []string{"zstd", "gzip"}
+
+// NodeReport 节点上报内容
+type NodeReport struct {
+	Protocol      int        `json:"protocol,omitempty"`
+	Version       string     `json:"version"`
+	Uptime        int64      `json:"uptime"`
+	TotalRequests int        `json:"total_requests"`
+	TrustedCount  int        `json:"trusted_count"`
+	BlockedCount  int        `json:"blocked_count"`
+	Domain        string     `json:"domain"`
+	Upstream      string     `json:"upstream"`
+	BatchID       string     `json:"batch_id,omitempty"`
+	Page          int        `json:"page,omitempty"` // 本轮上报的页码（从 1 开始）
+	More          bool       `json:"more,omitempty"` // 后面还有积压的页
+	Logs          []LogEntry `json:"logs"`
+	// 节点当前的白名单版本（0 表示未知）；旧版节点不带该字段，Master 返回全量 whitelist
+	WhitelistVersion *int64 `json:"whitelist_version,omitempty"`
+	// 节点已应用的期望配置版本（0 表示从未应用）和实际生效的配置；旧版节点不带这些字段
+	ConfigVersion *int64          `json:"config_version,omitempty"`
+	Config        *NodeConfigSpec `json:"config,omitempty"`
+	ConfigError   string          `json:"config_error,omitempty"`
+	// 节点健康指标，每轮上报只在第一页携带；旧版节点不带该字段
+	Health *NodeHealth `json:"health,omitempty"`
+	// 节点支持命令队列；命令执行结果只在第一页携带
+	Commands       bool            `json:"commands,omitempty"`
+	CommandResults []CommandResult `json:"command_results,omitempty"`
+	// 节点平台（os/arch）和自动更新状态；不支持自动更新的旧版节点不带这些字段
+	Platform string        `json:"platform,omitempty"`
+	Update   *UpdateStatus `json:"update,omitempty"`
+}
+
+// ReportCapabilities Master 通过响应头告知节点的能力
+// 旧版 Master 不返回这些头，节点按协议 1、不压缩处理
+type ReportCapabilities struct {
+	Protocol  int
+	Encodings []string
+	MaxLogs   int
+}
+
+// legacyReportCapabilities 旧版 Master 的能力
+func legacyReportCapabilities() ReportCapabilities {
+	return ReportCapabilities{Protocol: 1, MaxLogs: reportBatchSize}
+}
+
+// setReportCapabilityHeaders Master 在上报响应中声明能力
+func setReportCapabilityHeaders(h http.Header) {
+	h.Set(headerReportProtocol, strconv.Itoa(ReportProtocolVersion))
+	h.Set(headerReportEncoding, strings.Join(reportEncodings, ", "))
+	h.Set(headerReportMaxLogs, strconv.Itoa(reportMaxLogsPerPage))
+}
+
+// parseReportCapabilities 节点从 Master 响应头解析能力
+func parseReportCapabilities(h http.Header) ReportCapabilities {
+	caps := legacyReportCapabilities()
+	v, err := strconv.Atoi(h.Get(headerReportProtocol))
+	if err != nil || v < 2 {
+		return caps
+	}
+	caps.Protocol = v
+	if caps.Protocol > ReportProtocolVersion {
+		caps.Protocol = ReportProtocolVersion
+	}
+	for _, enc := range strings.Split(h.Get(headerReportEncoding), ",") {
+		enc = strings.TrimSpace(enc)
+		for _, ours := range reportEncodings {
+			if enc == ours {
+				caps.Encodings = append(caps.Encodings, enc)
+			}
+		}
+	}
+	if n, err := strconv.Atoi(h.Get(headerReportMaxLogs)); err == nil && n > 0 && n < caps.MaxLogs {
+		caps.MaxLogs = n
+	}
+	return caps
+}
+
+// PreferredEncoding 选择双方都支持的最优压缩方式，没有则返回 ""
+func (c ReportCapabilities) PreferredEncoding() string {
+	for _, ours := range reportEncodings {
+		for _, enc := range c.Encodings {
+			if enc == ours {
+				return enc
+			}
+		}
+	}
+	return ""
+}
+
+// encodeReportBody 序列化并按指定方式压缩上报内容
+func encodeReportBody(report *NodeReport, encoding string) ([]byte, error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	switch encoding {
+	case "":
+		return data, nil
+	case "gzip":
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(data); err != nil {
+			zw.Close()
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("不支持的压缩方式: %s", encoding)
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	errReportTooLarge     = errors.New("上报内容超出大小限制")
+	errReportBadEncoding  = errors.New("不支持的 Content-Encoding")
+	errReportTooManyLogs  = fmt.Errorf("单页日志超过 %d 条", reportMaxLogsPerPage)
+	errReportNewerVersion = fmt.Errorf("上报协议版本高于 Master 支持的 %d", ReportProtocolVersion)
+)
+
+// decodeNodeReport 读取并解析上报请求，兼容旧版节点（未压缩、无 protocol 字段）
+func decodeNodeReport(w http.ResponseWriter, r *http.Request) (*NodeReport, error) {
+	body := http.MaxBytesReader(w, r.Body, reportMaxBodyBytes)
+
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		reader = body
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	case "zstd":
+		zr, err := zstd.NewReader(body, zstd.WithDecoderMaxMemory(reportMaxDecodedBytes))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return nil, errReportBadEncoding
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, reportMaxDecodedBytes+1))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, errReportTooLarge
+		}
+		return nil, err
+	}
+	if len(data) > reportMaxDecodedBytes {
+		return nil, errReportTooLarge
+	}
+
+	var report NodeReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	if report.Protocol == 0 {
+		report.Protocol = 1
+	}
+	if report.Protocol > ReportProtocolVersion {
+		return nil, errReportNewerVersion
+	}
+	if len(report.Logs) > reportMaxLogsPerPage {
+		return nil, errReportTooManyLogs
+	}
+	return &report, nil
+}
+
+// reportErrorStatus 将解析错误映射为 HTTP 状态码
+func reportErrorStatus(err error) int {
+	switch err {
+	case errReportTooLarge, errReportTooManyLogs:
+		return http.StatusRequestEntityTooLarge
+	case errReportBadEncoding:
+		return http.StatusUnsupportedMediaType
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -2,97 +2,400 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	mrand "math/rand"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-const Version = "1.0.0"
+// Version 程序版本，发布时通过 -ldflags "-X main.Version=x.y.z" 设置
+var Version = "1.0.0"
+
+const (
+	reportBatchSize   = 500             // 单批最多日志条数
+	reportBackoffBase = 5 * time.Second // 首次重试间隔
+	reportBackoffMax  = 5 * time.Minute // 最大重试间隔
+)
 
 // Reporter 节点上报客户端
+// 日志进度由持久化游标（data/report_cursor.json）记录，只有 Master 确认收到
+// 或批次已写入离线缓存后游标才前进；Master 不可达时按指数退避 + 抖动重试。
 type Reporter struct {
 	cfg       *Config
 	store     *Store
+	link      *MasterLink
 	client    *http.Client
 	startTime time.Time
-	lastSent  string // 上次上报的最后一条日志时间戳，避免重复发送
+	spool     *Spool
+	cursor    int64              // 下一条待发送日志的游标
+	failures  int                // 连续失败次数
+	caps      ReportCapabilities // Master 在上一次响应中声明的能力
+	wlMu      sync.Mutex         // 上报响应与推送通道可能同时同步白名单
+	configs   *ConfigAgent       // 期望配置，为 nil 时不上报配置版本
+	health    *HealthCollector   // 健康指标，为 nil 时不上报
+	commands  *CommandAgent      // 命令执行，为 nil 时不接收命令
+	updater   *Updater           // 自动更新，为 nil 时不上报更新状态
+	mu        sync.Mutex         // 定时上报与 flush_spool 命令互斥
+	wake      chan struct{}      // 提前开始下一轮上报（命令执行完毕后尽快返回结果）
 }
 
-func NewReporter(cfg *Config, store *Store) *Reporter {
-	return &Reporter{
+func NewReporter(cfg *Config, store *Store, link *MasterLink) *Reporter {
+	rp := &Reporter{
 		cfg:       cfg,
 		store:     store,
+		link:      link,
 		startTime: time.Now(),
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		client:    link.Client(30 * time.Second),
+		wake:      make(chan struct{}, 1),
+		// 首次上报按旧版协议发送（不压缩），从响应头得知 Master 能力后再升级
+		caps: legacyReportCapabilities(),
+	}
+
+	spoolMax := cfg.SpoolMaxMB
+	if spoolMax <= 0 {
+		spoolMax = 64
 	}
+	spool, err := NewSpool(filepath.Join(cfg.DataDir, "report_spool"), int64(spoolMax)<<20)
+	if err != nil {
+		log.Printf("[Reporter] 初始化离线缓存失败: %v", err)
+	}
+	rp.spool = spool
+
+	cursor, ok, err := rp.loadCursor()
+	if err != nil {
+		log.Printf("[Reporter] 读取上报游标失败: %v", err)
+	}
+	if !ok {
+		// 首次启动：从当前日志末尾开始，历史日志不补发
+		cursor, err = store.LogCursorEnd()
+		if err != nil {
+			log.Printf("[Reporter] 获取日志末尾失败: %v", err)
+		}
+		rp.saveCursor(cursor)
+	}
+	rp.cursor = cursor
+	return rp
 }
 
 // Start 启动定时上报
 func (rp *Reporter) Start() {
-	if rp.cfg.MasterURL == "" || rp.cfg.NodeToken == "" {
+	masters := rp.cfg.MasterEndpoints()
+	if len(masters) == 0 || rp.cfg.NodeToken == "" {
 		log.Println("[Reporter] master_url 或 node_token 未配置，上报功能禁用")
 		return
 	}
 
-	interval := time.Duration(rp.cfg.ReportInterval) * time.Second
+	log.Printf("[Reporter] 上报已启动，间隔 %s，目标: %s", rp.interval(), strings.Join(masters, ", "))
+
+	// 首次立即上报
+	for {
+		delay := rp.interval()
+		rp.mu.Lock()
+		ok := rp.report()
+		rp.mu.Unlock()
+		if ok {
+			rp.failures = 0
+			if rp.updater != nil {
+				rp.updater.ReportOK()
+			}
+		} else {
+			rp.failures++
+			delay = rp.backoff()
+			log.Printf("[Reporter] 连续失败 %d 次，%s 后重试", rp.failures, delay.Round(time.Second))
+		}
+		select {
+		case <-time.After(delay):
+		case <-rp.wake:
+		}
+	}
+}
+
+// Wake 提前开始下一轮上报
+func (rp *Reporter) Wake() {
+	select {
+	case rp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Cursor 下一条待发送日志的游标
+func (rp *Reporter) Cursor() int64 {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.cursor
+}
+
+// Flush 立即执行一轮上报，补发离线缓存，返回补发前后的缓存情况
+func (rp *Reporter) Flush() (string, error) {
+	if rp.spool == nil {
+		return "", fmt.Errorf("离线缓存未启用")
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	before, beforeSize := rp.spool.Stats()
+	ok := rp.report()
+	after, afterSize := rp.spool.Stats()
+	msg := fmt.Sprintf("离线缓存 %d 批（%d KB）→ %d 批（%d KB）", before, beforeSize>>10, after, afterSize>>10)
+	if !ok {
+		return msg, fmt.Errorf("上报失败，%s", msg)
+	}
+	return msg, nil
+}
+
+// interval 上报间隔，可由 Master 下发的配置在线修改
+func (rp *Reporter) interval() time.Duration {
+	interval := time.Duration(rp.cfg.GetReportInterval()) * time.Second
 	if interval < 10*time.Second {
 		interval = 60 * time.Second
 	}
+	return interval
+}
 
-	log.Printf("[Reporter] 上报已启动，间隔 %s，目标: %s", interval, rp.cfg.MasterURL)
+func (rp *Reporter) backoff() time.Duration {
+	return backoffDelay(rp.failures, reportBackoffBase, reportBackoffMax)
+}
 
-	// 首次立即上报
-	rp.report()
+// backoffDelay 第 failures 次连续失败后的等待时间：指数退避 + 抖动，结果落在 [d/2, d)
+func backoffDelay(failures int, base, max time.Duration) time.Duration {
+	shift := failures - 1
+	if shift < 0 {
+		shift = 0
+	}
+	if shift > 10 {
+		shift = 10
+	}
+	d := base << shift
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(mrand.Int63n(int64(d/2)))
+}
+
+func (rp *Reporter) cursorPath() string {
+	return filepath.Join(rp.cfg.DataDir, "report_cursor.json")
+}
+
+func (rp *Reporter) loadCursor() (int64, bool, error) {
+	data, err := os.ReadFile(rp.cursorPath())
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var st struct {
+		Cursor int64 `json:"cursor"`
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return 0, false, err
+	}
+	return st.Cursor, true, nil
+}
+
+func (rp *Reporter) saveCursor(cursor int64) {
+	rp.cursor = cursor
+	data, _ := json.Marshal(map[string]interface{}{
+		"cursor":     cursor,
+		"updated_at": time.Now().Format("2006-01-02 15:04:05"),
+	})
+	if err := writeFileAtomic(rp.cursorPath(), data, 0644); err != nil {
+		log.Printf("[Reporter] 保存上报游标失败: %v", err)
+	}
+}
+
+// nextBatch 从游标处读取下一批日志
+func (rp *Reporter) nextBatch() (*ReportBatch, error) {
+	logs, next, err := rp.store.ReadLogsFrom(rp.cursor, rp.batchSize())
+	if err != nil {
+		return nil, err
+	}
+	return newReportBatch(rp.cursor, next, logs), nil
+}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for range ticker.C {
-		rp.report()
+// batchSize 单页日志条数，不超过 Master 声明的上限
+func (rp *Reporter) batchSize() int {
+	if rp.caps.MaxLogs > 0 && rp.caps.MaxLogs < reportBatchSize {
+		return rp.caps.MaxLogs
 	}
+	return reportBatchSize
 }
 
-func (rp *Reporter) report() {
+// report 执行一轮上报：先补发离线缓存，再发送游标之后的新日志，直到追平。
+// 返回 false 表示 Master 不可达或拒绝，调用方进入退避。
+func (rp *Reporter) report() bool {
 	stats := rp.store.GetStats()
+	page := 0
 
-	// 获取新增日志（上次上报之后的）
-	newLogs := rp.getNewLogs()
+	// 补发离线期间积压的批次
+	for rp.spool != nil {
+		batch, err := rp.spool.Oldest()
+		if err != nil {
+			log.Printf("[Reporter] 读取离线缓存失败: %v", err)
+			break
+		}
+		if batch == nil {
+			break
+		}
+		page++
+		if !rp.send(stats, batch, page, true) {
+			rp.spoolPending()
+			return false
+		}
+		rp.spool.Remove(batch)
+		log.Printf("[Reporter] 补发离线缓存批次 %s，%d 条日志", batch.ID, len(batch.Logs))
+	}
 
-	payload := map[string]interface{}{
-		"version":        Version,
-		"uptime":         int64(time.Since(rp.startTime).Seconds()),
-		"total_requests": stats.TotalRequests,
-		"trusted_count":  stats.TrustedCount,
-		"blocked_count":  stats.BlockedCount,
-		"domain":         rp.cfg.Domain,
-		"upstream":       rp.cfg.Upstream,
-		"logs":           newLogs,
+	// 发送新日志，积压超过一批时连续发送
+	for {
+		batch, err := rp.nextBatch()
+		if err != nil {
+			log.Printf("[Reporter] 读取日志失败: %v", err)
+			return false
+		}
+		page++
+		more := len(batch.Logs) >= rp.batchSize()
+		if !rp.send(stats, batch, page, more) {
+			if len(batch.Logs) > 0 {
+				rp.spoolBatch(batch)
+			}
+			rp.spoolPending()
+			return false
+		}
+		if batch.To != rp.cursor {
+			rp.saveCursor(batch.To)
+		}
+		if len(batch.Logs) > 0 {
+			log.Printf("[Reporter] 上报成功，发送 %d 条日志", len(batch.Logs))
+		}
+		if !more {
+			return true
+		}
 	}
+}
 
-	data, err := json.Marshal(payload)
+// renegotiate 上报失败后重新确定 Master 能力。
+// 当前版本的 Master 在所有上报响应中都带能力头，按头更新即可；
+// 没有能力头说明对方是旧版 Master（回滚或未升级的备用 Master）或前面的代理，
+// 旧版 Master 不认识压缩请求体，解析失败返回 400，因此压缩请求收到 400 同样退回协议 1
+func (rp *Reporter) renegotiate(resp *http.Response, encoding string) {
+	caps := legacyReportCapabilities()
+	if resp.Header.Get(headerReportProtocol) != "" && !(encoding != "" && resp.StatusCode == http.StatusBadRequest) {
+		caps = parseReportCapabilities(resp.Header)
+	}
+	if caps.Protocol != rp.caps.Protocol || caps.PreferredEncoding() != rp.caps.PreferredEncoding() {
+		log.Printf("[Reporter] Master 上报协议版本 %d，压缩: %q", caps.Protocol, caps.PreferredEncoding())
+	}
+	rp.caps = caps
+}
+
+// spoolBatch 将发送失败的批次写入离线缓存并前进游标
+func (rp *Reporter) spoolBatch(batch *ReportBatch) bool {
+	if rp.spool == nil {
+		return false
+	}
+	if err := rp.spool.Push(batch); err != nil {
+		if err != errSpoolFull {
+			log.Printf("[Reporter] 写入离线缓存失败: %v", err)
+		}
+		return false
+	}
+	rp.saveCursor(batch.To)
+	return true
+}
+
+// spoolPending Master 不可达期间把游标之后的日志转入离线缓存，缓存满则停止
+func (rp *Reporter) spoolPending() {
+	if rp.spool == nil {
+		return
+	}
+	for {
+		batch, err := rp.nextBatch()
+		if err != nil || len(batch.Logs) == 0 {
+			return
+		}
+		if !rp.spoolBatch(batch) {
+			n, size := rp.spool.Stats()
+			log.Printf("[Reporter] 离线缓存已满（%d 批, %d KB），剩余日志保留在日志文件中", n, size>>10)
+			return
+		}
+	}
+}
+
+// send 发送一页上报（状态 + 一批日志），Master 返回 200 视为确认
+func (rp *Reporter) send(stats Stats, batch *ReportBatch, page int, more bool) bool {
+	report := &NodeReport{
+		Version:       Version,
+		Uptime:        int64(time.Since(rp.startTime).Seconds()),
+		TotalRequests: stats.TotalRequests,
+		TrustedCount:  stats.TrustedCount,
+		BlockedCount:  stats.BlockedCount,
+		Domain:        rp.cfg.Domain,
+		Upstream:      rp.cfg.Upstream,
+		Logs:          batch.Logs,
+	}
+	if len(batch.Logs) > 0 {
+		report.BatchID = batch.ID
+	}
+	wlVersion := rp.store.WhitelistVersion()
+	report.WhitelistVersion = &wlVersion
+	if rp.configs != nil {
+		version, spec, errMsg := rp.configs.Status()
+		report.ConfigVersion, report.Config, report.ConfigError = &version, spec, errMsg
+	}
+	// 健康指标每轮只随第一页发送
+	var counters healthCounters
+	if rp.health != nil && page == 1 {
+		report.Health, counters = rp.health.Snapshot()
+	}
+	// 命令结果同样只随第一页发送
+	if rp.commands != nil {
+		report.Commands = true
+		if page == 1 {
+			report.CommandResults = rp.commands.PendingResults()
+		}
+	}
+	if rp.updater != nil {
+		report.Platform = runtime.GOOS + "/" + runtime.GOARCH
+		report.Update = rp.updater.Status()
+	}
+	if rp.caps.Protocol >= 2 {
+		report.Protocol = rp.caps.Protocol
+		report.Page = page
+		report.More = more
+	}
+
+	encoding := rp.caps.PreferredEncoding()
+	data, err := encodeReportBody(report, encoding)
 	if err != nil {
 		log.Printf("[Reporter] 序列化失败: %v", err)
-		return
+		return false
 	}
 
-	url := strings.TrimRight(rp.cfg.MasterURL, "/") + "/api/report"
-	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	req, err := rp.link.NewRequest(context.Background(), "POST", "/api/report", bytes.NewReader(data))
 	if err != nil {
 		log.Printf("[Reporter] 创建请求失败: %v", err)
-		return
+		return false
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+rp.cfg.NodeToken)
+	req.Header.Set(headerReportProtocol, strconv.Itoa(ReportProtocolVersion))
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
 
 	resp, err := rp.client.Do(req)
 	if err != nil {
 		log.Printf("[Reporter] 上报失败: %v", err)
-		return
+		return false
 	}
 	defer resp.Body.Close()
 
@@ -100,92 +403,103 @@ func (rp *Reporter) report() {
 
 	if resp.StatusCode != 200 {
 		log.Printf("[Reporter] 上报返回 %d: %s", resp.StatusCode, string(body))
-		return
+		rp.renegotiate(resp, encoding)
+		return false
 	}
 
-	// 解析返回的白名单并同步
-	var result struct {
-		Status    string           `json:"status"`
-		Whitelist []WhitelistEntry `json:"whitelist"`
+	caps := parseReportCapabilities(resp.Header)
+	if caps.Protocol != rp.caps.Protocol {
+		log.Printf("[Reporter] Master 上报协议版本 %d，压缩: %q", caps.Protocol, caps.PreferredEncoding())
 	}
-	if err := json.Unmarshal(body, &result); err == nil && result.Whitelist != nil {
-		rp.syncWhitelist(result.Whitelist)
+	rp.caps = caps
+	if report.Health != nil {
+		rp.health.Commit(counters)
 	}
-
-	if len(newLogs) > 0 {
-		log.Printf("[Reporter] 上报成功，发送 %d 条日志", len(newLogs))
+	if rp.commands != nil {
+		rp.commands.Ack(report.CommandResults)
 	}
-}
 
-// getNewLogs 获取上次上报之后新增的日志
-func (rp *Reporter) getNewLogs() []LogEntry {
-	allLogs := rp.store.ReadLogs()
-	if rp.lastSent == "" {
-		// 首次上报：只发最近 100 条
-		start := len(allLogs) - 100
-		if start < 0 {
-			start = 0
+	// 解析返回的白名单并同步
+	var result struct {
+		Status        string           `json:"status"`
+		Whitelist     []WhitelistEntry `json:"whitelist"`
+		WhitelistSync *WhitelistSync   `json:"whitelist_sync"`
+		ConfigVersion *int64           `json:"config_version"`
+		Commands      []NodeCommand    `json:"commands"`
+	}
+	if err := json.Unmarshal(body, &result); err == nil {
+		switch {
+		case result.WhitelistSync != nil:
+			rp.syncWhitelist(result.WhitelistSync)
+		case result.Whitelist != nil:
+			// 旧版 Master 只返回全量列表，没有版本号
+			rp.syncWhitelist(&WhitelistSync{Mode: WhitelistSyncFull, Entries: result.Whitelist})
+		}
+		if result.ConfigVersion != nil && rp.configs != nil {
+			go rp.configs.Check(*result.ConfigVersion)
 		}
-		result := allLogs[start:]
-		if len(allLogs) > 0 {
-			rp.lastSent = allLogs[len(allLogs)-1].Timestamp
+		if len(result.Commands) > 0 && rp.commands != nil {
+			rp.commands.Enqueue(result.Commands)
 		}
-		return result
 	}
+	return true
+}
+
+// syncWhitelist 应用 Master 下发的白名单同步结果；增量与本地版本对不上时改为拉取
+func (rp *Reporter) syncWhitelist(sync *WhitelistSync) {
+	rp.wlMu.Lock()
+	defer rp.wlMu.Unlock()
 
-	// 找到上次上报位置之后的新日志
-	var newLogs []LogEntry
-	for _, l := range allLogs {
-		if l.Timestamp > rp.lastSent {
-			newLogs = append(newLogs, l)
+	changed, err := rp.store.ApplyWhitelistSync(sync)
+	if err == errWhitelistVersionMismatch {
+		log.Printf("[Reporter] 白名单增量 %d→%d 与本地版本 %d 不符，重新拉取",
+			sync.Delta.From, sync.Delta.To, rp.store.WhitelistVersion())
+		if sync, err = rp.pullWhitelist(rp.store.WhitelistVersion()); err == nil {
+			changed, err = rp.store.ApplyWhitelistSync(sync)
+		}
+		if err == errWhitelistVersionMismatch {
+			if sync, err = rp.pullWhitelist(0); err == nil {
+				changed, err = rp.store.ApplyWhitelistSync(sync)
+			}
 		}
 	}
-	if len(newLogs) > 0 {
-		rp.lastSent = newLogs[len(newLogs)-1].Timestamp
+	if err != nil {
+		log.Printf("[Reporter] 白名单同步失败: %v", err)
+		return
 	}
 
-	// 限制单次上报最多 500 条
-	if len(newLogs) > 500 {
-		newLogs = newLogs[len(newLogs)-500:]
+	if changed {
+		log.Printf("[Reporter] 白名单已同步（%s），版本 %d，共 %d 条",
+			sync.Mode, sync.Version, len(rp.store.GetWhitelist()))
 	}
-	return newLogs
 }
 
-// syncWhitelist 用 master 返回的白名单覆盖本地
-func (rp *Reporter) syncWhitelist(masterList []WhitelistEntry) {
-	localList := rp.store.GetWhitelist()
-
-	// 构建 master 白名单的 index
-	masterIndex := make(map[string]bool, len(masterList))
-	for _, e := range masterList {
-		masterIndex[e.JA3Hash] = true
+// pullWhitelist 从 Master 拉取指定版本之后的白名单（version 为 0 时取全量）
+func (rp *Reporter) pullWhitelist(version int64) (*WhitelistSync, error) {
+	req, err := rp.link.NewRequest(context.Background(), "GET", fmt.Sprintf("/api/node/whitelist?version=%d", version), nil)
+	if err != nil {
+		return nil, err
 	}
 
-	// 构建本地白名单的 index
-	localIndex := make(map[string]bool, len(localList))
-	for _, e := range localList {
-		localIndex[e.JA3Hash] = true
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return nil, err
 	}
-
-	changed := false
-
-	// 添加 master 有但本地没有的
-	for _, e := range masterList {
-		if !localIndex[e.JA3Hash] {
-			rp.store.AddWhitelist(e.JA3Hash, fmt.Sprintf("[master] %s", e.Note))
-			changed = true
-		}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("拉取白名单返回 %d: %s", resp.StatusCode, string(body))
 	}
 
-	// 删除 master 没有但本地有的
-	for _, e := range localList {
-		if !masterIndex[e.JA3Hash] {
-			rp.store.RemoveWhitelist(e.JA3Hash)
-			changed = true
-		}
+	var result struct {
+		Whitelist     []WhitelistEntry `json:"whitelist"`
+		WhitelistSync *WhitelistSync   `json:"whitelist_sync"`
 	}
-
-	if changed {
-		log.Printf("[Reporter] 白名单已同步，共 %d 条", len(masterList))
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if result.WhitelistSync != nil {
+		return result.WhitelistSync, nil
 	}
+	return &WhitelistSync{Mode: WhitelistSyncFull, Entries: result.Whitelist}, nil
 }
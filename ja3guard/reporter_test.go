@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// legacyReportHandler 协议 1 的旧版 Master：只认未压缩 JSON，不返回能力头
+type legacyReportHandler struct {
+	mu        sync.Mutex
+	encodings []string
+	logs      int
+}
+
+func (lh *legacyReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	lh.encodings = append(lh.encodings, r.Header.Get("Content-Encoding"))
+	var report NodeReport
+	data, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(data, &report); err != nil {
+		http.Error(w, `{"error":"请求格式错误"}`, 400)
+		return
+	}
+	lh.logs += len(report.Logs)
+	w.Write([]byte(`{"status":"ok","whitelist":[]}`))
+}
+
+func newTestReporter(t *testing.T, masterURL string) (*Reporter, *Store) {
+	t.Helper()
+	dir := t.TempDir()
+	backend, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{DataDir: dir, MasterURL: masterURL, NodeToken: "test-token"}
+	return NewReporter(cfg, store, NewMasterLink(cfg)), store
+}
+
+func TestReporterFallsBackToLegacyMaster(t *testing.T) {
+	legacy := &legacyReportHandler{}
+	srv := httptest.NewServer(legacy)
+	defer srv.Close()
+
+	rp, store := newTestReporter(t, srv.URL)
+	// 上一次响应来自新版 Master，之后 Master 回滚到了旧版本
+	rp.caps = ReportCapabilities{Protocol: ReportProtocolVersion, Encodings: []string{"zstd", "gzip"}, MaxLogs: reportBatchSize}
+	store.LogRequest("1.2.3.4", "hash", "ua", false)
+
+	if rp.report() {
+		t.Fatal("旧版 Master 无法解析压缩请求体，第一次上报应失败")
+	}
+	if rp.caps.Protocol != 1 || rp.caps.PreferredEncoding() != "" {
+		t.Fatalf("收到不带能力头的 400 后应退回协议 1，实际 %+v", rp.caps)
+	}
+	if !rp.report() {
+		t.Fatal("退回协议 1 后上报应成功")
+	}
+
+	legacy.mu.Lock()
+	defer legacy.mu.Unlock()
+	// 第二轮先补发离线缓存，再发送一页状态
+	if len(legacy.encodings) < 2 || legacy.encodings[0] == "" {
+		t.Fatalf("请求压缩方式 = %q，第一次应压缩", legacy.encodings)
+	}
+	for _, enc := range legacy.encodings[1:] {
+		if enc != "" {
+			t.Fatalf("请求压缩方式 = %q，退回协议 1 后不应压缩", legacy.encodings)
+		}
+	}
+	if legacy.logs != 1 {
+		t.Fatalf("旧版 Master 收到 %d 条日志，want 1（失败批次经离线缓存补发）", legacy.logs)
+	}
+}
+
+func TestReporterNegotiatesWithCurrentMaster(t *testing.T) {
+	var encodings []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		setReportCapabilityHeaders(w.Header())
+		if _, err := decodeNodeReport(w, r); err != nil {
+			http.Error(w, err.Error(), reportErrorStatus(err))
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer srv.Close()
+
+	rp, _ := newTestReporter(t, srv.URL)
+	for i := 0; i < 2; i++ {
+		if !rp.report() {
+			t.Fatalf("第 %d 次上报失败", i+1)
+		}
+	}
+	if len(encodings) != 2 || encodings[0] != "" || encodings[1] != "zstd" {
+		t.Fatalf("请求压缩方式 = %q，首次不压缩、协商后使用 zstd", encodings)
+	}
+
+	// 带能力头的错误响应不降级
+	rp.renegotiate(&http.Response{StatusCode: 401, Header: srvHeader()}, "zstd")
+	if rp.caps.Protocol != ReportProtocolVersion {
+		t.Fatalf("带能力头的 401 不应降级: %+v", rp.caps)
+	}
+	rp.renegotiate(&http.Response{StatusCode: 502, Header: http.Header{}}, "zstd")
+	if rp.caps.Protocol != 1 {
+		t.Fatalf("没有能力头的错误响应应退回协议 1: %+v", rp.caps)
+	}
+}
+
+func srvHeader() http.Header {
+	h := http.Header{}
+	setReportCapabilityHeaders(h)
+	return h
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReportBatch 一批待上报的日志
+// ID 由日志游标区间生成，同一批次重发时 ID 不变，Master 据此去重
+type ReportBatch struct {
+	ID   string     `json:"id"`
+	From int64      `json:"from"`
+	To   int64      `json:"to"`
+	Logs []LogEntry `json:"logs"`
+}
+
+func newReportBatch(from, to int64, logs []LogEntry) *ReportBatch {
+	return &ReportBatch{
+		ID:   fmt.Sprintf("%d-%d", from, to),
+		From: from,
+		To:   to,
+		Logs: logs,
+	}
+}
+
+var errSpoolFull = errors.New("离线缓存已满")
+
+// Spool Master 不可达时暂存未送达的上报批次（data/report_spool/）
+// 每个批次一个文件，文件名按游标排序即为发送顺序；总大小超过 maxBytes 时拒绝写入，
+// 剩余日志留在日志文件中，由游标保证恢复后继续发送
+type Spool struct {
+	dir      string
+	maxBytes int64
+	mu       sync.Mutex
+}
+
+func NewSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir, maxBytes: maxBytes}, nil
+}
+
+func (sp *Spool) fileName(b *ReportBatch) string {
+	return fmt.Sprintf("%020d-%020d.json", b.From, b.To)
+}
+
+// list 返回按发送顺序排列的批次文件名及总大小
+func (sp *Spool) list() ([]string, int64, error) {
+	entries, err := os.ReadDir(sp.dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var names []string
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			total += info.Size()
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, total, nil
+}
+
+// Push 写入一个批次，超出容量时返回 errSpoolFull
+func (sp *Spool) Push(b *ReportBatch) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	_, total, err := sp.list()
+	if err != nil {
+		return err
+	}
+	if total+int64(len(data)) > sp.maxBytes {
+		return errSpoolFull
+	}
+	return writeFileAtomic(filepath.Join(sp.dir, sp.fileName(b)), data, 0600)
+}
+
+// Oldest 返回最早的批次，缓存为空时返回 nil
+func (sp *Spool) Oldest() (*ReportBatch, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	names, _, err := sp.list()
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(sp.dir, names[0]))
+	if err != nil {
+		return nil, err
+	}
+	var b ReportBatch
+	if err := json.Unmarshal(data, &b); err != nil {
+		// 损坏的批次直接丢弃，避免阻塞后续发送
+		os.Remove(filepath.Join(sp.dir, names[0]))
+		return nil, fmt.Errorf("离线缓存 %s 已损坏: %w", names[0], err)
+	}
+	return &b, nil
+}
+
+// Remove 删除已被 Master 确认的批次
+func (sp *Spool) Remove(b *ReportBatch) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return os.Remove(filepath.Join(sp.dir, sp.fileName(b)))
+}
+
+// Stats 返回缓存中的批次数和总字节数
+func (sp *Spool) Stats() (int, int64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	names, total, _ := sp.list()
+	return len(names), total
+}
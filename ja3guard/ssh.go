@@ -2,80 +2,548 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-// SSHClient 封装 SSH 连接操作
+const maxSSHJumps = 5 // proxy_jump 最多跳板数
+
+// SSH 认证方式
+const (
+	SSHAuthPassword            = "password"
+	SSHAuthKey                 = "key"
+	SSHAuthKeyboardInteractive = "keyboard-interactive"
+	SSHAuthAgent               = "agent"
+)
+
+// SSHAuth SSH 认证信息，节点、跳板机和共享凭据共用（JSON 中与所在结构的字段平铺）
+type SSHAuth struct {
+	AuthType         string `json:"auth_type"`                    // password / key / keyboard-interactive / agent
+	SSHKey           string `json:"ssh_key"`                      // SSH 私钥内容（auth_type=key 时），存储时加密
+	SSHKeyPassphrase string `json:"ssh_key_passphrase,omitempty"` // 私钥口令（私钥已加密时），存储时加密
+	SSHCert          string `json:"ssh_cert,omitempty"`           // OpenSSH 用户证书（CA 签发的 *-cert.pub），与私钥配对使用
+	SSHPass          string `json:"ssh_pass"`                     // SSH 密码（auth_type=password / keyboard-interactive 时），存储时加密
+}
+
+// SSHJump 跳板机，字段含义与节点的 SSH 字段相同；每台跳板机使用自己的认证和主机公钥
+type SSHJump struct {
+	Host    string `json:"host"`
+	SSHPort int    `json:"ssh_port"`
+	SSHUser string `json:"ssh_user"`
+	SSHAuth
+	CredentialID      string `json:"credential_id,omitempty"` // 引用的共享凭据，设置后忽略自身的认证信息
+	SSHHostKey        string `json:"ssh_host_key,omitempty"`
+	SSHHostKeyPending string `json:"ssh_host_key_pending,omitempty"`
+	SSHHostKeyAt      string `json:"ssh_host_key_at,omitempty"`
+}
+
+func (j *SSHJump) addr() string {
+	return net.JoinHostPort(j.Host, strconv.Itoa(j.SSHPort))
+}
+
+// sshHops 连接顺序：proxy_jump 中的跳板机依次在前，节点本身在最后
+func (n *NodeInfo) sshHops() []SSHJump {
+	hops := make([]SSHJump, 0, len(n.ProxyJump)+1)
+	hops = append(hops, n.ProxyJump...)
+	return append(hops, SSHJump{
+		Host:              n.Host,
+		SSHPort:           n.SSHPort,
+		SSHUser:           n.SSHUser,
+		SSHAuth:           n.SSHAuth,
+		CredentialID:      n.CredentialID,
+		SSHHostKey:        n.SSHHostKey,
+		SSHHostKeyPending: n.SSHHostKeyPending,
+		SSHHostKeyAt:      n.SSHHostKeyAt,
+	})
+}
+
+// SSHHostKeyStore 保存节点的 SSH 主机公钥（由 NodeStore 实现）。
+// hop 为 sshHops 中的下标：0..len(proxy_jump)-1 为跳板机，len(proxy_jump) 为节点本身
+type SSHHostKeyStore interface {
+	// TrustSSHHostKey 还没有记录公钥时记录 key（首次连接信任），返回最终记录的公钥
+	TrustSSHHostKey(id string, hop int, key string) (string, error)
+	// SetPendingSSHHostKey 记录与已保存公钥不符的新公钥，等待管理员确认
+	SetPendingSSHHostKey(id string, hop int, key string) error
+}
+
+// SSHClient 封装 SSH 连接操作。设置了连接池时复用到节点的连接，否则每次操作单独连接
 type SSHClient struct {
-	node *NodeInfo
+	node     *NodeInfo
+	hops     []SSHJump
+	hostKeys SSHHostKeyStore // 为 nil 时只接受已记录的主机公钥
+	pool     *SSHPool
 }
 
-func NewSSHClient(node *NodeInfo) *SSHClient {
-	return &SSHClient{node: node}
+func NewSSHClient(node *NodeInfo, hostKeys SSHHostKeyStore, pool *SSHPool) *SSHClient {
+	return &SSHClient{node: node, hops: node.sshHops(), hostKeys: hostKeys, pool: pool}
 }
 
-// buildConfig 构建 SSH 客户端配置
-func (sc *SSHClient) buildConfig() (*ssh.ClientConfig, error) {
+// HostKeyMismatchError 主机公钥与记录的不一致，可能是重装了系统，也可能是中间人攻击
+type HostKeyMismatchError struct {
+	Node     string
+	Hop      string // 跳板机地址，节点本身为空
+	Expected string // 已记录公钥的 SHA256 指纹
+	Got      string // 本次连接收到的公钥指纹
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	target := "节点 " + e.Node
+	if e.Hop != "" {
+		target += " 的跳板机 " + e.Hop
+	}
+	return fmt.Sprintf("%s 的 SSH 主机公钥已变化（记录 %s，收到 %s），已拒绝连接；确认确实更换了主机密钥后，请在面板上接受新公钥",
+		target, e.Expected, e.Got)
+}
+
+// normalizeSSHHostKey 解析 authorized_keys 格式（"ssh-ed25519 AAAA..."）或 known_hosts 格式
+// （ssh-keyscan 的输出）的主机公钥，统一为 authorized_keys 格式
+func normalizeSSHHostKey(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		if _, _, key, _, _, err = ssh.ParseKnownHosts([]byte(s)); err != nil {
+			return "", fmt.Errorf("主机公钥格式错误（应为 \"ssh-ed25519 AAAA...\" 或 ssh-keyscan 的输出）")
+		}
+	}
+	return marshalSSHHostKey(key), nil
+}
+
+func marshalSSHHostKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// sshHostKeyFingerprint 公钥的 SHA256 指纹，格式错误时返回空字符串
+func sshHostKeyFingerprint(s string) string {
+	if s == "" {
+		return ""
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+// hostKeyAlgorithms 已记录公钥时只协商该类型的主机密钥，避免服务端出示其他类型的密钥
+func hostKeyAlgorithms(key ssh.PublicKey) []string {
+	if key.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{key.Type()}
+}
+
+// hopName 日志和错误中使用的跳板机名称，节点本身为空
+func (sc *SSHClient) hopName(i int) string {
+	if i == len(sc.hops)-1 {
+		return ""
+	}
+	return sc.hops[i].addr()
+}
+
+// checkHostKey 校验第 i 跳的主机公钥：没有记录时首次连接信任并保存，之后必须一致
+func (sc *SSHClient) checkHostKey(i int, key ssh.PublicKey) error {
+	hop := &sc.hops[i]
+	got := marshalSSHHostKey(key)
+	want := hop.SSHHostKey
+	if want == "" {
+		if sc.hostKeys == nil {
+			return fmt.Errorf("%s 未记录 SSH 主机公钥", hop.addr())
+		}
+		var err error
+		if want, err = sc.hostKeys.TrustSSHHostKey(sc.node.ID, i, got); err != nil {
+			return fmt.Errorf("保存 SSH 主机公钥失败: %w", err)
+		}
+		if want == got {
+			log.Printf("[SSH] 首次连接节点 %s（%s），已记录主机公钥 %s", sc.node.Name, hop.addr(), ssh.FingerprintSHA256(key))
+		}
+		hop.SSHHostKey = want
+	}
+	if want == got {
+		return nil
+	}
+
+	mismatch := &HostKeyMismatchError{Node: sc.node.Name, Hop: sc.hopName(i), Expected: sshHostKeyFingerprint(want), Got: ssh.FingerprintSHA256(key)}
+	log.Printf("[SSH] 警告: %v", mismatch)
+	if sc.hostKeys != nil {
+		if err := sc.hostKeys.SetPendingSSHHostKey(sc.node.ID, i, got); err != nil {
+			log.Printf("[SSH] 记录待确认的主机公钥失败: %v", err)
+		}
+	}
+	return mismatch
+}
+
+// buildConfig 构建第 i 跳的 SSH 客户端配置
+func (sc *SSHClient) buildConfig(i int) (*ssh.ClientConfig, error) {
+	hop := &sc.hops[i]
 	config := &ssh.ClientConfig{
-		User:            sc.node.SSHUser,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
+		User: hop.SSHUser,
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			return sc.checkHostKey(i, key)
+		},
+		Timeout: 10 * time.Second,
+	}
+	if hop.SSHHostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hop.SSHHostKey))
+		if err != nil {
+			return nil, fmt.Errorf("%s 记录的 SSH 主机公钥格式错误: %w", hop.addr(), err)
+		}
+		config.HostKeyAlgorithms = hostKeyAlgorithms(key)
+	}
+
+	if hop.CredentialID != "" {
+		// 解析共享凭据后 CredentialID 会被清空，仍有值说明凭据已被删除
+		return nil, fmt.Errorf("%s 引用的共享凭据不存在: %s", hop.addr(), hop.CredentialID)
+	}
+	auth, err := hop.SSHAuth.authMethod()
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", hop.addr(), err)
 	}
+	config.Auth = []ssh.AuthMethod{auth}
+	return config, nil
+}
 
-	switch sc.node.AuthType {
-	case "key":
-		if sc.node.SSHKey == "" {
-			return nil, fmt.Errorf("SSH 私钥为空")
+// signer 解析私钥（有口令时用口令解密），设置了用户证书时返回证书签名器
+func (a *SSHAuth) signer() (ssh.Signer, error) {
+	if a.SSHKey == "" {
+		return nil, fmt.Errorf("SSH 私钥为空")
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(a.SSHKey))
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if a.SSHKeyPassphrase == "" {
+			return nil, fmt.Errorf("SSH 私钥已加密，请填写私钥口令")
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(a.SSHKey), []byte(a.SSHKeyPassphrase))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, fmt.Errorf("SSH 私钥口令错误")
 		}
-		signer, err := ssh.ParsePrivateKey([]byte(sc.node.SSHKey))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析 SSH 私钥失败: %w", err)
+	}
+	if a.SSHCert == "" {
+		return signer, nil
+	}
+	cert, err := parseSSHUserCert(a.SSHCert)
+	if err != nil {
+		return nil, err
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("SSH 证书与私钥不匹配")
+	}
+	return certSigner, nil
+}
+
+// parseSSHUserCert 解析 OpenSSH 用户证书（ssh-keygen -s 签发的 *-cert.pub 内容）
+func parseSSHUserCert(s string) (*ssh.Certificate, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(s)))
+	if err != nil {
+		return nil, fmt.Errorf("SSH 证书格式错误（应为 *-cert.pub 文件内容）")
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("SSH 证书格式错误：不是用户证书")
+	}
+	return cert, nil
+}
+
+// sshCertInfo 接口返回的用户证书信息
+type sshCertInfo struct {
+	KeyID       string   `json:"key_id"`
+	Principals  []string `json:"principals"`
+	ValidAfter  string   `json:"valid_after,omitempty"`
+	ValidBefore string   `json:"valid_before,omitempty"` // 为空表示永不过期
+	Expired     bool     `json:"expired"`
+	CA          string   `json:"ca"` // 签发 CA 公钥的 SHA256 指纹
+}
+
+// describeSSHCert 证书为空或格式错误时返回 nil
+func describeSSHCert(s string) *sshCertInfo {
+	if s == "" {
+		return nil
+	}
+	cert, err := parseSSHUserCert(s)
+	if err != nil {
+		return nil
+	}
+	info := &sshCertInfo{KeyID: cert.KeyId, Principals: cert.ValidPrincipals, CA: ssh.FingerprintSHA256(cert.SignatureKey)}
+	if cert.ValidAfter != 0 {
+		info.ValidAfter = time.Unix(int64(cert.ValidAfter), 0).Format("2006-01-02 15:04:05")
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		info.ValidBefore = time.Unix(int64(cert.ValidBefore), 0).Format("2006-01-02 15:04:05")
+		info.Expired = time.Now().Unix() > int64(cert.ValidBefore)
+	}
+	return info
+}
+
+// authMethod 按认证方式构建 SSH 认证
+func (a *SSHAuth) authMethod() (ssh.AuthMethod, error) {
+	switch a.AuthType {
+	case SSHAuthKey:
+		signer, err := a.signer()
 		if err != nil {
-			return nil, fmt.Errorf("解析 SSH 私钥失败: %w", err)
+			return nil, err
 		}
-		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
-	case "password":
-		if sc.node.SSHPass == "" {
+		if a.SSHCert != "" {
+			// 短期证书过期后服务端拒绝认证，提前给出明确的原因
+			cert := signer.PublicKey().(*ssh.Certificate)
+			if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() > int64(cert.ValidBefore) {
+				return nil, fmt.Errorf("SSH 证书已于 %s 过期", time.Unix(int64(cert.ValidBefore), 0).Format("2006-01-02 15:04:05"))
+			}
+		}
+		return ssh.PublicKeys(signer), nil
+	case SSHAuthPassword:
+		if a.SSHPass == "" {
 			return nil, fmt.Errorf("SSH 密码为空")
 		}
-		config.Auth = []ssh.AuthMethod{ssh.Password(sc.node.SSHPass)}
+		return ssh.Password(a.SSHPass), nil
+	case SSHAuthKeyboardInteractive:
+		if a.SSHPass == "" {
+			return nil, fmt.Errorf("SSH 密码为空")
+		}
+		// 服务端（通常是 PAM）的每个提问都用密码回答
+		pass := a.SSHPass
+		return ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = pass
+			}
+			return answers, nil
+		}), nil
+	case SSHAuthAgent:
+		// 使用 Master 进程环境中 SSH_AUTH_SOCK 指向的 ssh-agent，签名时才连接
+		return ssh.PublicKeysCallback(sshAgentSigners), nil
 	default:
-		return nil, fmt.Errorf("不支持的认证方式: %s", sc.node.AuthType)
+		return nil, fmt.Errorf("不支持的认证方式: %s", a.AuthType)
 	}
+}
 
-	return config, nil
+// withSSHAgent 连接 Master 进程环境中 SSH_AUTH_SOCK 指向的 ssh-agent，用完即关闭
+func withSSHAgent(fn func(agent.ExtendedAgent) error) error {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return fmt.Errorf("未设置 SSH_AUTH_SOCK，无法使用 ssh-agent")
+	}
+	conn, err := net.DialTimeout("unix", sock, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("连接 ssh-agent 失败: %w", err)
+	}
+	defer conn.Close()
+	return fn(agent.NewClient(conn))
+}
+
+// sshAgentSigners ssh-agent 中的密钥（含证书）
+func sshAgentSigners() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	err := withSSHAgent(func(ag agent.ExtendedAgent) error {
+		keys, err := ag.List()
+		if err != nil {
+			return fmt.Errorf("读取 ssh-agent 密钥失败: %w", err)
+		}
+		for _, k := range keys {
+			pub, err := ssh.ParsePublicKey(k.Blob)
+			if err != nil {
+				continue
+			}
+			signers = append(signers, agentSigner{pub: pub})
+		}
+		return nil
+	})
+	if err == nil && len(signers) == 0 {
+		err = fmt.Errorf("ssh-agent 中没有密钥")
+	}
+	return signers, err
+}
+
+// agentSigner 由 ssh-agent 签名，每次签名单独连接 agent，不必管理连接的生命周期
+type agentSigner struct {
+	pub ssh.PublicKey
+}
+
+func (s agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s agentSigner) SignWithAlgorithm(_ io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+	var sig *ssh.Signature
+	err := withSSHAgent(func(ag agent.ExtendedAgent) error {
+		var err error
+		sig, err = ag.SignWithFlags(s.pub, data, flags)
+		return err
+	})
+	return sig, err
 }
 
-// connect 建立 SSH 连接
-func (sc *SSHClient) connect() (*ssh.Client, error) {
-	config, err := sc.buildConfig()
+// dial 依次连接跳板机，最后经由上一跳连接节点
+func (sc *SSHClient) dial() (*sshConn, error) {
+	conn := &sshConn{}
+	for i := range sc.hops {
+		config, err := sc.buildConfig(i)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		addr := sc.hops[i].addr()
+		var client *ssh.Client
+		if i == 0 {
+			client, err = ssh.Dial("tcp", addr, config)
+		} else {
+			client, err = dialVia(conn.client, addr, config)
+		}
+		if err != nil {
+			conn.Close()
+			if i < len(sc.hops)-1 {
+				return nil, fmt.Errorf("SSH 连接跳板机失败 %s: %w", addr, err)
+			}
+			return nil, fmt.Errorf("SSH 连接失败 %s: %w", addr, err)
+		}
+		if conn.client != nil {
+			conn.jumps = append(conn.jumps, conn.client)
+		}
+		conn.client = client
+	}
+	return conn, nil
+}
+
+// dialVia 通过已建立的 SSH 连接（跳板机）转发 TCP 并在其上建立新的 SSH 连接
+func dialVia(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	type result struct {
+		client *ssh.Client
+		err    error
+	}
+	// 经跳板转发的连接不支持设置超时，握手放到 goroutine 中按 config.Timeout 等待
+	done := make(chan result, 1)
+	go func() {
+		nc, err := via.Dial("tcp", addr)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		c, chans, reqs, err := ssh.NewClientConn(nc, addr, config)
+		if err != nil {
+			nc.Close()
+			done <- result{err: err}
+			return
+		}
+		done <- result{client: ssh.NewClient(c, chans, reqs)}
+	}()
+	select {
+	case r := <-done:
+		return r.client, r.err
+	case <-time.After(config.Timeout):
+		go func() {
+			if r := <-done; r.client != nil {
+				r.client.Close()
+			}
+		}()
+		return nil, fmt.Errorf("连接超时")
+	}
+}
+
+// sshConn 到节点的连接及途经的跳板机连接
+type sshConn struct {
+	client *ssh.Client
+	jumps  []*ssh.Client
+}
+
+// Close 从节点开始依次关闭
+func (c *sshConn) Close() {
+	if c.client != nil {
+		c.client.Close()
+	}
+	for i := len(c.jumps) - 1; i >= 0; i-- {
+		c.jumps[i].Close()
+	}
+}
+
+// connect 取得到节点的连接（连接池中的或新建的），用完后调用 release
+func (sc *SSHClient) connect() (*ssh.Client, func(), error) {
+	if sc.pool == nil {
+		conn, err := sc.dial()
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn.client, conn.Close, nil
+	}
+	pc, err := sc.pool.Get(sc.node, sc.dial)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc.conn.client, func() { sc.pool.Put(pc) }, nil
+}
+
+// open 在连接上打开会话或 SFTP；复用的连接已断开时重新连接一次。返回的函数归还连接
+func (sc *SSHClient) open(fn func(*ssh.Client) error) (func(), error) {
+	client, release, err := sc.connect()
 	if err != nil {
 		return nil, err
 	}
+	err = fn(client)
+	if err != nil && sc.pool != nil {
+		release()
+		sc.pool.Forget(sc.node.ID)
+		if client, release, err = sc.connect(); err != nil {
+			return nil, err
+		}
+		err = fn(client)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
 
-	addr := fmt.Sprintf("%s:%d", sc.node.Host, sc.node.SSHPort)
-	client, err := ssh.Dial("tcp", addr, config)
+// session 打开一个会话
+func (sc *SSHClient) session() (*ssh.Session, func(), error) {
+	var session *ssh.Session
+	release, err := sc.open(func(client *ssh.Client) (err error) {
+		session, err = client.NewSession()
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("SSH 连接失败 %s: %w", addr, err)
+		return nil, nil, fmt.Errorf("创建会话失败: %w", err)
 	}
-	return client, nil
+	return session, func() {
+		session.Close()
+		release()
+	}, nil
 }
 
 // TestConnection 测试 SSH 连接
 func (sc *SSHClient) TestConnection() error {
-	client, err := sc.connect()
+	session, done, err := sc.session()
 	if err != nil {
 		return err
 	}
-	defer client.Close()
-
-	session, err := client.NewSession()
-	if err != nil {
-		return fmt.Errorf("创建会话失败: %w", err)
-	}
-	defer session.Close()
+	defer done()
 
 	output, err := session.CombinedOutput("echo 'JA3 Guard SSH OK' && uname -a")
 	if err != nil {
@@ -86,17 +554,11 @@ func (sc *SSHClient) TestConnection() error {
 
 // Exec 在远程服务器执行命令
 func (sc *SSHClient) Exec(cmd string) (string, error) {
-	client, err := sc.connect()
+	session, done, err := sc.session()
 	if err != nil {
 		return "", err
 	}
-	defer client.Close()
-
-	session, err := client.NewSession()
-	if err != nil {
-		return "", fmt.Errorf("创建会话失败: %w", err)
-	}
-	defer session.Close()
+	defer done()
 
 	var stdout, stderr bytes.Buffer
 	session.Stdout = &stdout
@@ -109,16 +571,58 @@ func (sc *SSHClient) Exec(cmd string) (string, error) {
 	return stdout.String() + stderr.String(), nil
 }
 
+// ExecStream 执行命令并把输出实时写入 stdout / stderr。命令在独立的进程组中运行（setsid），
+// ctx 取消时结束整个进程组，避免远程进程在断开后继续运行
+func (sc *SSHClient) ExecStream(ctx context.Context, cmd string, stdout, stderr io.Writer) error {
+	b := make([]byte, 8)
+	rand.Read(b)
+	pidFile := "/tmp/.ja3guard-job-" + hex.EncodeToString(b) + ".pid"
+	// -w 只有 util-linux 的 setsid 支持，BusyBox 没有。setsid 在这里不是进程组组长，
+	// 不加 -w 时也不会 fork，直接在当前进程中 exec；没有 setsid 时退化为不建立新进程组
+	wrapped := fmt.Sprintf(`if setsid -w true 2>/dev/null; then set -- setsid -w; elif command -v setsid >/dev/null 2>&1; then set -- setsid; else set --; fi; `+
+		`"$@" sh -c 'echo $$ > %s; exec "${SHELL:-/bin/sh}" -c "$1"' sh %s; rc=$?; rm -f %s; exit $rc`,
+		pidFile, shellQuote(cmd), pidFile)
+
+	session, done, err := sc.session()
+	if err != nil {
+		return err
+	}
+	defer done()
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(wrapped); err != nil {
+		return fmt.Errorf("启动命令失败: %w", err)
+	}
+
+	finished := make(chan error, 1)
+	go func() { finished <- session.Wait() }()
+	select {
+	case err := <-finished:
+		if err != nil {
+			return fmt.Errorf("命令执行失败: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	// 先 TERM 再 KILL 整个进程组（没有 setsid 时只能结束 shell 本身）；
+	// 会话信号只是兜底（OpenSSH 8.1 之前不支持）
+	session.Signal(ssh.SIGTERM)
+	kill := fmt.Sprintf(`pgid=$(cat %[1]s 2>/dev/null) && [ -n "$pgid" ] && { kill -TERM -$pgid 2>/dev/null || kill -TERM $pgid 2>/dev/null; sleep 2; kill -KILL -$pgid 2>/dev/null || kill -KILL $pgid 2>/dev/null; }; rm -f %[1]s; true`, pidFile)
+	if _, err := sc.Exec(kill); err != nil {
+		log.Printf("[SSH] 结束节点 %s 上的进程失败: %v", sc.node.Name, err)
+	}
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+	}
+	return ctx.Err()
+}
+
 // GetSystemInfo 获取远程系统信息
 func (sc *SSHClient) GetSystemInfo() (map[string]string, error) {
 	info := make(map[string]string)
 
-	client, err := sc.connect()
-	if err != nil {
-		return nil, err
-	}
-	defer client.Close()
-
 	// 一次性获取多项信息
 	cmd := `echo "OS=$(cat /etc/os-release 2>/dev/null | grep ^PRETTY_NAME | cut -d= -f2 | tr -d '"')"
 echo "KERNEL=$(uname -r)"
@@ -130,11 +634,11 @@ echo "DISK=$(df -h / | awk 'NR==2{print $3"/"$2}')"
 echo "NGINX=$(nginx -v 2>&1 | grep -o 'nginx/[0-9.]*' || echo 'not installed')"
 echo "JA3GUARD=$(ja3guard -version 2>&1 || systemctl is-active ja3guard 2>/dev/null || echo 'not installed')"`
 
-	session, err := client.NewSession()
+	session, done, err := sc.session()
 	if err != nil {
 		return nil, err
 	}
-	defer session.Close()
+	defer done()
 
 	var stdout bytes.Buffer
 	session.Stdout = &stdout
@@ -152,99 +656,43 @@ echo "JA3GUARD=$(ja3guard -version 2>&1 || systemctl is-active ja3guard 2>/dev/n
 
 // UploadAndExec 上传脚本内容并执行
 func (sc *SSHClient) UploadAndExec(scriptContent, remotePath string) (string, error) {
-	client, err := sc.connect()
-	if err != nil {
-		return "", err
-	}
-	defer client.Close()
-
-	// 写入脚本
-	session, err := client.NewSession()
-	if err != nil {
-		return "", err
-	}
-	session.Stdin = bytes.NewReader([]byte(scriptContent))
-	if err := session.Run(fmt.Sprintf("cat > %s && chmod +x %s", remotePath, remotePath)); err != nil {
-		session.Close()
-		return "", fmt.Errorf("上传脚本失败: %w", err)
-	}
-	session.Close()
-
-	// 执行脚本
-	session2, err := client.NewSession()
-	if err != nil {
-		return "", err
-	}
-	defer session2.Close()
-
-	var stdout, stderr bytes.Buffer
-	session2.Stdout = &stdout
-	session2.Stderr = &stderr
-
-	if err := session2.Run("bash " + remotePath); err != nil {
-		return stdout.String() + "\n" + stderr.String(), fmt.Errorf("执行脚本失败: %w", err)
-	}
-
-	return stdout.String() + stderr.String(), nil
+	return sc.uploadScript(scriptContent, remotePath, "bash "+shellQuote(remotePath))
 }
 
 // UploadAndRun 上传脚本并以指定环境变量前缀执行
 // envPrefix 示例: "JA3_MODE=node JA3_DOMAIN=sub.example.com JA3_SKIP_NGINX=1"
 func (sc *SSHClient) UploadAndRun(script, remotePath, envPrefix string) (string, error) {
-	client, err := sc.connect()
-	if err != nil {
-		return "", err
-	}
-	defer client.Close()
+	return sc.uploadScript(script, remotePath, envPrefix+" bash "+shellQuote(remotePath)+" node")
+}
 
+// uploadScript 上传脚本后执行 cmd
+func (sc *SSHClient) uploadScript(script, remotePath, cmd string) (string, error) {
 	// 写入脚本
-	session, err := client.NewSession()
-	if err != nil {
-		return "", err
-	}
-	session.Stdin = bytes.NewReader([]byte(script))
-	if err := session.Run(fmt.Sprintf("cat > %s && chmod +x %s", remotePath, remotePath)); err != nil {
-		session.Close()
+	if _, err := sc.PutFile(strings.NewReader(script), remotePath, PutFileOptions{Mode: 0755}); err != nil {
 		return "", fmt.Errorf("上传脚本失败: %w", err)
 	}
-	session.Close()
 
-	// 执行脚本（带环境变量前缀）
-	session2, err := client.NewSession()
+	// 执行脚本
+	session, done, err := sc.session()
 	if err != nil {
 		return "", err
 	}
-	defer session2.Close()
+	defer done()
 
 	var stdout, stderr bytes.Buffer
-	session2.Stdout = &stdout
-	session2.Stderr = &stderr
+	session.Stdout = &stdout
+	session.Stderr = &stderr
 
-	cmd := envPrefix + " bash " + remotePath + " node"
-	if err := session2.Run(cmd); err != nil {
+	if err := session.Run(cmd); err != nil {
 		return stdout.String() + "\n" + stderr.String(), fmt.Errorf("执行脚本失败: %w", err)
 	}
 
 	return stdout.String() + stderr.String(), nil
 }
 
-// WriteFile 通过 SSH 写入文件到远程服务器
-func (sc *SSHClient) WriteFile(content, remotePath string) error {
-	client, err := sc.connect()
-	if err != nil {
-		return err
-	}
-	defer client.Close()
-
-	session, err := client.NewSession()
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-
-	session.Stdin = bytes.NewReader([]byte(content))
-	cmd := fmt.Sprintf("mkdir -p $(dirname %s) && cat > %s", remotePath, remotePath)
-	if err := session.Run(cmd); err != nil {
+// WriteFile 通过 SFTP 写入文件到远程服务器（先写临时文件，校验后原子替换），权限为 mode
+func (sc *SSHClient) WriteFile(content, remotePath string, mode os.FileMode) error {
+	if _, err := sc.PutFile(strings.NewReader(content), remotePath, PutFileOptions{Mode: mode}); err != nil {
 		return fmt.Errorf("写入文件失败: %w", err)
 	}
 	return nil
@@ -252,7 +700,7 @@ func (sc *SSHClient) WriteFile(content, remotePath string) error {
 
 // CheckPort 检查远程端口是否开放
 func (sc *SSHClient) CheckPort(port int) bool {
-	addr := fmt.Sprintf("%s:%d", sc.node.Host, port)
+	addr := net.JoinHostPort(sc.node.Host, strconv.Itoa(port))
 	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
 	if err != nil {
 		return false
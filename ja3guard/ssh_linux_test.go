@@ -0,0 +1,126 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// assertExecStreamKillsGroup 取消 ExecStream 后，命令在后台启动的子进程也应被结束
+func assertExecStreamKillsGroup(t *testing.T, client *SSHClient) {
+	t.Helper()
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		// 子进程在后台运行，只结束 shell 不够，必须结束整个进程组
+		done <- client.ExecStream(ctx, "sleep 60 & echo $! > "+pidFile+"; wait", io.Discard, io.Discard)
+	}()
+
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("命令未启动")
+		}
+		data, _ := os.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("取消后应返回 context.Canceled，实际 %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("取消后 ExecStream 未返回")
+	}
+	// 后台的 sleep 与 shell 同属一个进程组，应已被结束（孤儿进程由 init 回收，稍等片刻）
+	for deadline := time.Now().Add(5 * time.Second); syscall.Kill(pid, 0) == nil; {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("取消后远程进程 %d 仍在运行", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func newExecStreamClient(t *testing.T) *SSHClient {
+	t.Helper()
+	srv := newTestSSHServer(t)
+	node := srv.node()
+	node.SSHHostKey = srv.hostKey()
+	return NewSSHClient(node, nil, NewSSHPool())
+}
+
+func TestSSHExecStreamKillsProcessGroup(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("需要 setsid")
+	}
+	assertExecStreamKillsGroup(t, newExecStreamClient(t))
+}
+
+func TestSSHExecStreamBusyBoxSetsid(t *testing.T) {
+	setsidPath, err := exec.LookPath("setsid")
+	if err != nil {
+		t.Skip("需要 setsid")
+	}
+	// 模拟 BusyBox 的 setsid：不支持 -w
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %s\ncase \"$1\" in -*) echo \"setsid: unrecognized option: $1\" >&2; exit 1;; esac\nexec %s \"$@\"\n", calls, setsidPath)
+	if err := os.WriteFile(filepath.Join(dir, "setsid"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	client := newExecStreamClient(t)
+	var out bytes.Buffer
+	if err := client.ExecStream(context.Background(), "echo hello", &out, io.Discard); err != nil {
+		t.Fatalf("setsid 不支持 -w 时应退回不带 -w 执行: %v", err)
+	}
+	if strings.TrimSpace(out.String()) != "hello" {
+		t.Fatalf("输出 = %q", out.String())
+	}
+	data, _ := os.ReadFile(calls)
+	if !strings.Contains(string(data), "\nsh -c ") {
+		t.Fatalf("应不带 -w 调用 setsid，实际调用: %q", data)
+	}
+	assertExecStreamKillsGroup(t, client)
+}
+
+func TestSSHExecStreamWithoutSetsid(t *testing.T) {
+	// PATH 中只有命令需要的程序，没有 setsid
+	dir := t.TempDir()
+	for _, name := range []string{"sh", "cat", "rm"} {
+		p, err := exec.LookPath(name)
+		if err != nil {
+			t.Skipf("需要 %s", name)
+		}
+		if err := os.Symlink(p, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv("SHELL", filepath.Join(dir, "sh"))
+
+	var out bytes.Buffer
+	if err := newExecStreamClient(t).ExecStream(context.Background(), "echo hello; exit 3", &out, io.Discard); err == nil {
+		t.Fatal("应返回命令的退出码")
+	}
+	if strings.TrimSpace(out.String()) != "hello" {
+		t.Fatalf("没有 setsid 时也应执行命令，输出 = %q", out.String())
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	sshPoolIdleTimeout = 5 * time.Minute  // 连接空闲超过该时间后关闭
+	sshPoolKeepalive   = 30 * time.Second // 空闲连接的心跳间隔
+)
+
+// SSHPool 按节点复用 SSH 连接（含跳板机连接）。部署等操作连续执行多条命令时不必每次重新握手
+type SSHPool struct {
+	mu    sync.Mutex
+	conns map[string]*pooledSSH
+}
+
+type pooledSSH struct {
+	nodeID   string
+	sig      string // 连接参数摘要，节点改了地址、认证或跳板机后不再复用
+	conn     *sshConn
+	users    int
+	lastUsed time.Time
+	closed   bool // 已从连接池移除，最后一个使用者归还时关闭
+}
+
+func NewSSHPool() *SSHPool {
+	p := &SSHPool{conns: make(map[string]*pooledSSH)}
+	go p.janitor()
+	return p
+}
+
+// sshConnSignature 连接参数摘要，不含主机公钥（公钥变化由 Forget 处理）
+func sshConnSignature(node *NodeInfo) string {
+	hops := node.sshHops()
+	for i := range hops {
+		hops[i].SSHHostKey, hops[i].SSHHostKeyPending, hops[i].SSHHostKeyAt = "", "", ""
+	}
+	data, _ := json.Marshal(hops)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get 取得节点的连接，没有可用连接时调用 dial 新建
+func (p *SSHPool) Get(node *NodeInfo, dial func() (*sshConn, error)) (*pooledSSH, error) {
+	sig := sshConnSignature(node)
+	p.mu.Lock()
+	if pc := p.conns[node.ID]; pc != nil {
+		if pc.sig == sig {
+			pc.users++
+			pc.lastUsed = time.Now()
+			p.mu.Unlock()
+			return pc, nil
+		}
+		p.removeLocked(pc)
+	}
+	p.mu.Unlock()
+
+	// 握手较慢，不持锁
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc := p.conns[node.ID]; pc != nil && pc.sig == sig {
+		// 并发建立了连接：使用已有的，关闭多余的
+		conn.Close()
+		pc.users++
+		pc.lastUsed = time.Now()
+		return pc, nil
+	} else if pc != nil {
+		p.removeLocked(pc)
+	}
+	pc := &pooledSSH{nodeID: node.ID, sig: sig, conn: conn, users: 1, lastUsed: time.Now()}
+	p.conns[node.ID] = pc
+	return pc, nil
+}
+
+// Put 归还连接
+func (p *SSHPool) Put(pc *pooledSSH) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.users--
+	pc.lastUsed = time.Now()
+	if pc.closed && pc.users == 0 {
+		pc.conn.Close()
+	}
+}
+
+// Forget 移除节点的连接（节点删除、主机公钥变更或连接已断开时调用），正在使用的连接用完后关闭
+func (p *SSHPool) Forget(nodeID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc := p.conns[nodeID]; pc != nil {
+		p.removeLocked(pc)
+	}
+}
+
+func (p *SSHPool) removeLocked(pc *pooledSSH) {
+	if p.conns[pc.nodeID] == pc {
+		delete(p.conns, pc.nodeID)
+	}
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	if pc.users == 0 {
+		pc.conn.Close()
+	}
+}
+
+// janitor 定时关闭空闲连接，并向保留的连接发送心跳，断开的连接及时移除
+func (p *SSHPool) janitor() {
+	ticker := time.NewTicker(sshPoolKeepalive)
+	defer ticker.Stop()
+	for range ticker.C {
+		var alive []*pooledSSH
+		p.mu.Lock()
+		for _, pc := range p.conns {
+			if pc.users == 0 && time.Since(pc.lastUsed) > sshPoolIdleTimeout {
+				p.removeLocked(pc)
+				continue
+			}
+			alive = append(alive, pc)
+		}
+		p.mu.Unlock()
+
+		for _, pc := range alive {
+			go p.keepalive(pc)
+		}
+	}
+}
+
+// keepalive 发送心跳，超时或失败时移除连接
+func (p *SSHPool) keepalive(pc *pooledSSH) {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := pc.conn.client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(15 * time.Second):
+		err = errors.New("心跳超时")
+	}
+	if err == nil {
+		return
+	}
+	log.Printf("[SSH] 节点 %s 的连接已断开: %v", pc.nodeID, err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeLocked(pc)
+}
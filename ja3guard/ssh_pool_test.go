@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestSSHPoolReusesConnection(t *testing.T) {
+	srv := newTestSSHServer(t)
+	pool := NewSSHPool()
+	node := srv.node()
+	node.SSHHostKey = srv.hostKey()
+
+	for i := 0; i < 3; i++ {
+		if _, err := NewSSHClient(node, nil, pool).Exec("true"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.connCount(); n != 1 {
+		t.Fatalf("连接池应复用同一个连接，实际建立了 %d 个", n)
+	}
+
+	// 连接参数变化后不再复用
+	changed := *node
+	changed.SSHUser = "other"
+	NewSSHClient(&changed, nil, pool).Exec("true")
+	if _, err := NewSSHClient(node, nil, pool).Exec("true"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.connCount(); n != 2 {
+		t.Fatalf("连接参数变化后应重新连接，实际共 %d 个连接", n)
+	}
+
+	// Forget 后重新连接
+	pool.Forget(node.ID)
+	if _, err := NewSSHClient(node, nil, pool).Exec("true"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.connCount(); n != 3 {
+		t.Fatalf("Forget 后应重新连接，实际共 %d 个连接", n)
+	}
+
+	// 没有连接池时每次单独连接
+	for i := 0; i < 2; i++ {
+		if _, err := NewSSHClient(node, nil, nil).Exec("true"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.connCount(); n != 5 {
+		t.Fatalf("不使用连接池时每次操作单独连接，实际共 %d 个连接", n)
+	}
+}
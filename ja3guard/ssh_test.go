@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer 进程内 SSH 服务端：密码认证，exec 请求交给本机 sh 执行，提供 sftp 子系统，
+// 支持 direct-tcpip 转发（充当跳板机）
+type testSSHServer struct {
+	addr     string
+	key      ssh.Signer
+	mu       sync.Mutex
+	conns    int      // 完成握手的连接数
+	forwards []string // 经本机转发的目标地址
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	s := &testSSHServer{key: newTestSSHSigner(t)}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "test" && string(pass) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("认证失败")
+		},
+	}
+	cfg.AddHostKey(s.key)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s.addr = ln.Addr().String()
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(nc, cfg)
+		}
+	}()
+	return s
+}
+
+func newTestSSHSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func (s *testSSHServer) handle(nc net.Conn, cfg *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	defer sconn.Close()
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		switch nch.ChannelType() {
+		case "session":
+			go s.session(nch)
+		case "direct-tcpip":
+			go s.forward(nch)
+		default:
+			nch.Reject(ssh.UnknownChannelType, "")
+		}
+	}
+}
+
+func (s *testSSHServer) session(nch ssh.NewChannel) {
+	ch, reqs, err := nch.Accept()
+	if err != nil {
+		return
+	}
+	for req := range reqs {
+		if req.Type == "subsystem" && string(req.Payload[4:]) == "sftp" {
+			req.Reply(true, nil)
+			go func() {
+				if srv, err := sftp.NewServer(ch); err == nil {
+					srv.Serve()
+				}
+				ch.Close()
+			}()
+			continue
+		}
+		if req.Type != "exec" {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+		go func() {
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+			code := 0
+			if err := cmd.Run(); err != nil {
+				code = 255
+				var exitErr *exec.ExitError
+				if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+					code = exitErr.ExitCode()
+				}
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Code uint32 }{uint32(code)}))
+			ch.Close()
+		}()
+	}
+}
+
+func (s *testSSHServer) forward(nch ssh.NewChannel) {
+	var target struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(nch.ExtraData(), &target); err != nil {
+		nch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	addr := net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port)))
+	s.mu.Lock()
+	s.forwards = append(s.forwards, addr)
+	s.mu.Unlock()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		nch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nch.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, conn)
+		ch.Close()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+}
+
+func (s *testSSHServer) connCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// jump 以本服务端为跳板机
+func (s *testSSHServer) jump() SSHJump {
+	host, port, _ := net.SplitHostPort(s.addr)
+	p, _ := strconv.Atoi(port)
+	return SSHJump{Host: host, SSHPort: p, SSHUser: "test", SSHAuth: SSHAuth{AuthType: SSHAuthPassword, SSHPass: "secret"}}
+}
+
+// node 以本服务端为目标的节点
+func (s *testSSHServer) node() *NodeInfo {
+	j := s.jump()
+	return &NodeInfo{ID: "n1", Name: "test-node", Host: j.Host, SSHPort: j.SSHPort, SSHUser: j.SSHUser, SSHAuth: j.SSHAuth}
+}
+
+func (s *testSSHServer) hostKey() string {
+	return marshalSSHHostKey(s.key.PublicKey())
+}
+
+// memHostKeys 内存中的 SSHHostKeyStore
+type memHostKeys struct {
+	mu      sync.Mutex
+	trusted map[int]string
+	pending map[int]string
+}
+
+func newMemHostKeys() *memHostKeys {
+	return &memHostKeys{trusted: make(map[int]string), pending: make(map[int]string)}
+}
+
+func (m *memHostKeys) TrustSSHHostKey(id string, hop int, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.trusted[hop]; ok {
+		return k, nil
+	}
+	m.trusted[hop] = key
+	return key, nil
+}
+
+func (m *memHostKeys) SetPendingSSHHostKey(id string, hop int, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[hop] = key
+	return nil
+}
+
+func TestSSHFirstConnectPinsHostKey(t *testing.T) {
+	srv := newTestSSHServer(t)
+	keys := newMemHostKeys()
+
+	out, err := NewSSHClient(srv.node(), keys, nil).Exec("echo hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out) != "hello" {
+		t.Fatalf("输出 = %q", out)
+	}
+	if keys.trusted[0] != srv.hostKey() {
+		t.Fatalf("首次连接应记录主机公钥，记录的是 %q", keys.trusted[0])
+	}
+
+	// 记录后按已保存的公钥校验
+	node := srv.node()
+	node.SSHHostKey = keys.trusted[0]
+	if err := NewSSHClient(node, nil, nil).TestConnection(); err != nil {
+		t.Fatalf("已记录公钥后连接失败: %v", err)
+	}
+}
+
+func TestSSHUnknownHostKeyWithoutStore(t *testing.T) {
+	srv := newTestSSHServer(t)
+	if _, err := NewSSHClient(srv.node(), nil, nil).Exec("true"); err == nil {
+		t.Fatal("没有记录公钥且不能保存时应拒绝连接")
+	}
+}
+
+func TestSSHChangedHostKeyRejectedAndPending(t *testing.T) {
+	srv := newTestSSHServer(t)
+	keys := newMemHostKeys()
+	old := marshalSSHHostKey(newTestSSHSigner(t).PublicKey())
+	node := srv.node()
+	node.SSHHostKey = old
+
+	_, err := NewSSHClient(node, keys, nil).Exec("echo should-not-run")
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("主机公钥变化应返回 HostKeyMismatchError，实际 %v", err)
+	}
+	if mismatch.Hop != "" || mismatch.Expected != sshHostKeyFingerprint(old) || mismatch.Got != ssh.FingerprintSHA256(srv.key.PublicKey()) {
+		t.Fatalf("错误信息不正确: %+v", mismatch)
+	}
+	if keys.pending[0] != srv.hostKey() {
+		t.Fatalf("新公钥应记录为待确认，实际 %q", keys.pending[0])
+	}
+	if len(keys.trusted) != 0 {
+		t.Fatalf("不应改动已记录的公钥: %v", keys.trusted)
+	}
+}
+
+func TestSSHProxyJump(t *testing.T) {
+	bastion := newTestSSHServer(t)
+	target := newTestSSHServer(t)
+	keys := newMemHostKeys()
+	node := target.node()
+	node.ProxyJump = []SSHJump{bastion.jump()}
+
+	out, err := NewSSHClient(node, keys, nil).Exec("echo via-jump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out) != "via-jump" {
+		t.Fatalf("输出 = %q", out)
+	}
+	// 每一跳分别记录自己的主机公钥
+	if keys.trusted[0] != bastion.hostKey() || keys.trusted[1] != target.hostKey() {
+		t.Fatalf("记录的主机公钥不正确: %v", keys.trusted)
+	}
+	bastion.mu.Lock()
+	forwards := append([]string(nil), bastion.forwards...)
+	bastion.mu.Unlock()
+	if len(forwards) != 1 || forwards[0] != target.addr {
+		t.Fatalf("跳板机应转发到 %s，实际 %v", target.addr, forwards)
+	}
+
+	// 跳板机公钥变化：拒绝连接，错误指明跳板机，新公钥记录在跳板机对应的下标
+	node.ProxyJump[0].SSHHostKey = marshalSSHHostKey(newTestSSHSigner(t).PublicKey())
+	node.SSHHostKey = keys.trusted[1]
+	_, err = NewSSHClient(node, keys, nil).Exec("true")
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Hop != bastion.addr {
+		t.Fatalf("跳板机公钥变化应返回指明跳板机的错误，实际 %v", err)
+	}
+	if keys.pending[0] != bastion.hostKey() {
+		t.Fatalf("跳板机的新公钥应记录为待确认: %v", keys.pending)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// 存储后端类型
+const (
+	StorageFile   = "file"   // JSON / JSONL 文件（默认）
+	StorageSQLite = "sqlite" // 内嵌 SQLite（纯 Go，无需 CGO）
+)
+
+// WhitelistBackend 白名单持久化
+type WhitelistBackend interface {
+	// LoadWhitelist 返回白名单及其版本号，从未记录过版本时为 0
+	LoadWhitelist() ([]WhitelistEntry, int64, error)
+	// SaveWhitelist 整体保存白名单和版本号，实现需保证白名单本身的原子性
+	SaveWhitelist(entries []WhitelistEntry, version int64) error
+}
+
+// LogBackend 请求日志持久化
+type LogBackend interface {
+	AppendLogs(entries []LogEntry) error
+	// AppendNodeLogs 追加节点上报的一批日志，batchID 非空且已记录过时不写入并返回 false
+	AppendNodeLogs(nodeID, batchID string, entries []LogEntry) (bool, error)
+	// QueryLogs 分页获取日志（最新在前），返回当页日志和总数；nodeID 为空表示全部节点
+	QueryLogs(nodeID string, page, size int) ([]LogEntry, int, error)
+	LogStats() (Stats, error)
+	// LogSummary 按 JA3 hash 聚合，InWhitelist 由 Store 填充；nodeID 为空表示全部节点
+	LogSummary(nodeID string) ([]JA3Summary, error)
+	// AllLogs 按写入顺序返回全部日志
+	AllLogs() ([]LogEntry, error)
+	// CleanupLogs 删除时间戳早于 cutoff 的日志
+	CleanupLogs(cutoff string) error
+	// ReadLogsFrom 读取游标之后最多 limit 条日志，返回下一次读取的游标。
+	// 游标单调递增且在日志清理后依然有效（文件后端为逻辑字节偏移，SQLite 为行 ID）
+	ReadLogsFrom(cursor int64, limit int) ([]LogEntry, int64, error)
+	// LogCursorEnd 返回当前日志末尾的游标
+	LogCursorEnd() (int64, error)
+}
+
+// NodeBackend 节点信息持久化（Master 模式）
+type NodeBackend interface {
+	LoadNodes() ([]NodeInfo, error)
+	SaveNodes(nodes []NodeInfo) error
+}
+
+// StatusBackend 节点运行状态持久化，Master 重启后保留最后一次上报
+type StatusBackend interface {
+	LoadStatuses() (map[string]*NodeStatus, error)
+	SaveStatus(status *NodeStatus) error
+	DeleteStatus(nodeID string) error
+}
+
+// ConfigBackend 节点期望配置持久化（Master 模式），整体读写
+type ConfigBackend interface {
+	// LoadNodeConfigs 从未保存过时返回 nil
+	LoadNodeConfigs() (*NodeConfigState, error)
+	SaveNodeConfigs(state *NodeConfigState) error
+}
+
+// CommandBackend 节点命令队列持久化（Master 模式），整体读写
+type CommandBackend interface {
+	LoadCommands() ([]NodeCommand, error)
+	SaveCommands(commands []NodeCommand) error
+}
+
+// JobBackend 异步任务历史持久化（Master 模式），整体读写
+type JobBackend interface {
+	LoadJobs() ([]Job, error)
+	SaveJobs(jobs []Job) error
+}
+
+// CredentialProfileBackend 共享 SSH 凭据持久化（Master 模式），整体读写，凭据字段已加密
+type CredentialProfileBackend interface {
+	LoadCredentialProfiles() ([]CredentialProfile, error)
+	SaveCredentialProfiles(profiles []CredentialProfile) error
+}
+
+// UserBackend 管理面板用户持久化，整体读写，密码为 bcrypt 哈希
+type UserBackend interface {
+	LoadUsers() ([]User, error)
+	SaveUsers(users []User) error
+}
+
+// AuditBackend 远程执行审计记录持久化（Master 模式），只追加不修改
+type AuditBackend interface {
+	AppendAudit(rec *AuditRecord) error
+	// LoadAudit 按序号升序返回全部审计记录
+	LoadAudit() ([]AuditRecord, error)
+}
+
+// Backend 完整的存储后端
+type Backend interface {
+	WhitelistBackend
+	LogBackend
+	NodeBackend
+	StatusBackend
+	ConfigBackend
+	CommandBackend
+	JobBackend
+	CredentialProfileBackend
+	AuditBackend
+	UserBackend
+	Close() error
+}
+
+// OpenBackend 按配置打开存储后端
+func OpenBackend(cfg *Config) (Backend, error) {
+	switch cfg.StorageBackend {
+	case "", StorageFile:
+		return NewFileBackend(cfg.DataDir)
+	case StorageSQLite:
+		return NewSQLiteBackend(cfg.SQLitePath())
+	default:
+		return nil, fmt.Errorf("不支持的存储后端: %s", cfg.StorageBackend)
+	}
+}
+
+// SQLitePath 返回 SQLite 数据库路径（默认 data_dir/ja3guard.db）
+func (c *Config) SQLitePath() string {
+	if c.SQLiteFile != "" {
+		return c.SQLiteFile
+	}
+	return filepath.Join(c.DataDir, "ja3guard.db")
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileBackend 基于文件的存储后端（默认）
+// 白名单: data/whitelist.json（whitelist.version 记录版本号）
+// 日志:   data/ja3_logs.jsonl（清理后首行 {"log_base":N} 记录清理掉的字节数，用于保持游标稳定）
+// 节点:   data/nodes.json
+// 状态:   data/node_status.json
+// 批次:   data/report_batches.json（节点上报批次去重）
+type FileBackend struct {
+	dataDir  string
+	logMu    sync.Mutex // 串行化日志追加与清理，同时保护 batches
+	stMu     sync.Mutex // 保护 statuses
+	statuses map[string]*NodeStatus
+	batches  map[string][]string // nodeID -> 最近收到的批次 ID
+}
+
+// 每个节点保留的已收批次 ID 数量
+const maxRecentBatches = 1000
+
+func NewFileBackend(dataDir string) (*FileBackend, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	fb := &FileBackend{dataDir: dataDir}
+	statuses, err := fb.readStatuses()
+	if err != nil {
+		return nil, err
+	}
+	fb.statuses = statuses
+	if fb.batches, err = fb.readBatches(); err != nil {
+		return nil, err
+	}
+	return fb, nil
+}
+
+func (fb *FileBackend) whitelistPath() string {
+	return filepath.Join(fb.dataDir, "whitelist.json")
+}
+
+func (fb *FileBackend) whitelistVersionPath() string {
+	return filepath.Join(fb.dataDir, "whitelist.version")
+}
+
+func (fb *FileBackend) logPath() string {
+	return filepath.Join(fb.dataDir, "ja3_logs.jsonl")
+}
+
+// logBasePath 旧版本单独保存清理字节数的文件，只在日志没有首行记录时读取
+func (fb *FileBackend) logBasePath() string {
+	return filepath.Join(fb.dataDir, "ja3_logs.base")
+}
+
+func (fb *FileBackend) batchesPath() string {
+	return filepath.Join(fb.dataDir, "report_batches.json")
+}
+
+func (fb *FileBackend) nodesPath() string {
+	return filepath.Join(fb.dataDir, "nodes.json")
+}
+
+func (fb *FileBackend) statusPath() string {
+	return filepath.Join(fb.dataDir, "node_status.json")
+}
+
+func (fb *FileBackend) nodeConfigsPath() string {
+	return filepath.Join(fb.dataDir, "node_configs.json")
+}
+
+func (fb *FileBackend) commandsPath() string {
+	return filepath.Join(fb.dataDir, "node_commands.json")
+}
+
+func (fb *FileBackend) jobsPath() string {
+	return filepath.Join(fb.dataDir, "jobs.json")
+}
+
+func (fb *FileBackend) credentialProfilesPath() string {
+	return filepath.Join(fb.dataDir, "credential_profiles.json")
+}
+
+func (fb *FileBackend) usersPath() string {
+	return filepath.Join(fb.dataDir, "users.json")
+}
+
+func (fb *FileBackend) auditPath() string {
+	return filepath.Join(fb.dataDir, "audit.jsonl")
+}
+
+func (fb *FileBackend) Close() error {
+	return nil
+}
+
+// --- 白名单 ---
+
+func (fb *FileBackend) LoadWhitelist() ([]WhitelistEntry, int64, error) {
+	data, err := os.ReadFile(fb.whitelistPath())
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var entries []WhitelistEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, fb.readWhitelistVersion(), nil
+}
+
+// readWhitelistVersion 版本文件缺失或损坏时返回 0（未知版本，同步时按全量处理）
+func (fb *FileBackend) readWhitelistVersion() int64 {
+	data, err := os.ReadFile(fb.whitelistVersionPath())
+	if err != nil {
+		return 0
+	}
+	v, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return v
+}
+
+// SaveWhitelist 先写白名单再写版本号。两步之间崩溃时版本号偏旧，
+// 之后收到的增量按 hash 覆盖 / 删除，重复应用结果不变
+func (fb *FileBackend) SaveWhitelist(entries []WhitelistEntry, version int64) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fb.whitelistPath(), data, 0644); err != nil {
+		return err
+	}
+	return writeFileAtomic(fb.whitelistVersionPath(), []byte(strconv.FormatInt(version, 10)+"\n"), 0644)
+}
+
+// --- 日志 ---
+
+// AppendLogs 追加日志（JSONL 格式，O_APPEND 原子写入）
+func (fb *FileBackend) AppendLogs(entries []LogEntry) error {
+	fb.logMu.Lock()
+	defer fb.logMu.Unlock()
+	return fb.appendLogsLocked(entries)
+}
+
+func (fb *FileBackend) appendLogsLocked(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf []byte
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+		buf = append(buf, '\n')
+	}
+
+	f, err := os.OpenFile(fb.logPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(buf)
+	return err
+}
+
+// AppendNodeLogs 追加节点日志并记录批次 ID。
+// 先写日志后记批次：两步之间崩溃时批次可能被重复写入一次，但不会丢失
+func (fb *FileBackend) AppendNodeLogs(nodeID, batchID string, entries []LogEntry) (bool, error) {
+	fb.logMu.Lock()
+	defer fb.logMu.Unlock()
+
+	if batchID != "" {
+		for _, id := range fb.batches[nodeID] {
+			if id == batchID {
+				return false, nil
+			}
+		}
+	}
+	if err := fb.appendLogsLocked(entries); err != nil {
+		return false, err
+	}
+	if batchID == "" {
+		return true, nil
+	}
+
+	recent := append(fb.batches[nodeID], batchID)
+	if len(recent) > maxRecentBatches {
+		recent = recent[len(recent)-maxRecentBatches:]
+	}
+	fb.batches[nodeID] = recent
+	data, err := json.Marshal(fb.batches)
+	if err != nil {
+		return true, err
+	}
+	return true, writeFileAtomic(fb.batchesPath(), data, 0644)
+}
+
+func (fb *FileBackend) readBatches() (map[string][]string, error) {
+	batches := make(map[string][]string)
+	data, err := os.ReadFile(fb.batchesPath())
+	if os.IsNotExist(err) {
+		return batches, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &batches); err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// filterLogs 按来源节点过滤
+func filterLogs(logs []LogEntry, nodeID string) []LogEntry {
+	if nodeID == "" {
+		return logs
+	}
+	filtered := logs[:0]
+	for _, l := range logs {
+		if l.NodeID == nodeID {
+			filtered = append(filtered, l)
+		}
+	}
+	return filtered
+}
+
+func (fb *FileBackend) AllLogs() ([]LogEntry, error) {
+	f, err := os.Open(fb.logPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var logs []LogEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 256*1024), 1024*1024)
+	first := true
+	for scanner.Scan() {
+		if first {
+			first = false
+			if _, ok := parseLogHeader(scanner.Bytes()); ok {
+				continue
+			}
+		}
+		var entry LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			logs = append(logs, entry)
+		}
+	}
+	return logs, scanner.Err()
+}
+
+func (fb *FileBackend) QueryLogs(nodeID string, page, size int) ([]LogEntry, int, error) {
+	logs, err := fb.AllLogs()
+	if err != nil {
+		return nil, 0, err
+	}
+	logs = filterLogs(logs, nodeID)
+	total := len(logs)
+
+	// 倒序（最新在前）
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
+	}
+
+	start := (page - 1) * size
+	if start >= total {
+		return nil, total, nil
+	}
+	end := start + size
+	if end > total {
+		end = total
+	}
+	return logs[start:end], total, nil
+}
+
+func (fb *FileBackend) LogStats() (Stats, error) {
+	logs, err := fb.AllLogs()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{TotalRequests: len(logs)}
+	for _, l := range logs {
+		if l.Trusted {
+			stats.TrustedCount++
+		}
+	}
+	stats.BlockedCount = stats.TotalRequests - stats.TrustedCount
+	return stats, nil
+}
+
+func (fb *FileBackend) LogSummary(nodeID string) ([]JA3Summary, error) {
+	logs, err := fb.AllLogs()
+	if err != nil {
+		return nil, err
+	}
+	logs = filterLogs(logs, nodeID)
+
+	m := make(map[string]*JA3Summary)
+	for _, l := range logs {
+		s, ok := m[l.JA3Hash]
+		if !ok {
+			s = &JA3Summary{JA3Hash: l.JA3Hash}
+			m[l.JA3Hash] = s
+		}
+		s.Count++
+		s.LastUA = l.UA
+		s.LastIP = l.IP
+		s.LastSeen = l.Timestamp
+	}
+
+	summaries := make([]JA3Summary, 0, len(m))
+	for _, s := range m {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Count > summaries[j].Count
+	})
+	return summaries, nil
+}
+
+// CleanupLogs 按追加顺序裁掉开头早于 cutoff 的日志。
+// 只删除前缀，被删除的字节数累加到首行的 log_base，已发出的游标不会错位。
+// 裁剪后的日志和 log_base 在同一个文件里一次原子替换，中途崩溃不会出现两者不一致
+func (fb *FileBackend) CleanupLogs(cutoff string) error {
+	fb.logMu.Lock()
+	defer fb.logMu.Unlock()
+
+	data, err := os.ReadFile(fb.logPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	base, start, err := fb.logBase(data)
+	if err != nil {
+		return err
+	}
+
+	removed := start
+	for removed < len(data) {
+		end := bytes.IndexByte(data[removed:], '\n')
+		if end < 0 {
+			break
+		}
+		var entry LogEntry
+		if json.Unmarshal(data[removed:removed+end], &entry) == nil && entry.Timestamp >= cutoff {
+			break
+		}
+		removed += end + 1
+	}
+	if removed == start {
+		return nil
+	}
+
+	out := logHeader(base + int64(removed-start))
+	out = append(out, data[removed:]...)
+	if err := writeFileAtomic(fb.logPath(), out, 0644); err != nil {
+		return err
+	}
+	// 旧版本的 ja3_logs.base 已并入首行
+	if err := os.Remove(fb.logBasePath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// logHeader 日志首行，记录已清理的字节数
+func logHeader(base int64) []byte {
+	return []byte(`{"log_base":` + strconv.FormatInt(base, 10) + "}\n")
+}
+
+// parseLogHeader 识别日志首行（不含换行符）
+func parseLogHeader(line []byte) (int64, bool) {
+	if !bytes.HasPrefix(line, []byte(`{"log_base":`)) {
+		return 0, false
+	}
+	var h struct {
+		LogBase int64 `json:"log_base"`
+	}
+	if json.Unmarshal(line, &h) != nil {
+		return 0, false
+	}
+	return h.LogBase, true
+}
+
+// logBase 根据日志开头的内容返回已清理的字节数和首条日志在文件中的偏移。
+// 游标 = base + (文件偏移 - 首条日志偏移)
+func (fb *FileBackend) logBase(head []byte) (int64, int, error) {
+	if end := bytes.IndexByte(head, '\n'); end >= 0 {
+		if base, ok := parseLogHeader(head[:end]); ok {
+			return base, end + 1, nil
+		}
+	}
+	data, err := os.ReadFile(fb.logBasePath())
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	base, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return base, 0, err
+}
+
+// openLog 打开日志文件并读取首行记录，文件不存在时返回 nil
+func (fb *FileBackend) openLog() (*os.File, int64, int, error) {
+	f, err := os.Open(fb.logPath())
+	if os.IsNotExist(err) {
+		base, _, err := fb.logBase(nil)
+		return nil, base, 0, err
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	head := make([]byte, 64)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	base, start, err := fb.logBase(head[:n])
+	if err != nil {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	return f, base, start, nil
+}
+
+func (fb *FileBackend) ReadLogsFrom(cursor int64, limit int) ([]LogEntry, int64, error) {
+	fb.logMu.Lock()
+	defer fb.logMu.Unlock()
+
+	f, base, start, err := fb.openLog()
+	if err != nil {
+		return nil, cursor, err
+	}
+	// 游标之前的日志已被清理，从现存的第一条开始
+	if cursor < base {
+		cursor = base
+	}
+	if f == nil {
+		return nil, cursor, nil
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(int64(start)+cursor-base, io.SeekStart); err != nil {
+		return nil, cursor, err
+	}
+
+	var logs []LogEntry
+	r := bufio.NewReaderSize(f, 64*1024)
+	for len(logs) < limit {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// 不完整的末行留到下次读取
+			break
+		}
+		cursor += int64(len(line))
+		var entry LogEntry
+		if json.Unmarshal(line, &entry) == nil {
+			logs = append(logs, entry)
+		}
+	}
+	return logs, cursor, nil
+}
+
+func (fb *FileBackend) LogCursorEnd() (int64, error) {
+	fb.logMu.Lock()
+	defer fb.logMu.Unlock()
+
+	f, base, start, err := fb.openLog()
+	if err != nil || f == nil {
+		return base, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return base + fi.Size() - int64(start), nil
+}
+
+// --- 节点 ---
+
+func (fb *FileBackend) LoadNodes() ([]NodeInfo, error) {
+	data, err := os.ReadFile(fb.nodesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nodes []NodeInfo
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (fb *FileBackend) SaveNodes(nodes []NodeInfo) error {
+	data, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fb.nodesPath(), data, 0600) // 0600: 含敏感信息
+}
+
+// --- 节点期望配置 ---
+
+func (fb *FileBackend) LoadNodeConfigs() (*NodeConfigState, error) {
+	data, err := os.ReadFile(fb.nodeConfigsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state NodeConfigState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (fb *FileBackend) SaveNodeConfigs(state *NodeConfigState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fb.nodeConfigsPath(), data, 0600) // 0600: 含 guard_secret
+}
+
+// --- 节点命令队列 ---
+
+func (fb *FileBackend) LoadCommands() ([]NodeCommand, error) {
+	data, err := os.ReadFile(fb.commandsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var commands []NodeCommand
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+func (fb *FileBackend) SaveCommands(commands []NodeCommand) error {
+	data, err := json.MarshalIndent(commands, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fb.commandsPath(), data, 0644)
+}
+
+// --- 异步任务历史 ---
+
+func (fb *FileBackend) LoadJobs() ([]Job, error) {
+	data, err := os.ReadFile(fb.jobsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (fb *FileBackend) SaveJobs(jobs []Job) error {
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fb.jobsPath(), data, 0600) // 0600: 输出中可能含远程主机信息
+}
+
+// --- 共享 SSH 凭据 ---
+
+func (fb *FileBackend) LoadCredentialProfiles() ([]CredentialProfile, error) {
+	data, err := os.ReadFile(fb.credentialProfilesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var profiles []CredentialProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+func (fb *FileBackend) SaveCredentialProfiles(profiles []CredentialProfile) error {
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fb.credentialProfilesPath(), data, 0600)
+}
+
+// --- 管理面板用户 ---
+
+func (fb *FileBackend) LoadUsers() ([]User, error) {
+	data, err := os.ReadFile(fb.usersPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (fb *FileBackend) SaveUsers(users []User) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fb.usersPath(), data, 0600)
+}
+
+// --- 审计记录 ---
+
+// AppendAudit 以追加方式写入一行并同步到磁盘，已有内容从不改写
+func (fb *FileBackend) AppendAudit(rec *AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fb.auditPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (fb *FileBackend) LoadAudit() ([]AuditRecord, error) {
+	data, err := os.ReadFile(fb.auditPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []AuditRecord
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("audit.jsonl 第 %d 行: %w", i+1, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// --- 节点状态 ---
+
+func (fb *FileBackend) readStatuses() (map[string]*NodeStatus, error) {
+	statuses := make(map[string]*NodeStatus)
+	data, err := os.ReadFile(fb.statusPath())
+	if os.IsNotExist(err) {
+		return statuses, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (fb *FileBackend) LoadStatuses() (map[string]*NodeStatus, error) {
+	fb.stMu.Lock()
+	defer fb.stMu.Unlock()
+
+	result := make(map[string]*NodeStatus, len(fb.statuses))
+	for id, s := range fb.statuses {
+		c := *s
+		result[id] = &c
+	}
+	return result, nil
+}
+
+func (fb *FileBackend) SaveStatus(status *NodeStatus) error {
+	fb.stMu.Lock()
+	defer fb.stMu.Unlock()
+
+	c := *status
+	fb.statuses[status.NodeID] = &c
+	return fb.flushStatuses()
+}
+
+func (fb *FileBackend) DeleteStatus(nodeID string) error {
+	fb.stMu.Lock()
+	defer fb.stMu.Unlock()
+
+	delete(fb.statuses, nodeID)
+	return fb.flushStatuses()
+}
+
+func (fb *FileBackend) flushStatuses() error {
+	data, err := json.MarshalIndent(fb.statuses, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fb.statusPath(), data, 0600)
+}
+
+// writeFileAtomic 先写临时文件再 rename，避免读者看到写了一半的文件
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
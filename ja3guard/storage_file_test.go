@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFileBackendCleanupKeepsCursor(t *testing.T) {
+	fb, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.AppendLogs([]LogEntry{
+		{Timestamp: "2026-01-01 00:00:00", JA3Hash: "a"},
+		{Timestamp: "2026-01-02 00:00:00", JA3Hash: "b"},
+		{Timestamp: "2026-01-03 00:00:00", JA3Hash: "c"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	logs, cursor, err := fb.ReadLogsFrom(0, 2)
+	if err != nil || len(logs) != 2 {
+		t.Fatalf("ReadLogsFrom = %v, %v", logs, err)
+	}
+	end, _ := fb.LogCursorEnd()
+
+	if err := fb.CleanupLogs("2026-01-02 12:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	// 裁剪结果和 log_base 在同一个文件里
+	if _, err := os.Stat(fb.logBasePath()); !os.IsNotExist(err) {
+		t.Fatalf("不应再写 ja3_logs.base: %v", err)
+	}
+	if got, _ := fb.LogCursorEnd(); got != end {
+		t.Fatalf("清理后 LogCursorEnd = %d, want %d", got, end)
+	}
+	logs, _, err = fb.ReadLogsFrom(cursor, 10)
+	if err != nil || len(logs) != 1 || logs[0].JA3Hash != "c" {
+		t.Fatalf("清理后从游标读取 = %v, %v", logs, err)
+	}
+	// 早于 base 的游标从现存第一条开始
+	logs, _, _ = fb.ReadLogsFrom(0, 10)
+	if len(logs) != 1 || logs[0].JA3Hash != "c" {
+		t.Fatalf("旧游标读取 = %v", logs)
+	}
+	all, _ := fb.AllLogs()
+	if len(all) != 1 {
+		t.Fatalf("AllLogs 应跳过首行记录: %v", all)
+	}
+
+	// 再次清理时 base 累加
+	if err := fb.AppendLogs([]LogEntry{{Timestamp: "2026-01-04 00:00:00", JA3Hash: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	end, _ = fb.LogCursorEnd()
+	if err := fb.CleanupLogs("2026-01-03 12:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fb.LogCursorEnd(); got != end {
+		t.Fatalf("第二次清理后 LogCursorEnd = %d, want %d", got, end)
+	}
+}
+
+func TestFileBackendLegacyLogBase(t *testing.T) {
+	dir := t.TempDir()
+	fb, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := `{"ts":"2026-01-03 00:00:00","ip":"","ja3":"c","ua":"","ok":false}` + "\n"
+	if err := os.WriteFile(fb.logPath(), []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fb.logBasePath(), []byte("100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if end, _ := fb.LogCursorEnd(); end != 100+int64(len(line)) {
+		t.Fatalf("LogCursorEnd = %d", end)
+	}
+	if err := fb.AppendLogs([]LogEntry{{Timestamp: "2026-01-04 00:00:00", JA3Hash: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	end, _ := fb.LogCursorEnd()
+	if err := fb.CleanupLogs("2026-01-03 12:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fb.LogCursorEnd(); got != end {
+		t.Fatalf("迁移旧 base 后 LogCursorEnd = %d, want %d", got, end)
+	}
+	data, _ := os.ReadFile(fb.logPath())
+	if !strings.HasPrefix(string(data), `{"log_base":`) {
+		t.Fatalf("清理后应写入首行记录: %q", data)
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteBackend 内嵌 SQLite 存储后端
+// 日志按列存储便于分页与聚合查询；节点与状态以 JSON 文档存储，字段增减无需改表
+type SQLiteBackend struct {
+	db *sql.DB
+}
+
+// sqliteMigrations 按顺序执行的表结构版本，执行到第 i 个后 user_version = i+1
+var sqliteMigrations = []string{
+	sqliteSchema,
+	// v2: 日志记录来源节点，节点上报批次去重
+	`ALTER TABLE logs ADD COLUMN node_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE logs ADD COLUMN node_name TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS idx_logs_node ON logs(node_id);
+	CREATE TABLE IF NOT EXISTS report_batches (
+		node_id     TEXT NOT NULL,
+		batch_id    TEXT NOT NULL,
+		received_at TEXT NOT NULL,
+		PRIMARY KEY (node_id, batch_id)
+	);`,
+	// v3: 键值元数据（白名单版本号等）
+	`CREATE TABLE IF NOT EXISTS meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+	// v4: 远程执行审计记录，触发器禁止修改和删除
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		seq  INTEGER PRIMARY KEY,
+		data TEXT NOT NULL
+	);
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;`,
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS whitelist (
+	ja3_hash TEXT PRIMARY KEY,
+	position INTEGER NOT NULL,
+	data     TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS logs (
+	id  INTEGER PRIMARY KEY AUTOINCREMENT,
+	ts  TEXT NOT NULL,
+	ip  TEXT NOT NULL,
+	ja3 TEXT NOT NULL,
+	ua  TEXT NOT NULL,
+	ok  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_logs_ts ON logs(ts);
+CREATE INDEX IF NOT EXISTS idx_logs_ja3 ON logs(ja3);
+CREATE TABLE IF NOT EXISTS nodes (
+	id       TEXT PRIMARY KEY,
+	position INTEGER NOT NULL,
+	data     TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS node_status (
+	node_id TEXT PRIMARY KEY,
+	data    TEXT NOT NULL
+);
+`
+
+// NewSQLiteBackend 打开（不存在时创建）数据库。
+// 库中有节点配置（含 guard_secret）、用户密码哈希、任务输出和审计日志，和 FileBackend 一样只允许属主读写
+func NewSQLiteBackend(path string) (*SQLiteBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// 先以 0600 创建文件，SQLite 创建 -wal/-shm 时沿用数据库文件的权限；
+	// 旧版本以默认权限 0644 创建的文件在这里收紧
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("创建 SQLite 文件失败: %w", err)
+	}
+	f.Close()
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		if err := os.Chmod(p, 0600); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("设置 %s 权限失败: %w", p, err)
+		}
+	}
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, fmt.Errorf("打开 SQLite 失败: %w", err)
+	}
+	// SQLite 单写者，限制连接数避免 SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	sb := &SQLiteBackend{db: db}
+	if err := sb.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("初始化 SQLite 表结构失败: %w", err)
+	}
+	return sb, nil
+}
+
+// migrate 将表结构升级到最新版本
+func (sb *SQLiteBackend) migrate() error {
+	var version int
+	if err := sb.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		err := sb.withTx(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("升级到版本 %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (sb *SQLiteBackend) Close() error {
+	return sb.db.Close()
+}
+
+// withTx 在事务中执行 fn，出错时回滚
+func (sb *SQLiteBackend) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := sb.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// --- 白名单 ---
+
+func (sb *SQLiteBackend) LoadWhitelist() ([]WhitelistEntry, int64, error) {
+	rows, err := sb.db.Query(`SELECT data FROM whitelist ORDER BY position`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var entries []WhitelistEntry
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, 0, err
+		}
+		var e WhitelistEntry
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var version int64
+	err = sb.db.QueryRow(`SELECT CAST(value AS INTEGER) FROM meta WHERE key = 'whitelist_version'`).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, 0, err
+	}
+	return entries, version, nil
+}
+
+func (sb *SQLiteBackend) SaveWhitelist(entries []WhitelistEntry, version int64) error {
+	return sb.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM whitelist`); err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(`INSERT INTO whitelist (ja3_hash, position, data) VALUES (?, ?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i, e := range entries {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.Exec(e.JA3Hash, i, string(data)); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`INSERT INTO meta (key, value) VALUES ('whitelist_version', ?)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value`, strconv.FormatInt(version, 10))
+		return err
+	})
+}
+
+// --- 日志 ---
+
+func (sb *SQLiteBackend) AppendLogs(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return sb.withTx(func(tx *sql.Tx) error {
+		return insertLogs(tx, entries)
+	})
+}
+
+func insertLogs(tx *sql.Tx, entries []LogEntry) error {
+	stmt, err := tx.Prepare(`INSERT INTO logs (ts, ip, ja3, ua, ok, node_id, node_name) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range entries {
+		if _, err := stmt.Exec(e.Timestamp, e.IP, e.JA3Hash, e.UA, e.Trusted, e.NodeID, e.NodeName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendNodeLogs 在同一事务中写入日志和批次记录，重复批次由主键冲突识别
+func (sb *SQLiteBackend) AppendNodeLogs(nodeID, batchID string, entries []LogEntry) (bool, error) {
+	inserted := true
+	err := sb.withTx(func(tx *sql.Tx) error {
+		if batchID != "" {
+			res, err := tx.Exec(`INSERT OR IGNORE INTO report_batches (node_id, batch_id, received_at) VALUES (?, ?, ?)`,
+				nodeID, batchID, time.Now().Format("2006-01-02 15:04:05"))
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				inserted = false
+				return nil
+			}
+		}
+		return insertLogs(tx, entries)
+	})
+	return inserted, err
+}
+
+const logColumns = `ts, ip, ja3, ua, ok, node_id, node_name`
+
+func (sb *SQLiteBackend) scanLogs(rows *sql.Rows) ([]LogEntry, error) {
+	defer rows.Close()
+	var logs []LogEntry
+	for rows.Next() {
+		var e LogEntry
+		if err := rows.Scan(&e.Timestamp, &e.IP, &e.JA3Hash, &e.UA, &e.Trusted, &e.NodeID, &e.NodeName); err != nil {
+			return nil, err
+		}
+		logs = append(logs, e)
+	}
+	return logs, rows.Err()
+}
+
+func (sb *SQLiteBackend) AllLogs() ([]LogEntry, error) {
+	rows, err := sb.db.Query(`SELECT ` + logColumns + ` FROM logs ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	return sb.scanLogs(rows)
+}
+
+func (sb *SQLiteBackend) QueryLogs(nodeID string, page, size int) ([]LogEntry, int, error) {
+	where, args := "", []interface{}{}
+	if nodeID != "" {
+		where, args = ` WHERE node_id = ?`, append(args, nodeID)
+	}
+	var total int
+	if err := sb.db.QueryRow(`SELECT COUNT(*) FROM logs`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := sb.db.Query(`SELECT `+logColumns+` FROM logs`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, size, (page-1)*size)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	logs, err := sb.scanLogs(rows)
+	return logs, total, err
+}
+
+func (sb *SQLiteBackend) LogStats() (Stats, error) {
+	var stats Stats
+	err := sb.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(ok), 0) FROM logs`).
+		Scan(&stats.TotalRequests, &stats.TrustedCount)
+	stats.BlockedCount = stats.TotalRequests - stats.TrustedCount
+	return stats, err
+}
+
+func (sb *SQLiteBackend) LogSummary(nodeID string) ([]JA3Summary, error) {
+	where, args := "", []interface{}{}
+	if nodeID != "" {
+		where, args = ` WHERE node_id = ?`, append(args, nodeID)
+	}
+	rows, err := sb.db.Query(`
+		SELECT l.ja3, g.cnt, l.ua, l.ip, l.ts
+		FROM (SELECT ja3, COUNT(*) AS cnt, MAX(id) AS last_id FROM logs`+where+` GROUP BY ja3) g
+		JOIN logs l ON l.id = g.last_id
+		ORDER BY g.cnt DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []JA3Summary{}
+	for rows.Next() {
+		var s JA3Summary
+		if err := rows.Scan(&s.JA3Hash, &s.Count, &s.LastUA, &s.LastIP, &s.LastSeen); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries, rows.Err()
+}
+
+func (sb *SQLiteBackend) CleanupLogs(cutoff string) error {
+	if _, err := sb.db.Exec(`DELETE FROM logs WHERE ts < ?`, cutoff); err != nil {
+		return err
+	}
+	_, err := sb.db.Exec(`DELETE FROM report_batches WHERE received_at < ?`, cutoff)
+	return err
+}
+
+func (sb *SQLiteBackend) ReadLogsFrom(cursor int64, limit int) ([]LogEntry, int64, error) {
+	rows, err := sb.db.Query(`SELECT id, `+logColumns+` FROM logs WHERE id > ? ORDER BY id LIMIT ?`, cursor, limit)
+	if err != nil {
+		return nil, cursor, err
+	}
+	defer rows.Close()
+
+	var logs []LogEntry
+	for rows.Next() {
+		var e LogEntry
+		if err := rows.Scan(&cursor, &e.Timestamp, &e.IP, &e.JA3Hash, &e.UA, &e.Trusted, &e.NodeID, &e.NodeName); err != nil {
+			return nil, cursor, err
+		}
+		logs = append(logs, e)
+	}
+	return logs, cursor, rows.Err()
+}
+
+func (sb *SQLiteBackend) LogCursorEnd() (int64, error) {
+	var end int64
+	err := sb.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM logs`).Scan(&end)
+	return end, err
+}
+
+// --- 节点 ---
+
+func (sb *SQLiteBackend) LoadNodes() ([]NodeInfo, error) {
+	rows, err := sb.db.Query(`SELECT data FROM nodes ORDER BY position`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []NodeInfo
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var n NodeInfo
+		if err := json.Unmarshal([]byte(data), &n); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+func (sb *SQLiteBackend) SaveNodes(nodes []NodeInfo) error {
+	return sb.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM nodes`); err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(`INSERT INTO nodes (id, position, data) VALUES (?, ?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i, n := range nodes {
+			data, err := json.Marshal(n)
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.Exec(n.ID, i, string(data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// --- 节点期望配置 ---
+
+func (sb *SQLiteBackend) LoadNodeConfigs() (*NodeConfigState, error) {
+	var data string
+	err := sb.db.QueryRow(`SELECT value FROM meta WHERE key = 'node_configs'`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state NodeConfigState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (sb *SQLiteBackend) SaveNodeConfigs(state *NodeConfigState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = sb.db.Exec(`INSERT INTO meta (key, value) VALUES ('node_configs', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, string(data))
+	return err
+}
+
+// --- 节点命令队列 ---
+
+func (sb *SQLiteBackend) LoadCommands() ([]NodeCommand, error) {
+	var data string
+	err := sb.db.QueryRow(`SELECT value FROM meta WHERE key = 'node_commands'`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var commands []NodeCommand
+	if err := json.Unmarshal([]byte(data), &commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+func (sb *SQLiteBackend) SaveCommands(commands []NodeCommand) error {
+	data, err := json.Marshal(commands)
+	if err != nil {
+		return err
+	}
+	_, err = sb.db.Exec(`INSERT INTO meta (key, value) VALUES ('node_commands', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, string(data))
+	return err
+}
+
+// --- 异步任务历史 ---
+
+func (sb *SQLiteBackend) LoadJobs() ([]Job, error) {
+	var data string
+	err := sb.db.QueryRow(`SELECT value FROM meta WHERE key = 'jobs'`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []Job
+	if err := json.Unmarshal([]byte(data), &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (sb *SQLiteBackend) SaveJobs(jobs []Job) error {
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+	_, err = sb.db.Exec(`INSERT INTO meta (key, value) VALUES ('jobs', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, string(data))
+	return err
+}
+
+// --- 共享 SSH 凭据 ---
+
+func (sb *SQLiteBackend) LoadCredentialProfiles() ([]CredentialProfile, error) {
+	var data string
+	err := sb.db.QueryRow(`SELECT value FROM meta WHERE key = 'credential_profiles'`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var profiles []CredentialProfile
+	if err := json.Unmarshal([]byte(data), &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+func (sb *SQLiteBackend) SaveCredentialProfiles(profiles []CredentialProfile) error {
+	data, err := json.Marshal(profiles)
+	if err != nil {
+		return err
+	}
+	_, err = sb.db.Exec(`INSERT INTO meta (key, value) VALUES ('credential_profiles', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, string(data))
+	return err
+}
+
+// --- 管理面板用户 ---
+
+func (sb *SQLiteBackend) LoadUsers() ([]User, error) {
+	var data string
+	err := sb.db.QueryRow(`SELECT value FROM meta WHERE key = 'users'`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal([]byte(data), &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (sb *SQLiteBackend) SaveUsers(users []User) error {
+	data, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+	_, err = sb.db.Exec(`INSERT INTO meta (key, value) VALUES ('users', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, string(data))
+	return err
+}
+
+// --- 审计记录 ---
+
+func (sb *SQLiteBackend) AppendAudit(rec *AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = sb.db.Exec(`INSERT INTO audit_log (seq, data) VALUES (?, ?)`, rec.Seq, string(data))
+	return err
+}
+
+func (sb *SQLiteBackend) LoadAudit() ([]AuditRecord, error) {
+	rows, err := sb.db.Query(`SELECT data FROM audit_log ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []AuditRecord
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// --- 节点状态 ---
+
+func (sb *SQLiteBackend) LoadStatuses() (map[string]*NodeStatus, error) {
+	rows, err := sb.db.Query(`SELECT node_id, data FROM node_status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make(map[string]*NodeStatus)
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var s NodeStatus
+		if err := json.Unmarshal([]byte(data), &s); err != nil {
+			return nil, err
+		}
+		statuses[id] = &s
+	}
+	return statuses, rows.Err()
+}
+
+func (sb *SQLiteBackend) SaveStatus(status *NodeStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = sb.db.Exec(`INSERT INTO node_status (node_id, data) VALUES (?, ?)
+		ON CONFLICT(node_id) DO UPDATE SET data = excluded.data`, status.NodeID, string(data))
+	return err
+}
+
+func (sb *SQLiteBackend) DeleteStatus(nodeID string) error {
+	_, err := sb.db.Exec(`DELETE FROM node_status WHERE node_id = ?`, nodeID)
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSQLiteBackendFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows 不支持 Unix 文件权限")
+	}
+	dir := filepath.Join(t.TempDir(), "data")
+	path := filepath.Join(dir, "ja3guard.db")
+	sb, err := NewSQLiteBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SaveNodes([]NodeInfo{{ID: "n1", Name: "n1"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s 权限 = %o, want 600", filepath.Base(p), mode)
+		}
+	}
+	if info, _ := os.Stat(dir); info.Mode().Perm() != 0700 {
+		t.Errorf("数据目录权限 = %o, want 700", info.Mode().Perm())
+	}
+	sb.Close()
+
+	// 旧版本创建的 0644 文件重新打开时收紧
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sb, err = NewSQLiteBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("重新打开后权限 = %o, want 600", info.Mode().Perm())
+	}
+}
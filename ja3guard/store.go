@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
-	"os"
-	"path/filepath"
-	"sort"
+	"fmt"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,6 +22,8 @@ type LogEntry struct {
 	JA3Hash   string `json:"ja3"`
 	UA        string `json:"ua"`
 	Trusted   bool   `json:"ok"`
+	NodeID    string `json:"node_id,omitempty"` // 来源节点（Master 汇总的日志）
+	NodeName  string `json:"node,omitempty"`
 }
 
 // JA3Summary 按 JA3 hash 聚合的统计
@@ -44,48 +44,52 @@ type Stats struct {
 }
 
 // Store 管理白名单和请求日志
-// 白名单: JSON 文件 (data/whitelist.json)
-// 日志:   JSONL 文件 (data/ja3_logs.jsonl)
+// 白名单常驻内存供代理快速查找，持久化与日志读写委托给存储后端
 type Store struct {
-	dataDir   string
-	whitelist []WhitelistEntry
-	wlIndex   map[string]bool // 快速查找
-	mu        sync.RWMutex
+	wlBackend  WhitelistBackend
+	logBackend LogBackend
+	whitelist  []WhitelistEntry
+	wlIndex    map[string]bool // 快速查找
+	mu         sync.RWMutex
+	// 白名单版本号：Master 每次变更 +1；Node 为已同步到的 Master 版本，本地改动后置 0
+	wlVersion int64
+	// 以下仅 Master（EnableWhitelistVersioning 之后）使用
+	versioned bool
+	wlChanges []whitelistChange // 最近的变更记录，用于计算增量
+	// 白名单变更回调，持锁调用，回调内不能再访问 Store
+	wlListeners []func(delta *WhitelistDelta)
+	// 写入失败而丢弃的请求日志条数（节点健康上报）
+	logDropped atomic.Int64
 }
 
-func NewStore(dataDir string) (*Store, error) {
+func NewStore(backend Backend) (*Store, error) {
 	s := &Store{
-		dataDir: dataDir,
-		wlIndex: make(map[string]bool),
+		wlBackend:  backend,
+		logBackend: backend,
+		wlIndex:    make(map[string]bool),
 	}
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return nil, err
+	if err := s.loadWhitelist(); err != nil {
+		return nil, fmt.Errorf("加载白名单失败: %w", err)
 	}
-	s.loadWhitelist()
 	return s, nil
 }
 
-func (s *Store) whitelistPath() string {
-	return filepath.Join(s.dataDir, "whitelist.json")
-}
-
-func (s *Store) logPath() string {
-	return filepath.Join(s.dataDir, "ja3_logs.jsonl")
-}
-
 // --- 白名单操作 ---
 
-func (s *Store) loadWhitelist() {
-	data, err := os.ReadFile(s.whitelistPath())
+func (s *Store) loadWhitelist() error {
+	entries, version, err := s.wlBackend.LoadWhitelist()
 	if err != nil {
-		return
-	}
-	var entries []WhitelistEntry
-	if json.Unmarshal(data, &entries) != nil {
-		return
+		return err
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.setWhitelistLocked(entries)
+	s.wlVersion = version
+	s.wlChanges = nil
+	return nil
+}
+
+func (s *Store) setWhitelistLocked(entries []WhitelistEntry) {
 	s.whitelist = entries
 	s.wlIndex = make(map[string]bool, len(entries))
 	for _, e := range entries {
@@ -93,12 +97,47 @@ func (s *Store) loadWhitelist() {
 	}
 }
 
-func (s *Store) saveWhitelist() error {
-	data, err := json.MarshalIndent(s.whitelist, "", "  ")
-	if err != nil {
+// saveWhitelist 持久化本地修改，touched 为本次新增、修改或删除的 hash
+func (s *Store) saveWhitelist(touched ...string) error {
+	if !s.versioned {
+		// 节点本地改动后与 Master 不再一致，下次同步取全量
+		return s.commitWhitelist(0)
+	}
+
+	from := s.wlVersion
+	if err := s.commitWhitelist(from + 1); err != nil {
 		return err
 	}
-	return os.WriteFile(s.whitelistPath(), data, 0644)
+	s.recordChangeLocked(s.wlVersion, touched)
+	if len(s.wlListeners) > 0 {
+		delta, _ := s.deltaLocked(from)
+		for _, fn := range s.wlListeners {
+			fn(delta)
+		}
+	}
+	return nil
+}
+
+// commitWhitelist 将内存中的白名单连同版本号写入后端
+func (s *Store) commitWhitelist(version int64) error {
+	if err := s.wlBackend.SaveWhitelist(s.whitelist, version); err != nil {
+		return err
+	}
+	s.wlVersion = version
+	return nil
+}
+
+// OnWhitelistChange 注册白名单变更回调（Master 用于向节点推送增量）
+// 回调在持有写锁时按变更顺序调用，必须快速返回且不能再调用 Store 的方法
+func (s *Store) OnWhitelistChange(fn func(delta *WhitelistDelta)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wlListeners = append(s.wlListeners, fn)
+}
+
+// ReloadWhitelist 重新从存储后端加载白名单（节点收到 SIGHUP 时调用）
+func (s *Store) ReloadWhitelist() error {
+	return s.loadWhitelist()
 }
 
 func (s *Store) IsWhitelisted(hash string) bool {
@@ -130,13 +169,16 @@ func (s *Store) AddWhitelist(hash, note string) error {
 		s.wlIndex[hash] = true
 	}
 
-	return s.saveWhitelist()
+	return s.saveWhitelist(hash)
 }
 
 func (s *Store) RemoveWhitelist(hash string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if !s.wlIndex[hash] {
+		return nil
+	}
 	delete(s.wlIndex, hash)
 	filtered := s.whitelist[:0]
 	for _, e := range s.whitelist {
@@ -145,7 +187,7 @@ func (s *Store) RemoveWhitelist(hash string) error {
 		}
 	}
 	s.whitelist = filtered
-	return s.saveWhitelist()
+	return s.saveWhitelist(hash)
 }
 
 func (s *Store) GetWhitelist() []WhitelistEntry {
@@ -156,9 +198,93 @@ func (s *Store) GetWhitelist() []WhitelistEntry {
 	return result
 }
 
+// ImportWhitelist 批量导入白名单，整个导入在一次加锁内完成并只写一次文件，
+// 读者（代理请求、节点同步）要么看到导入前的列表，要么看到导入后的列表。
+// replace=true 时不在导入列表中的条目会被删除；dryRun=true 时只计算差异不落盘。
+// 合并模式下导入的备注为空时保留现有备注。
+func (s *Store) ImportWhitelist(entries []WhitelistEntry, replace, dryRun bool) (*WhitelistImportReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &WhitelistImportReport{
+		Added:   []WhitelistEntry{},
+		Updated: []WhitelistEntry{},
+		Removed: []WhitelistEntry{},
+	}
+
+	existing := make(map[string]int, len(s.whitelist))
+	for i, e := range s.whitelist {
+		existing[e.JA3Hash] = i
+	}
+	incoming := make(map[string]bool, len(entries))
+	now := time.Now().Format("2006-01-02 15:04:05")
+
+	var result []WhitelistEntry
+	if !replace {
+		result = make([]WhitelistEntry, len(s.whitelist), len(s.whitelist)+len(entries))
+		copy(result, s.whitelist)
+	}
+
+	for _, e := range entries {
+		incoming[e.JA3Hash] = true
+		if i, ok := existing[e.JA3Hash]; ok {
+			cur := s.whitelist[i]
+			if e.Note == "" && !replace {
+				e.Note = cur.Note
+			}
+			if cur.Note != e.Note {
+				report.Updated = append(report.Updated, e)
+				cur.Note = e.Note
+			}
+			if replace {
+				result = append(result, cur)
+			} else {
+				result[i] = cur
+			}
+			continue
+		}
+		if e.CreatedAt == "" {
+			e.CreatedAt = now
+		}
+		report.Added = append(report.Added, e)
+		result = append(result, e)
+	}
+
+	if replace {
+		for _, e := range s.whitelist {
+			if !incoming[e.JA3Hash] {
+				report.Removed = append(report.Removed, e)
+			}
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	touched := make([]string, 0, len(report.Added)+len(report.Updated)+len(report.Removed))
+	for _, list := range [][]WhitelistEntry{report.Added, report.Updated, report.Removed} {
+		for _, e := range list {
+			touched = append(touched, e.JA3Hash)
+		}
+	}
+	if len(touched) == 0 {
+		return report, nil
+	}
+
+	old := s.whitelist
+	s.whitelist = result
+	if err := s.saveWhitelist(touched...); err != nil {
+		s.whitelist = old
+		return nil, err
+	}
+	s.setWhitelistLocked(result)
+	return report, nil
+}
+
 // --- 日志操作 ---
 
-// LogRequest 追加一条请求日志（JSONL 格式，O_APPEND 原子写入）
+// LogRequest 追加一条请求日志
 func (s *Store) LogRequest(ip, ja3Hash, ua string, trusted bool) {
 	entry := LogEntry{
 		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
@@ -167,135 +293,88 @@ func (s *Store) LogRequest(ip, ja3Hash, ua string, trusted bool) {
 		UA:        ua,
 		Trusted:   trusted,
 	}
-	data, err := json.Marshal(entry)
-	if err != nil {
-		return
+	if err := s.logBackend.AppendLogs([]LogEntry{entry}); err != nil {
+		s.logDropped.Add(1)
+		log.Printf("[Store] 写入日志失败: %v", err)
 	}
+}
 
-	f, err := os.OpenFile(s.logPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	f.Write(data)
-	f.Write([]byte("\n"))
+// LogDropped 启动以来写入失败而丢弃的日志条数
+func (s *Store) LogDropped() int64 {
+	return s.logDropped.Load()
 }
 
 // ReadLogs 读取全部日志条目
 func (s *Store) ReadLogs() []LogEntry {
-	f, err := os.Open(s.logPath())
+	logs, err := s.logBackend.AllLogs()
 	if err != nil {
-		return nil
-	}
-	defer f.Close()
-
-	var logs []LogEntry
-	scanner := bufio.NewScanner(f)
-	scanner.Buffer(make([]byte, 256*1024), 1024*1024)
-	for scanner.Scan() {
-		var entry LogEntry
-		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
-			logs = append(logs, entry)
-		}
+		log.Printf("[Store] 读取日志失败: %v", err)
 	}
 	return logs
 }
 
-// GetLogs 分页获取日志（最新在前）
-func (s *Store) GetLogs(page, size int) ([]LogEntry, int) {
-	logs := s.ReadLogs()
-	total := len(logs)
+// ReadLogsFrom 读取游标之后的日志（节点上报使用）
+func (s *Store) ReadLogsFrom(cursor int64, limit int) ([]LogEntry, int64, error) {
+	return s.logBackend.ReadLogsFrom(cursor, limit)
+}
 
-	// 倒序（最新在前）
-	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
-		logs[i], logs[j] = logs[j], logs[i]
-	}
+// LogCursorEnd 返回当前日志末尾的游标
+func (s *Store) LogCursorEnd() (int64, error) {
+	return s.logBackend.LogCursorEnd()
+}
 
-	start := (page - 1) * size
-	if start >= total {
-		return nil, total
+// AppendNodeLogs 保存节点上报的日志（Master 模式），保留节点上的原始时间戳并标记来源节点。
+// 同一节点重发的批次只保存一次，返回 false 表示该批次已经收到过
+func (s *Store) AppendNodeLogs(node *NodeInfo, batchID string, logs []LogEntry) (bool, error) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	entries := make([]LogEntry, len(logs))
+	for i, l := range logs {
+		if l.Timestamp == "" {
+			l.Timestamp = now
+		}
+		l.NodeID = node.ID
+		l.NodeName = node.Name
+		entries[i] = l
 	}
-	end := start + size
-	if end > total {
-		end = total
+	return s.logBackend.AppendNodeLogs(node.ID, batchID, entries)
+}
+
+// GetLogs 分页获取日志（最新在前），nodeID 非空时只返回该节点的日志
+func (s *Store) GetLogs(nodeID string, page, size int) ([]LogEntry, int) {
+	logs, total, err := s.logBackend.QueryLogs(nodeID, page, size)
+	if err != nil {
+		log.Printf("[Store] 查询日志失败: %v", err)
 	}
-	return logs[start:end], total
+	return logs, total
 }
 
 // GetStats 获取总体统计
 func (s *Store) GetStats() Stats {
-	logs := s.ReadLogs()
-	stats := Stats{TotalRequests: len(logs)}
-	for _, l := range logs {
-		if l.Trusted {
-			stats.TrustedCount++
-		}
+	stats, err := s.logBackend.LogStats()
+	if err != nil {
+		log.Printf("[Store] 统计日志失败: %v", err)
 	}
-	stats.BlockedCount = stats.TotalRequests - stats.TrustedCount
 	return stats
 }
 
-// GetJA3Summary 按 JA3 hash 聚合统计
-func (s *Store) GetJA3Summary() []JA3Summary {
-	logs := s.ReadLogs()
-
-	type info struct {
-		count    int
-		lastUA   string
-		lastIP   string
-		lastSeen string
-	}
-	m := make(map[string]*info)
-
-	for _, l := range logs {
-		if _, ok := m[l.JA3Hash]; !ok {
-			m[l.JA3Hash] = &info{}
-		}
-		m[l.JA3Hash].count++
-		m[l.JA3Hash].lastUA = l.UA
-		m[l.JA3Hash].lastIP = l.IP
-		m[l.JA3Hash].lastSeen = l.Timestamp
+// GetJA3Summary 按 JA3 hash 聚合统计，nodeID 非空时只统计该节点
+func (s *Store) GetJA3Summary(nodeID string) []JA3Summary {
+	summaries, err := s.logBackend.LogSummary(nodeID)
+	if err != nil {
+		log.Printf("[Store] 聚合日志失败: %v", err)
 	}
-
-	summaries := make([]JA3Summary, 0, len(m))
-	for hash, info := range m {
-		summaries = append(summaries, JA3Summary{
-			JA3Hash:     hash,
-			Count:       info.count,
-			LastUA:      info.lastUA,
-			LastIP:      info.lastIP,
-			LastSeen:    info.lastSeen,
-			InWhitelist: s.IsWhitelisted(hash),
-		})
+	for i := range summaries {
+		summaries[i].InWhitelist = s.IsWhitelisted(summaries[i].JA3Hash)
 	}
-
-	sort.Slice(summaries, func(i, j int) bool {
-		return summaries[i].Count > summaries[j].Count
-	})
 	return summaries
 }
 
 // Cleanup 清理指定天数前的日志
-func (s *Store) Cleanup(keepDays int) {
-	logs := s.ReadLogs()
+func (s *Store) Cleanup(keepDays int) error {
 	cutoff := time.Now().AddDate(0, 0, -keepDays).Format("2006-01-02 15:04:05")
-
-	var kept []LogEntry
-	for _, l := range logs {
-		if l.Timestamp >= cutoff {
-			kept = append(kept, l)
-		}
-	}
-
-	f, err := os.Create(s.logPath())
+	err := s.logBackend.CleanupLogs(cutoff)
 	if err != nil {
-		return
-	}
-	defer f.Close()
-
-	for _, entry := range kept {
-		data, _ := json.Marshal(entry)
-		f.Write(data)
-		f.Write([]byte("\n"))
+		log.Printf("[Store] 清理日志失败: %v", err)
 	}
+	return err
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultTerminalIdleTimeout = 15 // 分钟
+	terminalDefaultCols        = 120
+	terminalDefaultRows        = 32
+)
+
+// terminalMessage 浏览器发送的消息：input 为键盘输入，resize 为窗口大小变化
+type terminalMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+}
+
+// TerminalRecording 终端会话录像（asciicast v2），保存在 data/recordings
+type TerminalRecording struct {
+	Name      string `json:"name"`
+	NodeID    string `json:"node_id"`
+	NodeName  string `json:"node_name"`
+	User      string `json:"user"`
+	StartedAt string `json:"started_at"`
+	Size      int64  `json:"size"`
+}
+
+// asciicastHeader asciicast v2 文件首行，ja3guard_* 为附加的审计信息（播放器忽略未知字段）
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	NodeID    string            `json:"ja3guard_node_id,omitempty"`
+	NodeName  string            `json:"ja3guard_node_name,omitempty"`
+	User      string            `json:"ja3guard_user,omitempty"`
+}
+
+// castRecorder 写入 asciicast v2 事件。输出按 UTF-8 边界切分，不完整的字符留到下一段
+type castRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	start   time.Time
+	pending []byte
+}
+
+func newCastRecorder(path string, header asciicastHeader) (*castRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	rec := &castRecorder{f: f, w: bufio.NewWriter(f), start: time.Now()}
+	data, _ := json.Marshal(header)
+	rec.w.Write(append(data, '\n'))
+	return rec, rec.w.Flush()
+}
+
+func (rec *castRecorder) event(code, data string) {
+	line, _ := json.Marshal([]interface{}{
+		float64(time.Since(rec.start).Microseconds()) / 1e6, code, data,
+	})
+	rec.w.Write(append(line, '\n'))
+}
+
+func (rec *castRecorder) Output(p []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	data := append(rec.pending, p...)
+	// 末尾最多 3 个字节可能是被截断的多字节字符
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-3; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	rec.pending = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		rec.event("o", strings.ToValidUTF8(string(data[:cut]), "�"))
+	}
+	rec.w.Flush()
+}
+
+func (rec *castRecorder) Resize(cols, rows int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.event("r", fmt.Sprintf("%dx%d", cols, rows))
+	rec.w.Flush()
+}
+
+func (rec *castRecorder) Close() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.pending) > 0 {
+		rec.event("o", strings.ToValidUTF8(string(rec.pending), "�"))
+	}
+	rec.w.Flush()
+	rec.f.Close()
+}
+
+func (h *AdminHandler) recordingsDir() string {
+	return filepath.Join(h.cfg.DataDir, "recordings")
+}
+
+// terminalIdleTimeout 无输入超过该时间后断开，配置 terminal_idle_timeout（分钟）
+func (h *AdminHandler) terminalIdleTimeout() time.Duration {
+	minutes := h.cfg.TerminalIdleTimeout
+	if minutes <= 0 {
+		minutes = defaultTerminalIdleTimeout
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// checkTerminalOrigin 只接受管理面板页面发起的 WebSocket，防止其他网站借用浏览器保存的登录凭据
+func checkTerminalOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil // 非浏览器客户端
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Host, r.Host) {
+		return fmt.Errorf("不允许的来源: %s", origin)
+	}
+	return nil
+}
+
+// handleNodeTerminal 打开到节点的交互式终端（WebSocket + SSH PTY），会话全程录像
+func (h *AdminHandler) handleNodeTerminal(w http.ResponseWriter, r *http.Request, id string) {
+	if h.nodeStore == nil {
+		h.jsonErr(w, "节点管理仅在 master 模式下可用", 400)
+		return
+	}
+	node, err := h.nodeStore.GetNode(id)
+	if err != nil {
+		h.jsonErr(w, err.Error(), 404)
+		return
+	}
+	if err := checkTerminalOrigin(r); err != nil {
+		h.jsonErr(w, err.Error(), 403)
+		return
+	}
+	// 终端可以执行任意命令，受执行策略 allow_raw 约束
+	if !h.cfg.GetExecPolicy().AllowRaw {
+		h.jsonErr(w, "执行策略不允许任意命令，无法打开终端", 403)
+		return
+	}
+	actor := h.auditActor(r)
+
+	srv := websocket.Server{
+		// 来源已在上面检查
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			// 长连接：取消管理面板服务器的读写超时
+			ws.SetDeadline(time.Time{})
+			h.runTerminal(ws, node, actor, r.URL.Query())
+		},
+	}
+	srv.ServeHTTP(w, r)
+}
+
+func (h *AdminHandler) runTerminal(ws *websocket.Conn, node *NodeInfo, actor auditActor, query url.Values) {
+	defer ws.Close()
+	user := actor.User
+	cols, _ := strconv.Atoi(query.Get("cols"))
+	rows, _ := strconv.Atoi(query.Get("rows"))
+	if cols <= 0 || cols > 1000 {
+		cols = terminalDefaultCols
+	}
+	if rows <= 0 || rows > 1000 {
+		rows = terminalDefaultRows
+	}
+	fail := func(format string, args ...interface{}) {
+		websocket.Message.Send(ws, []byte("\r\n\x1b[31m"+fmt.Sprintf(format, args...)+"\x1b[0m\r\n"))
+	}
+
+	session, done, err := h.sshClient(node).session()
+	if err != nil {
+		fail("连接失败: %v", err)
+		return
+	}
+	defer done()
+	defer session.Close()
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	if err := session.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+		fail("申请终端失败: %v", err)
+		return
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		fail("打开终端失败: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(h.recordingsDir(), 0700); err != nil {
+		fail("创建录像目录失败: %v", err)
+		return
+	}
+	started := time.Now()
+	b := make([]byte, 4)
+	rand.Read(b)
+	name := fmt.Sprintf("%s-%s-%s.cast", started.Format("20060102-150405"), node.ID, hex.EncodeToString(b))
+	rec, err := newCastRecorder(filepath.Join(h.recordingsDir(), name), asciicastHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: started.Unix(),
+		Title:     fmt.Sprintf("%s@%s", user, node.Name),
+		Env:       map[string]string{"TERM": "xterm-256color"},
+		NodeID:    node.ID,
+		NodeName:  node.Name,
+		User:      user,
+	})
+	if err != nil {
+		// 无法录像时不允许打开终端
+		fail("创建录像失败: %v", err)
+		return
+	}
+	defer rec.Close()
+
+	audit, err := h.startAudit(actor, node, AuditRecord{Action: AuditTerminal, Recording: name})
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	out := &terminalWriter{ws: ws, rec: rec, digest: newOutputDigest()}
+	audit.digest = out.digest
+	session.Stdout = out
+	session.Stderr = out
+	if err := session.Shell(); err != nil {
+		fail("启动 shell 失败: %v", err)
+		audit.finish(err)
+		return
+	}
+	log.Printf("[Terminal] %s 打开节点 %s 的终端，录像 %s", user, node.Name, name)
+
+	// 空闲（没有键盘输入）超时后断开
+	idle := h.terminalIdleTimeout()
+	idleTimer := time.AfterFunc(idle, func() {
+		out.Write([]byte(fmt.Sprintf("\r\n\x1b[33m[超过 %s 没有输入，会话已断开]\x1b[0m\r\n", idle)))
+		session.Close()
+		ws.Close()
+	})
+	defer idleTimer.Stop()
+
+	go func() {
+		defer session.Close()
+		for {
+			var msg terminalMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			switch msg.Type {
+			case "input":
+				idleTimer.Reset(idle)
+				if _, err := io.WriteString(stdin, msg.Data); err != nil {
+					return
+				}
+			case "resize":
+				if msg.Cols > 0 && msg.Rows > 0 && msg.Cols <= 1000 && msg.Rows <= 1000 {
+					session.WindowChange(msg.Rows, msg.Cols)
+					rec.Resize(msg.Cols, msg.Rows)
+				}
+			}
+		}
+	}()
+
+	err = session.Wait()
+	log.Printf("[Terminal] %s 关闭节点 %s 的终端（%s）", user, node.Name, time.Since(started).Round(time.Second))
+
+	audit.finish(err)
+}
+
+// terminalWriter 把 SSH 输出发给浏览器并写入录像和审计摘要
+type terminalWriter struct {
+	mu     sync.Mutex
+	ws     *websocket.Conn
+	rec    *castRecorder
+	digest *outputDigest
+}
+
+func (tw *terminalWriter) Write(p []byte) (int, error) {
+	tw.rec.Output(p)
+	tw.digest.Write(p)
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if err := websocket.Message.Send(tw.ws, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// validRecordingName 录像文件名（不含路径）
+func validRecordingName(name string) bool {
+	return strings.HasSuffix(name, ".cast") && !strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".")
+}
+
+// handleRecordingList 终端录像列表（最新在前），?node= 只看某个节点
+func (h *AdminHandler) handleRecordingList(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.URL.Query().Get("node")
+	entries, err := os.ReadDir(h.recordingsDir())
+	if err != nil && !os.IsNotExist(err) {
+		h.jsonErr(w, err.Error(), 500)
+		return
+	}
+	list := []TerminalRecording{}
+	for _, e := range entries {
+		if e.IsDir() || !validRecordingName(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		header, err := readCastHeader(filepath.Join(h.recordingsDir(), e.Name()))
+		if err != nil || (nodeID != "" && header.NodeID != nodeID) {
+			continue
+		}
+		list = append(list, TerminalRecording{
+			Name:      e.Name(),
+			NodeID:    header.NodeID,
+			NodeName:  header.NodeName,
+			User:      header.User,
+			StartedAt: time.Unix(header.Timestamp, 0).Format("2006-01-02 15:04:05"),
+			Size:      info.Size(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name > list[j].Name })
+	h.jsonOK(w, list)
+}
+
+func readCastHeader(path string) (*asciicastHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// handleRecordingDownload 下载录像（asciicast v2，可用 asciinema play 回放）
+func (h *AdminHandler) handleRecordingDownload(w http.ResponseWriter, r *http.Request, name string) {
+	if !validRecordingName(name) {
+		h.jsonErr(w, "录像不存在", 404)
+		return
+	}
+	f, err := os.Open(filepath.Join(h.recordingsDir(), name))
+	if err != nil {
+		h.jsonErr(w, "录像不存在", 404)
+		return
+	}
+	defer f.Close()
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(10 * time.Minute))
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	io.Copy(w, f)
+}
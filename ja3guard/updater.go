@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 节点更新状态
+const (
+	UpdateDownloading = "downloading" // 正在下载并校验新版本
+	UpdateVerifying   = "verifying"   // 已替换并重启，等待健康检查
+	UpdateSucceeded   = "succeeded"
+	UpdateFailed      = "failed"      // 下载或校验失败，未替换
+	UpdateRolledBack  = "rolled_back" // 新版本健康检查失败，已换回旧版本
+)
+
+const (
+	updateRetryAfter    = 10 * time.Minute // 可重试的失败（网络、Master 暂无该平台的二进制）之后的等待时间
+	updateHealthTimeout = 2 * time.Minute  // 新版本启动后必须在该时间内成功上报
+)
+
+// updateGuardName 程序同目录下的更新守护脚本（install.sh 安装，systemd ExecStartPre 执行）。
+// 新版本在初始化阶段崩溃时运行不到 Updater.Start，由它统计启动次数并换回 .prev
+const updateGuardName = "update-guard.sh"
+
+// UpdateStatus 节点更新状态，持久化到 data/update_state.json 并随上报发送给 Master
+type UpdateStatus struct {
+	State     string `json:"state"`
+	Target    string `json:"target"`
+	Previous  string `json:"previous,omitempty"` // 更新前的版本
+	Error     string `json:"error,omitempty"`
+	RetryAt   string `json:"retry_at,omitempty"` // 可重试的失败：该时间之后再次尝试
+	UpdatedAt string `json:"updated_at"`
+}
+
+// updateError 更新失败；retry 为 true 表示稍后可以重试，否则等待 Master 指定新的目标版本
+type updateError struct {
+	err   error
+	retry bool
+}
+
+func (e *updateError) Error() string { return e.err.Error() }
+
+// Updater 节点自动更新：目标版本（target_version）与当前版本不同时从 Master 下载对应平台的二进制，
+// 校验 ed25519 签名和 SHA-256 后原子替换并重启。新版本在限定时间内未能成功上报时换回旧版本，
+// 反复启动失败时由更新守护脚本换回。旧版本保留为 <程序>.prev
+type Updater struct {
+	cfg      *Config
+	link     *MasterLink
+	client   *http.Client
+	restart  chan<- struct{}
+	exe      string // 启动时解析的程序路径（替换后 os.Executable 可能指向已删除的文件）
+	mu       sync.Mutex
+	state    UpdateStatus
+	busy     bool
+	reported chan struct{} // 本次启动后第一次成功上报时关闭
+	once     sync.Once
+}
+
+func NewUpdater(cfg *Config, link *MasterLink, restart chan<- struct{}) *Updater {
+	u := &Updater{
+		cfg:      cfg,
+		link:     link,
+		client:   link.Client(10 * time.Minute),
+		restart:  restart,
+		reported: make(chan struct{}),
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		log.Printf("[Update] 获取程序路径失败，自动更新不可用: %v", err)
+	}
+	u.exe = exe
+	data, err := os.ReadFile(u.statePath())
+	if err == nil {
+		err = json.Unmarshal(data, &u.state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[Update] 读取更新状态失败: %v", err)
+	}
+	return u
+}
+
+func (u *Updater) statePath() string {
+	return filepath.Join(u.cfg.DataDir, "update_state.json")
+}
+
+// bootsPath 更新守护脚本记录的新版本启动次数
+func (u *Updater) bootsPath() string {
+	return filepath.Join(u.cfg.DataDir, "update_boots")
+}
+
+// setLocked 更新并保存状态
+func (u *Updater) setLocked(st UpdateStatus) {
+	st.UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
+	u.state = st
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(u.statePath(), data, 0644)
+	}
+	if err != nil {
+		log.Printf("[Update] 保存更新状态失败: %v", err)
+	}
+}
+
+// Status 上报用，从未更新过时为 nil
+func (u *Updater) Status() *UpdateStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.state.State == "" {
+		return nil
+	}
+	st := u.state
+	return &st
+}
+
+// Start 启动时调用：上一次更新后处于验证状态时执行健康检查，通过则确认更新，否则回滚。
+// 启动次数由更新守护脚本在程序之外统计
+func (u *Updater) Start() {
+	u.mu.Lock()
+	st := u.state
+	u.mu.Unlock()
+	if st.State != UpdateVerifying {
+		return
+	}
+
+	if Version != st.Target {
+		u.rollback(fmt.Errorf("新版本启动后报告的版本为 %s", Version))
+		return
+	}
+	log.Printf("[Update] 已更新到 %s，等待健康检查（%s 内成功上报）", Version, updateHealthTimeout)
+	select {
+	case <-u.reported:
+		u.mu.Lock()
+		st = u.state
+		st.State, st.Error = UpdateSucceeded, ""
+		u.setLocked(st)
+		os.Remove(u.bootsPath())
+		u.mu.Unlock()
+		log.Printf("[Update] 版本 %s 健康检查通过（更新前 %s）", Version, st.Previous)
+	case <-time.After(updateHealthTimeout):
+		u.rollback(fmt.Errorf("新版本 %s 内未能成功上报", updateHealthTimeout))
+	}
+}
+
+// ReportOK 每次成功上报后调用：作为新版本的健康信号，并检查是否需要更新
+func (u *Updater) ReportOK() {
+	u.once.Do(func() { close(u.reported) })
+	go u.Check()
+}
+
+// Check 目标版本与当前版本不同时执行更新
+func (u *Updater) Check() {
+	target := u.cfg.GetTargetVersion()
+	u.mu.Lock()
+	st := u.state
+	if target == "" || target == Version || u.busy || u.exe == "" || st.State == UpdateVerifying {
+		u.mu.Unlock()
+		return
+	}
+	// 同一目标版本失败后：可重试的等到重试时间，其余的不再尝试
+	if st.Target == target && (st.State == UpdateFailed || st.State == UpdateRolledBack) {
+		if st.RetryAt == "" {
+			u.mu.Unlock()
+			return
+		}
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", st.RetryAt, time.Local); err == nil && time.Now().Before(t) {
+			u.mu.Unlock()
+			return
+		}
+	}
+	u.busy = true
+	u.setLocked(UpdateStatus{State: UpdateDownloading, Target: target, Previous: Version})
+	u.mu.Unlock()
+
+	log.Printf("[Update] 开始更新 %s → %s", Version, target)
+	err := u.update(target)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.busy = false
+	if err == nil {
+		// 守护脚本从 0 开始统计新版本的启动次数
+		os.Remove(u.bootsPath())
+		u.setLocked(UpdateStatus{State: UpdateVerifying, Target: target, Previous: Version})
+		log.Printf("[Update] 已替换为 %s，重启进程", target)
+		select {
+		case u.restart <- struct{}{}:
+		default:
+		}
+		return
+	}
+	failed := UpdateStatus{State: UpdateFailed, Target: target, Previous: Version, Error: err.Error()}
+	var ue *updateError
+	if errors.As(err, &ue) && ue.retry {
+		failed.RetryAt = time.Now().Add(updateRetryAfter).Format("2006-01-02 15:04:05")
+	}
+	u.setLocked(failed)
+	log.Printf("[Update] 更新到 %s 失败: %v", target, err)
+}
+
+// update 下载、校验并替换程序文件
+func (u *Updater) update(target string) error {
+	publicKey := u.cfg.ReleasePublicKey
+	if publicKey == "" {
+		return &updateError{err: errors.New("节点未配置 release_public_key，拒绝自动更新")}
+	}
+	// 没有守护脚本时新版本启动即崩溃将无法回滚；用新版 install.sh 重新部署或 upgrade 后自动重试
+	if _, err := os.Stat(filepath.Join(filepath.Dir(u.exe), updateGuardName)); err != nil {
+		return &updateError{err: fmt.Errorf("节点未安装 %s（由 install.sh 安装），拒绝自动更新", updateGuardName), retry: true}
+	}
+	query := url.Values{"version": {target}, "os": {runtime.GOOS}, "arch": {runtime.GOARCH}}.Encode()
+
+	// 1. 元数据：SHA-256 与签名，先校验签名再下载
+	var meta struct {
+		Artifact ReleaseArtifact `json:"artifact"`
+	}
+	body, err := u.get("/api/node/release?"+query, 1<<20)
+	if err != nil {
+		return &updateError{err: fmt.Errorf("获取版本信息失败: %w", err), retry: true}
+	}
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return &updateError{err: fmt.Errorf("解析版本信息失败: %w", err), retry: true}
+	}
+	art := meta.Artifact
+	if err := verifyReleaseSignature(publicKey, target, runtime.GOOS, runtime.GOARCH, art.SHA256, art.Signature); err != nil {
+		return &updateError{err: err}
+	}
+
+	// 2. 下载到程序同目录的临时文件，核对大小和 SHA-256
+	newPath := u.exe + ".new"
+	defer os.Remove(newPath)
+	if err := u.download("/api/node/release/download?"+query, newPath, art); err != nil {
+		return err
+	}
+
+	// 3. 新程序必须能运行并报告目标版本号
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, newPath, "-version").Output()
+	if err != nil {
+		return &updateError{err: fmt.Errorf("新版本无法运行: %w", err)}
+	}
+	if got := strings.TrimSpace(string(out)); got != target {
+		return &updateError{err: fmt.Errorf("新版本报告的版本为 %q", got)}
+	}
+
+	// 4. 保留旧版本后原子替换
+	prevPath := u.exe + ".prev"
+	os.Remove(prevPath)
+	if err := os.Link(u.exe, prevPath); err != nil {
+		if err := copyFile(u.exe, prevPath, 0755); err != nil {
+			return &updateError{err: fmt.Errorf("备份旧版本失败: %w", err)}
+		}
+	}
+	if err := os.Rename(newPath, u.exe); err != nil {
+		return &updateError{err: fmt.Errorf("替换程序失败: %w", err)}
+	}
+	return nil
+}
+
+// get 请求 Master 节点接口，返回响应体
+func (u *Updater) get(path string, limit int64) ([]byte, error) {
+	req, err := u.link.NewRequest(context.Background(), "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("返回 %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// download 下载二进制到 dst 并校验大小和 SHA-256
+func (u *Updater) download(path, dst string, art ReleaseArtifact) error {
+	req, err := u.link.NewRequest(context.Background(), "GET", path, nil)
+	if err != nil {
+		return &updateError{err: err, retry: true}
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return &updateError{err: fmt.Errorf("下载失败: %w", err), retry: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &updateError{err: fmt.Errorf("下载返回 %d: %s", resp.StatusCode, strings.TrimSpace(string(body))), retry: true}
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return &updateError{err: err}
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, art.Size+1))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return &updateError{err: fmt.Errorf("下载失败: %w", err), retry: true}
+	}
+	if n != art.Size || hex.EncodeToString(hash.Sum(nil)) != art.SHA256 {
+		return &updateError{err: fmt.Errorf("下载的文件与签名不符（%d 字节）", n), retry: true}
+	}
+	return nil
+}
+
+// rollback 换回更新前的版本并重启
+func (u *Updater) rollback(cause error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st := u.state
+	st.State, st.Error = UpdateRolledBack, cause.Error()
+	os.Remove(u.bootsPath())
+	if err := os.Rename(u.exe+".prev", u.exe); err != nil {
+		st.Error += fmt.Sprintf("；回滚失败: %v", err)
+		u.setLocked(st)
+		log.Printf("[Update] %s，回滚失败: %v", cause, err)
+		return
+	}
+	u.setLocked(st)
+	log.Printf("[Update] %s，已回滚到 %s，重启进程", cause, st.Previous)
+	select {
+	case u.restart <- struct{}{}:
+	default:
+	}
+}
+
+// copyFile 复制文件（无法创建硬链接时备份旧版本用）
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
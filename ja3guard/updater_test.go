@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdaterCheckRetryGating(t *testing.T) {
+	dir := t.TempDir()
+	pub, _ := newTestReleaseKey(t)
+	cfg := &Config{DataDir: dir, ReleasePublicKey: pub, TargetVersion: "9.9.9"}
+	u := NewUpdater(cfg, NewMasterLink(cfg), make(chan struct{}, 1))
+	// 程序同目录没有更新守护脚本：update 返回可重试的错误，不会访问 Master
+	u.exe = filepath.Join(dir, "ja3guard")
+
+	const sentinel = "上一次的失败"
+	future := time.Now().Add(time.Hour).Format("2006-01-02 15:04:05")
+	past := time.Now().Add(-time.Minute).Format("2006-01-02 15:04:05")
+	for _, tc := range []struct {
+		name  string
+		state UpdateStatus
+		runs  bool
+	}{
+		{"首次更新", UpdateStatus{}, true},
+		{"未到重试时间", UpdateStatus{State: UpdateFailed, Target: "9.9.9", Error: sentinel, RetryAt: future}, false},
+		{"已到重试时间", UpdateStatus{State: UpdateFailed, Target: "9.9.9", Error: sentinel, RetryAt: past}, true},
+		{"不可重试的失败", UpdateStatus{State: UpdateFailed, Target: "9.9.9", Error: sentinel}, false},
+		{"回滚后不再尝试", UpdateStatus{State: UpdateRolledBack, Target: "9.9.9", Error: sentinel}, false},
+		{"回滚后到了重试时间", UpdateStatus{State: UpdateRolledBack, Target: "9.9.9", Error: sentinel, RetryAt: past}, true},
+		{"失败的是其他目标版本", UpdateStatus{State: UpdateFailed, Target: "9.9.8", Error: sentinel}, true},
+		{"验证中", UpdateStatus{State: UpdateVerifying, Target: "9.9.9", Error: sentinel}, false},
+	} {
+		u.state = tc.state
+		u.Check()
+		ran := u.state.Error != sentinel
+		if ran != tc.runs {
+			t.Errorf("%s: 执行了更新 = %v, want %v（状态 %+v）", tc.name, ran, tc.runs, u.state)
+			continue
+		}
+		if !ran {
+			continue
+		}
+		// 缺少守护脚本属于可重试的失败
+		if u.state.State != UpdateFailed || u.state.Target != "9.9.9" || u.state.RetryAt == "" ||
+			!strings.Contains(u.state.Error, updateGuardName) {
+			t.Errorf("%s: 更新失败后的状态 = %+v", tc.name, u.state)
+		}
+	}
+
+	// 不可重试的失败（未配置公钥）不设置重试时间
+	cfg.ReleasePublicKey = ""
+	u.state = UpdateStatus{}
+	u.Check()
+	if u.state.State != UpdateFailed || u.state.RetryAt != "" {
+		t.Fatalf("未配置公钥的失败不应重试: %+v", u.state)
+	}
+	// 状态已持久化
+	data, err := os.ReadFile(u.statePath())
+	if err != nil || !strings.Contains(string(data), "release_public_key") {
+		t.Fatalf("update_state.json = %s, %v", data, err)
+	}
+
+	// 目标版本为空或与当前版本相同时不更新
+	for _, target := range []string{"", Version} {
+		cfg.TargetVersion = target
+		u.state = UpdateStatus{Error: sentinel}
+		u.Check()
+		if u.state.Error != sentinel {
+			t.Errorf("目标版本 %q 时不应更新: %+v", target, u.state)
+		}
+	}
+}
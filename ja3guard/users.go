@@ -0,0 +1,776 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 管理面板角色，权限依次递增，高级角色包含低级角色的全部权限
+const (
+	RoleViewer          = "viewer"           // 只读
+	RoleWhitelistEditor = "whitelist_editor" // 修改白名单
+	RoleNodeOperator    = "node_operator"    // 节点运维：SSH 任务、命令模板、部署、推送
+	RoleAdmin           = "admin"            // 全部权限：节点与凭据管理、任意命令、终端、文件传输、审计、用户管理
+)
+
+var roleLevels = map[string]int{RoleViewer: 1, RoleWhitelistEditor: 2, RoleNodeOperator: 3, RoleAdmin: 4}
+
+const (
+	sessionCookieName     = "ja3guard_session"
+	csrfHeader            = "X-CSRF-Token"
+	defaultSessionTimeout = 480 // 分钟
+	userBcryptCost        = 12
+	loginMaxFailures      = 5 // 同一来源 IP 在 loginFailureWindow 内失败该次数后暂时拒绝登录
+	loginFailureWindow    = 15 * time.Minute
+)
+
+var usernameRe = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// User 管理面板用户，密码以 bcrypt 哈希保存
+type User struct {
+	Username     string `json:"username"`
+	Role         string `json:"role"`
+	PasswordHash string `json:"password_hash"`
+	Disabled     bool   `json:"disabled,omitempty"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+}
+
+// userView 接口返回的用户（不含密码哈希）
+type userView struct {
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	Disabled  bool   `json:"disabled"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	Sessions  int    `json:"sessions"` // 当前有效的登录会话数
+}
+
+// HasRole 用户角色是否不低于 role
+func (u *User) HasRole(role string) bool {
+	return roleLevels[u.Role] >= roleLevels[role]
+}
+
+// userSession 登录会话，只保存在内存中，Master 重启后需要重新登录
+type userSession struct {
+	Username string
+	CSRF     string
+	LastSeen time.Time
+}
+
+type loginFailure struct {
+	count int
+	first time.Time
+}
+
+// UserStore 管理面板用户与登录会话
+type UserStore struct {
+	mu       sync.Mutex
+	backend  UserBackend
+	cfg      *Config
+	users    []User
+	sessions map[string]*userSession // key 为会话令牌的 sha256
+	failures map[string]*loginFailure
+	dummy    []byte // 用户不存在时也做一次 bcrypt 比较，避免按耗时探测用户名
+}
+
+// NewUserStore 加载用户。没有任何用户时用 admin_password 创建 admin 账户
+func NewUserStore(backend UserBackend, cfg *Config) (*UserStore, error) {
+	users, err := backend.LoadUsers()
+	if err != nil {
+		return nil, err
+	}
+	us := &UserStore{
+		backend:  backend,
+		cfg:      cfg,
+		users:    users,
+		sessions: make(map[string]*userSession),
+		failures: make(map[string]*loginFailure),
+	}
+	us.dummy, _ = bcrypt.GenerateFromPassword([]byte(generateRandomPassword(16)), userBcryptCost)
+	if len(users) == 0 {
+		// 不检查长度，升级前的密码可以继续使用
+		hash, err := bcrypt.GenerateFromPassword([]byte(cfg.AdminPassword), userBcryptCost)
+		if err != nil {
+			return nil, fmt.Errorf("admin_password: %w", err)
+		}
+		now := time.Now().Format("2006-01-02 15:04:05")
+		us.users = []User{{Username: "admin", Role: RoleAdmin, PasswordHash: string(hash), CreatedAt: now, UpdatedAt: now}}
+		if err := backend.SaveUsers(us.users); err != nil {
+			return nil, err
+		}
+		log.Printf("[User] 已用 admin_password 创建管理员账户 admin")
+	}
+	return us, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", fmt.Errorf("密码至少 8 个字符")
+	}
+	if len(password) > 72 {
+		return "", fmt.Errorf("密码不能超过 72 字节")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), userBcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func validRole(role string) bool {
+	return roleLevels[role] > 0
+}
+
+func (us *UserStore) sessionTimeout() time.Duration {
+	minutes := us.cfg.SessionTimeout
+	if minutes <= 0 {
+		minutes = defaultSessionTimeout
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// findLocked 调用方需持有锁
+func (us *UserStore) findLocked(username string) *User {
+	for i := range us.users {
+		if us.users[i].Username == username {
+			return &us.users[i]
+		}
+	}
+	return nil
+}
+
+// adminCountLocked 启用状态的管理员个数
+func (us *UserStore) adminCountLocked() int {
+	n := 0
+	for _, u := range us.users {
+		if u.Role == RoleAdmin && !u.Disabled {
+			n++
+		}
+	}
+	return n
+}
+
+// dropSessionsLocked 删除用户的全部会话（改密码、改角色、禁用、删除时）
+func (us *UserStore) dropSessionsLocked(username string) {
+	for k, s := range us.sessions {
+		if s.Username == username {
+			delete(us.sessions, k)
+		}
+	}
+}
+
+// allowLogin 检查来源 IP 是否因多次失败被暂时拒绝
+func (us *UserStore) allowLogin(ip string) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	f := us.failures[ip]
+	if f == nil || time.Since(f.first) > loginFailureWindow {
+		delete(us.failures, ip)
+		return true
+	}
+	return f.count < loginMaxFailures
+}
+
+func (us *UserStore) recordLogin(ip string, ok bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if ok {
+		delete(us.failures, ip)
+		return
+	}
+	f := us.failures[ip]
+	if f == nil || time.Since(f.first) > loginFailureWindow {
+		f = &loginFailure{first: time.Now()}
+		us.failures[ip] = f
+	}
+	f.count++
+}
+
+// Authenticate 校验用户名和密码，失败时不区分用户不存在、已禁用和密码错误
+func (us *UserStore) Authenticate(username, password string) (*User, bool) {
+	us.mu.Lock()
+	u := us.findLocked(username)
+	var user User
+	if u != nil {
+		user = *u
+	}
+	us.mu.Unlock()
+	if u == nil {
+		bcrypt.CompareHashAndPassword(us.dummy, []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil || user.Disabled {
+		return nil, false
+	}
+	return &user, true
+}
+
+// NewSession 创建登录会话，返回会话令牌和 CSRF 令牌
+func (us *UserStore) NewSession(username string) (string, string) {
+	token, csrf := randomHex(32), randomHex(32)
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.sessions[sessionKey(token)] = &userSession{Username: username, CSRF: csrf, LastSeen: time.Now()}
+	return token, csrf
+}
+
+// Session 返回会话对应的用户，超时、用户已删除或禁用时返回 nil
+func (us *UserStore) Session(token string) (*User, *userSession) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	key := sessionKey(token)
+	s := us.sessions[key]
+	if s == nil {
+		return nil, nil
+	}
+	u := us.findLocked(s.Username)
+	if u == nil || u.Disabled || time.Since(s.LastSeen) > us.sessionTimeout() {
+		delete(us.sessions, key)
+		return nil, nil
+	}
+	s.LastSeen = time.Now()
+	user, sess := *u, *s
+	return &user, &sess
+}
+
+func (us *UserStore) EndSession(token string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.sessions, sessionKey(token))
+}
+
+// RunCleanup 定时清理超时会话
+func (us *UserStore) RunCleanup() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		us.CleanupSessions()
+	}
+}
+
+// CleanupSessions 删除超时的会话和过期的登录失败记录
+func (us *UserStore) CleanupSessions() {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	timeout := us.sessionTimeout()
+	for k, s := range us.sessions {
+		if time.Since(s.LastSeen) > timeout {
+			delete(us.sessions, k)
+		}
+	}
+	for ip, f := range us.failures {
+		if time.Since(f.first) > loginFailureWindow {
+			delete(us.failures, ip)
+		}
+	}
+}
+
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// List 全部用户（不含密码哈希）
+func (us *UserStore) List() []userView {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	counts := make(map[string]int)
+	for _, s := range us.sessions {
+		counts[s.Username]++
+	}
+	result := make([]userView, 0, len(us.users))
+	for _, u := range us.users {
+		result = append(result, userView{
+			Username:  u.Username,
+			Role:      u.Role,
+			Disabled:  u.Disabled,
+			CreatedAt: u.CreatedAt,
+			UpdatedAt: u.UpdatedAt,
+			Sessions:  counts[u.Username],
+		})
+	}
+	return result
+}
+
+// Add 添加用户
+func (us *UserStore) Add(username, password, role string) error {
+	if !usernameRe.MatchString(username) {
+		return fmt.Errorf("用户名只能包含字母、数字和 ._@-，最长 64 个字符")
+	}
+	if !validRole(role) {
+		return fmt.Errorf("未知角色: %s", role)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.findLocked(username) != nil {
+		return fmt.Errorf("用户已存在: %s", username)
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+	us.users = append(us.users, User{Username: username, Role: role, PasswordHash: hash, CreatedAt: now, UpdatedAt: now})
+	if err := us.backend.SaveUsers(us.users); err != nil {
+		us.users = us.users[:len(us.users)-1]
+		return err
+	}
+	return nil
+}
+
+// userUpdate 修改用户，未填写的字段保持不变
+type userUpdate struct {
+	Role     *string `json:"role"`
+	Password *string `json:"password"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// Update 修改用户。不能让系统失去最后一个启用的管理员；修改后该用户需要重新登录
+func (us *UserStore) Update(username string, upd userUpdate) error {
+	var hash string
+	if upd.Password != nil {
+		var err error
+		if hash, err = hashPassword(*upd.Password); err != nil {
+			return err
+		}
+	}
+	if upd.Role != nil && !validRole(*upd.Role) {
+		return fmt.Errorf("未知角色: %s", *upd.Role)
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u := us.findLocked(username)
+	if u == nil {
+		return fmt.Errorf("用户不存在: %s", username)
+	}
+	old := *u
+	if upd.Role != nil {
+		u.Role = *upd.Role
+	}
+	if upd.Disabled != nil {
+		u.Disabled = *upd.Disabled
+	}
+	if hash != "" {
+		u.PasswordHash = hash
+	}
+	if us.adminCountLocked() == 0 {
+		*u = old
+		return fmt.Errorf("至少需要保留一个启用的管理员")
+	}
+	u.UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
+	if err := us.backend.SaveUsers(us.users); err != nil {
+		*u = old
+		return err
+	}
+	us.dropSessionsLocked(username)
+	return nil
+}
+
+// ChangePassword 用户修改自己的密码，需要原密码；其他会话退出登录
+func (us *UserStore) ChangePassword(username, oldPassword, newPassword, keepToken string) error {
+	if _, ok := us.Authenticate(username, oldPassword); !ok {
+		return fmt.Errorf("原密码错误")
+	}
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u := us.findLocked(username)
+	if u == nil {
+		return fmt.Errorf("用户不存在: %s", username)
+	}
+	old := *u
+	u.PasswordHash = hash
+	u.UpdatedAt = time.Now().Format("2006-01-02 15:04:05")
+	if err := us.backend.SaveUsers(us.users); err != nil {
+		*u = old
+		return err
+	}
+	keep := us.sessions[sessionKey(keepToken)]
+	us.dropSessionsLocked(username)
+	if keep != nil {
+		us.sessions[sessionKey(keepToken)] = keep
+	}
+	return nil
+}
+
+// Remove 删除用户，不能删除最后一个启用的管理员
+func (us *UserStore) Remove(username string) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	for i, u := range us.users {
+		if u.Username != username {
+			continue
+		}
+		old := us.users
+		us.users = append(append([]User{}, old[:i]...), old[i+1:]...)
+		if us.adminCountLocked() == 0 {
+			us.users = old
+			return fmt.Errorf("至少需要保留一个启用的管理员")
+		}
+		if err := us.backend.SaveUsers(us.users); err != nil {
+			us.users = old
+			return err
+		}
+		us.dropSessionsLocked(username)
+		return nil
+	}
+	return fmt.Errorf("用户不存在: %s", username)
+}
+
+// Users 全部用户（含密码哈希，复制快照用）
+func (us *UserStore) Users() []User {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return append([]User(nil), us.users...)
+}
+
+// ReplaceUsers 备用 Master 用主 Master 的用户整体替换本地的，返回是否有变化。
+// 密码、角色或状态变化的用户需要重新登录
+func (us *UserStore) ReplaceUsers(users []User) (bool, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if len(users) == 0 || reflect.DeepEqual(us.users, users) {
+		return false, nil
+	}
+	if err := us.backend.SaveUsers(users); err != nil {
+		return false, err
+	}
+	next := make(map[string]User, len(users))
+	for _, u := range users {
+		next[u.Username] = u
+	}
+	for _, u := range us.users {
+		if n, ok := next[u.Username]; !ok || n.PasswordHash != u.PasswordHash || n.Role != u.Role || n.Disabled != u.Disabled {
+			us.dropSessionsLocked(u.Username)
+		}
+	}
+	us.users = users
+	return true, nil
+}
+
+// ============================================================
+// 认证与权限
+// ============================================================
+
+type adminUserKey struct{}
+
+// requestUser 当前请求的登录用户
+func requestUser(r *http.Request) *User {
+	u, _ := r.Context().Value(adminUserKey{}).(*User)
+	return u
+}
+
+// authenticate 按会话 Cookie 或 Basic Auth（脚本调用）认证。
+// 会话认证的写请求必须带 X-CSRF-Token；Basic Auth 不发送 WWW-Authenticate，浏览器不会缓存并自动附带凭据
+func (h *AdminHandler) authenticate(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	if c, err := r.Cookie(sessionCookieName); err == nil && c.Value != "" {
+		if user, sess := h.users.Session(c.Value); user != nil {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+				subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(sess.CSRF)) != 1 {
+				h.jsonErr(w, "CSRF 校验失败，请刷新页面", 403)
+				return nil, false
+			}
+			return user, true
+		}
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		ip := remoteIP(r)
+		if !h.users.allowLogin(ip) {
+			h.jsonErr(w, "登录失败次数过多，请稍后再试", 429)
+			return nil, false
+		}
+		user, ok := h.users.Authenticate(username, password)
+		h.users.recordLogin(ip, ok)
+		if ok {
+			return user, true
+		}
+	}
+	h.jsonErr(w, "未登录或会话已过期", 401)
+	return nil, false
+}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// requiredRole 管理接口需要的最低角色，未列出的写操作只允许管理员
+func requiredRole(path, method string) string {
+	read := method == http.MethodGet || method == http.MethodHead
+	switch {
+	case path == "api/me" || path == "api/me/password":
+		return RoleViewer
+	case strings.HasPrefix(path, "api/users"), strings.HasPrefix(path, "api/credentials"),
+		strings.HasPrefix(path, "api/join-tokens"), strings.HasPrefix(path, "api/audit"),
+		strings.HasPrefix(path, "api/terminal/"),
+		strings.HasPrefix(path, "api/nodes/") && (strings.HasSuffix(path, "/terminal") || nodeFilesPath(path)):
+		// 文件传输可以读写节点上任意文件（含 config.json 中的令牌和密码），与终端一样只允许管理员
+		return RoleAdmin
+	case strings.HasPrefix(path, "api/jobs"), strings.HasPrefix(path, "api/fleet"), path == "api/whitelist/sync":
+		// 任务结果含部署生成的面板密码
+		return RoleNodeOperator
+	case strings.HasPrefix(path, "api/nodes/") && nodeOperatorPath(path, read):
+		return RoleNodeOperator
+	case read:
+		return RoleViewer
+	case strings.HasPrefix(path, "api/whitelist"):
+		return RoleWhitelistEditor
+	}
+	return RoleAdmin
+}
+
+// nodeFilesPath 节点文件上传、下载和查询
+func nodeFilesPath(path string) bool {
+	_, sub, _ := strings.Cut(strings.TrimPrefix(path, "api/nodes/"), "/")
+	return sub == "files" || strings.HasPrefix(sub, "files/")
+}
+
+// nodeOperatorPath 节点运维操作：SSH 执行、部署、推送、下发命令和运行时设置
+func nodeOperatorPath(path string, read bool) bool {
+	_, sub, _ := strings.Cut(strings.TrimPrefix(path, "api/nodes/"), "/")
+	switch sub {
+	case "ssh/info":
+		return true
+	case "ssh/test", "ssh/exec", "ssh/hostkey/accept", "deploy", "config/push", "whitelist/sync", "commands", "settings":
+		return !read
+	}
+	return strings.HasPrefix(sub, "commands/") && !read
+}
+
+// execPolicyFor 请求用户适用的执行策略：任意命令只允许管理员
+func (h *AdminHandler) execPolicyFor(r *http.Request) ExecPolicy {
+	p := h.cfg.GetExecPolicy()
+	if u := requestUser(r); u == nil || !u.HasRole(RoleAdmin) {
+		p.AllowRaw = false
+	}
+	return p
+}
+
+// showSecrets 只有管理员能看到配置中的 guard_secret
+func showSecrets(r *http.Request) bool {
+	u := requestUser(r)
+	return u != nil && u.HasRole(RoleAdmin)
+}
+
+func (h *AdminHandler) setSessionCookie(w http.ResponseWriter, r *http.Request, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ============================================================
+// 登录与用户管理 API
+// ============================================================
+
+// handleLogin 用户名密码登录，成功后设置会话 Cookie 并返回 CSRF 令牌
+func (h *AdminHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	ip := remoteIP(r)
+	if !h.users.allowLogin(ip) {
+		h.jsonErr(w, "登录失败次数过多，请稍后再试", 429)
+		return
+	}
+	user, ok := h.users.Authenticate(req.Username, req.Password)
+	h.users.recordLogin(ip, ok)
+	if !ok {
+		log.Printf("[User] 登录失败: %s（%s）", req.Username, ip)
+		h.jsonErr(w, "用户名或密码错误", 401)
+		return
+	}
+	token, csrf := h.users.NewSession(user.Username)
+	h.setSessionCookie(w, r, token, 0)
+	log.Printf("[User] %s 登录（%s）", user.Username, ip)
+	h.jsonOK(w, map[string]string{"username": user.Username, "role": user.Role, "csrf_token": csrf})
+}
+
+func (h *AdminHandler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		h.users.EndSession(c.Value)
+	}
+	h.setSessionCookie(w, r, "", -1)
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+// handleMe 当前用户；会话登录时附带 CSRF 令牌（页面刷新后取回）
+func (h *AdminHandler) handleMe(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	resp := map[string]string{"username": user.Username, "role": user.Role}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		if _, sess := h.users.Session(c.Value); sess != nil {
+			resp["csrf_token"] = sess.CSRF
+		}
+	}
+	h.jsonOK(w, resp)
+}
+
+func (h *AdminHandler) handleMePassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	var token string
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		token = c.Value
+	}
+	user := requestUser(r)
+	if err := h.users.ChangePassword(user.Username, req.OldPassword, req.NewPassword, token); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	log.Printf("[User] %s 修改了自己的密码", user.Username)
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+func (h *AdminHandler) handleUserList(w http.ResponseWriter, r *http.Request) {
+	h.jsonOK(w, h.users.List())
+}
+
+func (h *AdminHandler) handleUserAdd(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonErr(w, "请求格式错误", 400)
+		return
+	}
+	if err := h.users.Add(strings.TrimSpace(req.Username), req.Password, req.Role); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	log.Printf("[User] %s 添加了用户 %s（%s）", h.adminUser(r), req.Username, req.Role)
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+func (h *AdminHandler) handleUserUpdate(w http.ResponseWriter, r *http.Request, username string) {
+	var upd userUpdate
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&upd); err != nil {
+		h.jsonErr(w, "请求格式错误: "+err.Error(), 400)
+		return
+	}
+	if err := h.users.Update(username, upd); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	log.Printf("[User] %s 修改了用户 %s", h.adminUser(r), username)
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+func (h *AdminHandler) handleUserDelete(w http.ResponseWriter, r *http.Request, username string) {
+	if err := h.users.Remove(username); err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+	log.Printf("[User] %s 删除了用户 %s", h.adminUser(r), username)
+	h.jsonOK(w, map[string]string{"status": "ok"})
+}
+
+// withUser 把认证后的用户放入请求上下文
+func withUser(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminUserKey{}, user))
+}
+
+// runUsers 命令行管理面板用户（忘记密码时使用）。服务运行中修改后需要重启才生效
+func runUsers(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "用法: ja3guard users list|passwd|add -config /opt/ja3guard/data/config.json [-user admin] [-role admin]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("users "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "/data/config.json", "配置文件路径")
+	username := fs.String("user", "admin", "用户名")
+	role := fs.String("role", RoleAdmin, "角色（add 时使用）: viewer / whitelist_editor / node_operator / admin")
+	fs.Parse(args[1:])
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+	backend, err := OpenBackend(cfg)
+	if err != nil {
+		log.Fatalf("打开存储失败: %v", err)
+	}
+	defer backend.Close()
+	us, err := NewUserStore(backend, cfg)
+	if err != nil {
+		log.Fatalf("加载用户失败: %v", err)
+	}
+
+	switch args[0] {
+	case "list":
+		for _, u := range us.List() {
+			state := ""
+			if u.Disabled {
+				state = "（已禁用）"
+			}
+			fmt.Printf("%-24s %-16s %s%s\n", u.Username, u.Role, u.UpdatedAt, state)
+		}
+	case "passwd":
+		// 重置密码并启用账户，新密码随机生成，避免出现在 shell 历史中
+		password := generateRandomPassword(20)
+		enabled := false
+		if err := us.Update(*username, userUpdate{Password: &password, Disabled: &enabled}); err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "已重置 %s 的密码，服务运行中请重启后生效\n", *username)
+		fmt.Println(password)
+	case "add":
+		password := generateRandomPassword(20)
+		if err := us.Add(*username, password, *role); err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "已添加用户 %s（%s），服务运行中请重启后生效\n", *username, *role)
+		fmt.Println(password)
+	default:
+		log.Fatalf("未知操作: %s", args[0])
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequiredRoleMatrix(t *testing.T) {
+	for _, tc := range []struct {
+		method, path, role string
+	}{
+		{"GET", "api/me", RoleViewer},
+		{"POST", "api/me/password", RoleViewer},
+		{"GET", "api/stats", RoleViewer},
+		{"GET", "api/nodes", RoleViewer},
+		{"GET", "api/nodes/n1/config", RoleViewer},
+		{"GET", "api/node-configs", RoleViewer},
+		{"PUT", "api/node-configs/default", RoleAdmin},
+		{"GET", "api/whitelist", RoleViewer},
+		{"POST", "api/whitelist", RoleWhitelistEditor},
+		{"DELETE", "api/whitelist/abc", RoleWhitelistEditor},
+		{"POST", "api/whitelist/sync", RoleNodeOperator},
+		{"GET", "api/jobs", RoleNodeOperator},
+		{"GET", "api/fleet/status", RoleNodeOperator},
+		{"GET", "api/nodes/n1/ssh/info", RoleNodeOperator},
+		{"GET", "api/nodes/n1/files", RoleAdmin},
+		{"PUT", "api/nodes/n1/files", RoleAdmin},
+		{"POST", "api/nodes/n1/files", RoleAdmin},
+		{"GET", "api/nodes/n1/files/stat", RoleAdmin},
+		{"HEAD", "api/nodes/n1/files/stat", RoleAdmin},
+		{"GET", "api/nodes/n1/filesystem", RoleViewer},
+		{"POST", "api/nodes/n1/ssh/exec", RoleNodeOperator},
+		{"POST", "api/nodes/n1/ssh/test", RoleNodeOperator},
+		{"POST", "api/nodes/n1/ssh/hostkey/accept", RoleNodeOperator},
+		{"POST", "api/nodes/n1/deploy", RoleNodeOperator},
+		{"POST", "api/nodes/n1/config/push", RoleNodeOperator},
+		{"POST", "api/nodes/n1/commands", RoleNodeOperator},
+		{"DELETE", "api/nodes/n1/commands/c1", RoleNodeOperator},
+		{"GET", "api/nodes/n1/commands", RoleViewer},
+		{"PUT", "api/nodes/n1/settings", RoleNodeOperator},
+		{"GET", "api/nodes/n1/settings", RoleViewer},
+		{"GET", "api/nodes/n1/terminal", RoleAdmin},
+		{"GET", "api/terminal/abc", RoleAdmin},
+		{"GET", "api/users", RoleAdmin},
+		{"GET", "api/credentials", RoleAdmin},
+		{"GET", "api/join-tokens", RoleAdmin},
+		{"GET", "api/audit", RoleAdmin},
+		{"POST", "api/nodes", RoleAdmin},
+		{"DELETE", "api/nodes/n1", RoleAdmin},
+		{"PUT", "api/settings", RoleAdmin},
+	} {
+		if got := requiredRole(tc.path, tc.method); got != tc.role {
+			t.Errorf("requiredRole(%q, %s) = %s, want %s", tc.path, tc.method, got, tc.role)
+		}
+	}
+}
+
+func TestConfigSecretRedaction(t *testing.T) {
+	secret := "s3cret"
+	spec := NodeConfigSpec{GuardSecret: &secret}
+	if got := spec.Redacted(); *got.GuardSecret != redactedSecret || *spec.GuardSecret != secret {
+		t.Fatalf("Redacted 应返回遮盖后的副本: %q / %q", *got.GuardSecret, *spec.GuardSecret)
+	}
+	if got := (NodeConfigSpec{}).Redacted(); got.GuardSecret != nil {
+		t.Fatal("未设置的 guard_secret 不应被填充")
+	}
+
+	diffs := []ConfigFieldDiff{{Field: "guard_secret", Desired: "a", Applied: nil}, {Field: "mode", Desired: "node", Applied: "master"}}
+	redactConfigDiffs(diffs)
+	if diffs[0].Desired != redactedSecret || diffs[0].Applied != nil || diffs[1].Desired != "node" {
+		t.Fatalf("差异遮盖不正确: %+v", diffs)
+	}
+
+	for role, want := range map[string]bool{RoleViewer: false, RoleWhitelistEditor: false, RoleNodeOperator: false, RoleAdmin: true} {
+		r := withUser(httptest.NewRequest(http.MethodGet, "/api/node-configs", nil), &User{Username: "u", Role: role})
+		if showSecrets(r) != want {
+			t.Errorf("showSecrets(%s) = %v, want %v", role, !want, want)
+		}
+	}
+	if showSecrets(httptest.NewRequest(http.MethodGet, "/api/node-configs", nil)) {
+		t.Error("未认证的请求不应看到 guard_secret")
+	}
+}
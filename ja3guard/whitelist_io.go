@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 白名单导入文件大小上限
+const maxWhitelistImportSize = 10 << 20
+
+var ja3HashRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// WhitelistImportError 导入文件中的一条无效记录
+type WhitelistImportError struct {
+	Line    int    `json:"line"` // JSON 为数组下标（从 1 开始），CSV 为行号
+	JA3Hash string `json:"ja3_hash"`
+	Error   string `json:"error"`
+}
+
+// WhitelistImportReport 白名单导入结果（dry-run 时为预览）
+type WhitelistImportReport struct {
+	Mode    string                 `json:"mode"`
+	DryRun  bool                   `json:"dry_run"`
+	Applied bool                   `json:"applied"`
+	Added   []WhitelistEntry       `json:"added"`
+	Updated []WhitelistEntry       `json:"updated"`
+	Removed []WhitelistEntry       `json:"removed"`
+	Errors  []WhitelistImportError `json:"errors"`
+}
+
+// normalizeJA3Hash 统一为小写并校验格式（32 位十六进制 MD5）
+func normalizeJA3Hash(hash string) (string, error) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if hash == "" {
+		return "", fmt.Errorf("ja3_hash 不能为空")
+	}
+	if !ja3HashRe.MatchString(hash) {
+		return "", fmt.Errorf("无效的 JA3 hash（需为 32 位十六进制）")
+	}
+	return hash, nil
+}
+
+// parseWhitelistJSON 解析 JSON 导入文件
+// 支持 whitelist.json 的数组格式，也支持 GET /api/whitelist 返回的 {"entries": [...]} 格式
+func parseWhitelistJSON(data []byte) ([]WhitelistEntry, []WhitelistImportError, error) {
+	var entries []WhitelistEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		var wrapped struct {
+			Entries []WhitelistEntry `json:"entries"`
+		}
+		if err2 := json.Unmarshal(data, &wrapped); err2 != nil {
+			return nil, nil, fmt.Errorf("解析 JSON 失败: %w", err)
+		}
+		entries = wrapped.Entries
+	}
+	valid, errs := validateWhitelistImport(entries, func(i int) int { return i + 1 })
+	return valid, errs, nil
+}
+
+// parseWhitelistCSV 解析 CSV 导入文件，列顺序: ja3_hash,note,created_at（首行表头可选）
+func parseWhitelistCSV(data []byte) ([]WhitelistEntry, []WhitelistImportError, error) {
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	var entries []WhitelistEntry
+	var lines []int
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("解析 CSV 失败: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+		if len(record) == 0 || (len(record) == 1 && strings.TrimSpace(record[0]) == "") {
+			continue
+		}
+		if len(entries) == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "ja3_hash") {
+			continue
+		}
+		e := WhitelistEntry{JA3Hash: record[0]}
+		if len(record) > 1 {
+			e.Note = record[1]
+		}
+		if len(record) > 2 {
+			e.CreatedAt = strings.TrimSpace(record[2])
+		}
+		entries = append(entries, e)
+		lines = append(lines, line)
+	}
+	valid, errs := validateWhitelistImport(entries, func(i int) int { return lines[i] })
+	return valid, errs, nil
+}
+
+// validateWhitelistImport 校验 hash 格式并检查导入文件内的重复项
+func validateWhitelistImport(entries []WhitelistEntry, lineOf func(int) int) ([]WhitelistEntry, []WhitelistImportError) {
+	valid := make([]WhitelistEntry, 0, len(entries))
+	errs := []WhitelistImportError{}
+	seen := make(map[string]int, len(entries))
+
+	for i, e := range entries {
+		hash, err := normalizeJA3Hash(e.JA3Hash)
+		if err != nil {
+			errs = append(errs, WhitelistImportError{Line: lineOf(i), JA3Hash: e.JA3Hash, Error: err.Error()})
+			continue
+		}
+		if first, dup := seen[hash]; dup {
+			errs = append(errs, WhitelistImportError{
+				Line: lineOf(i), JA3Hash: e.JA3Hash,
+				Error: fmt.Sprintf("与第 %d 条重复", first),
+			})
+			continue
+		}
+		if e.CreatedAt != "" {
+			if _, err := time.Parse("2006-01-02 15:04:05", e.CreatedAt); err != nil {
+				errs = append(errs, WhitelistImportError{
+					Line: lineOf(i), JA3Hash: e.JA3Hash,
+					Error: "created_at 格式应为 2006-01-02 15:04:05",
+				})
+				continue
+			}
+		}
+		seen[hash] = lineOf(i)
+		e.JA3Hash = hash
+		e.Note = strings.TrimSpace(e.Note)
+		valid = append(valid, e)
+	}
+	return valid, errs
+}
+
+// ============================================================
+// 白名单导入导出 API
+// ============================================================
+
+// handleWhitelistExport 导出完整白名单 ?format=json|csv
+func (h *AdminHandler) handleWhitelistExport(w http.ResponseWriter, r *http.Request) {
+	entries := h.store.GetWhitelist()
+	stamp := time.Now().Format("20060102-150405")
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			h.jsonErr(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="whitelist-%s.json"`, stamp))
+		w.Write(data)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="whitelist-%s.csv"`, stamp))
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"ja3_hash", "note", "created_at"})
+		for _, e := range entries {
+			cw.Write([]string{e.JA3Hash, e.Note, e.CreatedAt})
+		}
+		cw.Flush()
+	default:
+		h.jsonErr(w, "format 仅支持 json 或 csv", 400)
+	}
+}
+
+// handleWhitelistImport 导入白名单
+// ?mode=merge|replace  合并（默认）或整体替换
+// ?dry_run=1           只返回差异报告，不修改白名单
+// ?format=json|csv     默认按 Content-Type 判断
+func (h *AdminHandler) handleWhitelistImport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mode := q.Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		h.jsonErr(w, "mode 仅支持 merge 或 replace", 400)
+		return
+	}
+	dryRun := q.Get("dry_run") == "1" || q.Get("dry_run") == "true"
+
+	format := q.Get("format")
+	if format == "" {
+		if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+			format = "csv"
+		} else {
+			format = "json"
+		}
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWhitelistImportSize))
+	if err != nil {
+		h.jsonErr(w, "读取导入文件失败: "+err.Error(), 400)
+		return
+	}
+
+	var entries []WhitelistEntry
+	var errs []WhitelistImportError
+	switch format {
+	case "json":
+		entries, errs, err = parseWhitelistJSON(data)
+	case "csv":
+		entries, errs, err = parseWhitelistCSV(data)
+	default:
+		h.jsonErr(w, "format 仅支持 json 或 csv", 400)
+		return
+	}
+	if err != nil {
+		h.jsonErr(w, err.Error(), 400)
+		return
+	}
+
+	// 有无效记录时只允许 dry-run，避免导入一半
+	applyDryRun := dryRun || len(errs) > 0
+	report, err := h.store.ImportWhitelist(entries, mode == "replace", applyDryRun)
+	if err != nil {
+		h.jsonErr(w, "导入失败: "+err.Error(), 500)
+		return
+	}
+	report.Mode = mode
+	report.DryRun = dryRun
+	report.Applied = !applyDryRun
+	report.Errors = errs
+
+	if !dryRun && len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	h.jsonOK(w, report)
+}
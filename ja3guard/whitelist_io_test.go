@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	hashA = "0123456789abcdef0123456789abcdef"
+	hashB = "fedcba9876543210fedcba9876543210"
+	hashC = "00000000000000000000000000000000"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	backend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestParseWhitelistCSV(t *testing.T) {
+	data := "ja3_hash,note,created_at\n" +
+		strings.ToUpper(hashA) + ", 办公室 ,2026-01-01 00:00:00\n" +
+		"\n" +
+		hashB + "\n" +
+		"not-a-hash,x\n" +
+		hashA + ",重复\n" +
+		hashC + ",,2026/01/01\n"
+	entries, errs, err := parseWhitelistCSV([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].JA3Hash != hashA || entries[0].Note != "办公室" ||
+		entries[0].CreatedAt != "2026-01-01 00:00:00" || entries[1].JA3Hash != hashB {
+		t.Fatalf("有效记录 = %+v", entries)
+	}
+	wantLines := []int{5, 6, 7}
+	if len(errs) != len(wantLines) {
+		t.Fatalf("错误 = %+v", errs)
+	}
+	for i, line := range wantLines {
+		if errs[i].Line != line {
+			t.Errorf("第 %d 个错误的行号 = %d, want %d（%s）", i, errs[i].Line, line, errs[i].Error)
+		}
+	}
+
+	if _, _, err := parseWhitelistCSV([]byte("\"unterminated\n")); err == nil {
+		t.Error("格式错误的 CSV 应返回错误")
+	}
+}
+
+func TestParseWhitelistJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		data  string
+		valid int
+		errs  int
+	}{
+		{"数组", `[{"ja3_hash":"` + hashA + `"},{"ja3_hash":"` + hashB + `","note":"n"}]`, 2, 0},
+		{"接口格式", `{"entries":[{"ja3_hash":"` + hashA + `"}]}`, 1, 0},
+		{"无效与重复", `[{"ja3_hash":""},{"ja3_hash":"` + hashA + `"},{"ja3_hash":"` + hashA + `"}]`, 1, 2},
+		{"创建时间格式", `[{"ja3_hash":"` + hashA + `","created_at":"yesterday"}]`, 0, 1},
+	} {
+		entries, errs, err := parseWhitelistJSON([]byte(tc.data))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(entries) != tc.valid || len(errs) != tc.errs {
+			t.Errorf("%s: 有效 %d 条、错误 %d 条，want %d、%d（%+v）", tc.name, len(entries), len(errs), tc.valid, tc.errs, errs)
+		}
+	}
+	if _, _, err := parseWhitelistJSON([]byte(`{"entries":`)); err == nil {
+		t.Error("无法解析的 JSON 应返回错误")
+	}
+}
+
+func TestImportWhitelistModes(t *testing.T) {
+	for _, tc := range []struct {
+		name                   string
+		replace, dryRun        bool
+		added, updated, remove int
+		notes                  map[string]string // 导入后的白名单
+	}{
+		{"合并", false, false, 1, 1, 0, map[string]string{hashA: "旧备注", hashB: "新备注", hashC: "c"}},
+		{"替换", true, false, 1, 2, 0, map[string]string{hashA: "", hashB: "新备注", hashC: "c"}},
+		{"合并预览", false, true, 1, 1, 0, map[string]string{hashA: "旧备注", hashB: "b"}},
+		{"替换预览", true, true, 1, 2, 0, map[string]string{hashA: "旧备注", hashB: "b"}},
+	} {
+		store := newTestStore(t)
+		store.AddWhitelist(hashA, "旧备注")
+		store.AddWhitelist(hashB, "b")
+
+		// hashA 备注为空：合并时保留原备注，替换时以文件为准
+		report, err := store.ImportWhitelist([]WhitelistEntry{
+			{JA3Hash: hashA},
+			{JA3Hash: hashB, Note: "新备注"},
+			{JA3Hash: hashC, Note: "c"},
+		}, tc.replace, tc.dryRun)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(report.Added) != tc.added || len(report.Updated) != tc.updated || len(report.Removed) != tc.remove {
+			t.Errorf("%s: added=%d updated=%d removed=%d", tc.name, len(report.Added), len(report.Updated), len(report.Removed))
+		}
+		got := make(map[string]string)
+		for _, e := range store.GetWhitelist() {
+			got[e.JA3Hash] = e.Note
+		}
+		if len(got) != len(tc.notes) {
+			t.Errorf("%s: 白名单 = %v, want %v", tc.name, got, tc.notes)
+			continue
+		}
+		for hash, note := range tc.notes {
+			if n, ok := got[hash]; !ok || n != note {
+				t.Errorf("%s: %s 的备注 = %q, want %q", tc.name, hash, n, note)
+			}
+		}
+	}
+
+	// 替换模式删除不在文件中的条目
+	store := newTestStore(t)
+	store.AddWhitelist(hashA, "a")
+	store.AddWhitelist(hashB, "b")
+	report, err := store.ImportWhitelist([]WhitelistEntry{{JA3Hash: hashB, Note: "b"}}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0].JA3Hash != hashA || len(report.Updated) != 0 {
+		t.Fatalf("替换报告 = %+v", report)
+	}
+	if store.IsWhitelisted(hashA) || !store.IsWhitelisted(hashB) {
+		t.Fatalf("替换后白名单 = %+v", store.GetWhitelist())
+	}
+}
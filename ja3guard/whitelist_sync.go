@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Master 保留的白名单变更记录数（按版本计），更早的版本只能全量同步
+const whitelistChangeLogSize = 1000
+
+// 白名单同步方式
+const (
+	WhitelistSyncUnchanged = "unchanged" // 节点已是最新版本
+	WhitelistSyncDelta     = "delta"     // 节点版本之后的增量
+	WhitelistSyncFull      = "full"      // 全量（节点版本未知、过旧或本地有改动）
+)
+
+// WhitelistDelta 两个白名单版本之间的差异
+// Upsert 按 hash 新增或覆盖（保留 Master 上的备注和创建时间），Remove 为删除的 hash
+type WhitelistDelta struct {
+	From   int64            `json:"from"`
+	To     int64            `json:"to"`
+	Upsert []WhitelistEntry `json:"upsert"`
+	Remove []string         `json:"remove"`
+}
+
+// WhitelistSync Master 下发给节点的白名单同步结果（上报响应、拉取接口、推送事件共用）
+type WhitelistSync struct {
+	Mode    string           `json:"mode"`
+	Version int64            `json:"version"`
+	Delta   *WhitelistDelta  `json:"delta,omitempty"`
+	Entries []WhitelistEntry `json:"entries,omitempty"` // Mode 为 full 时有效
+}
+
+type whitelistChange struct {
+	version int64
+	hashes  []string
+}
+
+var errWhitelistVersionMismatch = errors.New("本地白名单版本与增量不匹配")
+
+// EnableWhitelistVersioning 开启版本记录（Master 模式），
+// 此后每次变更版本号 +1 并保留最近的变更记录供节点增量同步
+func (s *Store) EnableWhitelistVersioning() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versioned = true
+	if s.wlVersion == 0 {
+		// 版本 0 表示“未知”，Master 从 1 开始，保证节点首次同步取全量
+		return s.commitWhitelist(1)
+	}
+	return nil
+}
+
+// WhitelistVersion 当前白名单版本
+func (s *Store) WhitelistVersion() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.wlVersion
+}
+
+func (s *Store) recordChangeLocked(version int64, hashes []string) {
+	s.wlChanges = append(s.wlChanges, whitelistChange{version: version, hashes: hashes})
+	if len(s.wlChanges) > whitelistChangeLogSize {
+		s.wlChanges = s.wlChanges[len(s.wlChanges)-whitelistChangeLogSize:]
+	}
+}
+
+// deltaLocked 计算 from 到当前版本的增量，变更记录不足时返回 false
+func (s *Store) deltaLocked(from int64) (*WhitelistDelta, bool) {
+	to := s.wlVersion
+	if from <= 0 || from > to {
+		return nil, false
+	}
+	delta := &WhitelistDelta{From: from, To: to, Upsert: []WhitelistEntry{}, Remove: []string{}}
+	if from == to {
+		return delta, true
+	}
+	if len(s.wlChanges) == 0 || s.wlChanges[0].version > from+1 {
+		return nil, false
+	}
+
+	touched := make(map[string]bool)
+	for _, c := range s.wlChanges {
+		if c.version > from {
+			for _, h := range c.hashes {
+				touched[h] = true
+			}
+		}
+	}
+	present := make(map[string]bool, len(touched))
+	for _, e := range s.whitelist {
+		if touched[e.JA3Hash] {
+			delta.Upsert = append(delta.Upsert, e)
+			present[e.JA3Hash] = true
+		}
+	}
+	for h := range touched {
+		if !present[h] {
+			delta.Remove = append(delta.Remove, h)
+		}
+	}
+	sort.Strings(delta.Remove)
+	return delta, true
+}
+
+// WhitelistSince 根据节点当前版本生成同步结果：相同返回 unchanged，
+// 能计算增量且增量不大于全量时返回 delta，否则返回 full
+func (s *Store) WhitelistSince(version int64) *WhitelistSync {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if version > 0 && version == s.wlVersion {
+		return &WhitelistSync{Mode: WhitelistSyncUnchanged, Version: s.wlVersion}
+	}
+	if delta, ok := s.deltaLocked(version); ok && len(delta.Upsert)+len(delta.Remove) <= len(s.whitelist) {
+		return &WhitelistSync{Mode: WhitelistSyncDelta, Version: s.wlVersion, Delta: delta}
+	}
+	return s.fullSyncLocked()
+}
+
+// WhitelistFull 全量同步结果
+func (s *Store) WhitelistFull() *WhitelistSync {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fullSyncLocked()
+}
+
+func (s *Store) fullSyncLocked() *WhitelistSync {
+	entries := make([]WhitelistEntry, len(s.whitelist))
+	copy(entries, s.whitelist)
+	return &WhitelistSync{Mode: WhitelistSyncFull, Version: s.wlVersion, Entries: entries}
+}
+
+// ApplyWhitelistSync 节点应用 Master 下发的同步结果，整个过程一次加锁、最多一次写入，
+// 备注和创建时间与 Master 保持一致。返回白名单内容是否发生变化。
+// 增量的起始版本与本地不符时返回 errWhitelistVersionMismatch，调用方应改为拉取全量
+func (s *Store) ApplyWhitelistSync(sync *WhitelistSync) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch sync.Mode {
+	case WhitelistSyncUnchanged:
+		return false, nil
+
+	case WhitelistSyncDelta:
+		d := sync.Delta
+		if d == nil {
+			return false, fmt.Errorf("缺少增量内容")
+		}
+		if s.wlVersion == d.To {
+			return false, nil
+		}
+		if s.wlVersion == 0 || s.wlVersion != d.From {
+			return false, errWhitelistVersionMismatch
+		}
+		result := applyWhitelistDelta(s.whitelist, d)
+		old := s.whitelist
+		s.whitelist = result
+		if err := s.commitWhitelist(d.To); err != nil {
+			s.whitelist = old
+			return false, err
+		}
+		s.setWhitelistLocked(result)
+		return len(d.Upsert)+len(d.Remove) > 0, nil
+
+	case WhitelistSyncFull:
+		// 不拒绝比本地旧的版本：Master 数据恢复后版本号可能回退，以 Master 为准。
+		// 与推送乱序时最多短暂回退，下一次上报会按版本补上增量
+		changed := !equalWhitelist(s.whitelist, sync.Entries)
+		if !changed && sync.Version == s.wlVersion {
+			return false, nil
+		}
+		entries := sync.Entries
+		if entries == nil {
+			entries = []WhitelistEntry{}
+		}
+		old := s.whitelist
+		s.whitelist = entries
+		if err := s.commitWhitelist(sync.Version); err != nil {
+			s.whitelist = old
+			return false, err
+		}
+		s.setWhitelistLocked(entries)
+		return changed, nil
+
+	default:
+		return false, fmt.Errorf("未知的同步方式: %s", sync.Mode)
+	}
+}
+
+// ReplicateWhitelist 备用 Master 应用主 Master 的白名单，版本号与主 Master 保持一致。
+// 与 ApplyWhitelistSync 不同，增量同样记入变更记录，连接到备用 Master 的节点仍可按版本增量同步
+func (s *Store) ReplicateWhitelist(sync *WhitelistSync) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch sync.Mode {
+	case WhitelistSyncUnchanged:
+		return false, nil
+
+	case WhitelistSyncDelta:
+		d := sync.Delta
+		if d == nil {
+			return false, fmt.Errorf("缺少增量内容")
+		}
+		if s.wlVersion == d.To {
+			return false, nil
+		}
+		if s.wlVersion != d.From {
+			return false, errWhitelistVersionMismatch
+		}
+		result := applyWhitelistDelta(s.whitelist, d)
+		old := s.whitelist
+		s.whitelist = result
+		if err := s.commitWhitelist(d.To); err != nil {
+			s.whitelist = old
+			return false, err
+		}
+		s.setWhitelistLocked(result)
+		touched := append([]string{}, d.Remove...)
+		for _, e := range d.Upsert {
+			touched = append(touched, e.JA3Hash)
+		}
+		s.recordChangeLocked(d.To, touched)
+		return true, nil
+
+	case WhitelistSyncFull:
+		if sync.Version == s.wlVersion && equalWhitelist(s.whitelist, sync.Entries) {
+			return false, nil
+		}
+		entries := sync.Entries
+		if entries == nil {
+			entries = []WhitelistEntry{}
+		}
+		old := s.whitelist
+		s.whitelist = entries
+		if err := s.commitWhitelist(sync.Version); err != nil {
+			s.whitelist = old
+			return false, err
+		}
+		s.setWhitelistLocked(entries)
+		// 与主 Master 的变更记录无法对应，之前的版本只能全量同步
+		s.wlChanges = nil
+		return true, nil
+
+	default:
+		return false, fmt.Errorf("未知的同步方式: %s", sync.Mode)
+	}
+}
+
+// applyWhitelistDelta 在副本上应用增量：已有条目原位覆盖，新条目追加到末尾
+func applyWhitelistDelta(list []WhitelistEntry, d *WhitelistDelta) []WhitelistEntry {
+	removed := make(map[string]bool, len(d.Remove))
+	for _, h := range d.Remove {
+		removed[h] = true
+	}
+	upsert := make(map[string]WhitelistEntry, len(d.Upsert))
+	for _, e := range d.Upsert {
+		upsert[e.JA3Hash] = e
+	}
+
+	result := make([]WhitelistEntry, 0, len(list)+len(d.Upsert))
+	for _, e := range list {
+		if removed[e.JA3Hash] {
+			continue
+		}
+		if u, ok := upsert[e.JA3Hash]; ok {
+			e = u
+			delete(upsert, e.JA3Hash)
+		}
+		result = append(result, e)
+	}
+	for _, e := range d.Upsert {
+		if _, ok := upsert[e.JA3Hash]; ok {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func equalWhitelist(a, b []WhitelistEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}